@@ -2,77 +2,494 @@ package main
 
 import (
 	"botanic/internal/auth"
+	"botanic/internal/avatar"
 	"botanic/internal/db"
 	"botanic/internal/handlers"
 	"botanic/internal/litellm" // <-- CHANGED
+	"botanic/internal/llm"
+	"botanic/internal/logging"
+	"botanic/internal/metrics"
 	"botanic/internal/middleware"
-	"log"
+	"botanic/internal/models"
+	"botanic/internal/moderation"
+	"botanic/internal/validation"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 	emiddleware "github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/bytes"
 )
 
 func main() {
-	if err := godotenv.Load(); err != nil {
-		log.Printf("Warning: .env file not found")
+	// Load .env first so LOG_LEVEL can come from it
+	envErr := godotenv.Load()
+	logging.Init()
+	if envErr != nil {
+		slog.Warn(".env file not found")
 	}
 
 	if err := db.InitializeRedis(); err != nil {
-		log.Fatalf("Failed to initialize Redis: %v", err)
+		fatal("failed to initialize Redis", err)
 	}
-	defer db.CloseRedis()
 
 	if err := auth.Initialize(); err != nil {
-		log.Fatalf("Failed to initialize auth: %v", err)
+		fatal("failed to initialize auth", err)
 	}
 
+	avatarStore, err := avatar.NewStoreFromEnv()
+	if err != nil {
+		fatal("failed to initialize avatar storage", err)
+	}
+	handlers.InitAvatars(avatarStore)
+	handlers.InitModeration(moderation.NewFromEnv())
+
 	// Initialize LiteLLM client
 	liteLLMClient := litellm.NewClient() // <-- CHANGED
 
+	// Select the default chat completion provider (LLM_PROVIDER) and the
+	// backends sessions may choose instead
+	backends := llm.NewBackends(liteLLMClient)
+	provider := backends.Default()
+	handlers.InitModels(backends)
+
+	// Check the provider is reachable; the server still starts if it is not
+	checkCtx, cancelCheck := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := provider.HealthCheck(checkCtx); err != nil {
+		slog.Warn("LLM provider check failed", "provider", provider.Name(), "error", err)
+	}
+	cancelCheck()
+
+	go migrateMessageScores()
+	go migrateFeedbackIndex()
+	go sweepExpired()
+
 	e := echo.New()
+	e.Validator = validation.New()
+	// Rate limits and device alerts key on the client IP, which must not come
+	// from headers the client controls
+	ipExtractor, err := ipExtractorFromEnv()
+	if err != nil {
+		fatal("invalid TRUSTED_PROXIES", err)
+	}
+	e.IPExtractor = ipExtractor
 
-	e.Use(emiddleware.Logger())
+	e.HideBanner = true
+	e.Use(emiddleware.RequestID())
+	e.Use(logging.Middleware())
+	if metrics.Enabled() {
+		e.Use(metrics.Middleware())
+		e.GET("/metrics", metrics.Handler)
+	}
 	e.Use(emiddleware.Recover())
+	e.Use(emiddleware.BodyLimitWithConfig(emiddleware.BodyLimitConfig{
+		Skipper: isAvatarUpload,
+		Limit:   bodyLimit(),
+	}))
+	timeout := requestTimeout()
+	e.Use(emiddleware.ContextTimeoutWithConfig(emiddleware.ContextTimeoutConfig{
+		Skipper: isLongLived,
+		ErrorHandler: func(err error, c echo.Context) error {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return echo.NewHTTPError(http.StatusRequestTimeout, "request timed out")
+			}
+			return err
+		},
+		Timeout: timeout,
+	}))
+	// Slow clients may not hold connections open by trickling headers or
+	// bodies
+	e.Server.ReadHeaderTimeout = 10 * time.Second
+	e.Server.ReadTimeout = timeout
+	allowedOrigins := auth.AllowedOrigins()
 	e.Use(emiddleware.CORSWithConfig(emiddleware.CORSConfig{
-		AllowOrigins:     []string{"http://localhost:5173"},
+		AllowOrigins:     allowedOrigins,
 		AllowMethods:     []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions},
 		AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization, echo.HeaderCookie, "X-CSRF-Token"},
 		AllowCredentials: true,
 		MaxAge:           300,
 		ExposeHeaders:    []string{"Set-Cookie", "Authorization"},
 		AllowOriginFunc: func(origin string) (bool, error) {
-			return origin == "http://localhost:5173", nil
+			return slices.Contains(allowedOrigins, origin), nil
 		}}))
+	wsHandler := handlers.NewWSHandler(provider, handlers.WithBackends(backends))
+	registerRoutes(e, routeDeps{
+		provider:      provider,
+		liteLLMClient: liteLLMClient,
+		wsHandler:     wsHandler,
+	})
+
+	addr, err := listenAddr()
+	if err != nil {
+		fatal("invalid listen address", err)
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		if err := e.Start(addr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- err
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-stop:
+		slog.Info("shutting down", "signal", sig.String())
+	case err := <-serverErr:
+		fatal("server failed", err)
+	}
+
+	if err := shutdown(e, wsHandler); err != nil {
+		os.Exit(1)
+	}
+	slog.Info("shutdown complete")
+}
+
+// routeDeps holds what the route handlers are built from
+type routeDeps struct {
+	provider      llm.Provider
+	liteLLMClient *litellm.Client
+	wsHandler     *handlers.WSHandler
+}
+
+// registerRoutes registers the API under /api/v1 and, for one release, under
+// the legacy unversioned /api prefix, plus the routes that are not versioned
+func registerRoutes(e *echo.Echo, deps routeDeps) {
+	// Embeddings and completions are limited per user since each call hits
+	// the model. The limiters are shared so both prefixes count against the
+	// same budget.
+	limiters := routeLimiters{
+		embeddings:  userRateLimiter(),
+		completions: userRateLimiter(),
+		auth:        auth.NewAuthThrottleFromEnv().Middleware(),
+	}
+
+	// Every API route is limited per IP, except the health checks polled by
+	// load balancers. Avatars and metrics are not under the API, and the
+	// WebSocket limits each connection's messages itself.
+	apiLimiter := auth.RateLimiter(isHealthCheck)
+
+	registerAPIRoutes(e.Group("/api/v1", apiLimiter), deps, limiters)
+	registerAPIRoutes(e.Group("/api", deprecated, apiLimiter), deps, limiters)
+
+	e.GET("/uploads/avatars/:filename", handlers.ServeAvatar)
+
+	// WebSocket endpoint
+	e.GET("/ws", deps.wsHandler.HandleWebSocket) // <-- CHANGED
+}
+
+// isHealthCheck reports whether the request is for a health or readiness check
+func isHealthCheck(c echo.Context) bool {
+	return strings.HasSuffix(c.Path(), "/health") || strings.HasSuffix(c.Path(), "/ready")
+}
+
+// avatarBodyLimit leaves room for a 5MB avatar plus multipart framing
+const avatarBodyLimit = "6M"
+
+// bodyLimit returns the largest request body accepted, from BODY_LIMIT in the
+// form "512K" or "1M" (default 1M)
+func bodyLimit() string {
+	if value := os.Getenv("BODY_LIMIT"); value != "" {
+		if _, err := bytes.Parse(value); err == nil {
+			return value
+		}
+		slog.Warn("ignoring invalid BODY_LIMIT", "value", value)
+	}
+	return "1M"
+}
+
+// ipExtractorFromEnv takes the client IP from X-Forwarded-For only when the
+// request comes through one of the TRUSTED_PROXIES, a comma-separated list of
+// IPs and CIDR ranges. Without trusted proxies the peer address is used, and
+// forwarding headers are ignored.
+func ipExtractorFromEnv() (echo.IPExtractor, error) {
+	var options []echo.TrustOption
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address %q", entry)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, ipRange, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy range %q: %w", entry, err)
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	if len(options) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+
+	// Only the listed proxies are trusted, not every private address
+	options = append(options, echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false))
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+// isAvatarUpload reports whether the request is an avatar upload, which has
+// its own body limit
+func isAvatarUpload(c echo.Context) bool {
+	return c.Request().Method == http.MethodPost && strings.HasSuffix(c.Path(), "/auth/avatar")
+}
+
+// isLongLived reports whether the request is a WebSocket or a streamed
+// completion, which stay open for as long as the client wants
+func isLongLived(c echo.Context) bool {
+	if c.Path() == "/ws" {
+		return true
+	}
+	return strings.HasSuffix(c.Path(), "/completions") && c.QueryParam("stream") == "true"
+}
+
+// requestTimeout returns how long a request may take, from REQUEST_TIMEOUT
+// (default 2m, above the LLM timeout so completions can finish)
+func requestTimeout() time.Duration {
+	if value := os.Getenv("REQUEST_TIMEOUT"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return 2 * time.Minute
+}
+
+// routeLimiters holds the rate limiters shared by both API prefixes
+type routeLimiters struct {
+	embeddings  echo.MiddlewareFunc
+	completions echo.MiddlewareFunc
+	// auth throttles registration and login per IP and per email
+	auth echo.MiddlewareFunc
+}
+
+// userRateLimiter allows each user one request per second with bursts of 5.
+// It must run after middleware.Auth.
+func userRateLimiter() echo.MiddlewareFunc {
+	return emiddleware.RateLimiterWithConfig(emiddleware.RateLimiterConfig{
+		Store: emiddleware.NewRateLimiterMemoryStoreWithConfig(emiddleware.RateLimiterMemoryStoreConfig{
+			Rate:      1,
+			Burst:     5,
+			ExpiresIn: 3 * time.Minute,
+		}),
+		IdentifierExtractor: func(c echo.Context) (string, error) {
+			return handlers.GetUserID(c)
+		},
+	})
+}
+
+// deprecated marks responses from the legacy unversioned API
+func deprecated(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set("Deprecation", "true")
+		return next(c)
+	}
+}
+
+// registerAPIRoutes registers the API routes on api
+func registerAPIRoutes(api *echo.Group, deps routeDeps, limiters routeLimiters) {
 	// Auth routes
-	e.POST("/api/auth/register", handlers.Register)
-	e.POST("/api/auth/login", handlers.Login)
-	e.POST("/api/auth/verify", handlers.VerifyToken)
-	e.POST("/api/auth/refresh", handlers.RefreshToken)
-	e.POST("/api/auth/logout", handlers.Logout)
-	e.GET("/api/auth/google", handlers.HandleGoogleAuth)
-	e.GET("/api/auth/github", handlers.HandleGithubAuth)
-	e.GET("/api/auth/:provider/callback", handlers.OAuthCallback)
-	e.GET("/api/auth/profile", handlers.GetProfile, middleware.Auth)
-	e.PUT("/api/auth/profile", handlers.UpdateProfile, middleware.Auth)
-	e.PUT("/api/auth/preferences", handlers.UpdatePreferences, middleware.Auth)
-	e.POST("/api/auth/avatar", handlers.UploadAvatar, middleware.Auth)
+	api.POST("/auth/register", handlers.Register, limiters.auth)
+	api.POST("/auth/login", handlers.Login, limiters.auth)
+	api.POST("/auth/verify", handlers.VerifyToken)
+	api.POST("/auth/refresh", handlers.RefreshToken)
+	api.POST("/auth/logout", handlers.Logout)
+	api.GET("/auth/google", handlers.HandleGoogleAuth)
+	api.GET("/auth/github", handlers.HandleGithubAuth)
+	api.GET("/auth/:provider/callback", handlers.OAuthCallback)
+	api.POST("/auth/link", handlers.LinkProvider, middleware.Auth)
+	api.GET("/auth/profile", handlers.GetProfile, middleware.Auth)
+	api.PUT("/auth/profile", handlers.UpdateProfile, middleware.Auth)
+	api.GET("/auth/export", handlers.ExportData, middleware.Auth)
+	api.GET("/auth/quota", handlers.GetQuota, middleware.Auth)
+	api.GET("/auth/stats", handlers.GetStats, middleware.Auth)
+	api.PUT("/auth/preferences", handlers.UpdatePreferences, middleware.Auth)
+	api.POST("/auth/avatar", handlers.UploadAvatar, middleware.Auth, emiddleware.BodyLimit(avatarBodyLimit))
+	api.DELETE("/auth/avatar", handlers.DeleteAvatar, middleware.Auth)
+
+	// Health routes
+	healthHandler := handlers.NewHealthHandler(deps.provider)
+	api.GET("/health", healthHandler.Health)
+	api.GET("/ready", healthHandler.Ready)
 
 	// Models routes
-	e.GET("/api/models", handlers.GetModels)
+	api.GET("/models", handlers.GetModels, middleware.OptionalAuth)
+
+	// Embeddings routes
+	embeddingsHandler := handlers.NewEmbeddingsHandler(deps.liteLLMClient)
+	api.POST("/embeddings", embeddingsHandler.CreateEmbeddings, middleware.Auth, limiters.embeddings)
+
+	// One-shot completions for integrations that do not use chat sessions
+	completionsHandler := handlers.NewCompletionsHandler(deps.provider)
+	api.POST("/completions", completionsHandler.CreateCompletion, middleware.Auth, limiters.completions)
 
 	// Chat routes
-	chat := e.Group("/api/chat")
+	chat := api.Group("/chat")
 	chat.Use(middleware.Auth)
 	chat.POST("/sessions", handlers.CreateSession)
 	chat.GET("/sessions", handlers.GetSessions)
+	chat.DELETE("/sessions", handlers.DeleteSessions)
 	chat.GET("/sessions/:id", handlers.GetSession)
 	chat.DELETE("/sessions/:id", handlers.DeleteSession)
+	chat.POST("/sessions/:id/restore", handlers.RestoreSession)
+	chat.POST("/sessions/:id/duplicate", handlers.DuplicateSession)
+	chat.PUT("/sessions/:id/tags", handlers.UpdateSessionTags)
+	chat.GET("/sessions/:id/usage", handlers.GetSessionUsage)
+	chat.POST("/sessions/:id/share", handlers.ShareSession)
+	chat.DELETE("/sessions/:id/share", handlers.UnshareSession)
+	chat.GET("/sessions/:id/messages", handlers.GetMessages)
 	chat.POST("/sessions/:id/messages", handlers.CreateMessage)
+	chat.DELETE("/sessions/:id/messages/:messageId", handlers.DeleteMessage)
+	chat.POST("/sessions/:id/messages/:messageId/feedback", handlers.SetMessageFeedback)
+	chat.GET("/feedback/stats", handlers.GetFeedbackStats, middleware.AdminAuth)
+	chat.GET("/sessions/:id/messages/:messageId/alternatives", handlers.GetAlternatives)
+	chat.POST("/sessions/:id/messages/:messageId/alternatives", handlers.CreateAlternative)
+	chat.DELETE("/sessions/:id/messages/:messageId/alternatives/:alternativeId", handlers.DeleteAlternative)
 
-	// WebSocket endpoint
-	e.GET("/ws", handlers.NewWSHandler(liteLLMClient).HandleWebSocket) // <-- CHANGED
+	// Shared sessions are public and read-only
+	api.GET("/chat/shared/:token", handlers.GetSharedSession)
+
+	// Admin routes
+	admin := api.Group("/admin", middleware.Auth, middleware.AdminAuth)
+	admin.GET("/users", handlers.ListUsers)
+	admin.GET("/users/:id", handlers.GetUser)
+	admin.PUT("/users/:id/quota", handlers.SetUserQuota)
+	admin.GET("/ws-stats", deps.wsHandler.GetStats)
+	// Alias of /api/chat/feedback/stats
+	admin.GET("/feedback/stats", handlers.GetFeedbackStats)
+}
+
+// listenAddr builds the address to listen on from HOST and PORT, defaulting
+// to ":8000". HOST may carry its own port, which PORT overrides when set.
+func listenAddr() (string, error) {
+	host := os.Getenv("HOST")
+	port := "8000"
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+	if value := os.Getenv("PORT"); value != "" {
+		port = value
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("PORT must be a number between 1 and 65535, got %q", port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
 
-	e.Logger.Fatal(e.Start(":8000"))
+// shutdown drains HTTP requests, disconnects WebSocket clients and closes
+// Redis, waiting at most SHUTDOWN_TIMEOUT (default 15s). Every step runs even
+// if an earlier one fails; the first error is returned.
+func shutdown(e *echo.Echo, wsHandler *handlers.WSHandler) error {
+	timeout := 15 * time.Second
+	if value := os.Getenv("SHUTDOWN_TIMEOUT"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			timeout = parsed
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var firstErr error
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"HTTP server", func() error { return e.Shutdown(ctx) }},
+		{"WebSocket hub", func() error { return wsHandler.Shutdown(ctx) }},
+		{"Redis", db.CloseRedis},
+	}
+	for _, step := range steps {
+		slog.Info("stopping", "component", step.name)
+		if err := step.run(); err != nil {
+			slog.Error("failed to stop", "component", step.name, "error", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// fatal logs a startup failure and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// migrateMessageScores rescores messages indexed by second before scores
+// moved to milliseconds
+func migrateMessageScores() {
+	migrated, err := models.MigrateMessageScores()
+	if err != nil {
+		slog.Error("message score migration failed", "error", err)
+		return
+	}
+	if migrated > 0 {
+		slog.Info("migrated message scores", "messages", migrated)
+	}
+}
+
+// migrateFeedbackIndex indexes feedback left before it was indexed per user
+func migrateFeedbackIndex() {
+	migrated, err := models.MigrateFeedbackIndex()
+	if err != nil {
+		slog.Error("feedback index migration failed", "error", err)
+		return
+	}
+	if migrated > 0 {
+		slog.Info("indexed feedback by user", "feedback", migrated)
+	}
+}
+
+// sweepExpired periodically clears index entries that point at expired keys,
+// every SESSION_SWEEP_INTERVAL (default 1h)
+func sweepExpired() {
+	interval := time.Hour
+	if value := os.Getenv("SESSION_SWEEP_INTERVAL"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			interval = parsed
+		}
+	}
+
+	sweeps := []struct {
+		name  string
+		sweep func() (int, error)
+	}{
+		{"user sessions", models.SweepUserSessions},
+		{"chat sessions", models.SweepChatSessions},
+		{"deleted chat sessions", models.SweepDeletedChatSessions},
+		{"messages", models.SweepMessages},
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, s := range sweeps {
+			removed, err := s.sweep()
+			if err != nil {
+				slog.Error("sweep of expired keys failed", "kind", s.name, "error", err)
+				continue
+			}
+			slog.Info("sweep removed expired keys", "kind", s.name, "removed", removed)
+		}
+	}
 }
@@ -18,7 +18,16 @@ var (
 type Config struct {
 	JWTSecret     string
 	TokenDuration time.Duration
-	Issuer        string
+	// RememberDuration is the lifetime of tokens issued to users who ask to
+	// be remembered
+	RememberDuration time.Duration
+	Issuer           string
+	// VerifyIssuer rejects tokens from other issuers. It is only set when
+	// JWT_ISSUER is, as tokens were always issued with the default.
+	VerifyIssuer bool
+	// Audience is put in issued tokens and required of verified ones, unless
+	// it is empty
+	Audience string
 }
 
 var config Config
@@ -38,11 +47,28 @@ func Initialize() error {
 		}
 	}
 
+	// Default to 30 days if not specified
+	rememberDuration := 30 * 24 * time.Hour
+	if duration := os.Getenv("JWT_REMEMBER_DURATION"); duration != "" {
+		if parsed, err := time.ParseDuration(duration); err == nil && parsed > 0 {
+			rememberDuration = parsed
+		}
+	}
+
 	config = Config{
-		JWTSecret:     jwtSecret,
-		TokenDuration: tokenDuration,
-		Issuer:        getEnvOrDefault("JWT_ISSUER", "botanic"),
+		JWTSecret:        jwtSecret,
+		TokenDuration:    tokenDuration,
+		RememberDuration: rememberDuration,
+		Issuer:           getEnvOrDefault("JWT_ISSUER", "botanic"),
+		VerifyIssuer:     os.Getenv("JWT_ISSUER") != "",
+		Audience:         os.Getenv("JWT_AUDIENCE"),
 	}
+
+	m, err := NewMailerFromEnv()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrConfigError, err)
+	}
+	mailer = m
 	return nil
 }
 
@@ -59,15 +85,43 @@ type Claims struct {
 	jwt.RegisteredClaims
 }
 
-func GenerateToken(userID string) (string, error) {
+// SessionDuration returns the lifetime of a login's token and session:
+// RememberDuration if the user asked to be remembered, TokenDuration if not
+func SessionDuration(rememberMe bool) time.Duration {
+	if rememberMe {
+		return config.RememberDuration
+	}
+	return config.TokenDuration
+}
+
+// TokenLifetime returns how long the token holding claims was issued for, so
+// refreshed tokens keep the lifetime chosen at login
+func TokenLifetime(claims *Claims) time.Duration {
+	if claims.ExpiresAt != nil && claims.IssuedAt != nil {
+		if lifetime := claims.ExpiresAt.Sub(claims.IssuedAt.Time); lifetime > 0 {
+			return lifetime
+		}
+	}
+	return config.TokenDuration
+}
+
+// GenerateToken issues a token for the user carrying their ID and email
+func GenerateToken(userID string, email string) (string, error) {
+	return GenerateTokenWithDuration(userID, email, config.TokenDuration)
+}
+
+// GenerateTokenWithDuration is like GenerateToken but the token expires after
+// duration
+func GenerateTokenWithDuration(userID string, email string, duration time.Duration) (string, error) {
 	if config.JWTSecret == "" {
 		return "", fmt.Errorf("%w: auth not initialized", ErrConfigError)
 	}
 
-	expirationTime := time.Now().Add(config.TokenDuration)
+	expirationTime := time.Now().Add(duration)
 
 	claims := &Claims{
 		UserID: userID,
+		Email:  email,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -76,46 +130,52 @@ func GenerateToken(userID string) (string, error) {
 			Subject:   userID,
 		},
 	}
+	if config.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{config.Audience}
+	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString([]byte(config.JWTSecret))
 }
 
 func VerifyToken(tokenString string) (string, error) {
-	if config.JWTSecret == "" {
-		return "", fmt.Errorf("%w: auth not initialized", ErrConfigError)
-	}
-
-	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(config.JWTSecret), nil
-	})
-
+	claims, err := parseToken(tokenString)
 	if err != nil {
-		if errors.Is(err, jwt.ErrTokenExpired) {
-			return "", ErrExpiredToken
-		}
-		return "", ErrInvalidToken
-	}
-
-	if !token.Valid {
-		return "", ErrInvalidToken
+		return "", err
 	}
-
 	return claims.UserID, nil
 }
 
 func ValidateToken(tokenString string) (*Claims, error) {
+	return parseToken(tokenString)
+}
+
+// parseToken verifies a token's signature and claims, including its issuer
+// and audience when those are configured, and returns the claims
+func parseToken(tokenString string) (*Claims, error) {
 	if config.JWTSecret == "" {
 		return nil, fmt.Errorf("%w: auth not initialized", ErrConfigError)
 	}
 
+	var opts []jwt.ParserOption
+	if config.VerifyIssuer {
+		opts = append(opts, jwt.WithIssuer(config.Issuer))
+	}
+	if config.Audience != "" {
+		opts = append(opts, jwt.WithAudience(config.Audience))
+	}
+
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 		return []byte(config.JWTSecret), nil
-	})
+	}, opts...)
 
 	if err != nil {
+		// A token meant for another deployment stays invalid once expired,
+		// so it cannot be refreshed either
+		if errors.Is(err, jwt.ErrTokenInvalidIssuer) || errors.Is(err, jwt.ErrTokenInvalidAudience) {
+			return nil, ErrInvalidToken
+		}
 		if errors.Is(err, jwt.ErrTokenExpired) {
 			return nil, ErrExpiredToken
 		}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// initTestConfig configures signing with the given issuer and audience
+func initTestConfig(t *testing.T, issuer, audience string) {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "test-secret")
+	t.Setenv("JWT_DURATION", "")
+	t.Setenv("JWT_REMEMBER_DURATION", "")
+	t.Setenv("JWT_ISSUER", issuer)
+	t.Setenv("JWT_AUDIENCE", audience)
+	t.Setenv("SMTP_HOST", "")
+	if err := Initialize(); err != nil {
+		t.Fatalf("initialize: %v", err)
+	}
+}
+
+func TestTokensFromOtherDeploymentsAreRejected(t *testing.T) {
+	tests := []struct {
+		name                     string
+		issuer, audience         string
+		wantIssuer, wantAudience string
+	}{
+		{"wrong issuer", "staging", "", "production", ""},
+		{"wrong audience", "", "staging-web", "", "production-web"},
+		{"missing audience", "", "", "", "production-web"},
+	}
+	for _, tt := range tests {
+		initTestConfig(t, tt.issuer, tt.audience)
+		token, err := GenerateToken("user-1", "owner@example.com")
+		if err != nil {
+			t.Fatalf("%s: generate: %v", tt.name, err)
+		}
+
+		initTestConfig(t, tt.wantIssuer, tt.wantAudience)
+		if _, err := ValidateToken(token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: validate: got %v, want ErrInvalidToken", tt.name, err)
+		}
+		if _, err := VerifyToken(token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: verify: got %v, want ErrInvalidToken", tt.name, err)
+		}
+	}
+}
+
+func TestTokensFromThisDeploymentAreAccepted(t *testing.T) {
+	for _, audience := range []string{"", "production-web"} {
+		initTestConfig(t, "production", audience)
+		token, err := GenerateToken("user-1", "owner@example.com")
+		if err != nil {
+			t.Fatalf("generate: %v", err)
+		}
+		claims, err := ValidateToken(token)
+		if err != nil || claims.UserID != "user-1" {
+			t.Fatalf("audience %q: validate: %v, %v", audience, claims, err)
+		}
+	}
+}
+
+func TestUnconfiguredIssuerAcceptsAnyIssuer(t *testing.T) {
+	initTestConfig(t, "elsewhere", "")
+	token, err := GenerateToken("user-1", "owner@example.com")
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	// Without JWT_ISSUER, tokens keep validating as they always did
+	initTestConfig(t, "", "")
+	if _, err := ValidateToken(token); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+}
+
+func TestExpiredTokenFromOtherIssuerIsInvalid(t *testing.T) {
+	initTestConfig(t, "staging", "")
+	token, err := GenerateTokenWithDuration("user-1", "owner@example.com", -time.Minute)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	// Reporting it as expired would let it be refreshed
+	initTestConfig(t, "production", "")
+	if _, err := ValidateToken(token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("validate: got %v, want ErrInvalidToken", err)
+	}
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Mailer sends plain text email, such as security notifications
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+var mailer Mailer = LogMailer{}
+
+// GetMailer returns the mailer set up by Initialize
+func GetMailer() Mailer {
+	return mailer
+}
+
+// NewMailerFromEnv creates an SMTP mailer if SMTP_HOST is set, and a
+// LogMailer otherwise
+func NewMailerFromEnv() (Mailer, error) {
+	if os.Getenv("SMTP_HOST") == "" {
+		return LogMailer{}, nil
+	}
+	return NewSMTPMailerFromEnv()
+}
+
+// LogMailer logs email instead of sending it, for deployments without a mail
+// server
+type LogMailer struct{}
+
+func (LogMailer) Send(to, subject, body string) error {
+	slog.Info("email not sent, no mailer configured", "to", to, "subject", subject)
+	return nil
+}
+
+// SMTPMailer sends email through an SMTP server, using STARTTLS when the
+// server offers it
+type SMTPMailer struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+// NewSMTPMailerFromEnv configures an SMTP mailer from SMTP_HOST, SMTP_PORT
+// (default 587), SMTP_FROM and the optional SMTP_USERNAME and SMTP_PASSWORD
+func NewSMTPMailerFromEnv() (*SMTPMailer, error) {
+	m := &SMTPMailer{
+		host:     os.Getenv("SMTP_HOST"),
+		username: os.Getenv("SMTP_USERNAME"),
+		password: os.Getenv("SMTP_PASSWORD"),
+		from:     os.Getenv("SMTP_FROM"),
+	}
+	if m.host == "" || m.from == "" {
+		return nil, errors.New("SMTP_HOST and SMTP_FROM are required for the smtp mailer")
+	}
+	m.addr = net.JoinHostPort(m.host, getEnvOrDefault("SMTP_PORT", "587"))
+	return m, nil
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	// Line breaks in a header would let the caller inject further headers
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return errors.New("email headers must not contain line breaks")
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+	if err := smtp.SendMail(m.addr, auth, m.from, []string{to}, []byte(msg.String())); err != nil {
+		return fmt.Errorf("send email: %w", err)
+	}
+	return nil
+}
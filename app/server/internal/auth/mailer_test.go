@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// smtpMessage is an email received by the fake SMTP server
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// serveSMTP starts a fake SMTP server accepting a single message, without
+// STARTTLS or authentication, and points the SMTP_* env at it
+func serveSMTP(t *testing.T) <-chan smtpMessage {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	t.Setenv("SMTP_HOST", host)
+	t.Setenv("SMTP_PORT", port)
+	t.Setenv("SMTP_FROM", "noreply@example.com")
+	t.Setenv("SMTP_USERNAME", "")
+	t.Setenv("SMTP_PASSWORD", "")
+
+	received := make(chan smtpMessage, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		var msg smtpMessage
+
+		text.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch command {
+			case "EHLO", "HELO":
+				text.PrintfLine("250 localhost")
+			case "MAIL":
+				msg.from = strings.TrimPrefix(line, "MAIL FROM:")
+				text.PrintfLine("250 OK")
+			case "RCPT":
+				msg.to = append(msg.to, strings.TrimPrefix(line, "RCPT TO:"))
+				text.PrintfLine("250 OK")
+			case "DATA":
+				text.PrintfLine("354 go ahead")
+				data, err := text.ReadDotLines()
+				if err != nil {
+					return
+				}
+				msg.data = strings.Join(data, "\n")
+				text.PrintfLine("250 OK")
+			case "QUIT":
+				text.PrintfLine("221 bye")
+				received <- msg
+				return
+			default:
+				text.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+	return received
+}
+
+func TestSMTPMailerSendsEmail(t *testing.T) {
+	received := serveSMTP(t)
+
+	m, err := NewMailerFromEnv()
+	if err != nil {
+		t.Fatalf("new mailer: %v", err)
+	}
+	if _, ok := m.(*SMTPMailer); !ok {
+		t.Fatalf("mailer is %T, want *SMTPMailer", m)
+	}
+	if err := m.Send("user@example.com", "New login", "Someone signed in.\nWas it you?"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	msg := <-received
+	if msg.from != "<noreply@example.com>" {
+		t.Errorf("from %q, want <noreply@example.com>", msg.from)
+	}
+	if len(msg.to) != 1 || msg.to[0] != "<user@example.com>" {
+		t.Errorf("to %q, want [<user@example.com>]", msg.to)
+	}
+	header, body, _ := strings.Cut(msg.data, "\n\n")
+	for _, want := range []string{"From: noreply@example.com", "To: user@example.com", "Subject: New login"} {
+		if !strings.Contains(header, want) {
+			t.Errorf("header %q does not contain %q", header, want)
+		}
+	}
+	if body != "Someone signed in.\nWas it you?" {
+		t.Errorf("body %q", body)
+	}
+}
+
+func TestSMTPMailerRejectsHeaderInjection(t *testing.T) {
+	m := &SMTPMailer{addr: "127.0.0.1:1", host: "127.0.0.1", from: "noreply@example.com"}
+
+	for _, to := range []string{"user@example.com\r\nBcc: victim@example.com", "user@example.com\nBcc: victim@example.com"} {
+		if err := m.Send(to, "New login", "body"); err == nil || !strings.Contains(err.Error(), "line breaks") {
+			t.Errorf("send to %q: %v, want a line break error", to, err)
+		}
+	}
+	if err := m.Send("user@example.com", "New login\r\nBcc: victim@example.com", "body"); err == nil {
+		t.Error("subject with a line break was accepted")
+	}
+}
+
+func TestMailerFallsBackToLogging(t *testing.T) {
+	t.Setenv("SMTP_HOST", "")
+
+	m, err := NewMailerFromEnv()
+	if err != nil {
+		t.Fatalf("new mailer: %v", err)
+	}
+	if _, ok := m.(LogMailer); !ok {
+		t.Fatalf("mailer is %T, want LogMailer", m)
+	}
+}
+
+func TestSMTPMailerRequiresFrom(t *testing.T) {
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	t.Setenv("SMTP_FROM", "")
+
+	if _, err := NewSMTPMailerFromEnv(); err == nil {
+		t.Fatal("mailer without SMTP_FROM was created")
+	}
+}
@@ -1,43 +1,34 @@
 package auth
 
 import (
-	"net"
+	"log/slog"
+	"math"
 	"net/http"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	echo "github.com/labstack/echo/v4"
+	emiddleware "github.com/labstack/echo/v4/middleware"
 )
 
-// JWTAuth middleware (remains unchanged)
-func JWTAuth() echo.MiddlewareFunc {
-	return func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func(c echo.Context) error {
-			authHeader := c.Request().Header.Get("Authorization")
-			if authHeader == "" {
-				return echo.NewHTTPError(http.StatusUnauthorized, "missing authorization header")
-			}
-
-			parts := strings.Split(authHeader, " ")
-			if len(parts) != 2 || parts[0] != "Bearer" {
-				return echo.NewHTTPError(http.StatusUnauthorized, "invalid authorization header format")
-			}
-
-			claims, err := ValidateToken(parts[1])
-			if err != nil {
-				if err == ErrExpiredToken {
-					return echo.NewHTTPError(http.StatusUnauthorized, "token has expired")
-				}
-				return echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
-			}
-
-			c.Set("user_id", claims.UserID)
-			c.Set("email", claims.Email)
+// Context keys under which middleware.Auth stores the authenticated user
+const (
+	UserIDKey = "userID"
+	EmailKey  = "email"
+)
 
-			return next(c)
-		}
+// UserID returns the ID of the authenticated user of a request. It fails with
+// 401 when the request did not pass through middleware.Auth.
+func UserID(c echo.Context) (string, error) {
+	userID, ok := c.Get(UserIDKey).(string)
+	if !ok || userID == "" {
+		return "", echo.NewHTTPError(http.StatusUnauthorized, "user not authenticated")
 	}
+	return userID, nil
 }
 
 type tokenBucket struct {
@@ -53,11 +44,10 @@ var (
 )
 
 const (
-	rateLimitCapacity = 20
-	rateLimitRefill   = 20
-	rateLimitWindow   = 1 * time.Minute
-	cleanupInterval   = 5 * time.Minute  // <-- ADDED: How often to run cleanup
-	bucketMaxAge      = 15 * time.Minute // <-- ADDED: Max age of an inactive bucket
+	defaultRateLimit = 120
+	rateLimitWindow  = 1 * time.Minute
+	cleanupInterval  = 5 * time.Minute  // <-- ADDED: How often to run cleanup
+	bucketMaxAge     = 15 * time.Minute // <-- ADDED: Max age of an inactive bucket
 )
 
 // Initialize a background goroutine to clean up old buckets
@@ -83,15 +73,23 @@ func cleanupBuckets() {
 	}
 }
 
-func RateLimiter() echo.MiddlewareFunc {
+// RateLimiter allows each client IP RATE_LIMIT_PER_MINUTE requests a minute
+// (default 120), counted across every route it is applied to. Requests for
+// which skipper returns true are not counted. The IP comes from the server's
+// IPExtractor, so forwarding headers count only from trusted proxies.
+func RateLimiter(skipper emiddleware.Skipper) echo.MiddlewareFunc {
+	limit := envPositiveInt("RATE_LIMIT_PER_MINUTE", defaultRateLimit)
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			ip := getIP(c.Request())
+			if skipper != nil && skipper(c) {
+				return next(c)
+			}
+			ip := c.RealIP()
 
 			bucketsMutex.Lock()
 			bucket, exists := buckets[ip]
 			if !exists {
-				bucket = &tokenBucket{tokens: rateLimitCapacity, lastRefill: time.Now()}
+				bucket = &tokenBucket{tokens: limit, lastRefill: time.Now()}
 				buckets[ip] = bucket
 			}
 			// Update last seen time on every request
@@ -102,7 +100,7 @@ func RateLimiter() echo.MiddlewareFunc {
 			defer bucket.mu.Unlock()
 
 			if time.Since(bucket.lastRefill) > rateLimitWindow {
-				bucket.tokens = rateLimitRefill
+				bucket.tokens = limit
 				bucket.lastRefill = time.Now()
 			}
 
@@ -111,29 +109,39 @@ func RateLimiter() echo.MiddlewareFunc {
 				return next(c)
 			}
 
+			retryAfter := rateLimitWindow - time.Since(bucket.lastRefill)
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
 			return echo.NewHTTPError(http.StatusTooManyRequests, "rate limit exceeded")
 		}
 	}
 }
 
-func getIP(r *http.Request) string {
-	ip := r.Header.Get("X-Real-IP")
-	if ip == "" {
-		ip = r.Header.Get("X-Forwarded-For")
+// AllowedOrigins returns the origins allowed to make credentialed
+// cross-origin requests, from the comma-separated CORS_ALLOWED_ORIGINS
+// (default "http://localhost:5173"). A wildcard is never allowed since it
+// cannot be combined with credentials.
+func AllowedOrigins() []string {
+	value := os.Getenv("CORS_ALLOWED_ORIGINS")
+	if value == "" {
+		value = "http://localhost:5173"
 	}
-	if ip == "" {
-		ip, _, _ = net.SplitHostPort(r.RemoteAddr)
+
+	var origins []string
+	for _, origin := range strings.Split(value, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin == "" {
+			continue
+		}
+		if origin == "*" {
+			slog.Warn("ignoring wildcard in CORS_ALLOWED_ORIGINS; list origins explicitly")
+			continue
+		}
+		origins = append(origins, origin)
 	}
-	return ip
+	return origins
 }
 
-// IsAllowedOrigin (remains unchanged)
+// IsAllowedOrigin reports whether origin exactly matches an allowed origin
 func IsAllowedOrigin(origin string) bool {
-	allowed := []string{"http://localhost:5173"}
-	for _, o := range allowed {
-		if origin == o {
-			return true
-		}
-	}
-	return false
+	return slices.Contains(AllowedOrigins(), origin)
 }
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultAuthAttemptsPerIP    = 10
+	defaultAuthAttemptsPerEmail = 5
+)
+
+// throttleLimiter is the limiter of one IP or email and when it was last used
+type throttleLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// throttleSet keeps a limiter per key, forgetting keys idle for bucketMaxAge
+type throttleSet struct {
+	perMinute int
+	mu        sync.Mutex
+	limiters  map[string]*throttleLimiter
+	swept     time.Time
+}
+
+func newThrottleSet(perMinute int) *throttleSet {
+	return &throttleSet{perMinute: perMinute, limiters: make(map[string]*throttleLimiter), swept: time.Now()}
+}
+
+// reserve takes an attempt for key, returning how long to wait before
+// retrying if none is left
+func (s *throttleSet) reserve(key string) time.Duration {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.swept) > cleanupInterval {
+		for k, l := range s.limiters {
+			if now.Sub(l.lastSeen) > bucketMaxAge {
+				delete(s.limiters, k)
+			}
+		}
+		s.swept = now
+	}
+
+	l, ok := s.limiters[key]
+	if !ok {
+		l = &throttleLimiter{limiter: rate.NewLimiter(rate.Every(time.Minute/time.Duration(s.perMinute)), s.perMinute)}
+		s.limiters[key] = l
+	}
+	l.lastSeen = now
+
+	r := l.limiter.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return delay
+	}
+	return 0
+}
+
+// AuthThrottle limits registration and login attempts per client IP and per
+// email address, far more strictly than the general API limiter, to slow
+// down credential stuffing and mass account creation
+type AuthThrottle struct {
+	perIP    *throttleSet
+	perEmail *throttleSet
+}
+
+// NewAuthThrottleFromEnv allows AUTH_ATTEMPTS_PER_IP (default 10) attempts
+// per minute from each IP and AUTH_ATTEMPTS_PER_EMAIL (default 5) for each
+// email address
+func NewAuthThrottleFromEnv() *AuthThrottle {
+	return &AuthThrottle{
+		perIP:    newThrottleSet(envPositiveInt("AUTH_ATTEMPTS_PER_IP", defaultAuthAttemptsPerIP)),
+		perEmail: newThrottleSet(envPositiveInt("AUTH_ATTEMPTS_PER_EMAIL", defaultAuthAttemptsPerEmail)),
+	}
+}
+
+func envPositiveInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+// Middleware rejects attempts over either limit with 429 and a Retry-After
+// header. The email is read from the JSON body, which is left for the handler.
+func (t *AuthThrottle) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			delay := t.perIP.reserve(c.RealIP())
+			if email := requestEmail(c.Request()); email != "" && delay == 0 {
+				delay = t.perEmail.reserve(email)
+			}
+			if delay > 0 {
+				seconds := int(math.Ceil(delay.Seconds()))
+				c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+				return echo.NewHTTPError(http.StatusTooManyRequests, "too many attempts, try again later")
+			}
+			return next(c)
+		}
+	}
+}
+
+// requestEmail returns the normalized email of a JSON request body, putting
+// the body back so it can still be bound
+func requestEmail(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(req.Email))
+}
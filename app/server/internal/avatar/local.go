@@ -0,0 +1,85 @@
+package avatar
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// LocalDir is where the local store keeps avatars by default
+	LocalDir = "uploads/avatars"
+	// LocalURLPrefix is the path local avatars are served under
+	LocalURLPrefix = "/uploads/avatars/"
+)
+
+// LocalStore keeps avatars on the local filesystem and returns relative URLs
+type LocalStore struct {
+	dir       string
+	urlPrefix string
+}
+
+// NewLocalStore creates a store writing to dir, serving under urlPrefix
+func NewLocalStore(dir string, urlPrefix string) *LocalStore {
+	return &LocalStore{dir: dir, urlPrefix: urlPrefix}
+}
+
+// Dir returns the directory avatars are written to
+func (s *LocalStore) Dir() string {
+	return s.dir
+}
+
+func (s *LocalStore) Put(id string, r io.Reader, contentType string) (string, error) {
+	if id != filepath.Base(id) {
+		return "", errors.New("invalid avatar id")
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return "", err
+	}
+
+	dst, err := os.Create(filepath.Join(s.dir, id))
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, r); err != nil {
+		return "", err
+	}
+	return s.urlPrefix + id, nil
+}
+
+func (s *LocalStore) Delete(url string) error {
+	path, ok := s.path(url)
+	if !ok {
+		return nil
+	}
+
+	err := os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// path returns the absolute path of the file url is served from. Only plain
+// file names directly inside the avatar directory are accepted.
+func (s *LocalStore) path(url string) (string, bool) {
+	id, ok := strings.CutPrefix(url, s.urlPrefix)
+	if !ok || id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return "", false
+	}
+
+	dir, err := filepath.Abs(s.dir)
+	if err != nil {
+		return "", false
+	}
+	path := filepath.Join(dir, id)
+	if filepath.Dir(path) != dir {
+		return "", false
+	}
+	return path, true
+}
@@ -0,0 +1,44 @@
+package avatar
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalDeleteStaysInsideTheAvatarDirectory(t *testing.T) {
+	root := t.TempDir()
+	store := NewLocalStore(filepath.Join(root, "avatars"), LocalURLPrefix)
+
+	url, err := store.Put("avatar.png", strings.NewReader("png"), ContentType)
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	outside := filepath.Join(root, "secret")
+	if err := os.WriteFile(outside, []byte("keep"), 0600); err != nil {
+		t.Fatalf("write outside file: %v", err)
+	}
+
+	for _, foreign := range []string{
+		LocalURLPrefix + "../secret",
+		LocalURLPrefix + "..%2fsecret",
+		"/uploads/secret",
+		"https://example.com/avatar.png",
+		LocalURLPrefix,
+	} {
+		if err := store.Delete(foreign); err != nil {
+			t.Errorf("delete %q: %v", foreign, err)
+		}
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Fatalf("file outside the avatar directory was removed: %v", err)
+	}
+
+	if err := store.Delete(url); err != nil {
+		t.Fatalf("delete %q: %v", url, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "avatars", "avatar.png")); !os.IsNotExist(err) {
+		t.Fatalf("uploaded avatar still exists: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+// Package avatar processes and stores user avatar images.
+package avatar
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+
+	// Register the decoders for the accepted upload formats
+	_ "image/gif"
+	_ "image/png"
+)
+
+const (
+	// MaxDimension is the largest width or height of a stored avatar
+	MaxDimension = 512
+	// maxSourcePixels rejects uploads that would take too much memory to
+	// decode, whatever their size on disk
+	maxSourcePixels = 40_000_000
+	jpegQuality     = 85
+)
+
+// ContentType is the format every processed avatar is stored in
+const ContentType = "image/jpeg"
+
+// Extension is the file extension of processed avatars
+const Extension = ".jpg"
+
+// ErrInvalidImage is returned when an upload is not a decodable image
+var ErrInvalidImage = errors.New("file is not a valid image")
+
+// Process decodes an uploaded PNG, JPEG or GIF image, scales it down to fit
+// within MaxDimension and re-encodes it as JPEG. Re-encoding drops any
+// metadata such as EXIF.
+func Process(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxSourcePixels {
+		return nil, fmt.Errorf("%w: dimensions %dx%d are not supported", ErrInvalidImage, config.Width, config.Height)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, resize(src, MaxDimension), &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// resize scales src down so neither side exceeds maxDim, averaging the source
+// pixels covered by each destination pixel. Transparent areas are flattened
+// onto white since JPEG has no alpha channel.
+func resize(src image.Image, maxDim int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// Flatten onto white in RGBA so pixels can be read directly
+	flat := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(flat, flat.Bounds(), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), src, bounds.Min, draw.Over)
+
+	if width <= maxDim && height <= maxDim {
+		return flat
+	}
+
+	dstWidth, dstHeight := maxDim, maxDim
+	if width > height {
+		dstHeight = max(1, height*maxDim/width)
+	} else {
+		dstWidth = max(1, width*maxDim/height)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		y0, y1 := y*height/dstHeight, max((y+1)*height/dstHeight, y*height/dstHeight+1)
+		for x := 0; x < dstWidth; x++ {
+			x0, x1 := x*width/dstWidth, max((x+1)*width/dstWidth, x*width/dstWidth+1)
+
+			var r, g, b, n uint64
+			for sy := y0; sy < y1; sy++ {
+				offset := flat.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint64(flat.Pix[offset])
+					g += uint64(flat.Pix[offset+1])
+					b += uint64(flat.Pix[offset+2])
+					offset += 4
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: 255})
+		}
+	}
+	return dst
+}
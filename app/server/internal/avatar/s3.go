@@ -0,0 +1,196 @@
+package avatar
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3KeyPrefix is the object key prefix avatars are stored under
+const s3KeyPrefix = "avatars/"
+
+// S3Store keeps avatars in an S3-compatible bucket, addressed path-style so it
+// works with AWS as well as MinIO, R2 and similar services. It returns
+// absolute URLs.
+type S3Store struct {
+	endpoint   string
+	bucket     string
+	region     string
+	accessKey  string
+	secretKey  string
+	publicURL  string
+	httpClient *http.Client
+}
+
+// NewS3StoreFromEnv configures an S3 store from S3_ENDPOINT, S3_BUCKET,
+// S3_REGION, S3_ACCESS_KEY_ID, S3_SECRET_ACCESS_KEY and the optional
+// S3_PUBLIC_URL, the base URL objects are publicly served from
+func NewS3StoreFromEnv() (*S3Store, error) {
+	store := &S3Store{
+		endpoint:   strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/"),
+		bucket:     os.Getenv("S3_BUCKET"),
+		region:     os.Getenv("S3_REGION"),
+		accessKey:  os.Getenv("S3_ACCESS_KEY_ID"),
+		secretKey:  os.Getenv("S3_SECRET_ACCESS_KEY"),
+		publicURL:  strings.TrimSuffix(os.Getenv("S3_PUBLIC_URL"), "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+	if store.endpoint == "" || store.bucket == "" || store.accessKey == "" || store.secretKey == "" {
+		return nil, errors.New("S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required for the s3 avatar store")
+	}
+	if store.region == "" {
+		store.region = "us-east-1"
+	}
+	if store.publicURL == "" {
+		store.publicURL = store.endpoint + "/" + store.bucket
+	}
+	return store, nil
+}
+
+// Put uploads the avatar to avatars/<id> with a long-lived cache header and
+// returns its public URL
+func (s *S3Store) Put(id string, r io.Reader, contentType string) (string, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	key := s3KeyPrefix + id
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(key), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Cache-Control", "public, max-age=31536000, immutable")
+	if err := s.do(req, body); err != nil {
+		return "", err
+	}
+	return s.publicURL + "/" + key, nil
+}
+
+// Delete removes the object url is served from. URLs outside the avatar
+// prefix are ignored.
+func (s *S3Store) Delete(url string) error {
+	key, ok := s.key(url)
+	if !ok {
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	return s.do(req, nil)
+}
+
+// key returns the object key url is served from. Only plain names under the
+// avatar prefix are accepted, so no other object in the bucket can be named.
+func (s *S3Store) key(url string) (string, bool) {
+	key, ok := strings.CutPrefix(url, s.publicURL+"/")
+	if !ok {
+		return "", false
+	}
+	id, ok := strings.CutPrefix(key, s3KeyPrefix)
+	if !ok || id == "" || id != path.Base(id) || strings.HasPrefix(id, ".") {
+		return "", false
+	}
+	return key, true
+}
+
+func (s *S3Store) objectURL(key string) string {
+	return s.endpoint + "/" + s.bucket + "/" + key
+}
+
+// do signs and sends a request, treating any non-2xx status as an error
+func (s *S3Store) do(req *http.Request, body []byte) error {
+	s.sign(req, body, time.Now().UTC())
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making request to object storage: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("object storage returned %s: %s", resp.Status, respBody)
+	}
+	return nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req
+func (s *S3Store) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		headers["content-type"] = contentType
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,29 @@
+package avatar
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Store saves processed avatars and removes them again
+type Store interface {
+	// Put stores an avatar under id and returns the URL it is served from
+	Put(id string, r io.Reader, contentType string) (url string, err error)
+	// Delete removes the avatar served from url. URLs the store does not own,
+	// such as an OAuth provider's picture, are ignored.
+	Delete(url string) error
+}
+
+// NewStoreFromEnv creates the store selected by AVATAR_STORE: "local"
+// (the default) keeps avatars on disk, "s3" uses S3-compatible object storage
+func NewStoreFromEnv() (Store, error) {
+	switch name := os.Getenv("AVATAR_STORE"); name {
+	case "", "local":
+		return NewLocalStore(LocalDir, LocalURLPrefix), nil
+	case "s3":
+		return NewS3StoreFromEnv()
+	default:
+		return nil, fmt.Errorf("unknown AVATAR_STORE %q", name)
+	}
+}
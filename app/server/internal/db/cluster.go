@@ -0,0 +1,45 @@
+package db
+
+import (
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// clusterSlots is the number of hash slots a Redis cluster divides keys into
+const clusterSlots = 16384
+
+// keySlot returns the cluster hash slot of key. Only the part between the
+// first { and the following } is hashed when it is not empty, so keys sharing
+// such a hash tag share a slot.
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// crc16 is the CRC-16/XMODEM checksum Redis cluster hashes keys with
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// isCluster reports whether the client talks to a Redis cluster, where a
+// transaction cannot span hash slots
+func isCluster() bool {
+	_, ok := redisClient.(*redis.ClusterClient)
+	return ok
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestKeySlot(t *testing.T) {
+	// Slots as reported by CLUSTER KEYSLOT
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"123456789", 12739},
+		{"foo", 12182},
+		{"bar", 5061},
+		{"{bar}.sessions", 5061},
+		{"foo{bar}{zap}", 5061},
+		{"foo{}{bar}", keySlot("foo{}{bar}")},
+	}
+	for _, tt := range tests {
+		if got := keySlot(tt.key); got != tt.want {
+			t.Errorf("keySlot(%q) = %d, want %d", tt.key, got, tt.want)
+		}
+	}
+
+	// An empty hash tag hashes the whole key
+	if keySlot("foo{}{bar}") == keySlot("bar") {
+		t.Error("empty hash tag was skipped for the next one")
+	}
+	if keySlot("{user1000}.following") != keySlot("{user1000}.followers") {
+		t.Error("keys with the same hash tag are in different slots")
+	}
+}
+
+func TestPipelinerQueuesOtherSlotsSeparately(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"})
+	defer client.Close()
+	const watched, index = "chat:session-1", "chat:user:user-1"
+	if keySlot(watched) == keySlot(index) {
+		t.Fatalf("%s and %s share a slot, pick other keys", watched, index)
+	}
+
+	pipe, after := client.TxPipeline(), client.TxPipeline()
+	p := &Pipeliner{ctx: context.Background(), pipe: pipe, after: after, slot: keySlot(watched)}
+	if err := p.Set(watched, "session", 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	p.ZAdd(index, 1, "session-1")
+	p.ZRem(index, "session-0")
+	p.Delete(watched)
+	if pipe.Len() != 2 || after.Len() != 2 {
+		t.Fatalf("queued %d commands in the watched slot and %d after, want 2 and 2", pipe.Len(), after.Len())
+	}
+
+	// Outside a cluster every command joins the one transaction
+	pipe = client.TxPipeline()
+	p = &Pipeliner{ctx: context.Background(), pipe: pipe}
+	p.ZAdd(index, 1, "session-1")
+	p.Delete(watched)
+	if pipe.Len() != 2 {
+		t.Fatalf("queued %d commands, want 2", pipe.Len())
+	}
+}
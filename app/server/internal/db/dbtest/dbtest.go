@@ -0,0 +1,75 @@
+// Package dbtest points the db package at a scratch Redis for tests
+package dbtest
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+
+	"botanic/internal/db"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const defaultTestDB = 15
+
+// Setup connects the db package to the Redis at TEST_REDIS_ADDR, using
+// database TEST_REDIS_DB (default 15), and empties that database before and
+// after the test. The test is skipped when TEST_REDIS_ADDR is unset, since
+// the database is flushed.
+func Setup(t testing.TB) {
+	t.Helper()
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR not set")
+	}
+	index := defaultTestDB
+	if value := os.Getenv("TEST_REDIS_DB"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			t.Fatalf("invalid TEST_REDIS_DB %q", value)
+		}
+		index = parsed
+	}
+
+	useRedis(t, addr, index)
+	if err := db.InitializeRedis(); err != nil {
+		t.Fatalf("connect to test redis: %v", err)
+	}
+
+	flush := redis.NewClient(&redis.Options{Addr: addr, DB: index})
+	flushDB := func() {
+		if err := flush.FlushDB(context.Background()).Err(); err != nil {
+			t.Fatalf("flush test redis: %v", err)
+		}
+	}
+	flushDB()
+	t.Cleanup(func() {
+		flushDB()
+		flush.Close()
+		db.CloseRedis()
+	})
+}
+
+// SetupUnreachable connects the db package to an address nothing listens
+// on, so every command fails with a connection error
+func SetupUnreachable(t testing.TB) {
+	t.Helper()
+	useRedis(t, "127.0.0.1:1", 0)
+	t.Setenv("REDIS_DIAL_TIMEOUT", "100ms")
+	if err := db.InitializeRedis(); err == nil {
+		t.Fatal("expected connecting to an unreachable redis to fail")
+	}
+	t.Cleanup(func() { db.CloseRedis() })
+}
+
+func useRedis(t testing.TB, addr string, index int) {
+	t.Setenv("REDIS_URL", "")
+	t.Setenv("REDIS_SENTINEL_ADDRS", "")
+	t.Setenv("REDIS_CLUSTER_ADDRS", "")
+	t.Setenv("REDIS_ADDR", addr)
+	t.Setenv("REDIS_PASSWORD", "")
+	t.Setenv("REDIS_DB", strconv.Itoa(index))
+	t.Setenv("REDIS_CONNECT_ATTEMPTS", "1")
+}
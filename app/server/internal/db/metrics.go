@@ -0,0 +1,42 @@
+package db
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"botanic/internal/metrics"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var commandDuration = metrics.NewHistogramVec("redis_command_duration_seconds",
+	"Redis command latency in seconds, by command. Pipelines are timed as a whole.",
+	[]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}, "command")
+
+// metricsHook times every command and pipeline sent to Redis
+type metricsHook struct{}
+
+func (metricsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (metricsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		commandDuration.Observe(time.Since(start).Seconds(), cmd.Name())
+		return err
+	}
+}
+
+func (metricsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		commandDuration.Observe(time.Since(start).Seconds(), "pipeline")
+		return err
+	}
+}
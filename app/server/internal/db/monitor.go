@@ -0,0 +1,126 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Status is the last observed health of the Redis connection
+type Status struct {
+	Healthy   bool      `json:"healthy"`
+	Since     time.Time `json:"since"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+var (
+	statusMu      sync.RWMutex
+	currentStatus Status
+	monitorOnce   sync.Once
+)
+
+// CurrentStatus returns the status recorded by the health monitor
+func CurrentStatus() Status {
+	statusMu.RLock()
+	defer statusMu.RUnlock()
+	return currentStatus
+}
+
+// recordStatus stores the outcome of a health check, logging transitions
+// between healthy and unhealthy
+func recordStatus(err error) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	healthy := err == nil
+	if healthy != currentStatus.Healthy || currentStatus.Since.IsZero() {
+		if healthy {
+			slog.Info("Redis is healthy")
+		} else {
+			slog.Error("Redis is unhealthy", "error", err)
+		}
+		currentStatus.Healthy = healthy
+		currentStatus.Since = time.Now()
+	}
+	currentStatus.LastError = ""
+	if err != nil {
+		currentStatus.LastError = err.Error()
+	}
+}
+
+// connectWithRetry pings Redis until it answers, retrying with exponential
+// backoff up to REDIS_CONNECT_ATTEMPTS times (default 5) so the server can
+// start slightly before Redis does
+func connectWithRetry() error {
+	attempts := 5
+	if value := os.Getenv("REDIS_CONNECT_ATTEMPTS"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			attempts = parsed
+		}
+	}
+
+	delay := time.Second
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = Ping(5 * time.Second); err == nil {
+			recordStatus(nil)
+			return nil
+		}
+		recordStatus(err)
+		if attempt == attempts {
+			break
+		}
+		slog.Warn("Redis not reachable, retrying", "attempt", attempt, "attempts", attempts, "delay", delay.String(), "error", err)
+		time.Sleep(delay)
+		delay = min(delay*2, 30*time.Second)
+	}
+	return err
+}
+
+// startHealthMonitor pings Redis every REDIS_HEALTH_INTERVAL (default 10s)
+// and records the result. The client reconnects on its own, so the monitor
+// only observes; it never stops the process.
+func startHealthMonitor() {
+	monitorOnce.Do(func() {
+		interval := 10 * time.Second
+		if value := os.Getenv("REDIS_HEALTH_INTERVAL"); value != "" {
+			if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+				interval = parsed
+			}
+		}
+
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for range ticker.C {
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				recordStatus(redisClient.Ping(ctx).Err())
+				cancel()
+			}
+		}()
+	})
+}
+
+// IsConnectionError reports whether err means Redis could not be reached, as
+// opposed to a missing key or a rejected command
+func IsConnectionError(err error) bool {
+	if err == nil || errors.Is(err, redis.Nil) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, redis.ErrClosed)
+}
@@ -3,44 +3,198 @@ package db
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
 	"os"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"botanic/internal/metrics"
+
 	"github.com/redis/go-redis/v9"
 )
 
-var (
-	redisClient *redis.Client
-	ctx         = context.Background()
-)
+// redisClient is a plain, Sentinel-backed or cluster client depending on the
+// configuration. Related keys, such as a session and its owner's session
+// index, are not hash-tagged, since sessions are looked up by ID alone. In
+// cluster mode Tx therefore runs one transaction per slot, and WatchTx applies
+// writes outside the watched slot after its transaction succeeds.
+var redisClient redis.UniversalClient
 
 // InitializeRedis sets up the Redis client
 func InitializeRedis() error {
+	opts, err := redisOptions()
+	if err != nil {
+		return err
+	}
+	if err := applyPoolOptions(opts); err != nil {
+		return err
+	}
+	slog.Info("Redis pool configured",
+		"size", opts.PoolSize,
+		"min_idle", opts.MinIdleConns,
+		"dial_timeout", opts.DialTimeout.String(),
+		"read_timeout", opts.ReadTimeout.String(),
+		"write_timeout", opts.WriteTimeout.String(),
+	)
+
+	redisClient = newClient(opts)
+	if metrics.Enabled() {
+		redisClient.AddHook(metricsHook{})
+	}
+
+	// Test the connection, giving Redis a chance to come up
+	if err := connectWithRetry(); err != nil {
+		return fmt.Errorf("failed to connect to Redis: %v", err)
+	}
+	startHealthMonitor()
+
+	return nil
+}
+
+// newClient creates a Sentinel failover client when REDIS_SENTINEL_ADDRS and
+// REDIS_MASTER_NAME are set, a cluster client when REDIS_CLUSTER_ADDRS is set,
+// and a plain client otherwise. Credentials, TLS and pool settings come from
+// opts in every case.
+func newClient(opts *redis.Options) redis.UniversalClient {
+	if sentinelAddrs := splitAddrs(os.Getenv("REDIS_SENTINEL_ADDRS")); len(sentinelAddrs) > 0 {
+		if masterName := os.Getenv("REDIS_MASTER_NAME"); masterName != "" {
+			slog.Info("Redis using Sentinel", "master", masterName, "sentinels", sentinelAddrs)
+			return redis.NewFailoverClient(&redis.FailoverOptions{
+				MasterName:       masterName,
+				SentinelAddrs:    sentinelAddrs,
+				SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+				Username:         opts.Username,
+				Password:         opts.Password,
+				DB:               opts.DB,
+				TLSConfig:        opts.TLSConfig,
+				PoolSize:         opts.PoolSize,
+				MinIdleConns:     opts.MinIdleConns,
+				DialTimeout:      opts.DialTimeout,
+				ReadTimeout:      opts.ReadTimeout,
+				WriteTimeout:     opts.WriteTimeout,
+
+				ContextTimeoutEnabled: opts.ContextTimeoutEnabled,
+			})
+		}
+		slog.Warn("REDIS_SENTINEL_ADDRS is set without REDIS_MASTER_NAME, ignoring Sentinel")
+	}
+
+	if clusterAddrs := splitAddrs(os.Getenv("REDIS_CLUSTER_ADDRS")); len(clusterAddrs) > 0 {
+		slog.Info("Redis using cluster", "addrs", clusterAddrs)
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        clusterAddrs,
+			Username:     opts.Username,
+			Password:     opts.Password,
+			TLSConfig:    opts.TLSConfig,
+			PoolSize:     opts.PoolSize,
+			MinIdleConns: opts.MinIdleConns,
+			DialTimeout:  opts.DialTimeout,
+			ReadTimeout:  opts.ReadTimeout,
+			WriteTimeout: opts.WriteTimeout,
+
+			ContextTimeoutEnabled: opts.ContextTimeoutEnabled,
+		})
+	}
+
+	return redis.NewClient(opts)
+}
+
+// splitAddrs parses a comma-separated list of host:port addresses
+func splitAddrs(value string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(value, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// redisOptions builds the connection options from REDIS_URL when set, such as
+// the rediss:// URL of a managed Redis (which enables TLS), and otherwise from
+// REDIS_ADDR, REDIS_PASSWORD and REDIS_DB
+func redisOptions() (*redis.Options, error) {
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		opts, err := redis.ParseURL(redisURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_URL value: %v", err)
+		}
+		return opts, nil
+	}
+
 	addr := getEnvOrDefault("REDIS_ADDR", "localhost:6379")
 	password := getEnvOrDefault("REDIS_PASSWORD", "")
 	dbStr := getEnvOrDefault("REDIS_DB", "0")
 	db, err := strconv.Atoi(dbStr)
 	if err != nil {
-		return fmt.Errorf("invalid REDIS_DB value: %v", err)
+		return nil, fmt.Errorf("invalid REDIS_DB value: %v", err)
 	}
 
-	redisClient = redis.NewClient(&redis.Options{
+	return &redis.Options{
 		Addr:     addr,
 		Password: password,
 		DB:       db,
-	})
+	}, nil
+}
 
-	// Test the connection
-	_, err = redisClient.Ping(ctx).Result()
-	if err != nil {
-		return fmt.Errorf("failed to connect to Redis: %v", err)
+// applyPoolOptions sets the pool size and timeouts from REDIS_POOL_SIZE,
+// REDIS_MIN_IDLE_CONNS, REDIS_DIAL_TIMEOUT, REDIS_READ_TIMEOUT and
+// REDIS_WRITE_TIMEOUT. Context deadlines are honored so a slow Redis cannot
+// hold a caller past its own deadline.
+func applyPoolOptions(opts *redis.Options) error {
+	opts.PoolSize = 10 * runtime.GOMAXPROCS(0)
+	opts.DialTimeout = 5 * time.Second
+	opts.ReadTimeout = 3 * time.Second
+	opts.WriteTimeout = 3 * time.Second
+	opts.ContextTimeoutEnabled = true
+
+	ints := map[string]*int{
+		"REDIS_POOL_SIZE":      &opts.PoolSize,
+		"REDIS_MIN_IDLE_CONNS": &opts.MinIdleConns,
+	}
+	for key, dest := range ints {
+		if value := os.Getenv(key); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				return fmt.Errorf("invalid %s value: %q", key, value)
+			}
+			*dest = parsed
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"REDIS_DIAL_TIMEOUT":  &opts.DialTimeout,
+		"REDIS_READ_TIMEOUT":  &opts.ReadTimeout,
+		"REDIS_WRITE_TIMEOUT": &opts.WriteTimeout,
+	}
+	for key, dest := range durations {
+		if value := os.Getenv(key); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed <= 0 {
+				return fmt.Errorf("invalid %s value: %q", key, value)
+			}
+			*dest = parsed
+		}
 	}
 
 	return nil
 }
 
+// Ping checks that Redis is reachable, giving up after timeout
+func Ping(timeout time.Duration) error {
+	pingCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return redisClient.Ping(pingCtx).Err()
+}
+
 // getEnvOrDefault returns the environment variable value or a default if not set
 func getEnvOrDefault(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -59,6 +213,11 @@ func CloseRedis() error {
 
 // Set stores a value in Redis with an expiration time
 func Set(key string, value interface{}, expiration time.Duration) error {
+	return SetCtx(context.Background(), key, value, expiration)
+}
+
+// SetCtx is like Set but honors the cancellation and deadline of ctx
+func SetCtx(ctx context.Context, key string, value interface{}, expiration time.Duration) error {
 	jsonData, err := json.Marshal(value)
 	if err != nil {
 		return err
@@ -68,6 +227,11 @@ func Set(key string, value interface{}, expiration time.Duration) error {
 
 // Get retrieves a value from Redis
 func Get(key string, dest interface{}) error {
+	return GetCtx(context.Background(), key, dest)
+}
+
+// GetCtx is like Get but honors the cancellation and deadline of ctx
+func GetCtx(ctx context.Context, key string, dest interface{}) error {
 	val, err := redisClient.Get(ctx, key).Result()
 	if err != nil {
 		return err
@@ -75,19 +239,367 @@ func Get(key string, dest interface{}) error {
 	return json.Unmarshal([]byte(val), dest)
 }
 
+// GetT retrieves and unmarshals the value stored at key
+func GetT[T any](key string) (T, error) {
+	return GetTCtx[T](context.Background(), key)
+}
+
+// GetTCtx is like GetT but honors the cancellation and deadline of ctx
+func GetTCtx[T any](ctx context.Context, key string) (T, error) {
+	var value T
+	err := GetCtx(ctx, key, &value)
+	return value, err
+}
+
+// SetT marshals and stores a value with an optional expiration
+func SetT[T any](key string, value T, expiration time.Duration) error {
+	return SetTCtx(context.Background(), key, value, expiration)
+}
+
+// SetTCtx is like SetT but honors the cancellation and deadline of ctx
+func SetTCtx[T any](ctx context.Context, key string, value T, expiration time.Duration) error {
+	return SetCtx(ctx, key, value, expiration)
+}
+
+// Pipeliner queues commands for a transaction started with Tx or WatchTx
+type Pipeliner struct {
+	ctx  context.Context
+	pipe redis.Pipeliner
+	// after, if set, takes the commands for keys outside slot, which a
+	// cluster cannot run in the same transaction as the watched keys
+	after redis.Pipeliner
+	slot  int
+}
+
+// pipeFor returns the pipeline commands for key are queued on
+func (p *Pipeliner) pipeFor(key string) redis.Pipeliner {
+	if p.after != nil && keySlot(key) != p.slot {
+		return p.after
+	}
+	return p.pipe
+}
+
+// Set queues storing a JSON-marshaled value with an expiration time
+func (p *Pipeliner) Set(key string, value interface{}, expiration time.Duration) error {
+	jsonData, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	p.pipeFor(key).Set(p.ctx, key, jsonData, expiration)
+	return nil
+}
+
+// ZAdd queues adding a member to a sorted set
+func (p *Pipeliner) ZAdd(key string, score float64, member string) {
+	p.pipeFor(key).ZAdd(p.ctx, key, redis.Z{Score: score, Member: member})
+}
+
+// ZRem queues removing a member from a sorted set
+func (p *Pipeliner) ZRem(key string, member string) {
+	p.pipeFor(key).ZRem(p.ctx, key, member)
+}
+
+// ZCard queues counting the members of a sorted set. The count is available
+// from the returned command once the transaction has run.
+func (p *Pipeliner) ZCard(key string) *redis.IntCmd {
+	return p.pipeFor(key).ZCard(p.ctx, key)
+}
+
+// HSet queues storing a JSON-marshaled value in a hash field
+func (p *Pipeliner) HSet(key string, field string, value interface{}) error {
+	jsonData, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	p.pipeFor(key).HSet(p.ctx, key, field, jsonData)
+	return nil
+}
+
+// HDel queues removing fields from a hash
+func (p *Pipeliner) HDel(key string, fields ...string) {
+	p.pipeFor(key).HDel(p.ctx, key, fields...)
+}
+
+// Incr queues incrementing a counter. The new value is available from the
+// returned command once the transaction has run.
+func (p *Pipeliner) Incr(key string) *redis.IntCmd {
+	return p.pipeFor(key).Incr(p.ctx, key)
+}
+
+// ExpireAt queues setting the time a key expires
+func (p *Pipeliner) ExpireAt(key string, at time.Time) {
+	p.pipeFor(key).ExpireAt(p.ctx, key, at)
+}
+
+// Delete queues removing a key
+func (p *Pipeliner) Delete(key string) {
+	p.pipeFor(key).Del(p.ctx, key)
+}
+
+// Tx runs the commands queued by fn atomically in a single MULTI/EXEC round
+// trip. Nothing is sent if fn returns an error. In cluster mode the commands
+// are atomic per hash slot only.
+func Tx(fn func(p *Pipeliner) error) error {
+	return TxCtx(context.Background(), fn)
+}
+
+// TxCtx is like Tx but honors the cancellation and deadline of ctx
+func TxCtx(ctx context.Context, fn func(p *Pipeliner) error) error {
+	_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		return fn(&Pipeliner{ctx: ctx, pipe: pipe})
+	})
+	return err
+}
+
+// ErrConflict is returned by WatchTx when the watched keys kept changing
+var ErrConflict = errors.New("watched keys changed concurrently")
+
+// watchAttempts bounds how many times WatchTx runs its function
+const watchAttempts = 10
+
+// watchBackoff is the longest WatchTx waits before its second attempt. Each
+// later attempt may wait one more step, at random so that writers contending
+// for a key spread out rather than collide again.
+const watchBackoff = time.Millisecond
+
+// WatchTx is like Tx but sends the queued commands only if none of keys has
+// changed since fn started, so fn can read keys and write values derived from
+// them. If one has, fn runs again after a short random wait; after repeated
+// conflicts WatchTx gives up with ErrConflict.
+//
+// A cluster cannot run a transaction across hash slots, so there keys must
+// share a slot, and commands for keys in other slots, such as indexes, are
+// sent in their own transaction once the watched one has succeeded.
+func WatchTx(fn func(p *Pipeliner) error, keys ...string) error {
+	return WatchTxCtx(context.Background(), fn, keys...)
+}
+
+// WatchTxCtx is like WatchTx but honors the cancellation and deadline of ctx
+func WatchTxCtx(ctx context.Context, fn func(p *Pipeliner) error, keys ...string) error {
+	split := isCluster() && len(keys) > 0
+	for attempt := range watchAttempts {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(rand.N(time.Duration(attempt) * watchBackoff)):
+			}
+		}
+		var after redis.Pipeliner
+		err := redisClient.Watch(ctx, func(tx *redis.Tx) error {
+			_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				p := &Pipeliner{ctx: ctx, pipe: pipe}
+				if split {
+					after = redisClient.TxPipeline()
+					p.after, p.slot = after, keySlot(keys[0])
+				}
+				return fn(p)
+			})
+			return err
+		}, keys...)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil || after == nil || after.Len() == 0 {
+			return err
+		}
+		_, err = after.Exec(ctx)
+		return err
+	}
+	return ErrConflict
+}
+
+// ErrInvalidCursor is returned by ScanPage for a malformed cursor
+var ErrInvalidCursor = errors.New("invalid scan cursor")
+
+// scanCount is the number of keys requested per SCAN call
+const scanCount = 100
+
+// Scan calls fn for every key matching pattern. Keys are fetched in batches
+// with SCAN, so Redis is never blocked and the keys are never all held in
+// memory at once. Iteration stops at the first error returned by fn. A key
+// may be visited more than once if the keyspace changes during the scan.
+func Scan(pattern string, fn func(key string) error) error {
+	return ScanCtx(context.Background(), pattern, fn)
+}
+
+// ScanCtx is like Scan but honors the cancellation and deadline of ctx
+func ScanCtx(ctx context.Context, pattern string, fn func(key string) error) error {
+	nodes, err := scanNodes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if err := scanNode(ctx, node, pattern, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScanPage returns about count keys matching pattern, starting at cursor,
+// and the cursor of the next page. The cursor is opaque; an empty cursor
+// starts a new scan, and an empty next cursor means the scan is complete. As
+// with SCAN, a key may appear on more than one page.
+func ScanPage(cursor string, pattern string, count int64) ([]string, string, error) {
+	return ScanPageCtx(context.Background(), cursor, pattern, count)
+}
+
+// ScanPageCtx is like ScanPage but honors the cancellation and deadline of ctx
+func ScanPageCtx(ctx context.Context, cursor string, pattern string, count int64) ([]string, string, error) {
+	// The cursor is "<node index>:<SCAN cursor on that node>"
+	var (
+		node       int
+		nodeCursor uint64
+	)
+	if cursor != "" {
+		index, position, ok := strings.Cut(cursor, ":")
+		var err1, err2 error
+		node, err1 = strconv.Atoi(index)
+		nodeCursor, err2 = strconv.ParseUint(position, 10, 64)
+		if !ok || err1 != nil || err2 != nil || node < 0 {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+
+	nodes, err := scanNodes(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	if node >= len(nodes) {
+		return nil, "", ErrInvalidCursor
+	}
+
+	var keys []string
+	for node < len(nodes) && int64(len(keys)) < count {
+		batch, next, err := nodes[node].Scan(ctx, nodeCursor, pattern, count).Result()
+		if err != nil {
+			return nil, "", err
+		}
+		keys = append(keys, batch...)
+		if next == 0 {
+			node++
+		}
+		nodeCursor = next
+	}
+
+	if node >= len(nodes) {
+		return keys, "", nil
+	}
+	return keys, strconv.Itoa(node) + ":" + strconv.FormatUint(nodeCursor, 10), nil
+}
+
+// scanNodes returns the nodes holding the keyspace. A cluster's keyspace is
+// spread over its masters, which are returned in a stable order so they can
+// be scanned one at a time and callbacks never run concurrently.
+func scanNodes(ctx context.Context) ([]redis.Cmdable, error) {
+	cluster, ok := redisClient.(*redis.ClusterClient)
+	if !ok {
+		return []redis.Cmdable{redisClient}, nil
+	}
+
+	var (
+		mu      sync.Mutex
+		masters []*redis.Client
+	)
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+		mu.Lock()
+		masters = append(masters, master)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(masters, func(i, j int) bool {
+		return masters[i].Options().Addr < masters[j].Options().Addr
+	})
+
+	nodes := make([]redis.Cmdable, len(masters))
+	for i, master := range masters {
+		nodes[i] = master
+	}
+	return nodes, nil
+}
+
+// scanNode runs the SCAN cursor loop against a single node
+func scanNode(ctx context.Context, client redis.Cmdable, pattern string, fn func(key string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(ctx, cursor, pattern, scanCount).Result()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
 // Delete removes a key from Redis
 func Delete(key string) error {
+	return DeleteCtx(context.Background(), key)
+}
+
+// DeleteCtx is like Delete but honors the cancellation and deadline of ctx
+func DeleteCtx(ctx context.Context, key string) error {
 	return redisClient.Del(ctx, key).Err()
 }
 
+// Expire sets a key's time to live
+func Expire(key string, expiration time.Duration) error {
+	return ExpireCtx(context.Background(), key, expiration)
+}
+
+// ExpireCtx is like Expire but honors the cancellation and deadline of ctx
+func ExpireCtx(ctx context.Context, key string, expiration time.Duration) error {
+	return redisClient.Expire(ctx, key, expiration).Err()
+}
+
+// ExpireAt makes a key expire at the given time
+func ExpireAt(key string, at time.Time) error {
+	return ExpireAtCtx(context.Background(), key, at)
+}
+
+// ExpireAtCtx is like ExpireAt but honors the cancellation and deadline of ctx
+func ExpireAtCtx(ctx context.Context, key string, at time.Time) error {
+	return redisClient.ExpireAt(ctx, key, at).Err()
+}
+
+// Incr increments a counter and returns its new value
+func Incr(key string) (int64, error) {
+	return IncrCtx(context.Background(), key)
+}
+
+// IncrCtx is like Incr but honors the cancellation and deadline of ctx
+func IncrCtx(ctx context.Context, key string) (int64, error) {
+	return redisClient.Incr(ctx, key).Result()
+}
+
 // Exists checks if a key exists in Redis
 func Exists(key string) (bool, error) {
+	return ExistsCtx(context.Background(), key)
+}
+
+// ExistsCtx is like Exists but honors the cancellation and deadline of ctx
+func ExistsCtx(ctx context.Context, key string) (bool, error) {
 	n, err := redisClient.Exists(ctx, key).Result()
 	return n > 0, err
 }
 
 // List operations
 func LPush(key string, value interface{}) error {
+	return LPushCtx(context.Background(), key, value)
+}
+
+// LPushCtx is like LPush but honors the cancellation and deadline of ctx
+func LPushCtx(ctx context.Context, key string, value interface{}) error {
 	jsonData, err := json.Marshal(value)
 	if err != nil {
 		return err
@@ -96,11 +608,21 @@ func LPush(key string, value interface{}) error {
 }
 
 func LRange(key string, start, stop int64) ([]string, error) {
+	return LRangeCtx(context.Background(), key, start, stop)
+}
+
+// LRangeCtx is like LRange but honors the cancellation and deadline of ctx
+func LRangeCtx(ctx context.Context, key string, start, stop int64) ([]string, error) {
 	return redisClient.LRange(ctx, key, start, stop).Result()
 }
 
 // Hash operations
 func HSet(key string, field string, value interface{}) error {
+	return HSetCtx(context.Background(), key, field, value)
+}
+
+// HSetCtx is like HSet but honors the cancellation and deadline of ctx
+func HSetCtx(ctx context.Context, key string, field string, value interface{}) error {
 	jsonData, err := json.Marshal(value)
 	if err != nil {
 		return err
@@ -109,6 +631,11 @@ func HSet(key string, field string, value interface{}) error {
 }
 
 func HGet(key string, field string, dest interface{}) error {
+	return HGetCtx(context.Background(), key, field, dest)
+}
+
+// HGetCtx is like HGet but honors the cancellation and deadline of ctx
+func HGetCtx(ctx context.Context, key string, field string, dest interface{}) error {
 	val, err := redisClient.HGet(ctx, key, field).Result()
 	if err != nil {
 		return err
@@ -117,39 +644,228 @@ func HGet(key string, field string, dest interface{}) error {
 }
 
 // Sorted Set operations
-func ZAdd(key string, score float64, member interface{}) error {
-	jsonData, err := json.Marshal(member)
-	if err != nil {
-		return err
-	}
+//
+// Members are stored as raw strings, without JSON encoding, and returned
+// verbatim, so a member read back compares equal to the one that was added.
+
+// ZAdd adds a member to a sorted set
+func ZAdd(key string, score float64, member string) error {
+	return ZAddCtx(context.Background(), key, score, member)
+}
+
+// ZAddCtx is like ZAdd but honors the cancellation and deadline of ctx
+func ZAddCtx(ctx context.Context, key string, score float64, member string) error {
 	return redisClient.ZAdd(ctx, key, redis.Z{
 		Score:  score,
-		Member: jsonData,
+		Member: member,
 	}).Err()
 }
 
 // ZRange retrieves members from a sorted set
 func ZRange(key string, start, stop int64) ([]string, error) {
-	vals, err := redisClient.ZRange(ctx, key, start, stop).Result()
+	return ZRangeCtx(context.Background(), key, start, stop)
+}
+
+// ZRangeCtx is like ZRange but honors the cancellation and deadline of ctx
+func ZRangeCtx(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	return redisClient.ZRange(ctx, key, start, stop).Result()
+}
+
+// ZRevRange retrieves members from a sorted set, highest score first
+func ZRevRange(key string, start, stop int64) ([]string, error) {
+	return ZRevRangeCtx(context.Background(), key, start, stop)
+}
+
+// ZRevRangeCtx is like ZRevRange but honors the cancellation and deadline of ctx
+func ZRevRangeCtx(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	return redisClient.ZRevRange(ctx, key, start, stop).Result()
+}
+
+// ZRem removes a member from a sorted set
+func ZRem(key string, member string) error {
+	return ZRemCtx(context.Background(), key, member)
+}
+
+// ZRemCtx is like ZRem but honors the cancellation and deadline of ctx
+func ZRemCtx(ctx context.Context, key string, member string) error {
+	return redisClient.ZRem(ctx, key, member).Err()
+}
+
+// ScoredMember is a sorted set member together with its score
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+// ZRevRangeByScore retrieves up to count members with a score strictly below
+// max, highest score first
+func ZRevRangeByScore(key string, max float64, count int64) ([]ScoredMember, error) {
+	return ZRevRangeByScoreCtx(context.Background(), key, max, count)
+}
+
+// ZRevRangeByScoreCtx is like ZRevRangeByScore but honors the cancellation and deadline of ctx
+func ZRevRangeByScoreCtx(ctx context.Context, key string, max float64, count int64) ([]ScoredMember, error) {
+	vals, err := redisClient.ZRevRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+		Max:   "(" + formatScore(max),
+		Min:   "-inf",
+		Count: count,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	return scoredMembers(vals), nil
+}
+
+// ZRevRangeByScoreFrom retrieves up to count members with a score at or
+// below max, highest score first, after skipping the first offset of them
+func ZRevRangeByScoreFrom(key string, max float64, offset, count int64) ([]ScoredMember, error) {
+	return ZRevRangeByScoreFromCtx(context.Background(), key, max, offset, count)
+}
+
+// ZRevRangeByScoreFromCtx is like ZRevRangeByScoreFrom but honors the cancellation and deadline of ctx
+func ZRevRangeByScoreFromCtx(ctx context.Context, key string, max float64, offset, count int64) ([]ScoredMember, error) {
+	vals, err := redisClient.ZRevRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+		Max:    formatScore(max),
+		Min:    "-inf",
+		Offset: offset,
+		Count:  count,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	return scoredMembers(vals), nil
+}
+
+// ZRangeByScore retrieves the members with a score between min and max
+// inclusive, lowest score first
+func ZRangeByScore(key string, min, max float64) ([]ScoredMember, error) {
+	return ZRangeByScoreCtx(context.Background(), key, min, max)
+}
+
+// ZRangeByScoreCtx is like ZRangeByScore but honors the cancellation and deadline of ctx
+func ZRangeByScoreCtx(ctx context.Context, key string, min, max float64) ([]ScoredMember, error) {
+	vals, err := redisClient.ZRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+		Min: formatScore(min),
+		Max: formatScore(max),
+	}).Result()
 	if err != nil {
 		return nil, err
 	}
+	return scoredMembers(vals), nil
+}
+
+// formatScore formats a score as a range bound, including the infinities
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "+inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
 
-	// Unmarshal each value from JSON
-	var result []string
+func scoredMembers(vals []redis.Z) []ScoredMember {
+	result := make([]ScoredMember, 0, len(vals))
 	for _, val := range vals {
-		var unmarshaled string
-		if err := json.Unmarshal([]byte(val), &unmarshaled); err != nil {
-			// If unmarshaling fails, use the raw value
-			result = append(result, val)
-		} else {
-			result = append(result, unmarshaled)
-		}
+		member, _ := val.Member.(string)
+		result = append(result, ScoredMember{Member: member, Score: val.Score})
 	}
+	return result
+}
 
-	return result, nil
+// ZCard returns the number of members in a sorted set
+func ZCard(key string) (int64, error) {
+	return ZCardCtx(context.Background(), key)
 }
 
-func ZRem(key string, member interface{}) error {
-	return redisClient.ZRem(ctx, key, member).Err()
+// ZCardCtx is like ZCard but honors the cancellation and deadline of ctx
+func ZCardCtx(ctx context.Context, key string) (int64, error) {
+	return redisClient.ZCard(ctx, key).Result()
+}
+
+// RPush appends a JSON-marshaled value to the end of a list and returns the
+// new length of the list
+func RPush(key string, value interface{}) (int64, error) {
+	return RPushCtx(context.Background(), key, value)
+}
+
+// RPushCtx is like RPush but honors the cancellation and deadline of ctx
+func RPushCtx(ctx context.Context, key string, value interface{}) (int64, error) {
+	jsonData, err := json.Marshal(value)
+	if err != nil {
+		return 0, err
+	}
+	return redisClient.RPush(ctx, key, jsonData).Result()
+}
+
+// LLen returns the length of a list
+func LLen(key string) (int64, error) {
+	return LLenCtx(context.Background(), key)
+}
+
+// LLenCtx is like LLen but honors the cancellation and deadline of ctx
+func LLenCtx(ctx context.Context, key string) (int64, error) {
+	return redisClient.LLen(ctx, key).Result()
+}
+
+// LRem removes up to count occurrences of a raw list element
+func LRem(key string, count int64, value string) error {
+	return LRemCtx(context.Background(), key, count, value)
+}
+
+// LRemCtx is like LRem but honors the cancellation and deadline of ctx
+func LRemCtx(ctx context.Context, key string, count int64, value string) error {
+	return redisClient.LRem(ctx, key, count, value).Err()
+}
+
+// HIncrBy increments an integer hash field
+func HIncrBy(key string, field string, incr int64) error {
+	return HIncrByCtx(context.Background(), key, field, incr)
+}
+
+// HIncrByCtx is like HIncrBy but honors the cancellation and deadline of ctx
+func HIncrByCtx(ctx context.Context, key string, field string, incr int64) error {
+	return redisClient.HIncrBy(ctx, key, field, incr).Err()
+}
+
+// HDel removes fields from a hash
+func HDel(key string, fields ...string) error {
+	return HDelCtx(context.Background(), key, fields...)
+}
+
+// HDelCtx is like HDel but honors the cancellation and deadline of ctx
+func HDelCtx(ctx context.Context, key string, fields ...string) error {
+	return redisClient.HDel(ctx, key, fields...).Err()
+}
+
+// HGetAll retrieves all raw fields and values of a hash
+func HGetAll(key string) (map[string]string, error) {
+	return HGetAllCtx(context.Background(), key)
+}
+
+// HGetAllCtx is like HGetAll but honors the cancellation and deadline of ctx
+func HGetAllCtx(ctx context.Context, key string) (map[string]string, error) {
+	return redisClient.HGetAll(ctx, key).Result()
+}
+
+// SAdd adds a member to a set, reporting whether it was not already a member
+func SAdd(key string, member string) (bool, error) {
+	return SAddCtx(context.Background(), key, member)
+}
+
+// SAddCtx is like SAdd but honors the cancellation and deadline of ctx
+func SAddCtx(ctx context.Context, key string, member string) (bool, error) {
+	added, err := redisClient.SAdd(ctx, key, member).Result()
+	return added > 0, err
+}
+
+// SCard returns the number of members in a set
+func SCard(key string) (int64, error) {
+	return SCardCtx(context.Background(), key)
+}
+
+// SCardCtx is like SCard but honors the cancellation and deadline of ctx
+func SCardCtx(ctx context.Context, key string) (int64, error) {
+	return redisClient.SCard(ctx, key).Result()
 }
@@ -0,0 +1,70 @@
+package db_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"botanic/internal/db"
+	"botanic/internal/db/dbtest"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestSortedSetMembersRoundTrip(t *testing.T) {
+	dbtest.Setup(t)
+
+	members := []string{
+		"plain-id",
+		`"quoted"`,
+		`with "inner" quotes`,
+		`back\slash`,
+		`{"json":"object"}`,
+		"42",
+		"",
+	}
+	for i, member := range members {
+		if err := db.ZAdd("zset", float64(i), member); err != nil {
+			t.Fatalf("add %q: %v", member, err)
+		}
+	}
+
+	got, err := db.ZRange("zset", 0, -1)
+	if err != nil {
+		t.Fatalf("range: %v", err)
+	}
+	if !slices.Equal(got, members) {
+		t.Fatalf("range returned %q, want %q", got, members)
+	}
+
+	// Removal matches the stored encoding
+	for _, member := range members {
+		if err := db.ZRem("zset", member); err != nil {
+			t.Fatalf("remove %q: %v", member, err)
+		}
+	}
+	if count, err := db.ZCard("zset"); err != nil || count != 0 {
+		t.Fatalf("%d members left (%v), want none", count, err)
+	}
+}
+
+func TestTxIncrementsAndExpiresTogether(t *testing.T) {
+	dbtest.Setup(t)
+
+	var incr *redis.IntCmd
+	err := db.Tx(func(p *db.Pipeliner) error {
+		incr = p.Incr("counter")
+		p.Incr("expired")
+		p.ExpireAt("expired", time.Now().Add(-time.Minute))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("tx: %v", err)
+	}
+	if incr.Val() != 1 {
+		t.Fatalf("counter = %d, want 1", incr.Val())
+	}
+	if exists, err := db.Exists("expired"); err != nil || exists {
+		t.Fatalf("counter expired in the past exists: %v, %v", exists, err)
+	}
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"botanic/internal/db"
+	"botanic/internal/litellm"
+	"botanic/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultUsersPageSize = 50
+	maxUsersPageSize     = 200
+)
+
+// UsersPage is a page of users. NextCursor is empty on the last page.
+type UsersPage struct {
+	Users      []*models.User `json:"users"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// AdminUserDetail is an administrator's view of a single user
+type AdminUserDetail struct {
+	*models.User
+	ChatSessions  int                  `json:"chat_sessions"`
+	LoginSessions []models.UserSession `json:"login_sessions"`
+	Usage         *litellm.Usage       `json:"usage"`
+}
+
+// ListUsers returns a page of registered users. Pages are walked with the
+// "cursor" returned by the previous page.
+func ListUsers(c echo.Context) error {
+	limit := defaultUsersPageSize
+	if param := c.QueryParam("limit"); param != "" {
+		var err error
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid limit parameter")
+		}
+		if limit > maxUsersPageSize {
+			limit = maxUsersPageSize
+		}
+	}
+
+	users, next, err := models.ListUsers(c.Request().Context(), c.QueryParam("cursor"), limit)
+	if err != nil {
+		if errors.Is(err, db.ErrInvalidCursor) {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid cursor parameter")
+		}
+		requestLogger(c).Error("failed to list users", "error", err)
+		return storeFailed(err, "failed to list users")
+	}
+
+	return c.JSON(http.StatusOK, UsersPage{Users: users, NextCursor: next})
+}
+
+// GetUser returns a single user with a summary of their activity
+func GetUser(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Param("id")
+	// Only user IDs are looked up, never the index keys sharing their prefix
+	if _, err := uuid.Parse(userID); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "user not found")
+	}
+
+	user, err := models.GetUserByIDCtx(ctx, userID)
+	if err != nil {
+		return lookupFailed(err, "user not found", "failed to get user")
+	}
+
+	sessions, err := models.GetUserSessionsCtx(ctx, userID)
+	if err != nil {
+		return storeFailed(err, "failed to get chat sessions")
+	}
+	loginSessions, err := models.GetUserActiveSessions(userID)
+	if err != nil {
+		return storeFailed(err, "failed to get login sessions")
+	}
+	usage, err := models.GetUserTokenUsage(userID)
+	if err != nil {
+		return storeFailed(err, "failed to get usage")
+	}
+
+	if loginSessions == nil {
+		loginSessions = []models.UserSession{}
+	}
+	return c.JSON(http.StatusOK, AdminUserDetail{
+		User:          user,
+		ChatSessions:  len(sessions),
+		LoginSessions: loginSessions,
+		Usage:         usage,
+	})
+}
+
+// SetUserQuota overrides a user's AI completion quotas. Omitted limits fall
+// back to the global defaults; zero means unlimited.
+func SetUserQuota(c echo.Context) error {
+	userID := c.Param("id")
+	if _, err := uuid.Parse(userID); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "user not found")
+	}
+
+	var req models.UserQuota
+	if err := bindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	user, err := models.GetUserByIDCtx(c.Request().Context(), userID)
+	if err != nil {
+		return lookupFailed(err, "user not found", "failed to get user")
+	}
+
+	quota := &req
+	if req.Daily == nil && req.Monthly == nil {
+		quota = nil
+	}
+	if err := models.SetUserQuota(user, quota); err != nil {
+		return storeFailed(err, "failed to update quota")
+	}
+
+	return c.JSON(http.StatusOK, user)
+}
+
+// GetFeedbackStats returns a summary of message ratings across all users
+func GetFeedbackStats(c echo.Context) error {
+	stats, err := models.GetFeedbackStats()
+	if err != nil {
+		return storeFailed(err, "failed to get feedback stats")
+	}
+
+	return c.JSON(http.StatusOK, stats)
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	maxAttachments     = 4
+	maxAttachmentBytes = 2 << 20 // 2 MiB per decoded image
+	// maxAttachmentBase64Size is the encoded length of the largest image
+	maxAttachmentBase64Size = (maxAttachmentBytes + 2) / 3 * 4
+)
+
+// allowedImageTypes lists the image MIME types accepted in data URIs
+var allowedImageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// Attachment is an image sent along with a user message, given either as an
+// http(s) URL or a base64 data URI
+type Attachment struct {
+	URL string `json:"url"`
+}
+
+// validateAttachments checks the number, type and size of attachments
+func validateAttachments(attachments []Attachment) error {
+	if len(attachments) > maxAttachments {
+		return fmt.Errorf("at most %d attachments are allowed", maxAttachments)
+	}
+	for _, attachment := range attachments {
+		if err := validateAttachment(attachment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateAttachment(attachment Attachment) error {
+	if strings.HasPrefix(attachment.URL, "https://") || strings.HasPrefix(attachment.URL, "http://") {
+		return nil
+	}
+
+	rest, ok := strings.CutPrefix(attachment.URL, "data:")
+	if !ok {
+		return errors.New("attachment must be an http(s) URL or a data URI")
+	}
+	mediaType, data, ok := strings.Cut(rest, ";base64,")
+	if !ok {
+		return errors.New("attachment data URI must be base64 encoded")
+	}
+	if !allowedImageTypes[mediaType] {
+		return fmt.Errorf("unsupported attachment type %q", mediaType)
+	}
+	if base64.StdEncoding.DecodedLen(len(data)) > maxAttachmentBytes {
+		return fmt.Errorf("attachment exceeds %d bytes", maxAttachmentBytes)
+	}
+	if _, err := base64.StdEncoding.DecodeString(data); err != nil {
+		return errors.New("attachment data URI is not valid base64")
+	}
+	return nil
+}
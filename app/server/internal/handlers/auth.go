@@ -1,14 +1,15 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -16,12 +17,15 @@ import (
 	"encoding/base64"
 
 	"botanic/internal/auth"
+	"botanic/internal/avatar"
 	"botanic/internal/models"
+	"botanic/internal/validation"
 	"net/url"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/github"
 	"golang.org/x/oauth2/google"
@@ -49,13 +53,13 @@ var (
 )
 
 type RegisterRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email    string `json:"email" validate:"required,email"`
+	Password string `json:"password" validate:"required,min=8,maxbytes=72"`
 }
 
 type LoginRequest struct {
-	Email      string `json:"email"`
-	Password   string `json:"password"`
+	Email      string `json:"email" validate:"required,email"`
+	Password   string `json:"password" validate:"required"`
 	RememberMe bool   `json:"remember_me"`
 }
 
@@ -68,19 +72,62 @@ type AuthResponse struct {
 	} `json:"session"`
 }
 
+// UpdateProfileRequest changes the user's name and theme. Avatars are only
+// changed by uploading or deleting them.
 type UpdateProfileRequest struct {
-	Name        string `json:"name" binding:"required,min=2,max=50"`
-	AvatarURL   string `json:"avatar_url"`
+	Name        string `json:"name" validate:"required,min=2,max=50"`
 	Preferences struct {
-		Theme string `json:"theme" binding:"required,oneof=light dark system"`
+		Theme string `json:"theme" validate:"required,oneof=light dark system"`
 	} `json:"preferences"`
 }
 
+// UpdatePreferencesRequest updates the user's preferences. Empty theme,
+// language, timezone, font size and message density values, and omitted
+// notifications, login_alerts and defaults, leave the stored ones unchanged.
+// An empty default_model or default_system_prompt clears the default.
 type UpdatePreferencesRequest struct {
-	Theme         string `json:"theme"`
-	Language      string `json:"language"`
-	Timezone      string `json:"timezone"`
-	Notifications bool   `json:"notifications"`
+	Theme               string   `json:"theme" validate:"omitempty,oneof=light dark system"`
+	Language            string   `json:"language"`
+	Timezone            string   `json:"timezone"`
+	Notifications       *bool    `json:"notifications"`
+	LoginAlerts         *bool    `json:"login_alerts"`
+	FontSize            string   `json:"font_size" validate:"omitempty,oneof=small medium large"`
+	MessageDensity      string   `json:"message_density" validate:"omitempty,oneof=compact comfortable"`
+	DefaultModel        *string  `json:"default_model"`
+	DefaultTemperature  *float64 `json:"default_temperature" validate:"omitempty,min=0,max=2"`
+	DefaultSystemPrompt *string  `json:"default_system_prompt"`
+}
+
+// allowedLanguages returns the languages users may choose, from the
+// comma-separated ALLOWED_LANGUAGES (default "en,fa")
+func allowedLanguages() []string {
+	value := os.Getenv("ALLOWED_LANGUAGES")
+	if value == "" {
+		value = "en,fa"
+	}
+	var languages []string
+	for _, language := range strings.Split(value, ",") {
+		if language = strings.TrimSpace(language); language != "" {
+			languages = append(languages, language)
+		}
+	}
+	return languages
+}
+
+// validatePreferences checks the preference values that cannot be expressed
+// as validate tags
+func validatePreferences(req *UpdatePreferencesRequest) validation.FieldErrors {
+	errs := validation.FieldErrors{}
+	if req.Language != "" && !slices.Contains(allowedLanguages(), req.Language) {
+		errs["language"] = "must be one of " + strings.Join(allowedLanguages(), " ")
+	}
+	// LoadLocation accepts "" and "Local", which are not real timezones
+	if req.Timezone != "" {
+		if _, err := time.LoadLocation(req.Timezone); err != nil || req.Timezone == "Local" {
+			errs["timezone"] = "must be a valid IANA timezone"
+		}
+	}
+	return errs
 }
 
 // SessionInfo represents a user's session information
@@ -108,12 +155,16 @@ type RefreshTokenRequest struct {
 // Register handles user registration
 func Register(c echo.Context) error {
 	var req RegisterRequest
-	if err := c.Bind(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	if err := bindAndValidate(c, &req); err != nil {
+		return err
 	}
 
 	// Check if user already exists
-	existingUser, _ := models.GetUserByEmail(req.Email)
+	existingUser, err := models.GetUserByEmail(req.Email)
+	if err != nil {
+		requestLogger(c).Error("failed to check for existing user", "error", err)
+		return storeFailed(err, "failed to check for existing user")
+	}
 	if existingUser != nil {
 		return echo.NewHTTPError(http.StatusConflict, "user already exists")
 	}
@@ -121,11 +172,11 @@ func Register(c echo.Context) error {
 	// Create new user
 	user, err := models.CreateUser(req.Email, req.Password, "email", "", "", "")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create user")
+		return storeFailed(err, "failed to create user")
 	}
 
 	// Generate JWT token
-	token, err := auth.GenerateToken(user.ID)
+	token, err := auth.GenerateToken(user.ID, user.Email)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate token")
 	}
@@ -141,13 +192,17 @@ func Register(c echo.Context) error {
 // Login handles user login
 func Login(c echo.Context) error {
 	var req LoginRequest
-	if err := c.Bind(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	if err := bindAndValidate(c, &req); err != nil {
+		return err
 	}
 
 	// Get user by email
 	user, err := models.GetUserByEmail(req.Email)
 	if err != nil {
+		requestLogger(c).Error("failed to get user", "error", err)
+		return storeFailed(err, "failed to get user")
+	}
+	if user == nil {
 		return echo.NewHTTPError(http.StatusUnauthorized, "invalid credentials")
 	}
 
@@ -156,23 +211,20 @@ func Login(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "invalid credentials")
 	}
 
-	// Generate JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": user.ID,
-		"exp": time.Now().Add(30 * 24 * time.Hour).Unix(),
-	})
-
-	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	// Generate JWT token, long-lived only if the user asked to be remembered
+	duration := auth.SessionDuration(req.RememberMe)
+	tokenString, err := auth.GenerateTokenWithDuration(user.ID, user.Email, duration)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate token"})
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate token")
 	}
 
 	// Create a session
-	expiresAt := time.Now().Add(30 * 24 * time.Hour)
+	expiresAt := time.Now().Add(duration)
 	session, err := models.CreateUserSession(user.ID, expiresAt)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create session")
+		return storeFailed(err, "failed to create session")
 	}
+	checkLoginDevice(c, user)
 
 	resp := AuthResponse{
 		Token: tokenString,
@@ -195,42 +247,45 @@ func RefreshToken(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "missing token")
 	}
 
-	// Try to verify token and get user ID
-	userID, err := auth.VerifyToken(req.Token)
+	// Try to verify token and get its claims
+	claims, err := auth.ValidateToken(req.Token)
 	if err != nil {
-		// If token is expired, try to extract user ID from claims without validation
+		// If token is expired, try to extract claims without validation
 		if err == auth.ErrExpiredToken {
-			claims := &auth.Claims{}
+			claims = &auth.Claims{}
 			token, _ := jwt.ParseWithClaims(req.Token, claims, func(token *jwt.Token) (interface{}, error) {
 				return []byte(os.Getenv("JWT_SECRET")), nil
 			})
-			if token != nil && claims.UserID != "" {
-				userID = claims.UserID
-			} else {
+			if token == nil || claims.UserID == "" {
 				return echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
 			}
 		} else {
 			return echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
 		}
 	}
+	userID := claims.UserID
 
 	// Get user from database
-	user, err := models.GetUserByID(userID)
+	user, err := models.GetUserByIDCtx(c.Request().Context(), userID)
+	if errors.Is(err, models.ErrUnavailable) {
+		return storeFailed(err, "failed to get user")
+	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusUnauthorized, "user not found")
 	}
 
-	// Generate new token
-	newToken, err := auth.GenerateToken(user.ID)
+	// Generate new token with the lifetime of the old one
+	duration := auth.TokenLifetime(claims)
+	newToken, err := auth.GenerateTokenWithDuration(user.ID, user.Email, duration)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate new token")
 	}
 
 	// Create a new session
-	expiresAt := time.Now().Add(30 * 24 * time.Hour)
+	expiresAt := time.Now().Add(duration)
 	session, err := models.CreateUserSession(user.ID, expiresAt)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create session")
+		return storeFailed(err, "failed to create session")
 	}
 
 	return c.JSON(http.StatusOK, map[string]interface{}{
@@ -255,17 +310,17 @@ func generateState() (string, error) {
 // HandleGoogleAuth initiates Google OAuth flow with state
 func HandleGoogleAuth(c echo.Context) error {
 	// Log OAuth configuration
-	log.Printf("OAuth Configuration:")
-	log.Printf("ClientID: %s", googleOAuthConfig.ClientID)
-	log.Printf("RedirectURL: %s", googleOAuthConfig.RedirectURL)
-	log.Printf("Scopes: %v", googleOAuthConfig.Scopes)
+	requestLogger(c).Debug("starting Google OAuth",
+		"client_id", googleOAuthConfig.ClientID,
+		"redirect_url", googleOAuthConfig.RedirectURL,
+		"scopes", googleOAuthConfig.Scopes,
+	)
 
 	state, err := generateState()
 	if err != nil {
-		log.Printf("Failed to generate state: %v", err)
+		requestLogger(c).Error("failed to generate OAuth state", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate state")
 	}
-	log.Printf("Generated OAuth state: %s", state)
 
 	cookie := new(http.Cookie)
 	cookie.Name = "oauth_state"
@@ -276,7 +331,6 @@ func HandleGoogleAuth(c echo.Context) error {
 	cookie.SameSite = http.SameSiteLaxMode
 	cookie.MaxAge = 300 // 5 minutes
 	c.SetCookie(cookie)
-	log.Printf("Set OAuth state cookie")
 
 	// Add additional parameters for Google OAuth
 	opts := []oauth2.AuthCodeOption{
@@ -284,7 +338,7 @@ func HandleGoogleAuth(c echo.Context) error {
 		oauth2.ApprovalForce,
 	}
 	url := googleOAuthConfig.AuthCodeURL(state, opts...)
-	log.Printf("Redirecting to Google OAuth URL: %s", url)
+	requestLogger(c).Debug("redirecting to Google OAuth", "url", url)
 	return c.Redirect(http.StatusTemporaryRedirect, url)
 }
 
@@ -365,7 +419,7 @@ func HandleGoogleCallback(c echo.Context) error {
 	}
 
 	// Generate JWT token
-	tokenString, err := auth.GenerateToken(user.ID)
+	tokenString, err := auth.GenerateToken(user.ID, user.Email)
 	if err != nil {
 		return c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/login?error=%s", os.Getenv("FRONTEND_URL"), url.QueryEscape("failed_to_generate_token")))
 	}
@@ -485,7 +539,7 @@ func HandleGithubCallback(c echo.Context) error {
 	}
 
 	// Generate JWT token
-	tokenString, err := auth.GenerateToken(user.ID)
+	tokenString, err := auth.GenerateToken(user.ID, user.Email)
 	if err != nil {
 		return c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/login?error=%s", os.Getenv("FRONTEND_URL"), url.QueryEscape("failed_to_generate_token")))
 	}
@@ -511,49 +565,71 @@ func HandleGithubCallback(c echo.Context) error {
 
 // GetProfile returns the user's profile information
 func GetProfile(c echo.Context) error {
-	// Get user ID from context (set by auth middleware)
-	userID := c.Get("userID").(string)
-	if userID == "" {
-		return echo.NewHTTPError(http.StatusUnauthorized, "user not authenticated")
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
 	}
 
 	// Get user from database
-	user, err := models.GetUserByID(userID)
+	user, err := models.GetUserByIDCtx(c.Request().Context(), userID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusNotFound, "user not found")
+		return lookupFailed(err, "user not found", "failed to get user")
 	}
 
 	return c.JSON(http.StatusOK, user)
 }
 
+// ExportData returns everything stored about the user as a downloadable
+// JSON document
+func ExportData(c echo.Context) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	export, err := models.ExportUserData(c.Request().Context(), userID)
+	if err != nil {
+		requestLogger(c).Error("failed to export user data", "user_id", userID, "error", err)
+		return storeFailed(err, "failed to export data")
+	}
+
+	filename := fmt.Sprintf("botanic-export-%s.json", export.ExportedAt.Format("2006-01-02"))
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	c.Response().WriteHeader(http.StatusOK)
+	// The status is sent, so a failure part way only cuts the download short
+	if err := export.WriteJSON(c.Request().Context(), c.Response()); err != nil {
+		requestLogger(c).Error("failed to write data export", "user_id", userID, "error", err)
+	}
+	return nil
+}
+
 // UpdateProfile updates the user's profile information
 func UpdateProfile(c echo.Context) error {
-	// Get user ID from context (set by auth middleware)
-	userID := c.Get("userID").(string)
-	if userID == "" {
-		return echo.NewHTTPError(http.StatusUnauthorized, "user not authenticated")
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
 	}
 
 	var req UpdateProfileRequest
-	if err := c.Bind(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	if err := bindAndValidate(c, &req); err != nil {
+		return err
 	}
 
 	// Get user from database
-	user, err := models.GetUserByID(userID)
+	user, err := models.GetUserByIDCtx(c.Request().Context(), userID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusNotFound, "user not found")
+		return lookupFailed(err, "user not found", "failed to get user")
 	}
 
-	// Update profile
-	if err := user.UpdateProfile(req.Name, req.AvatarURL); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update profile")
+	if err := user.UpdateProfile(req.Name); err != nil {
+		return storeFailed(err, "failed to update profile")
 	}
 
 	// Update preferences
 	user.Preferences.Theme = req.Preferences.Theme
 	if err := user.UpdatePreferences(user.Preferences); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update preferences")
+		return storeFailed(err, "failed to update preferences")
 	}
 
 	return c.JSON(http.StatusOK, user)
@@ -561,42 +637,142 @@ func UpdateProfile(c echo.Context) error {
 
 // UpdatePreferences updates the user's preferences
 func UpdatePreferences(c echo.Context) error {
-	// Get user ID from context (set by auth middleware)
-	userID := c.Get("userID").(string)
-	if userID == "" {
-		return echo.NewHTTPError(http.StatusUnauthorized, "user not authenticated")
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
 	}
 
 	var req UpdatePreferencesRequest
-	if err := c.Bind(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	if err := bindAndValidate(c, &req); err != nil {
+		return err
+	}
+	errs := validatePreferences(&req)
+	if req.DefaultModel != nil && *req.DefaultModel != "" {
+		known, err := isKnownModel(*req.DefaultModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadGateway, "failed to validate default model")
+		}
+		if !known {
+			errs["default_model"] = "must be an available model"
+		}
+	}
+	if len(errs) > 0 {
+		return validationError(errs)
 	}
 
 	// Get user from database
-	user, err := models.GetUserByID(userID)
+	user, err := models.GetUserByIDCtx(c.Request().Context(), userID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusNotFound, "user not found")
+		return lookupFailed(err, "user not found", "failed to get user")
 	}
 
 	// Update preferences
-	user.Preferences.Theme = req.Theme
-	user.Preferences.Language = req.Language
-	user.Preferences.Timezone = req.Timezone
-	user.Preferences.Notifications = req.Notifications
+	if req.Theme != "" {
+		user.Preferences.Theme = req.Theme
+	}
+	if req.Language != "" {
+		user.Preferences.Language = req.Language
+	}
+	if req.Timezone != "" {
+		user.Preferences.Timezone = req.Timezone
+	}
+	if req.FontSize != "" {
+		user.Preferences.FontSize = req.FontSize
+	}
+	if req.MessageDensity != "" {
+		user.Preferences.MessageDensity = req.MessageDensity
+	}
+	if req.Notifications != nil {
+		user.Preferences.Notifications = *req.Notifications
+	}
+	if req.LoginAlerts != nil {
+		user.Preferences.LoginAlerts = *req.LoginAlerts
+	}
+	if req.DefaultModel != nil {
+		user.Preferences.DefaultModel = *req.DefaultModel
+	}
+	if req.DefaultTemperature != nil {
+		user.Preferences.DefaultTemperature = req.DefaultTemperature
+	}
+	if req.DefaultSystemPrompt != nil {
+		user.Preferences.DefaultSystemPrompt = *req.DefaultSystemPrompt
+	}
 
 	if err := user.UpdatePreferences(user.Preferences); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update preferences")
+		return storeFailed(err, "failed to update preferences")
 	}
 
 	return c.JSON(http.StatusOK, user.Preferences)
 }
 
+// avatarStore holds uploaded avatars; local disk unless InitAvatars says
+// otherwise
+var avatarStore avatar.Store = avatar.NewLocalStore(avatar.LocalDir, avatar.LocalURLPrefix)
+
+// InitAvatars sets the store uploaded avatars are saved to
+func InitAvatars(store avatar.Store) {
+	avatarStore = store
+}
+
+// ServeAvatar serves an uploaded avatar. Avatar filenames are random and never
+// reused, so responses may be cached indefinitely.
+func ServeAvatar(c echo.Context) error {
+	filename := c.Param("filename")
+	// Only plain file names are accepted, never paths
+	if filename == "" || filename != filepath.Base(filename) || strings.HasPrefix(filename, ".") {
+		return echo.NewHTTPError(http.StatusNotFound, "avatar not found")
+	}
+
+	path := filepath.Join(avatar.LocalDir, filename)
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		return echo.NewHTTPError(http.StatusNotFound, "avatar not found")
+	}
+
+	c.Response().Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	c.Response().Header().Set("X-Content-Type-Options", "nosniff")
+	return c.File(path)
+}
+
+// removeAvatar deletes a stored avatar file. Failures only leave an orphaned
+// file behind, so they are logged rather than returned.
+func removeAvatar(c echo.Context, avatarURL string) {
+	if avatarURL == "" {
+		return
+	}
+	if err := avatarStore.Delete(avatarURL); err != nil {
+		requestLogger(c).Warn("failed to delete old avatar", "url", avatarURL, "error", err)
+	}
+}
+
+// DeleteAvatar removes the user's avatar so the default one is shown again
+func DeleteAvatar(c echo.Context) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	user, err := models.GetUserByIDCtx(c.Request().Context(), userID)
+	if err != nil {
+		return lookupFailed(err, "user not found", "failed to get user")
+	}
+
+	if user.AvatarURL == "" {
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	removeAvatar(c, user.AvatarURL)
+	if err := user.SetAvatar(""); err != nil {
+		return storeFailed(err, "failed to update profile")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
 // UploadAvatar handles avatar file uploads
 func UploadAvatar(c echo.Context) error {
-	// Get user ID from context (set by auth middleware)
-	userID := c.Get("userID").(string)
-	if userID == "" {
-		return echo.NewHTTPError(http.StatusUnauthorized, "user not authenticated")
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
 	}
 
 	// Get file from request
@@ -605,60 +781,46 @@ func UploadAvatar(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "invalid file upload")
 	}
 
-	// Validate file type
-	if !strings.HasPrefix(file.Header.Get("Content-Type"), "image/") {
-		return echo.NewHTTPError(http.StatusBadRequest, "file must be an image")
-	}
-
 	// Validate file size (max 5MB)
 	if file.Size > 5*1024*1024 {
 		return echo.NewHTTPError(http.StatusBadRequest, "file size must be less than 5MB")
 	}
 
-	// Create uploads directory if it doesn't exist
-	uploadsDir := "uploads/avatars"
-	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create uploads directory")
-	}
-
-	// Generate unique filename
-	ext := filepath.Ext(file.Filename)
-	filename := fmt.Sprintf("%s%s", uuid.New().String(), ext)
-	filepath := filepath.Join(uploadsDir, filename)
-
-	// Save file
+	// Decode the upload to make sure it is really an image, then store a
+	// resized, re-encoded copy rather than the original
 	src, err := file.Open()
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to open uploaded file")
 	}
 	defer src.Close()
 
-	dst, err := os.Create(filepath)
+	processed, err := avatar.Process(src)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save uploaded file")
+		if errors.Is(err, avatar.ErrInvalidImage) {
+			return echo.NewHTTPError(http.StatusBadRequest, "file must be a PNG, JPEG or GIF image")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to process uploaded file")
 	}
-	defer dst.Close()
 
-	if _, err = io.Copy(dst, src); err != nil {
+	// Store under a unique name
+	avatarURL, err := avatarStore.Put(uuid.New().String()+avatar.Extension, bytes.NewReader(processed), avatar.ContentType)
+	if err != nil {
+		requestLogger(c).Error("failed to store avatar", "user_id", userID, "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save uploaded file")
 	}
 
 	// Get user from database
-	user, err := models.GetUserByID(userID)
+	user, err := models.GetUserByIDCtx(c.Request().Context(), userID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusNotFound, "user not found")
+		return lookupFailed(err, "user not found", "failed to get user")
 	}
 
 	// Delete old avatar if exists
-	if user.AvatarURL != "" {
-		oldPath := strings.TrimPrefix(user.AvatarURL, "/")
-		os.Remove(oldPath)
-	}
+	removeAvatar(c, user.AvatarURL)
 
 	// Update user's avatar URL
-	avatarURL := fmt.Sprintf("/uploads/avatars/%s", filename)
-	if err := user.UpdateProfile(user.Name, avatarURL); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update profile")
+	if err := user.SetAvatar(avatarURL); err != nil {
+		return storeFailed(err, "failed to update profile")
 	}
 
 	return c.JSON(http.StatusOK, map[string]string{
@@ -668,19 +830,19 @@ func UploadAvatar(c echo.Context) error {
 
 // GetUserSessions returns a list of the user's active sessions
 func GetUserSessions(c echo.Context) error {
-	userID := c.Get("userID").(string)
-	if userID == "" {
-		return echo.NewHTTPError(http.StatusUnauthorized, "user not authenticated")
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
 	}
 
-	user, err := models.GetUserByID(userID)
+	user, err := models.GetUserByIDCtx(c.Request().Context(), userID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusNotFound, "user not found")
+		return lookupFailed(err, "user not found", "failed to get user")
 	}
 
 	sessions, err := models.GetUserActiveSessions(user.ID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get sessions")
+		return storeFailed(err, "failed to get sessions")
 	}
 
 	response := make([]SessionInfo, len(sessions))
@@ -699,9 +861,9 @@ func GetUserSessions(c echo.Context) error {
 
 // DeleteUserSession deletes a user session
 func DeleteUserSession(c echo.Context) error {
-	userID := c.Get("userID").(string)
-	if userID == "" {
-		return echo.NewHTTPError(http.StatusUnauthorized, "user not authenticated")
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
 	}
 
 	sessionID := c.Param("id")
@@ -710,12 +872,50 @@ func DeleteUserSession(c echo.Context) error {
 	}
 
 	if err := models.DeleteUserSession(userID, sessionID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete session")
+		return storeFailed(err, "failed to delete session")
 	}
 
 	return c.NoContent(http.StatusNoContent)
 }
 
+// pendingLinkTTL is how long a user has to confirm linking an OAuth login to
+// their existing account
+const pendingLinkTTL = 10 * time.Minute
+
+// AccountLinkRequiredError is returned by AuthenticateWithProvider when an
+// OAuth login's email belongs to a password account that has not linked a
+// provider. The owner must sign in with their password and confirm the link
+// with Token.
+type AccountLinkRequiredError struct {
+	Message  string `json:"message"`
+	Token    string `json:"link_token"`
+	Email    string `json:"email"`
+	Provider string `json:"provider"`
+	// ExistingProvider is how the existing account signs in
+	ExistingProvider string `json:"existing_provider"`
+}
+
+func (e *AccountLinkRequiredError) Error() string {
+	return e.Message
+}
+
+// oauthAutoLink reports whether OAUTH_AUTO_LINK is set, linking OAuth logins
+// to password accounts with the same email without asking their owner
+func oauthAutoLink() bool {
+	return os.Getenv("OAUTH_AUTO_LINK") == "true"
+}
+
+// requiresLinkConfirmation reports whether linking a provider to user must be
+// confirmed by its owner: accounts with a password could otherwise be taken
+// over by whoever controls an OAuth account with the same email. Linked
+// providers are found by provider ID before this is asked.
+func requiresLinkConfirmation(user *models.User) (bool, error) {
+	if oauthAutoLink() {
+		return false, nil
+	}
+	return models.HasPassword(user.ID)
+}
+
 func AuthenticateWithProvider(provider, code, state string) (string, *models.User, error) {
 	var config *oauth2.Config
 	switch provider {
@@ -757,58 +957,54 @@ func AuthenticateWithProvider(provider, code, state string) (string, *models.Use
 			return "", nil, fmt.Errorf("email not verified")
 		}
 	} else {
-		// GitHub user info
-		resp, err := client.Get("https://api.github.com/user")
+		githubUser, err := githubUserInfo(client)
 		if err != nil {
-			return "", nil, fmt.Errorf("failed to get user info: %v", err)
+			return "", nil, err
 		}
-		defer resp.Body.Close()
-
-		var githubUser struct {
-			ID    int    `json:"id"`
-			Email string `json:"email"`
-			Name  string `json:"name"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&githubUser); err != nil {
-			return "", nil, fmt.Errorf("failed to decode user info: %v", err)
-		}
-
-		// Get primary email if not provided
-		if githubUser.Email == "" {
-			emailsResp, err := client.Get("https://api.github.com/user/emails")
-			if err != nil {
-				return "", nil, fmt.Errorf("failed to get user emails: %v", err)
-			}
-			defer emailsResp.Body.Close()
-
-			var emails []struct {
-				Email    string `json:"email"`
-				Primary  bool   `json:"primary"`
-				Verified bool   `json:"verified"`
-			}
-			if err := json.NewDecoder(emailsResp.Body).Decode(&emails); err != nil {
-				return "", nil, fmt.Errorf("failed to decode emails: %v", err)
-			}
-
-			for _, email := range emails {
-				if email.Primary && email.Verified {
-					githubUser.Email = email.Email
-					break
-				}
-			}
-		}
-
 		userInfo.ID = fmt.Sprintf("%d", githubUser.ID)
 		userInfo.Email = githubUser.Email
 		userInfo.Name = githubUser.Name
 		userInfo.VerifiedEmail = true
 	}
 
+	if strings.TrimSpace(userInfo.Email) == "" {
+		return "", nil, errors.New("no email address was provided by " + provider)
+	}
+
 	// Try to find user by provider ID
 	user, err := models.GetUserByProviderID(provider, userInfo.ID)
-	if err != nil || user == nil {
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		return "", nil, fmt.Errorf("failed to look up user: %w", err)
+	}
+	if user == nil {
 		// If not found, try to find by email
-		existingUser, _ := models.GetUserByEmail(userInfo.Email)
+		existingUser, err := models.GetUserByEmail(userInfo.Email)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to look up user: %w", err)
+		}
+		confirm := false
+		if existingUser != nil {
+			if confirm, err = requiresLinkConfirmation(existingUser); err != nil {
+				return "", nil, fmt.Errorf("failed to look up password: %w", err)
+			}
+		}
+		if confirm {
+			linkToken, err := models.CreatePendingLink(models.PendingLink{
+				UserID:     existingUser.ID,
+				Provider:   provider,
+				ProviderID: userInfo.ID,
+			}, pendingLinkTTL)
+			if err != nil {
+				return "", nil, fmt.Errorf("failed to create pending link: %v", err)
+			}
+			return "", nil, &AccountLinkRequiredError{
+				Message:          "account link required",
+				Token:            linkToken,
+				Email:            existingUser.Email,
+				Provider:         provider,
+				ExistingProvider: existingUser.Provider,
+			}
+		}
 		if existingUser != nil {
 			err = models.LinkProviderToUser(existingUser.ID, provider, userInfo.ID)
 			if err != nil {
@@ -824,7 +1020,7 @@ func AuthenticateWithProvider(provider, code, state string) (string, *models.Use
 	}
 
 	// Generate JWT token
-	jwtToken, err := auth.GenerateToken(user.ID)
+	jwtToken, err := auth.GenerateToken(user.ID, user.Email)
 	if err != nil {
 		return "", nil, fmt.Errorf("failed to generate token: %v", err)
 	}
@@ -844,22 +1040,38 @@ func OAuthCallback(c echo.Context) error {
 	}
 
 	if oauthErr != "" {
-		log.Printf("OAuth error: %s", oauthErr)
+		requestLogger(c).Warn("OAuth provider returned an error", "error", oauthErr)
 		return c.Redirect(http.StatusSeeOther, fmt.Sprintf("%s/login?error=%s", frontendURL, url.QueryEscape(oauthErr)))
 	}
 
 	if code == "" || state == "" {
-		log.Printf("Missing code or state. Code: %s, State: %s", code, state)
+		requestLogger(c).Warn("OAuth callback is missing code or state")
 		return c.Redirect(http.StatusSeeOther, fmt.Sprintf("%s/login?error=Missing+code+or+state", frontendURL))
 	}
 
 	token, user, err := AuthenticateWithProvider(provider, code, state)
+	var linkErr *AccountLinkRequiredError
+	if errors.As(err, &linkErr) {
+		requestLogger(c).Info("OAuth login requires linking to an existing account", "provider", provider)
+		if strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMEApplicationJSON) {
+			return c.JSON(http.StatusConflict, linkErr)
+		}
+		query := url.Values{
+			"error":             {"account_link_required"},
+			"link_token":        {linkErr.Token},
+			"email":             {linkErr.Email},
+			"provider":          {linkErr.Provider},
+			"existing_provider": {linkErr.ExistingProvider},
+		}
+		return c.Redirect(http.StatusSeeOther, fmt.Sprintf("%s/login?%s", frontendURL, query.Encode()))
+	}
 	if err != nil {
-		log.Printf("Authentication failed: %v", err)
+		requestLogger(c).Warn("OAuth authentication failed", "error", err)
 		return c.Redirect(http.StatusSeeOther, fmt.Sprintf("%s/login?error=%s", frontendURL, url.QueryEscape(err.Error())))
 	}
 
-	log.Printf("Authentication successful for user %s", user.Email)
+	requestLogger(c).Info("OAuth authentication succeeded", "user_id", user.ID)
+	checkLoginDevice(c, user)
 
 	// Create auth response
 	authResponse := AuthResponse{
@@ -870,7 +1082,7 @@ func OAuthCallback(c echo.Context) error {
 	// Encode the response data
 	responseData, err := json.Marshal(authResponse)
 	if err != nil {
-		log.Printf("Failed to encode response: %v", err)
+		requestLogger(c).Error("failed to encode OAuth response", "error", err)
 		return c.Redirect(http.StatusSeeOther, fmt.Sprintf("%s/login?error=%s", frontendURL, url.QueryEscape("failed_to_encode_response")))
 	}
 
@@ -881,6 +1093,50 @@ func OAuthCallback(c echo.Context) error {
 	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("%s/auth/callback/complete?data=%s", frontendURL, url.QueryEscape(encodedData)))
 }
 
+// LinkProviderRequest confirms linking a pending OAuth login
+type LinkProviderRequest struct {
+	Token string `json:"link_token" validate:"required"`
+}
+
+// LinkProvider links the OAuth login held by a pending link token to the
+// signed-in user, who must own the account the login was matched to
+func LinkProvider(c echo.Context) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req LinkProviderRequest
+	if err := bindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	link, err := models.ConsumePendingLink(req.Token)
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return echo.NewHTTPError(http.StatusNotFound, "link request not found or expired")
+		}
+		return storeFailed(err, "failed to get link request")
+	}
+	if link.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "link request belongs to another account")
+	}
+
+	linked, err := models.GetUserByProviderID(link.Provider, link.ProviderID)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		return storeFailed(err, "failed to link provider")
+	}
+	if linked != nil && linked.ID != userID {
+		return echo.NewHTTPError(http.StatusConflict, "provider account is already linked to another user")
+	}
+	if err := models.LinkProviderToUser(userID, link.Provider, link.ProviderID); err != nil {
+		return storeFailed(err, "failed to link provider")
+	}
+
+	requestLogger(c).Info("linked OAuth provider", "user_id", userID, "provider", link.Provider)
+	return c.NoContent(http.StatusNoContent)
+}
+
 // VerifyToken handles token verification
 func VerifyToken(c echo.Context) error {
 	// Get token from Authorization header
@@ -955,8 +1211,68 @@ func Logout(c echo.Context) error {
 
 	// Delete user session
 	if err := models.DeleteUserSession(userID, token); err != nil {
-		log.Printf("Failed to delete user session: %v", err)
+		requestLogger(c).Error("failed to delete user session", "error", err)
 	}
 
 	return c.NoContent(http.StatusOK)
 }
+
+// githubAPIURL is the API GitHub users are looked up with
+var githubAPIURL = "https://api.github.com"
+
+// githubUser is the GitHub account signing in
+type githubUser struct {
+	ID    int    `json:"id"`
+	Login string `json:"login"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+// githubUserInfo fetches the GitHub account client is authorized for. Its
+// email is the public one, else the verified primary one, else the noreply
+// address GitHub uses for the account's commits, so it is never empty
+func githubUserInfo(client *http.Client) (*githubUser, error) {
+	resp, err := client.Get(githubAPIURL + "/user")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user info: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var user githubUser
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return nil, fmt.Errorf("failed to decode user info: %v", err)
+	}
+
+	// Get primary email if not provided
+	if user.Email == "" {
+		emailsResp, err := client.Get(githubAPIURL + "/user/emails")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get user emails: %v", err)
+		}
+		defer emailsResp.Body.Close()
+
+		var emails []struct {
+			Email    string `json:"email"`
+			Primary  bool   `json:"primary"`
+			Verified bool   `json:"verified"`
+		}
+		if err := json.NewDecoder(emailsResp.Body).Decode(&emails); err != nil {
+			return nil, fmt.Errorf("failed to decode emails: %v", err)
+		}
+
+		for _, email := range emails {
+			if email.Primary && email.Verified {
+				user.Email = email.Email
+				break
+			}
+		}
+	}
+
+	// Users without a verified primary email still get a unique address,
+	// the one GitHub uses for their commits
+	if user.Email == "" {
+		user.Email = fmt.Sprintf("%d+%s@users.noreply.github.com", user.ID, user.Login)
+	}
+
+	return &user, nil
+}
@@ -0,0 +1,452 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"botanic/internal/auth"
+	"botanic/internal/avatar"
+	"botanic/internal/db/dbtest"
+	"botanic/internal/models"
+	"botanic/internal/validation"
+
+	"github.com/labstack/echo/v4"
+)
+
+// serveJSON calls handler with a JSON request body as userID, returning the
+// recorded response. params are the route's path parameters, as name and
+// value pairs.
+func serveJSON(t *testing.T, handler echo.HandlerFunc, method, body, userID string, params ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	e := echo.New()
+	e.Validator = validation.New()
+	req := httptest.NewRequest(method, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	var names, values []string
+	for i := 0; i+1 < len(params); i += 2 {
+		names = append(names, params[i])
+		values = append(values, params[i+1])
+	}
+	c.SetParamNames(names...)
+	c.SetParamValues(values...)
+	if userID != "" {
+		c.Set(auth.UserIDKey, userID)
+	}
+	if err := handler(c); err != nil {
+		e.HTTPErrorHandler(err, c)
+	}
+	return rec
+}
+
+func TestRequiresLinkConfirmationAfterRoundTrip(t *testing.T) {
+	dbtest.Setup(t)
+	t.Setenv("OAUTH_AUTO_LINK", "")
+
+	if _, err := models.CreateUser("owner@example.com", "correct horse battery", "email", "", "", ""); err != nil {
+		t.Fatalf("create password user: %v", err)
+	}
+	if _, err := models.CreateUser("social@example.com", "", "google", "google-1", "Social", ""); err != nil {
+		t.Fatalf("create oauth user: %v", err)
+	}
+
+	owner, err := models.GetUserByEmail("owner@example.com")
+	if err != nil || owner == nil {
+		t.Fatalf("load password user: %v, %v", owner, err)
+	}
+	social, err := models.GetUserByEmail("social@example.com")
+	if err != nil || social == nil {
+		t.Fatalf("load oauth user: %v, %v", social, err)
+	}
+
+	// An OAuth account that later set a password can be signed in to with it
+	hybrid, err := models.CreateUser("hybrid@example.com", "correct horse battery", "google", "google-2", "Hybrid", "")
+	if err != nil {
+		t.Fatalf("create oauth user with a password: %v", err)
+	}
+
+	requires := func(user *models.User) bool {
+		t.Helper()
+		confirm, err := requiresLinkConfirmation(user)
+		if err != nil {
+			t.Fatalf("requires link confirmation: %v", err)
+		}
+		return confirm
+	}
+	if !requires(owner) {
+		t.Error("password account loaded from redis should require link confirmation")
+	}
+	if requires(social) {
+		t.Error("oauth account should not require link confirmation")
+	}
+	if !requires(hybrid) {
+		t.Error("oauth account with a password should require link confirmation")
+	}
+
+	t.Setenv("OAUTH_AUTO_LINK", "true")
+	if requires(owner) {
+		t.Error("OAUTH_AUTO_LINK=true should link without confirmation")
+	}
+}
+
+func TestUpdateProfileKeepsAvatar(t *testing.T) {
+	dbtest.Setup(t)
+	const uploaded = "/uploads/avatars/5f0c8a4e-1b2c-4d3e-8f90-0a1b2c3d4e5f.png"
+	user, err := models.CreateUser("owner@example.com", "correct horse battery", "email", "", "Owner", uploaded)
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"omitted", `{"name":"Renamed","preferences":{"theme":"dark"}}`},
+		{"path traversal", `{"name":"Renamed","avatar_url":"/uploads/avatars/../../.env","preferences":{"theme":"dark"}}`},
+		{"foreign URL", `{"name":"Renamed","avatar_url":"https://evil.example/track.png","preferences":{"theme":"dark"}}`},
+		{"cleared", `{"name":"Renamed","avatar_url":"","preferences":{"theme":"dark"}}`},
+	}
+	for _, tt := range tests {
+		rec := serveJSON(t, UpdateProfile, http.MethodPut, tt.body, user.ID)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: update profile: %d %s", tt.name, rec.Code, rec.Body.String())
+		}
+		stored, err := models.GetUserByID(user.ID)
+		if err != nil {
+			t.Fatalf("%s: load user: %v", tt.name, err)
+		}
+		if stored.AvatarURL != uploaded {
+			t.Errorf("%s: avatar is %q, want %q", tt.name, stored.AvatarURL, uploaded)
+		}
+		if stored.Name != "Renamed" {
+			t.Errorf("%s: name is %q, want Renamed", tt.name, stored.Name)
+		}
+	}
+}
+
+// initTestAuth configures token signing for a test
+func initTestAuth(t *testing.T) {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "test-secret")
+	t.Setenv("JWT_DURATION", "")
+	t.Setenv("JWT_REMEMBER_DURATION", "")
+	t.Setenv("JWT_ISSUER", "")
+	t.Setenv("JWT_AUDIENCE", "")
+	t.Setenv("SMTP_HOST", "")
+	if err := auth.Initialize(); err != nil {
+		t.Fatalf("initialize auth: %v", err)
+	}
+}
+
+// login logs in through the handler and returns the response
+func login(t *testing.T, body string) AuthResponse {
+	t.Helper()
+	rec := serveJSON(t, Login, http.MethodPost, body, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login: %d %s", rec.Code, rec.Body.String())
+	}
+	var response AuthResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode login: %v", err)
+	}
+	return response
+}
+
+func TestLoginTokenValidates(t *testing.T) {
+	dbtest.Setup(t)
+	initTestAuth(t)
+	user, err := models.CreateUser("owner@example.com", "correct horse battery", "email", "", "Owner", "")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	response := login(t, `{"email":"owner@example.com","password":"correct horse battery"}`)
+	claims, err := auth.ValidateToken(response.Token)
+	if err != nil {
+		t.Fatalf("validate login token: %v", err)
+	}
+	if claims.UserID != user.ID || claims.Subject != user.ID {
+		t.Fatalf("token is for user %q (subject %q), want %q", claims.UserID, claims.Subject, user.ID)
+	}
+
+	rec := serveJSON(t, Login, http.MethodPost, `{"email":"owner@example.com","password":"wrong password"}`, "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("login with a wrong password: %d, want 401", rec.Code)
+	}
+}
+
+func TestRememberMeExtendsLogin(t *testing.T) {
+	dbtest.Setup(t)
+	initTestAuth(t)
+	t.Setenv("JWT_DURATION", "2h")
+	t.Setenv("JWT_REMEMBER_DURATION", "720h")
+	if err := auth.Initialize(); err != nil {
+		t.Fatalf("initialize auth: %v", err)
+	}
+	if _, err := models.CreateUser("owner@example.com", "correct horse battery", "email", "", "Owner", ""); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	for _, tt := range []struct {
+		rememberMe bool
+		want       time.Duration
+	}{
+		{false, 2 * time.Hour},
+		{true, 720 * time.Hour},
+	} {
+		response := login(t, fmt.Sprintf(`{"email":"owner@example.com","password":"correct horse battery","remember_me":%t}`, tt.rememberMe))
+		claims, err := auth.ValidateToken(response.Token)
+		if err != nil {
+			t.Fatalf("remember me %t: validate token: %v", tt.rememberMe, err)
+		}
+		if lifetime := claims.ExpiresAt.Sub(claims.IssuedAt.Time); lifetime != tt.want {
+			t.Errorf("remember me %t: token lasts %s, want %s", tt.rememberMe, lifetime, tt.want)
+		}
+		if lifetime := time.Until(response.Session.ExpiresAt); lifetime < tt.want-time.Minute || lifetime > tt.want {
+			t.Errorf("remember me %t: session lasts %s, want %s", tt.rememberMe, lifetime, tt.want)
+		}
+	}
+}
+
+// serveGitHub points githubAPIURL at a fake GitHub API returning user and
+// emails
+func serveGitHub(t *testing.T, user, emails string) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/user":
+			fmt.Fprint(w, user)
+		case "/user/emails":
+			fmt.Fprint(w, emails)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	previous := githubAPIURL
+	githubAPIURL = server.URL
+	t.Cleanup(func() { githubAPIURL = previous })
+}
+
+func TestGitHubUserEmail(t *testing.T) {
+	tests := []struct {
+		name   string
+		user   string
+		emails string
+		want   string
+	}{
+		{"public", `{"id":7,"login":"octo","email":"octo@example.com"}`, `[]`, "octo@example.com"},
+		{"verified primary", `{"id":7,"login":"octo"}`, `[{"email":"other@example.com","verified":true},{"email":"primary@example.com","primary":true,"verified":true}]`, "primary@example.com"},
+		{"unverified primary", `{"id":7,"login":"octo"}`, `[{"email":"primary@example.com","primary":true}]`, "7+octo@users.noreply.github.com"},
+		{"none", `{"id":7,"login":"octo","email":""}`, `[]`, "7+octo@users.noreply.github.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serveGitHub(t, tt.user, tt.emails)
+
+			user, err := githubUserInfo(http.DefaultClient)
+			if err != nil {
+				t.Fatalf("github user info: %v", err)
+			}
+			if user.Email != tt.want {
+				t.Fatalf("email %q, want %q", user.Email, tt.want)
+			}
+		})
+	}
+}
+
+// chdirTemp runs the rest of the test in a fresh working directory, for code
+// writing relative paths
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestUploadedAvatarIsServed(t *testing.T) {
+	dbtest.Setup(t)
+	chdirTemp(t)
+	InitAvatars(avatar.NewLocalStore(avatar.LocalDir, avatar.LocalURLPrefix))
+	user, err := models.CreateUser("avatar@example.com", "", "github", "gh-avatar", "Avatar", "")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	e := echo.New()
+	e.POST("/api/auth/avatar", UploadAvatar, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(auth.UserIDKey, user.ID)
+			return next(c)
+		}
+	})
+	e.GET("/uploads/avatars/:filename", ServeAvatar)
+
+	var upload bytes.Buffer
+	form := multipart.NewWriter(&upload)
+	part, err := form.CreateFormFile("avatar", "me.png")
+	if err != nil {
+		t.Fatalf("create form file: %v", err)
+	}
+	if err := png.Encode(part, image.NewRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/avatar", &upload)
+	req.Header.Set(echo.HeaderContentType, form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", rec.Code, rec.Body.String())
+	}
+	var uploaded struct {
+		AvatarURL string `json:"avatar_url"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &uploaded); err != nil {
+		t.Fatalf("decode upload: %v", err)
+	}
+	if !strings.HasPrefix(uploaded.AvatarURL, avatar.LocalURLPrefix) {
+		t.Fatalf("avatar URL %q is not under %s", uploaded.AvatarURL, avatar.LocalURLPrefix)
+	}
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, uploaded.AvatarURL, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("get %s: %d %s", uploaded.AvatarURL, rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get(echo.HeaderContentType); got != avatar.ContentType {
+		t.Errorf("content type %q, want %s", got, avatar.ContentType)
+	}
+	if got := rec.Header().Get("Cache-Control"); !strings.Contains(got, "immutable") {
+		t.Errorf("cache control %q, want immutable", got)
+	}
+
+	for _, path := range []string{"/uploads/avatars/missing.jpg", "/uploads/avatars/..%2f..%2fgo.mod", "/uploads/avatars/.hidden"} {
+		rec = httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("get %s: %d, want 404", path, rec.Code)
+		}
+	}
+}
+
+func TestPartialPreferencesUpdateKeepsDefaults(t *testing.T) {
+	dbtest.Setup(t)
+	user, err := models.CreateUser("prefs@example.com", "", "github", "gh-prefs", "Prefs", "")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	temperature := 0.3
+	preferences := user.Preferences
+	preferences.Notifications = true
+	preferences.LoginAlerts = true
+	preferences.DefaultModel = "gpt-4o"
+	preferences.DefaultTemperature = &temperature
+	preferences.DefaultSystemPrompt = "Answer briefly."
+	if err := user.UpdatePreferences(preferences); err != nil {
+		t.Fatalf("update preferences: %v", err)
+	}
+
+	rec := serveJSON(t, UpdatePreferences, http.MethodPut, `{"theme":"dark"}`, user.ID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update preferences: %d %s", rec.Code, rec.Body.String())
+	}
+
+	stored, err := models.GetUserByID(user.ID)
+	if err != nil {
+		t.Fatalf("load user: %v", err)
+	}
+	got := stored.Preferences
+	if got.Theme != "dark" {
+		t.Errorf("theme %q, want dark", got.Theme)
+	}
+	if !got.Notifications || !got.LoginAlerts {
+		t.Errorf("notifications %v, login alerts %v, want both kept on", got.Notifications, got.LoginAlerts)
+	}
+	if got.DefaultModel != "gpt-4o" || got.DefaultSystemPrompt != "Answer briefly." {
+		t.Errorf("defaults %q, %q, want them kept", got.DefaultModel, got.DefaultSystemPrompt)
+	}
+	if got.DefaultTemperature == nil || *got.DefaultTemperature != temperature {
+		t.Errorf("default temperature %v, want %v", got.DefaultTemperature, temperature)
+	}
+
+	// Explicit values still change them
+	rec = serveJSON(t, UpdatePreferences, http.MethodPut, `{"notifications":false,"default_model":"","default_system_prompt":""}`, user.ID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("clear defaults: %d %s", rec.Code, rec.Body.String())
+	}
+	stored, err = models.GetUserByID(user.ID)
+	if err != nil {
+		t.Fatalf("load user: %v", err)
+	}
+	if stored.Preferences.Notifications || stored.Preferences.DefaultModel != "" || stored.Preferences.DefaultSystemPrompt != "" {
+		t.Errorf("preferences %+v, want notifications off and defaults cleared", stored.Preferences)
+	}
+}
+
+func TestUnknownDefaultModelIsAFieldError(t *testing.T) {
+	dbtest.Setup(t)
+	initTestModels(t, "gpt-4o")
+	user, err := models.CreateUser("model@example.com", "", "github", "gh-model", "Model", "")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	rec := serveJSON(t, UpdatePreferences, http.MethodPut, `{"default_model":"no-such-model"}`, user.ID)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("unknown model: %d %s, want 422", rec.Code, rec.Body.String())
+	}
+	var response ValidationErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if response.Errors["default_model"] == "" {
+		t.Errorf("errors %v, want one for default_model", response.Errors)
+	}
+
+	if rec := serveJSON(t, UpdatePreferences, http.MethodPut, `{"default_model":"gpt-4o"}`, user.ID); rec.Code != http.StatusOK {
+		t.Fatalf("known model: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRegisterRejectsInvalidCredentials(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		field string
+	}{
+		{"display name email", `{"email":"Bob <bob@example.com>","password":"correct horse battery"}`, "email"},
+		{"password over 72 bytes", `{"email":"bob@example.com","password":"` + strings.Repeat("é", 40) + `"}`, "password"},
+	}
+	for _, tt := range tests {
+		rec := serveJSON(t, Register, http.MethodPost, tt.body, "")
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("%s: %d %s, want 422", tt.name, rec.Code, rec.Body.String())
+		}
+		var response ValidationErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s: decode: %v", tt.name, err)
+		}
+		if response.Errors[tt.field] == "" {
+			t.Errorf("%s: errors %v, want one for %s", tt.name, response.Errors, tt.field)
+		}
+	}
+}
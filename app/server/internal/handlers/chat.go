@@ -1,12 +1,23 @@
 package handlers
 
 import (
+	"context"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"botanic/internal/auth"
+	"botanic/internal/litellm"
+	"botanic/internal/logging"
 	"botanic/internal/models"
+	"botanic/internal/tokenizer"
+	"botanic/internal/validation"
 
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
@@ -14,8 +25,12 @@ import (
 )
 
 type CreateSessionRequest struct {
-	Title string `json:"title"`
-	Model string `json:"model"`
+	Title            string `json:"title"`
+	Model            string `json:"model"`
+	Backend          string `json:"backend"`
+	CacheCompletions bool   `json:"cache_completions"`
+	SystemPrompt     string `json:"system_prompt"`
+	litellm.CompletionOptions
 }
 
 type CreateSessionResponse struct {
@@ -24,7 +39,208 @@ type CreateSessionResponse struct {
 }
 
 type CreateMessageRequest struct {
-	Content string `json:"content"`
+	Content string `json:"content" validate:"required"`
+}
+
+type UpdateTagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+type FeedbackRequest struct {
+	Rating  string `json:"rating" validate:"required,oneof=up down"`
+	Comment string `json:"comment"`
+}
+
+type ShareSessionRequest struct {
+	TTLSeconds int `json:"ttl_seconds" validate:"min=0"`
+}
+
+// SharedSession is the public, read-only view of a shared chat session. It
+// deliberately omits the owner's identity.
+type SharedSession struct {
+	Title     string           `json:"title"`
+	Model     string           `json:"model"`
+	CreatedAt time.Time        `json:"created_at"`
+	Messages  []*SharedMessage `json:"messages"`
+}
+
+// SharedMessage is the public view of a message in a shared session
+type SharedMessage struct {
+	Role      string    `json:"role"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CreateAlternativeRequest struct {
+	Content string `json:"content" validate:"required"`
+	Model   string `json:"model"`
+}
+
+// SessionSummary is the listing view of a chat session
+type SessionSummary struct {
+	ID           string    `json:"id"`
+	Title        string    `json:"title"`
+	Model        string    `json:"model"`
+	Tags         []string  `json:"tags,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	MessageCount int64     `json:"message_count"`
+	Preview      string    `json:"preview"`
+	// DeletedAt is set on sessions listed with ?deleted=true
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// SessionUsage reports how much of the model's context window a session uses
+type SessionUsage struct {
+	SessionID     string `json:"session_id"`
+	Model         string `json:"model"`
+	MessageCount  int    `json:"message_count"`
+	TotalTokens   int    `json:"total_tokens"`
+	ContextLength int    `json:"context_length,omitempty"`
+	Remaining     int    `json:"remaining,omitempty"`
+	Warning       string `json:"warning,omitempty"`
+}
+
+// MessagesPage is a page of messages, oldest first. NextBefore is the cursor
+// of the next page, passed back as "before".
+type MessagesPage struct {
+	Messages   []*models.Message `json:"messages"`
+	HasMore    bool              `json:"has_more"`
+	NextBefore string            `json:"next_before,omitempty"`
+}
+
+const (
+	defaultMessagesPageSize = 50
+	maxMessagesPageSize     = 200
+	defaultMaxAlternatives  = 5
+	maxPreviewLength        = 100
+	fallbackDefaultModel    = "deepseek/deepseek-chat:free"
+	fallbackTemperature     = 0.7
+)
+
+// defaultModel returns the model used when neither the request nor the
+// user's preferences name one
+func defaultModel() string {
+	if model := os.Getenv("DEFAULT_MODEL"); model != "" {
+		return model
+	}
+	return fallbackDefaultModel
+}
+
+// defaultTemperature returns the temperature used when neither the message
+// nor the session sets one. DEFAULT_TEMPERATURE must be between 0 and 2.
+func defaultTemperature() float64 {
+	if value := os.Getenv("DEFAULT_TEMPERATURE"); value != "" {
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil && parsed >= 0 && parsed <= 2 {
+			return parsed
+		}
+	}
+	return fallbackTemperature
+}
+
+// sessionModel returns the session's model, falling back to the default for
+// sessions stored before the model was recorded
+func sessionModel(session *models.ChatSession) string {
+	if session.Model == "" {
+		return defaultModel()
+	}
+	return session.Model
+}
+
+// truncatePreview shortens message content for session listings
+func truncatePreview(content string) string {
+	runes := []rune(content)
+	if len(runes) <= maxPreviewLength {
+		return content
+	}
+	return string(runes[:maxPreviewLength]) + "…"
+}
+
+// maxMessageAlternatives returns the configured cap on alternatives per message
+func maxMessageAlternatives() int {
+	if value := os.Getenv("MAX_MESSAGE_ALTERNATIVES"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return defaultMaxAlternatives
+}
+
+// sessionLimitError tells the user they have as many sessions as they may keep
+func sessionLimitError() error {
+	return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("session limit reached: at most %d sessions are allowed, delete one to create another", models.MaxSessionsPerUser()))
+}
+
+// getOwnedSession loads the session named by the :id param and verifies that
+// it belongs to userID
+func getOwnedSession(c echo.Context, userID string) (*models.ChatSession, error) {
+	return loadOwnedSession(c, c.Param("id"), userID)
+}
+
+// loadOwnedSession loads the session with the given ID and verifies that it
+// belongs to userID
+func loadOwnedSession(c echo.Context, id string, userID string) (*models.ChatSession, error) {
+	sessionID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid session ID")
+	}
+
+	session, err := models.GetChatSessionCtx(c.Request().Context(), sessionID.String())
+	if err != nil {
+		requestLogger(c).Error("failed to get chat session", "session_id", sessionID.String(), "error", err)
+		return nil, storeFailed(err, "failed to get session")
+	}
+	if session == nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "session not found")
+	}
+
+	if session.UserID != userID {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "not authorized to access this session")
+	}
+
+	return session, nil
+}
+
+// getSessionMessage loads the message named by the :messageId param and
+// verifies that it belongs to the session
+func getSessionMessage(c echo.Context, session *models.ChatSession) (*models.Message, error) {
+	messageID, err := uuid.Parse(c.Param("messageId"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid message ID")
+	}
+
+	message, err := models.GetMessageCtx(c.Request().Context(), messageID.String())
+	if err != nil {
+		return nil, lookupFailed(err, "message not found", "failed to get message")
+	}
+
+	if message.SessionID != session.ID {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "message not found")
+	}
+
+	return message, nil
+}
+
+// getMessagesPage loads up to limit messages older than before and reports
+// whether further pages exist
+func getMessagesPage(ctx context.Context, sessionID string, before models.MessageCursor, limit int) (*MessagesPage, error) {
+	// Fetch one extra message to know whether there is another page
+	messages, err := models.GetSessionMessagesPagedCtx(ctx, sessionID, before, limit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &MessagesPage{Messages: messages}
+	if len(messages) > limit {
+		page.Messages = messages[1:]
+		page.HasMore = true
+		page.NextBefore = models.CursorOf(page.Messages[0]).String()
+	}
+	if page.Messages == nil {
+		page.Messages = []*models.Message{}
+	}
+
+	return page, nil
 }
 
 // CreateSession creates a new chat session with an optional initial message
@@ -35,19 +251,88 @@ func CreateSession(c echo.Context) error {
 	}
 
 	var req CreateSessionRequest
-	if err := c.Bind(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	if err := bindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	// Apply the user's defaults to any settings the request omits
+	user, err := models.GetUserByIDCtx(c.Request().Context(), userID)
+	if err != nil {
+		requestLogger(c).Warn("failed to load user preferences", "user_id", userID, "error", err)
+	} else {
+		if req.Model == "" {
+			req.Model = user.Preferences.DefaultModel
+		}
+		if req.Temperature == nil {
+			req.Temperature = user.Preferences.DefaultTemperature
+		}
+		if req.SystemPrompt == "" {
+			req.SystemPrompt = user.Preferences.DefaultSystemPrompt
+		}
 	}
 
 	// Set default model if not provided
 	if req.Model == "" {
-		req.Model = "deepseek/deepseek-chat:free"
+		req.Model = defaultModel()
+	}
+
+	if err := req.CompletionOptions.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	// A chosen backend must be configured and offer the model
+	if req.Backend != "" {
+		if _, ok := backends.Get(req.Backend); !ok {
+			return validationError(validation.FieldErrors{"backend": "must be one of " + strings.Join(backends.Names(), ", ")})
+		}
+		model, err := findModel(req.Backend, req.Model)
+		if err != nil {
+			requestLogger(c).Error("failed to fetch backend models", "backend", req.Backend, "error", err)
+			return echo.NewHTTPError(http.StatusBadGateway, "failed to validate model")
+		}
+		if model == nil {
+			return validationError(validation.FieldErrors{"model": "is not offered by the " + req.Backend + " backend"})
+		}
 	}
 
 	// Create session
-	session, err := models.CreateChatSession(userID, req.Title, req.Model)
+	session, err := models.CreateChatSession(userID, req.Title, req.Model, models.SessionSettings{
+		Backend:           req.Backend,
+		CacheCompletions:  req.CacheCompletions,
+		SystemPrompt:      req.SystemPrompt,
+		CompletionOptions: req.CompletionOptions,
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrTooManySessions) {
+			return sessionLimitError()
+		}
+		return storeFailed(err, "failed to create session")
+	}
+
+	return c.JSON(http.StatusCreated, CreateSessionResponse{
+		Session: session,
+		Message: nil,
+	})
+}
+
+// DuplicateSession creates a copy of a chat session and its messages
+func DuplicateSession(c echo.Context) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	original, err := getOwnedSession(c, userID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create session")
+		return err
+	}
+
+	session, err := models.DuplicateChatSession(original.ID, userID)
+	if err != nil {
+		if errors.Is(err, models.ErrTooManySessions) {
+			return sessionLimitError()
+		}
+		return storeFailed(err, "failed to duplicate session")
 	}
 
 	return c.JSON(http.StatusCreated, CreateSessionResponse{
@@ -68,17 +353,10 @@ func GetSession(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "invalid session ID")
 	}
 
-	session, err := models.GetChatSession(sessionID.String())
+	session, err := models.GetChatSessionCtx(c.Request().Context(), sessionID.String())
 	if err != nil {
-		// Specifically check if the error is `redis: nil` (key not found)
-		// and return a proper 404 Not Found error.
-		if errors.Is(err, redis.Nil) {
-			return echo.NewHTTPError(http.StatusNotFound, "session not found")
-		}
-
-		// For all other unexpected errors, log them and return a generic 500 error.
-		log.Printf("ERROR getting chat session %s from models: %v", sessionID.String(), err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get session")
+		requestLogger(c).Error("failed to get chat session", "session_id", sessionID.String(), "error", err)
+		return storeFailed(err, "failed to get session")
 	}
 
 	if session == nil {
@@ -89,27 +367,33 @@ func GetSession(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "not authorized to access this session")
 	}
 
-	// Get messages for the session
-	messages, err := models.GetSessionMessages(sessionID.String())
+	// Get the most recent page of messages for the session
+	page, err := getMessagesPage(c.Request().Context(), sessionID.String(), models.LatestMessages, defaultMessagesPageSize)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get messages")
+		return storeFailed(err, "failed to get messages")
 	}
 
 	// Create response with session and messages
 	response := struct {
-		ID        string            `json:"id"`
-		UserID    string            `json:"user_id"`
-		Title     string            `json:"title"`
-		CreatedAt time.Time         `json:"created_at"`
-		UpdatedAt time.Time         `json:"updated_at"`
-		Messages  []*models.Message `json:"messages"`
+		ID         string            `json:"id"`
+		UserID     string            `json:"user_id"`
+		Title      string            `json:"title"`
+		Model      string            `json:"model"`
+		CreatedAt  time.Time         `json:"created_at"`
+		UpdatedAt  time.Time         `json:"updated_at"`
+		Messages   []*models.Message `json:"messages"`
+		HasMore    bool              `json:"has_more"`
+		NextBefore string            `json:"next_before,omitempty"`
 	}{
-		ID:        session.ID,
-		UserID:    session.UserID,
-		Title:     session.Title,
-		CreatedAt: session.CreatedAt,
-		UpdatedAt: session.UpdatedAt,
-		Messages:  messages,
+		ID:         session.ID,
+		UserID:     session.UserID,
+		Title:      session.Title,
+		Model:      sessionModel(session),
+		CreatedAt:  session.CreatedAt,
+		UpdatedAt:  session.UpdatedAt,
+		Messages:   page.Messages,
+		HasMore:    page.HasMore,
+		NextBefore: page.NextBefore,
 	}
 
 	return c.JSON(http.StatusOK, response)
@@ -117,59 +401,61 @@ func GetSession(c echo.Context) error {
 
 // GetUserID retrieves the user ID from the Echo context
 func GetUserID(c echo.Context) (string, error) {
-	userID, ok := c.Get("userID").(string)
-	if !ok {
-		return "", echo.NewHTTPError(http.StatusUnauthorized, "user not authenticated")
-	}
-	return userID, nil
+	return auth.UserID(c)
+}
+
+// requestLogger returns the logger of the current request, tagged with its
+// request ID
+func requestLogger(c echo.Context) *slog.Logger {
+	return logging.FromContext(c.Request().Context())
 }
 
-// GetSessions retrieves all chat sessions for the authenticated user
+// GetSessions retrieves all chat sessions for the authenticated user. With
+// ?deleted=true it lists the deleted sessions that can still be restored.
 func GetSessions(c echo.Context) error {
 	userID, err := GetUserID(c)
 	if err != nil {
 		return err
 	}
 
-	sessions, err := models.GetUserSessions(userID)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get sessions")
+	var sessions []*models.ChatSession
+	if c.QueryParam("deleted") == "true" {
+		sessions, err = models.GetDeletedUserSessions(c.Request().Context(), userID)
+	} else if tag := c.QueryParam("tag"); tag != "" {
+		sessions, err = models.GetUserSessionsByTag(userID, tag)
+	} else {
+		sessions, err = models.GetUserSessionsCtx(c.Request().Context(), userID)
 	}
-
-	// Create response with sessions and their messages
-	var response []struct {
-		ID        string            `json:"id"`
-		UserID    string            `json:"user_id"`
-		Title     string            `json:"title"`
-		Model     string            `json:"model"`
-		CreatedAt time.Time         `json:"created_at"`
-		UpdatedAt time.Time         `json:"updated_at"`
-		Messages  []*models.Message `json:"messages"`
+	if err != nil {
+		return storeFailed(err, "failed to get sessions")
 	}
 
+	// Create response with sessions and a summary of their messages
+	response := make([]SessionSummary, 0, len(sessions))
 	for _, session := range sessions {
-		messages, err := models.GetSessionMessages(session.ID)
+		count, err := models.GetSessionMessageCountCtx(c.Request().Context(), session.ID)
+		if err != nil {
+			requestLogger(c).Error("failed to count messages", "session_id", session.ID, "error", err)
+		}
+
+		var preview string
+		latest, err := models.GetLatestMessageCtx(c.Request().Context(), session.ID)
 		if err != nil {
-			log.Printf("Failed to get messages for session %s: %v", session.ID, err)
-			messages = []*models.Message{}
-		}
-
-		response = append(response, struct {
-			ID        string            `json:"id"`
-			UserID    string            `json:"user_id"`
-			Title     string            `json:"title"`
-			Model     string            `json:"model"`
-			CreatedAt time.Time         `json:"created_at"`
-			UpdatedAt time.Time         `json:"updated_at"`
-			Messages  []*models.Message `json:"messages"`
-		}{
-			ID:        session.ID,
-			UserID:    session.UserID,
-			Title:     session.Title,
-			Model:     "default", // Default model if not specified
-			CreatedAt: session.CreatedAt,
-			UpdatedAt: session.UpdatedAt,
-			Messages:  messages,
+			requestLogger(c).Error("failed to get latest message", "session_id", session.ID, "error", err)
+		} else if latest != nil {
+			preview = truncatePreview(latest.Content)
+		}
+
+		response = append(response, SessionSummary{
+			ID:           session.ID,
+			Title:        session.Title,
+			Model:        sessionModel(session),
+			Tags:         session.Tags,
+			CreatedAt:    session.CreatedAt,
+			UpdatedAt:    session.UpdatedAt,
+			MessageCount: count,
+			Preview:      preview,
+			DeletedAt:    session.DeletedAt,
 		})
 	}
 
@@ -188,9 +474,9 @@ func DeleteSession(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "invalid session ID")
 	}
 
-	session, err := models.GetChatSession(sessionID.String())
+	session, err := models.GetChatSessionCtx(c.Request().Context(), sessionID.String())
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get session")
+		return storeFailed(err, "failed to get session")
 	}
 
 	if session == nil {
@@ -201,13 +487,162 @@ func DeleteSession(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "not authorized to delete this session")
 	}
 
-	if err := models.DeleteChatSession(sessionID.String()); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete session")
+	if err := removeSession(sessionID.String()); err != nil {
+		return storeFailed(err, "failed to delete session")
 	}
 
 	return c.NoContent(http.StatusNoContent)
 }
 
+// removeSession deletes a chat session, keeping it restorable for the
+// recovery window if there is one
+func removeSession(sessionID string) error {
+	if models.SessionRecoveryWindow() > 0 {
+		return models.SoftDeleteChatSession(sessionID)
+	}
+	return models.DeleteChatSession(sessionID)
+}
+
+// bulkDeleteConcurrency bounds how many sessions a bulk delete removes at once
+const bulkDeleteConcurrency = 8
+
+// DeleteSessionsRequest names the sessions to delete in a bulk delete
+type DeleteSessionsRequest struct {
+	IDs []string `json:"ids" validate:"max=500"`
+}
+
+// DeleteSessionResult is the outcome of deleting one session in a bulk delete
+type DeleteSessionResult struct {
+	ID      string `json:"id"`
+	Deleted bool   `json:"deleted"`
+	Error   string `json:"error,omitempty"`
+}
+
+// DeleteSessions deletes the sessions named in the request body, or all of
+// the user's sessions with ?all=true. It responds 200 if every deletion
+// succeeded and 207 with the outcome of each otherwise.
+func DeleteSessions(c echo.Context) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	if c.QueryParam("all") == "true" {
+		sessions, err := models.GetUserSessionsCtx(c.Request().Context(), userID)
+		if err != nil {
+			return storeFailed(err, "failed to get sessions")
+		}
+		for _, session := range sessions {
+			ids = append(ids, session.ID)
+		}
+	} else {
+		var req DeleteSessionsRequest
+		if err := bindAndValidate(c, &req); err != nil {
+			return err
+		}
+		if len(req.IDs) == 0 {
+			return validationError(validation.FieldErrors{"ids": "must not be empty"})
+		}
+		seen := make(map[string]bool, len(req.IDs))
+		for _, id := range req.IDs {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	results := make([]DeleteSessionResult, len(ids))
+	slots := make(chan struct{}, bulkDeleteConcurrency)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			results[i] = deleteOwnedSession(c, userID, id)
+		}()
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	for _, result := range results {
+		if !result.Deleted {
+			status = http.StatusMultiStatus
+			break
+		}
+	}
+
+	return c.JSON(status, map[string]interface{}{"results": results})
+}
+
+// deleteOwnedSession deletes one session of a bulk delete if userID owns it
+func deleteOwnedSession(c echo.Context, userID string, id string) DeleteSessionResult {
+	result := DeleteSessionResult{ID: id}
+
+	sessionID, err := uuid.Parse(id)
+	if err != nil {
+		result.Error = "invalid session ID"
+		return result
+	}
+
+	session, err := models.GetChatSessionCtx(c.Request().Context(), sessionID.String())
+	switch {
+	case err != nil:
+		requestLogger(c).Error("failed to get chat session", "session_id", id, "error", err)
+		result.Error = "failed to get session"
+		return result
+	case session == nil:
+		result.Error = "session not found"
+		return result
+	case session.UserID != userID:
+		result.Error = "not authorized to delete this session"
+		return result
+	}
+
+	if err := removeSession(session.ID); err != nil {
+		requestLogger(c).Error("failed to delete session", "session_id", id, "error", err)
+		result.Error = "failed to delete session"
+		return result
+	}
+
+	result.Deleted = true
+	return result
+}
+
+// RestoreSession restores a deleted chat session still within its recovery
+// window
+func RestoreSession(c echo.Context) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	sessionID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid session ID")
+	}
+
+	session, err := models.GetDeletedChatSessionCtx(c.Request().Context(), sessionID.String())
+	if err != nil {
+		return lookupFailed(err, "deleted session not found", "failed to get session")
+	}
+	if session.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "not authorized to restore this session")
+	}
+
+	restored, err := models.RestoreChatSession(c.Request().Context(), session.ID)
+	if err != nil {
+		return lookupFailed(err, "deleted session not found", "failed to restore session")
+	}
+
+	return c.JSON(http.StatusOK, restored)
+}
+
 // CreateMessage creates a new message in a chat session
 func CreateMessage(c echo.Context) error {
 	userID, err := GetUserID(c)
@@ -220,9 +655,9 @@ func CreateMessage(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "invalid session ID")
 	}
 
-	session, err := models.GetChatSession(sessionID.String())
+	session, err := models.GetChatSessionCtx(c.Request().Context(), sessionID.String())
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get session")
+		return storeFailed(err, "failed to get session")
 	}
 
 	if session == nil {
@@ -234,14 +669,389 @@ func CreateMessage(c echo.Context) error {
 	}
 
 	var req CreateMessageRequest
-	if err := c.Bind(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	if err := bindAndValidate(c, &req); err != nil {
+		return err
+	}
+	content, reason := sanitizeContent(req.Content)
+	if reason != "" {
+		return validationError(validation.FieldErrors{"content": reason})
+	}
+	allowed, reason, err := moderator.Check(c.Request().Context(), content)
+	if err != nil {
+		requestLogger(c).Error("failed to moderate message", "session_id", session.ID, "error", err)
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "content moderation unavailable")
+	}
+	if !allowed {
+		return validationError(validation.FieldErrors{"content": reason})
 	}
 
-	message, err := models.CreateMessage(sessionID.String(), "user", req.Content)
+	message, err := models.CreateMessage(sessionID.String(), "user", content)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create message")
+		return storeFailed(err, "failed to create message")
+	}
+	if err := models.TouchChatSession(message.SessionID); err != nil {
+		requestLogger(c).Error("failed to update session activity", "session_id", message.SessionID, "error", err)
 	}
 
 	return c.JSON(http.StatusCreated, message)
 }
+
+// GetMessages retrieves a page of messages in a chat session. Messages before
+// the "before" cursor, the next_before of the previous page, are returned
+// oldest first.
+func GetMessages(c echo.Context) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	before := models.LatestMessages
+	if param := c.QueryParam("before"); param != "" {
+		before, err = models.ParseMessageCursor(param)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid before parameter")
+		}
+	}
+
+	limit := defaultMessagesPageSize
+	if param := c.QueryParam("limit"); param != "" {
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid limit parameter")
+		}
+		if limit > maxMessagesPageSize {
+			limit = maxMessagesPageSize
+		}
+	}
+
+	session, err := getOwnedSession(c, userID)
+	if err != nil {
+		return err
+	}
+
+	page, err := getMessagesPage(c.Request().Context(), session.ID, before, limit)
+	if err != nil {
+		return storeFailed(err, "failed to get messages")
+	}
+
+	return c.JSON(http.StatusOK, page)
+}
+
+// CreateAlternative adds an alternative response to an assistant message
+func CreateAlternative(c echo.Context) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	session, err := getOwnedSession(c, userID)
+	if err != nil {
+		return err
+	}
+
+	message, err := getSessionMessage(c, session)
+	if err != nil {
+		return err
+	}
+
+	if message.Role != "assistant" {
+		return echo.NewHTTPError(http.StatusBadRequest, "alternatives can only be added to assistant messages")
+	}
+
+	var req CreateAlternativeRequest
+	if err := bindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	if req.Model == "" {
+		req.Model = session.Model
+	}
+
+	alternative, err := models.AddMessageAlternative(message.ID, req.Content, req.Model, maxMessageAlternatives())
+	if err != nil {
+		if errors.Is(err, models.ErrTooManyAlternatives) {
+			return echo.NewHTTPError(http.StatusConflict, "maximum number of alternatives reached")
+		}
+		return storeFailed(err, "failed to create alternative")
+	}
+
+	return c.JSON(http.StatusCreated, alternative)
+}
+
+// GetAlternatives retrieves the alternatives for a message
+func GetAlternatives(c echo.Context) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	session, err := getOwnedSession(c, userID)
+	if err != nil {
+		return err
+	}
+
+	message, err := getSessionMessage(c, session)
+	if err != nil {
+		return err
+	}
+
+	alternatives, err := models.GetMessageAlternatives(message.ID)
+	if err != nil {
+		return storeFailed(err, "failed to get alternatives")
+	}
+
+	return c.JSON(http.StatusOK, alternatives)
+}
+
+// DeleteAlternative deletes a single alternative from a message
+func DeleteAlternative(c echo.Context) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	session, err := getOwnedSession(c, userID)
+	if err != nil {
+		return err
+	}
+
+	message, err := getSessionMessage(c, session)
+	if err != nil {
+		return err
+	}
+
+	if err := models.DeleteMessageAlternative(message.ID, c.Param("alternativeId")); err != nil {
+		if errors.Is(err, models.ErrAlternativeNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "alternative not found")
+		}
+		return storeFailed(err, "failed to delete alternative")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// UpdateSessionTags replaces the tags of a chat session
+func UpdateSessionTags(c echo.Context) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	session, err := getOwnedSession(c, userID)
+	if err != nil {
+		return err
+	}
+
+	var req UpdateTagsRequest
+	if err := bindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	if err := session.SetTags(req.Tags); err != nil {
+		return lookupFailed(err, "session not found", "failed to update tags")
+	}
+
+	return c.JSON(http.StatusOK, session)
+}
+
+// DeleteMessage deletes a single message from a chat session
+func DeleteMessage(c echo.Context) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	session, err := getOwnedSession(c, userID)
+	if err != nil {
+		return err
+	}
+
+	message, err := getSessionMessage(c, session)
+	if err != nil {
+		return err
+	}
+
+	if err := models.DeleteMessage(message.ID); err != nil {
+		return storeFailed(err, "failed to delete message")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GetSessionUsage sums the tokens used by a session's messages and compares
+// them with the context length of the session's model
+func GetSessionUsage(c echo.Context) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	session, err := getOwnedSession(c, userID)
+	if err != nil {
+		return err
+	}
+
+	messages, err := models.GetSessionMessages(session.ID)
+	if err != nil {
+		return storeFailed(err, "failed to get messages")
+	}
+
+	usage := SessionUsage{
+		SessionID:    session.ID,
+		Model:        sessionModel(session),
+		MessageCount: len(messages),
+	}
+	for _, message := range messages {
+		count := message.TokenCount
+		if count == 0 {
+			// Messages stored before token counting was added
+			count = tokenizer.Count(message.Content)
+		}
+		usage.TotalTokens += count
+	}
+
+	model, err := findModel(session.Backend, usage.Model)
+	if err != nil {
+		requestLogger(c).Warn("failed to look up model context length", "model", usage.Model, "error", err)
+	}
+	if model != nil && model.ContextLength > 0 {
+		usage.ContextLength = model.ContextLength
+		usage.Remaining = model.ContextLength - usage.TotalTokens
+		if usage.Remaining < 0 {
+			usage.Remaining = 0
+		}
+		if usage.TotalTokens*10 >= model.ContextLength*9 {
+			usage.Warning = "session is within 10% of the model's context length"
+		}
+	}
+
+	return c.JSON(http.StatusOK, usage)
+}
+
+// SetMessageFeedback records the session owner's rating of an assistant message
+func SetMessageFeedback(c echo.Context) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	session, err := getOwnedSession(c, userID)
+	if err != nil {
+		return err
+	}
+
+	message, err := getSessionMessage(c, session)
+	if err != nil {
+		return err
+	}
+
+	if message.Role != "assistant" {
+		return echo.NewHTTPError(http.StatusBadRequest, "only assistant messages can be rated")
+	}
+
+	var req FeedbackRequest
+	if err := bindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	feedback := &models.Feedback{
+		MessageID: message.ID,
+		SessionID: session.ID,
+		UserID:    userID,
+		Model:     sessionModel(session),
+		Rating:    req.Rating,
+		Comment:   req.Comment,
+		CreatedAt: time.Now(),
+	}
+	if err := models.SetMessageFeedback(feedback); err != nil {
+		return storeFailed(err, "failed to save feedback")
+	}
+
+	return c.JSON(http.StatusOK, feedback)
+}
+
+// ShareSession creates a public read-only share link for a chat session
+func ShareSession(c echo.Context) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	session, err := getOwnedSession(c, userID)
+	if err != nil {
+		return err
+	}
+
+	var req ShareSessionRequest
+	if err := bindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	token, err := models.CreateShareLink(session.ID, time.Duration(req.TTLSeconds)*time.Second)
+	if err != nil {
+		return storeFailed(err, "failed to create share link")
+	}
+
+	return c.JSON(http.StatusCreated, map[string]string{
+		"token": token,
+	})
+}
+
+// UnshareSession revokes a chat session's share link
+func UnshareSession(c echo.Context) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	session, err := getOwnedSession(c, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := models.RevokeShareLink(session.ID); err != nil {
+		return storeFailed(err, "failed to revoke share link")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GetSharedSession returns a shared chat session without authentication
+func GetSharedSession(c echo.Context) error {
+	sessionID, err := models.GetSharedSessionID(c.Param("token"))
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return echo.NewHTTPError(http.StatusNotFound, "shared session not found")
+		}
+		return storeFailed(err, "failed to get shared session")
+	}
+
+	session, err := models.GetChatSessionCtx(c.Request().Context(), sessionID)
+	if err != nil {
+		return storeFailed(err, "failed to get shared session")
+	}
+	if session == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "shared session not found")
+	}
+
+	messages, err := models.GetSessionMessages(session.ID)
+	if err != nil {
+		return storeFailed(err, "failed to get messages")
+	}
+
+	shared := SharedSession{
+		Title:     session.Title,
+		Model:     sessionModel(session),
+		CreatedAt: session.CreatedAt,
+		Messages:  make([]*SharedMessage, 0, len(messages)),
+	}
+	for _, message := range messages {
+		shared.Messages = append(shared.Messages, &SharedMessage{
+			Role:      message.Role,
+			Content:   message.Content,
+			CreatedAt: message.CreatedAt,
+		})
+	}
+
+	return c.JSON(http.StatusOK, shared)
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"botanic/internal/db/dbtest"
+	"botanic/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+func TestSessionListReportsStoredModel(t *testing.T) {
+	dbtest.Setup(t)
+	t.Setenv("DEFAULT_MODEL", "local/llama3")
+
+	rec := serveJSON(t, CreateSession, http.MethodPost, `{"title":"plants","model":"openai/gpt-4o"}`, "user-1")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create session: %d %s", rec.Code, rec.Body.String())
+	}
+	var created CreateSessionResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode created session: %v", err)
+	}
+
+	// Sessions saved before the model was stored have none
+	time.Sleep(2 * time.Millisecond)
+	legacy, err := models.CreateChatSession("user-1", "old", "", models.SessionSettings{})
+	if err != nil {
+		t.Fatalf("create legacy session: %v", err)
+	}
+
+	rec = serveJSON(t, GetSessions, http.MethodGet, "", "user-1")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list sessions: %d %s", rec.Code, rec.Body.String())
+	}
+	var sessions []SessionSummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &sessions); err != nil {
+		t.Fatalf("decode sessions: %v", err)
+	}
+
+	want := map[string]string{
+		created.Session.ID: "openai/gpt-4o",
+		legacy.ID:          "local/llama3",
+	}
+	if len(sessions) != len(want) {
+		t.Fatalf("listed %d sessions, want %d", len(sessions), len(want))
+	}
+	for _, session := range sessions {
+		if session.Model != want[session.ID] {
+			t.Errorf("session %s reports model %q, want %q", session.ID, session.Model, want[session.ID])
+		}
+	}
+}
+
+func TestMissingSessionIsNotFound(t *testing.T) {
+	dbtest.Setup(t)
+	deleted, err := models.CreateChatSession("user-1", "deleted", "", models.SessionSettings{})
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	if err := models.SoftDeleteChatSession(deleted.ID); err != nil {
+		t.Fatalf("delete session: %v", err)
+	}
+	owned, err := models.CreateChatSession("user-2", "someone else's", "", models.SessionSettings{})
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	endpoints := []struct {
+		name    string
+		handler echo.HandlerFunc
+		method  string
+		body    string
+	}{
+		{"get", GetSession, http.MethodGet, ""},
+		{"delete", DeleteSession, http.MethodDelete, ""},
+		{"create message", CreateMessage, http.MethodPost, `{"content":"hello"}`},
+	}
+	for _, endpoint := range endpoints {
+		for _, tt := range []struct {
+			session string
+			want    int
+		}{
+			{uuid.New().String(), http.StatusNotFound},
+			{deleted.ID, http.StatusNotFound},
+			{owned.ID, http.StatusForbidden},
+			{"not-a-uuid", http.StatusBadRequest},
+		} {
+			rec := serveJSON(t, endpoint.handler, endpoint.method, endpoint.body, "user-1", "id", tt.session)
+			if rec.Code != tt.want {
+				t.Errorf("%s %s: %d %s, want %d", endpoint.name, tt.session, rec.Code, rec.Body.String(), tt.want)
+			}
+		}
+	}
+}
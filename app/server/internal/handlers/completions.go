@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"botanic/internal/litellm"
+	"botanic/internal/llm"
+	"botanic/internal/models"
+	"botanic/internal/validation"
+
+	"github.com/labstack/echo/v4"
+)
+
+// CompletionRequest represents the request body for a one-shot completion
+type CompletionRequest struct {
+	Model       string              `json:"model"`
+	Messages    []CompletionMessage `json:"messages" validate:"required,max=100"`
+	Temperature *float64            `json:"temperature" validate:"omitempty,min=0,max=2"`
+	MaxTokens   int                 `json:"max_tokens" validate:"min=0"`
+}
+
+// CompletionMessage is one message of a completion request
+type CompletionMessage struct {
+	Role    string `json:"role" validate:"required,oneof=system user assistant"`
+	Content string `json:"content" validate:"required,max=32000"`
+}
+
+// CompletionResponse holds the model's answer and the tokens it used
+type CompletionResponse struct {
+	Model   string         `json:"model"`
+	Content string         `json:"content"`
+	Usage   *litellm.Usage `json:"usage,omitempty"`
+	// RequestedModel is set when a fallback model answered instead of Model
+	RequestedModel string `json:"requested_model,omitempty"`
+}
+
+type CompletionsHandler struct {
+	provider llm.Provider
+}
+
+func NewCompletionsHandler(provider llm.Provider) *CompletionsHandler {
+	return &CompletionsHandler{provider: provider}
+}
+
+// CompletionDelta is a piece of a streamed completion
+type CompletionDelta struct {
+	Content string `json:"content"`
+}
+
+// CreateCompletion runs a chat completion outside any session, for
+// programmatic use. It counts against the user's quota like chat completions.
+// With ?stream=true the answer is sent as server-sent events: "delta" events
+// carrying CompletionDelta, then a "done" event carrying CompletionResponse
+// without the content, or an "error" event.
+func (h *CompletionsHandler) CreateCompletion(c echo.Context) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req CompletionRequest
+	if err := bindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	if req.Model == "" {
+		req.Model = defaultModel()
+	}
+	known, err := isKnownModel(req.Model)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadGateway, "failed to validate model")
+	}
+	if !known {
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown model")
+	}
+
+	ctx := c.Request().Context()
+	// Like the WebSocket, a failed quota lookup lets the request through, so
+	// an outage of the quota store does not stop completions
+	exceeded, err := models.QuotaExceeded(ctx, userID)
+	if err != nil {
+		requestLogger(c).Error("failed to check quota", "user_id", userID, "error", err)
+	} else if exceeded {
+		return echo.NewHTTPError(http.StatusTooManyRequests, "AI request quota exceeded")
+	}
+
+	opts := litellm.CompletionOptions{Temperature: req.Temperature, MaxTokens: req.MaxTokens}
+	if opts.Temperature == nil {
+		temperature := defaultTemperature()
+		opts.Temperature = &temperature
+	}
+	messages := make([]litellm.ChatMessage, len(req.Messages))
+	for i, message := range req.Messages {
+		messages[i] = litellm.ChatMessage{Role: message.Role, Content: message.Content}
+		if message.Role != "user" {
+			continue
+		}
+		allowed, reason, err := moderator.Check(ctx, message.Content)
+		if err != nil {
+			requestLogger(c).Error("failed to moderate message", "user_id", userID, "error", err)
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "content moderation unavailable")
+		}
+		if !allowed {
+			return validationError(validation.FieldErrors{fmt.Sprintf("messages[%d].content", i): reason})
+		}
+	}
+
+	if c.QueryParam("stream") == "true" {
+		return h.streamCompletion(c, userID, req.Model, messages, opts)
+	}
+
+	result, err := h.provider.Complete(ctx, messages, req.Model, opts)
+	if err != nil {
+		requestLogger(c).Error("completion failed", "model", req.Model, "error", err)
+		return echo.NewHTTPError(http.StatusBadGateway, "failed to get completion")
+	}
+	recordUserCompletion(c, userID, result.Usage)
+
+	return c.JSON(http.StatusOK, newCompletionResponse(req.Model, result))
+}
+
+// streamCompletion sends a completion as server-sent events, flushing each
+// one so proxies do not hold the answer back. Generation stops when the
+// client disconnects. Providers that cannot stream send the whole answer as
+// one delta.
+func (h *CompletionsHandler) streamCompletion(c echo.Context, userID string, model string, messages []litellm.ChatMessage, opts litellm.CompletionOptions) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	ctx := c.Request().Context()
+	var result *litellm.CompletionResult
+	var err error
+	if streamer, ok := h.provider.(llm.Streamer); ok {
+		result, err = streamer.Stream(ctx, messages, model, opts, func(delta string) {
+			writeEvent(res, "delta", CompletionDelta{Content: delta})
+		})
+	} else {
+		result, err = h.provider.Complete(ctx, messages, model, opts)
+		if err == nil {
+			writeEvent(res, "delta", CompletionDelta{Content: result.Content})
+		}
+	}
+
+	if ctx.Err() != nil {
+		requestLogger(c).Info("completion stream closed by client", "model", model)
+		if result != nil && result.Content != "" {
+			recordUserCompletion(c, userID, result.Usage)
+		}
+		return nil
+	}
+	if err != nil {
+		requestLogger(c).Error("completion stream failed", "model", model, "error", err)
+		writeEvent(res, "error", map[string]string{"message": "failed to get completion"})
+		return nil
+	}
+	recordUserCompletion(c, userID, result.Usage)
+
+	done := newCompletionResponse(model, result)
+	done.Content = ""
+	writeEvent(res, "done", done)
+	return nil
+}
+
+// writeEvent writes one server-sent event and flushes it
+func writeEvent(res *echo.Response, event string, data any) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event, payload)
+	res.Flush()
+}
+
+// newCompletionResponse describes a completion requested for model
+func newCompletionResponse(model string, result *litellm.CompletionResult) CompletionResponse {
+	response := CompletionResponse{
+		Model:   result.Model,
+		Content: result.Content,
+		Usage:   result.Usage,
+	}
+	if result.Model != model {
+		response.RequestedModel = model
+	}
+	return response
+}
+
+// recordUserCompletion counts a completion against the user's quota and records
+// its token usage, if known. It runs even when the client has gone away.
+func recordUserCompletion(c echo.Context, userID string, usage *litellm.Usage) {
+	ctx := context.WithoutCancel(c.Request().Context())
+	if err := models.ConsumeQuota(ctx, userID); err != nil {
+		requestLogger(c).Error("failed to count completion against quota", "user_id", userID, "error", err)
+	}
+	if usage != nil {
+		if err := models.RecordUserUsage(userID, *usage); err != nil {
+			requestLogger(c).Error("failed to record usage", "user_id", userID, "error", err)
+		}
+	}
+}
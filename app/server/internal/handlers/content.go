@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"botanic/internal/moderation"
+)
+
+const defaultMaxMessageLength = 16000
+
+// moderator checks user messages before they reach the model. Everything is
+// allowed unless InitModeration says otherwise.
+var moderator moderation.Moderator = moderation.Noop{}
+
+// InitModeration sets the moderator user messages are checked with
+func InitModeration(m moderation.Moderator) {
+	moderator = m
+}
+
+// maxMessageLength returns MAX_MESSAGE_LENGTH, the most characters a user
+// message may have (default 16000)
+func maxMessageLength() int {
+	if value := os.Getenv("MAX_MESSAGE_LENGTH"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return defaultMaxMessageLength
+}
+
+// stripControlCharacters reports whether STRIP_CONTROL_CHARACTERS is set,
+// removing control characters other than newlines and tabs from messages
+func stripControlCharacters() bool {
+	return os.Getenv("STRIP_CONTROL_CHARACTERS") == "true"
+}
+
+// sanitizeContent prepares the content of a user message for storage. It
+// returns the content to store, or the reason it was rejected.
+func sanitizeContent(content string) (string, string) {
+	if stripControlCharacters() {
+		content = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' {
+				return -1
+			}
+			return r
+		}, strings.ToValidUTF8(content, ""))
+	}
+	if strings.TrimSpace(content) == "" {
+		return "", "must not be empty"
+	}
+	if limit := maxMessageLength(); utf8.RuneCountInString(content) > limit {
+		return "", fmt.Sprintf("must be at most %d characters", limit)
+	}
+	return content, ""
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"botanic/internal/litellm"
+	"botanic/internal/models"
+	"botanic/internal/tokenizer"
+)
+
+// Strategies for fitting a long session into the model's context
+const (
+	// contextTruncate sends only the newest messages that fit
+	contextTruncate = "truncate"
+	// contextSummarize replaces the oldest messages with a running summary
+	contextSummarize = "summarize"
+)
+
+const defaultContextTokens = 4096
+
+const summaryInstructions = "Summarize the conversation below so it can stand in for the original messages. " +
+	"Keep facts, decisions, names, code and open questions. Be concise and write only the summary."
+
+// contextStrategy returns CONTEXT_STRATEGY, "truncate" (the default) or
+// "summarize"
+func contextStrategy() string {
+	if os.Getenv("CONTEXT_STRATEGY") == contextSummarize {
+		return contextSummarize
+	}
+	return contextTruncate
+}
+
+// contextBudget returns CONTEXT_MAX_TOKENS, the tokens of earlier messages
+// sent with each completion (default 4096)
+func contextBudget() int {
+	if value := os.Getenv("CONTEXT_MAX_TOKENS"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return defaultContextTokens
+}
+
+// messageTokens returns the token count of a message, counting it for
+// messages stored before token counting was added
+func messageTokens(message *models.Message) int {
+	if message.TokenCount > 0 {
+		return message.TokenCount
+	}
+	return tokenizer.Count(message.Content)
+}
+
+// recentMessages returns the newest messages whose tokens fit within budget,
+// oldest first
+func recentMessages(messages []*models.Message, budget int) []*models.Message {
+	start := len(messages)
+	for tokens := 0; start > 0; start-- {
+		tokens += messageTokens(messages[start-1])
+		if tokens > budget {
+			break
+		}
+	}
+	return messages[start:]
+}
+
+// buildHistory returns the earlier messages of the session to send with a
+// completion, fitted into the context budget with the configured strategy.
+// The message being answered, excludeID, is left out.
+func (h *Hub) buildHistory(ctx context.Context, session *models.ChatSession, model string, excludeID string) ([]litellm.ChatMessage, error) {
+	stored, err := models.GetSessionMessages(session.ID)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*models.Message, 0, len(stored))
+	for _, message := range stored {
+		if message.ID != excludeID {
+			messages = append(messages, message)
+		}
+	}
+
+	budget := contextBudget()
+	var history []litellm.ChatMessage
+	if contextStrategy() == contextSummarize {
+		messages = h.summarize(ctx, session, model, messages, budget)
+		if session.Summary != "" {
+			history = append(history, litellm.ChatMessage{Role: "system", Content: "Summary of the earlier conversation:\n" + session.Summary})
+		}
+	}
+	for _, message := range recentMessages(messages, budget) {
+		history = append(history, litellm.ChatMessage{Role: message.Role, Content: message.Content})
+	}
+	return history, nil
+}
+
+// summarize folds the oldest messages into the session's running summary once
+// the messages it does not cover exceed budget, keeping the newest half of
+// the budget verbatim. Only the newly folded messages are sent to the model,
+// with the previous summary, so the summary is extended rather than rebuilt.
+// It returns the messages the summary does not cover; if summarizing fails
+// the summary is left as it was.
+func (h *Hub) summarize(ctx context.Context, session *models.ChatSession, model string, messages []*models.Message, budget int) []*models.Message {
+	var pending []*models.Message
+	tokens := 0
+	for _, message := range messages {
+		if models.MessageScore(message) > session.SummaryThrough {
+			pending = append(pending, message)
+			tokens += messageTokens(message)
+		}
+	}
+	if tokens <= budget {
+		return pending
+	}
+
+	keep := recentMessages(pending, budget/2)
+	fold := pending[:len(pending)-len(keep)]
+	if len(fold) == 0 {
+		return pending
+	}
+
+	var transcript strings.Builder
+	if session.Summary != "" {
+		transcript.WriteString("Summary so far:\n" + session.Summary + "\n\nNew messages:\n")
+	}
+	for _, message := range fold {
+		transcript.WriteString(message.Role + ": " + message.Content + "\n")
+	}
+
+	provider := h.providerFor(session)
+	if summaryModel := os.Getenv("SUMMARY_MODEL"); summaryModel != "" {
+		model = summaryModel
+		provider = h.llmClient
+	}
+	// Summaries count against MAX_CONCURRENT_COMPLETIONS like the replies
+	// they precede. When the queue is full the history is truncated instead.
+	release, err := h.completions.acquire(ctx, func(int) {})
+	if err != nil {
+		slog.Warn("no completion slot to summarize session, truncating instead", "session_id", session.ID, "error", err)
+		return pending
+	}
+	temperature := 0.0
+	result, err := provider.Complete(ctx, []litellm.ChatMessage{
+		{Role: "system", Content: summaryInstructions},
+		{Role: "user", Content: transcript.String()},
+	}, model, litellm.CompletionOptions{Temperature: &temperature})
+	release()
+	if err != nil {
+		slog.Warn("failed to summarize session, truncating instead", "session_id", session.ID, "error", err)
+		return pending
+	}
+	if result.Usage != nil {
+		if err := models.RecordUsage(session.ID, session.UserID, *result.Usage); err != nil {
+			slog.Error("failed to record usage", "session_id", session.ID, "error", err)
+		}
+	}
+
+	// The new summary is used for this completion even if it cannot be saved
+	if err := session.SetSummary(result.Content, models.MessageScore(fold[len(fold)-1])); err != nil {
+		slog.Error("failed to store session summary", "session_id", session.ID, "error", err)
+	}
+	return keep
+}
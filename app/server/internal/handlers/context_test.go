@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"botanic/internal/db/dbtest"
+	"botanic/internal/models"
+)
+
+// longConversation returns n messages of 10 tokens each, oldest first
+func longConversation(sessionID string, n int) []*models.Message {
+	start := time.Now().Add(-time.Hour)
+	messages := make([]*models.Message, n)
+	for i := range messages {
+		messages[i] = &models.Message{
+			ID:         fmt.Sprintf("message-%d", i),
+			SessionID:  sessionID,
+			Role:       "user",
+			Content:    "Should I repot my fern?",
+			TokenCount: 10,
+			CreatedAt:  start.Add(time.Duration(i) * time.Second),
+		}
+	}
+	return messages
+}
+
+func TestSummaryWaitsForACompletionSlot(t *testing.T) {
+	hub, provider := startRecordingHub(t)
+	hub.completions = &completionQueue{slots: make(chan struct{}, 1), maxWaiting: 0}
+	release, err := hub.completions.acquire(context.Background(), func(int) {})
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	defer release()
+
+	session := &models.ChatSession{ID: "session"}
+	messages := longConversation(session.ID, 6)
+	kept := hub.summarize(context.Background(), session, "model", messages, 20)
+	if len(kept) != len(messages) {
+		t.Errorf("kept %d messages without a summary, want all %d", len(kept), len(messages))
+	}
+	select {
+	case <-provider.models:
+		t.Error("summary was requested while every completion slot was taken")
+	default:
+	}
+}
+
+func TestSummaryReleasesItsCompletionSlot(t *testing.T) {
+	dbtest.Setup(t)
+	hub, provider := startRecordingHub(t)
+	hub.completions = &completionQueue{slots: make(chan struct{}, 1), maxWaiting: 0}
+	session, err := models.CreateChatSession("user-1", "ferns", "session-model", models.SessionSettings{})
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	messages := longConversation(session.ID, 6)
+	kept := hub.summarize(context.Background(), session, "session-model", messages, 20)
+	requestedModel(t, provider)
+	if len(kept) >= len(messages) {
+		t.Errorf("kept %d of %d messages, want the oldest summarized", len(kept), len(messages))
+	}
+	if n := len(hub.completions.slots); n != 0 {
+		t.Errorf("%d completion slots still taken after summarizing", n)
+	}
+
+	stored, err := models.GetChatSession(session.ID)
+	if err != nil || stored == nil || stored.Summary == "" {
+		t.Fatalf("summary not stored: %v, %v", stored, err)
+	}
+}
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"botanic/internal/auth"
+	"botanic/internal/models"
+
+	"github.com/labstack/echo/v4"
+)
+
+// checkLoginDevice remembers the device the user just logged in from and, if
+// it has not been seen before and the user opted in to login alerts, emails
+// them an alert. Failures are logged rather than failing the login.
+func checkLoginDevice(c echo.Context, user *models.User) {
+	ip := c.RealIP()
+	userAgent := c.Request().UserAgent()
+
+	isNew, err := models.RememberDevice(c.Request().Context(), user.ID, models.DeviceFingerprint(ip, userAgent))
+	if err != nil {
+		requestLogger(c).Error("failed to remember login device", "user_id", user.ID, "error", err)
+		return
+	}
+	if !isNew || !user.Preferences.LoginAlerts {
+		return
+	}
+
+	subject := "New sign-in to your Botanic account"
+	body := fmt.Sprintf("Your Botanic account was signed in to from a new device.\n\n"+
+		"IP address: %s\nDevice: %s\nTime: about %s\n\n"+
+		"If this was you, there is nothing to do. If not, change your password now.\n",
+		ip, userAgent, time.Now().UTC().Format("January 2, 2006 15:04 MST"))
+
+	// Send in the background so a slow mail server does not delay the login
+	go func() {
+		if err := auth.GetMailer().Send(user.Email, subject, body); err != nil {
+			slog.Error("failed to send new device alert", "user_id", user.ID, "error", err)
+		}
+	}()
+}
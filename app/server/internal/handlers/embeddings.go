@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+
+	"botanic/internal/litellm"
+
+	"github.com/labstack/echo/v4"
+)
+
+// EmbeddingsRequest represents the request body for creating embeddings
+type EmbeddingsRequest struct {
+	Input []string `json:"input" validate:"required,min=1,max=256"`
+	Model string   `json:"model"`
+}
+
+// EmbeddingsResponse holds one embedding per input, in input order
+type EmbeddingsResponse struct {
+	Model      string      `json:"model"`
+	Embeddings [][]float32 `json:"embeddings"`
+}
+
+type EmbeddingsHandler struct {
+	llmClient *litellm.Client
+}
+
+func NewEmbeddingsHandler(llmClient *litellm.Client) *EmbeddingsHandler {
+	return &EmbeddingsHandler{llmClient: llmClient}
+}
+
+// CreateEmbeddings proxies an embeddings request to the LLM backend. The model
+// defaults to EMBEDDING_MODEL when the request does not name one.
+func (h *EmbeddingsHandler) CreateEmbeddings(c echo.Context) error {
+	var req EmbeddingsRequest
+	if err := bindAndValidate(c, &req); err != nil {
+		return err
+	}
+	for _, input := range req.Input {
+		if input == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "input must not contain empty strings")
+		}
+	}
+
+	if req.Model == "" {
+		req.Model = os.Getenv("EMBEDDING_MODEL")
+	}
+	if req.Model == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "model is required")
+	}
+
+	embeddings, err := h.llmClient.CreateEmbedding(c.Request().Context(), req.Input, req.Model)
+	if err != nil {
+		requestLogger(c).Error("failed to create embeddings", "model", req.Model, "error", err)
+		return echo.NewHTTPError(http.StatusBadGateway, "failed to create embeddings")
+	}
+
+	return c.JSON(http.StatusOK, EmbeddingsResponse{
+		Model:      req.Model,
+		Embeddings: embeddings,
+	})
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"botanic/internal/litellm"
+)
+
+// newTestEmbeddingsHandler proxies to a fake LiteLLM proxy embedding every
+// input as a vector holding its length, or failing with status if non-zero
+func newTestEmbeddingsHandler(t *testing.T, status int) *EmbeddingsHandler {
+	t.Helper()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != 0 {
+			http.Error(w, `{"error":{"message":"upstream failed"}}`, status)
+			return
+		}
+		var req struct {
+			Input []string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var data []string
+		for i, input := range req.Input {
+			data = append(data, fmt.Sprintf(`{"index":%d,"embedding":[%d]}`, i, len(input)))
+		}
+		fmt.Fprintf(w, `{"data":[%s]}`, strings.Join(data, ","))
+	}))
+	t.Cleanup(proxy.Close)
+
+	t.Setenv("LITELLM_URL", proxy.URL)
+	t.Setenv("LITELLM_MAX_RETRIES", "0")
+	t.Setenv("EMBEDDING_MODEL", "embed-small")
+	return NewEmbeddingsHandler(litellm.NewClient())
+}
+
+func TestCreateEmbeddings(t *testing.T) {
+	h := newTestEmbeddingsHandler(t, 0)
+
+	rec := serveJSON(t, h.CreateEmbeddings, http.MethodPost, `{"input":["a","abc"]}`, "user-1")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create embeddings: %d %s", rec.Code, rec.Body.String())
+	}
+	var response EmbeddingsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if response.Model != "embed-small" {
+		t.Errorf("model %q, want the EMBEDDING_MODEL default", response.Model)
+	}
+	if fmt.Sprint(response.Embeddings) != "[[1] [3]]" {
+		t.Errorf("embeddings %v, want [[1] [3]]", response.Embeddings)
+	}
+}
+
+func TestCreateEmbeddingsValidatesInput(t *testing.T) {
+	h := newTestEmbeddingsHandler(t, 0)
+	tooMany := `{"input":["a"` + strings.Repeat(`,"a"`, 256) + `]}`
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"missing", `{}`, http.StatusUnprocessableEntity},
+		{"empty", `{"input":[]}`, http.StatusUnprocessableEntity},
+		{"too many", tooMany, http.StatusUnprocessableEntity},
+		{"empty string", `{"input":["a",""]}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := serveJSON(t, h.CreateEmbeddings, http.MethodPost, tt.body, "user-1"); rec.Code != tt.want {
+			t.Errorf("%s: %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+
+	t.Setenv("EMBEDDING_MODEL", "")
+	if rec := serveJSON(t, h.CreateEmbeddings, http.MethodPost, `{"input":["a"]}`, "user-1"); rec.Code != http.StatusBadRequest {
+		t.Errorf("no model: %d, want 400", rec.Code)
+	}
+}
+
+func TestCreateEmbeddingsUpstreamFailure(t *testing.T) {
+	h := newTestEmbeddingsHandler(t, http.StatusInternalServerError)
+
+	if rec := serveJSON(t, h.CreateEmbeddings, http.MethodPost, `{"input":["a"]}`, "user-1"); rec.Code != http.StatusBadGateway {
+		t.Fatalf("upstream failure: %d %s, want 502", rec.Code, rec.Body.String())
+	}
+}
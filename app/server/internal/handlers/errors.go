@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"botanic/internal/db"
+	"botanic/internal/models"
+
+	"github.com/labstack/echo/v4"
+)
+
+// lookupFailed converts an error from loading a record into a response: 404
+// with notFound if it does not exist, otherwise as storeFailed does
+func lookupFailed(err error, notFound string, failed string) error {
+	if errors.Is(err, models.ErrNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, notFound)
+	}
+	return storeFailed(err, failed)
+}
+
+// storeFailed converts a storage error into a response: 503 if storage is
+// unreachable and 500 with failed otherwise. Errors the models layer passes
+// through unclassified are checked for connection failures too.
+func storeFailed(err error, failed string) error {
+	if errors.Is(err, models.ErrUnavailable) || db.IsConnectionError(err) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "service temporarily unavailable")
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, failed)
+}
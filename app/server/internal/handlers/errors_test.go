@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+
+	"botanic/internal/auth"
+	"botanic/internal/db/dbtest"
+	"botanic/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisOutageIsServiceUnavailable(t *testing.T) {
+	initTestAuth(t)
+	dbtest.SetupUnreachable(t)
+	token, err := auth.GenerateToken("user-1", "owner@example.com")
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	sessionID := uuid.New().String()
+
+	tests := []struct {
+		name string
+		rec  func() int
+	}{
+		{"register", func() int {
+			return serveJSON(t, Register, http.MethodPost, `{"email":"new@example.com","password":"correct horse battery"}`, "").Code
+		}},
+		{"login", func() int {
+			return serveJSON(t, Login, http.MethodPost, `{"email":"owner@example.com","password":"correct horse battery"}`, "").Code
+		}},
+		{"refresh", func() int {
+			return serveJSON(t, RefreshToken, http.MethodPost, `{"token":"`+token+`"}`, "").Code
+		}},
+		{"list sessions", func() int {
+			return serveJSON(t, GetSessions, http.MethodGet, "", "user-1").Code
+		}},
+		{"get session", func() int {
+			return serveJSON(t, GetSession, http.MethodGet, "", "user-1", "id", sessionID).Code
+		}},
+		{"delete session", func() int {
+			return serveJSON(t, DeleteSession, http.MethodDelete, "", "user-1", "id", sessionID).Code
+		}},
+		{"create session", func() int {
+			return serveJSON(t, CreateSession, http.MethodPost, `{"title":"ferns"}`, "user-1").Code
+		}},
+		{"create message", func() int {
+			return serveJSON(t, CreateMessage, http.MethodPost, `{"content":"How often?"}`, "user-1", "id", sessionID).Code
+		}},
+		{"quota", func() int {
+			return serveJSON(t, GetQuota, http.MethodGet, "", "user-1").Code
+		}},
+		{"stats", func() int {
+			return serveJSON(t, GetStats, http.MethodGet, "", "user-1").Code
+		}},
+	}
+	for _, tt := range tests {
+		if code := tt.rec(); code != http.StatusServiceUnavailable {
+			t.Errorf("%s: %d, want 503", tt.name, code)
+		}
+	}
+}
+
+func TestStoreFailedTellsOutagesFromFailures(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"unavailable", fmt.Errorf("%w: %w", models.ErrUnavailable, refused), http.StatusServiceUnavailable},
+		{"unclassified connection error", fmt.Errorf("save message: %w", refused), http.StatusServiceUnavailable},
+		{"closed client", redis.ErrClosed, http.StatusServiceUnavailable},
+		{"other failure", errors.New("WRONGTYPE"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		var httpErr *echo.HTTPError
+		if err := storeFailed(tt.err, "failed to save"); !errors.As(err, &httpErr) || httpErr.Code != tt.want {
+			t.Errorf("%s: %v, want %d", tt.name, err, tt.want)
+		}
+	}
+}
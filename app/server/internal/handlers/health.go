@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"botanic/internal/db"
+	"botanic/internal/llm"
+
+	"github.com/labstack/echo/v4"
+)
+
+// healthCheckTimeout bounds each dependency check so probes never hang
+const healthCheckTimeout = 2 * time.Second
+
+// DependencyStatus reports the health of a single dependency
+type DependencyStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HealthResponse reports the overall and per-dependency health
+type HealthResponse struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]DependencyStatus `json:"dependencies,omitempty"`
+}
+
+type HealthHandler struct {
+	llmClient llm.Provider
+}
+
+func NewHealthHandler(llmClient llm.Provider) *HealthHandler {
+	return &HealthHandler{llmClient: llmClient}
+}
+
+// Health pings Redis and checks the LLM provider, returning 200 only when
+// both are healthy and 503 otherwise
+func (hh *HealthHandler) Health(c echo.Context) error {
+	return hh.checkDependencies(c)
+}
+
+// Ready reports whether the server can serve requests. It checks the same
+// dependencies as Health.
+func (hh *HealthHandler) Ready(c echo.Context) error {
+	return hh.checkDependencies(c)
+}
+
+// checkDependencies checks each dependency concurrently and responds with
+// the status of each
+func (hh *HealthHandler) checkDependencies(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), healthCheckTimeout)
+	defer cancel()
+
+	checks := map[string]func() error{
+		"redis":             func() error { return db.Ping(healthCheckTimeout) },
+		hh.llmClient.Name(): func() error { return hh.llmClient.HealthCheck(ctx) },
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	response := HealthResponse{
+		Status:       "ok",
+		Dependencies: make(map[string]DependencyStatus, len(checks)),
+	}
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := check()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				response.Status = "unavailable"
+				response.Dependencies[name] = DependencyStatus{Status: "down", Error: err.Error()}
+			} else {
+				response.Dependencies[name] = DependencyStatus{Status: "up"}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if response.Status != "ok" {
+		return c.JSON(http.StatusServiceUnavailable, response)
+	}
+	return c.JSON(http.StatusOK, response)
+}
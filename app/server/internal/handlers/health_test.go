@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"botanic/internal/db/dbtest"
+	"botanic/internal/llm"
+
+	"github.com/labstack/echo/v4"
+)
+
+// downProvider is an LLM provider that fails its health check
+type downProvider struct {
+	llm.Provider
+}
+
+func (downProvider) Name() string { return "down" }
+
+func (downProvider) HealthCheck(context.Context) error { return errors.New("unreachable") }
+
+func serveHealth(t *testing.T, handler echo.HandlerFunc) (int, HealthResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	if err := handler(c); err != nil {
+		t.Fatalf("handler: %v", err)
+	}
+	var response HealthResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, response
+}
+
+// upProvider is an LLM provider that passes its health check
+type upProvider struct {
+	llm.Provider
+}
+
+func (upProvider) Name() string { return "up" }
+
+func (upProvider) HealthCheck(context.Context) error { return nil }
+
+func TestHealthAndReadyReportDependencies(t *testing.T) {
+	dbtest.Setup(t)
+
+	for name, handler := range map[string]func(*HealthHandler) echo.HandlerFunc{
+		"health": func(hh *HealthHandler) echo.HandlerFunc { return hh.Health },
+		"ready":  func(hh *HealthHandler) echo.HandlerFunc { return hh.Ready },
+	} {
+		code, response := serveHealth(t, handler(NewHealthHandler(upProvider{})))
+		if code != http.StatusOK || response.Status != "ok" {
+			t.Fatalf("%s: %d %+v, want 200 ok", name, code, response)
+		}
+		if response.Dependencies["redis"].Status != "up" || response.Dependencies["up"].Status != "up" {
+			t.Fatalf("%s dependencies are %+v, want redis and the provider up", name, response.Dependencies)
+		}
+
+		code, response = serveHealth(t, handler(NewHealthHandler(downProvider{})))
+		if code != http.StatusServiceUnavailable || response.Status != "unavailable" {
+			t.Fatalf("%s: %d %+v, want 503 unavailable", name, code, response)
+		}
+		if response.Dependencies["down"].Status != "down" {
+			t.Fatalf("%s: provider is %+v, want down", name, response.Dependencies["down"])
+		}
+	}
+}
+
+func TestHealthPingsRedis(t *testing.T) {
+	dbtest.SetupUnreachable(t)
+
+	for name, handler := range map[string]echo.HandlerFunc{
+		"health": NewHealthHandler(upProvider{}).Health,
+		"ready":  NewHealthHandler(upProvider{}).Ready,
+	} {
+		code, response := serveHealth(t, handler)
+		if code != http.StatusServiceUnavailable || response.Status != "unavailable" {
+			t.Fatalf("%s: %d %+v, want 503 unavailable", name, code, response)
+		}
+		if redis := response.Dependencies["redis"]; redis.Status != "down" || redis.Error == "" {
+			t.Fatalf("%s: redis is %+v, want down with an error", name, redis)
+		}
+		if response.Dependencies["up"].Status != "up" {
+			t.Fatalf("%s: provider is %+v, want up", name, response.Dependencies["up"])
+		}
+	}
+}
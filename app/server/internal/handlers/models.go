@@ -1,10 +1,17 @@
 package handlers
 
 import (
+	"log/slog"
+	"math"
 	"net/http"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"botanic/internal/litellm" // <-- CHANGED
+	"botanic/internal/llm"
 
 	"github.com/labstack/echo/v4"
 )
@@ -23,9 +30,88 @@ type ModelsResponse struct {
 	Details string `json:"details,omitempty"`
 }
 
-// GetModels handles the /api/models endpoint
+var (
+	backends    *llm.Backends
+	modelCaches map[string]*litellm.ModelCache
+)
+
+// InitModels sets the backends whose models are listed and validated against.
+// It must be called before the models routes are served.
+func InitModels(b *llm.Backends) {
+	// Default to 60 seconds if not specified
+	ttl := 60 * time.Second
+	if value := os.Getenv("MODELS_CACHE_TTL"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			ttl = parsed
+		}
+	}
+	backends = b
+	modelCaches = make(map[string]*litellm.ModelCache)
+	for _, name := range b.Names() {
+		provider, _ := b.Get(name)
+		modelCaches[name] = litellm.NewModelCache(backendModels{name: name, provider: provider}, ttl)
+	}
+}
+
+// backendModels lists a backend's models tagged with the backend's name
+type backendModels struct {
+	name     string
+	provider llm.Provider
+}
+
+func (b backendModels) GetAvailableModels() ([]litellm.Model, error) {
+	models, err := b.provider.GetAvailableModels()
+	if err != nil {
+		return nil, err
+	}
+	for i := range models {
+		models[i].Backend = b.name
+	}
+	return models, nil
+}
+
+// getModelCache returns the model list cache of the named backend, or of the
+// default backend if name is empty. It returns nil for unknown backends.
+func getModelCache(name string) *litellm.ModelCache {
+	if name == "" {
+		name = backends.Names()[0]
+	}
+	return modelCaches[name]
+}
+
+// listModels returns the models of the named backend, or of every backend if
+// name is empty. A backend that fails is skipped unless all of them do.
+func listModels(name string, refresh bool) ([]litellm.Model, error) {
+	if name != "" {
+		return getModelCache(name).Models(refresh)
+	}
+
+	var all []litellm.Model
+	var firstErr error
+	for _, backend := range backends.Names() {
+		models, err := getModelCache(backend).Models(refresh)
+		if err != nil {
+			slog.Warn("failed to fetch backend models", "backend", backend, "error", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		all = append(all, models...)
+	}
+	if all == nil && firstErr != nil {
+		return nil, firstErr
+	}
+	return all, nil
+}
+
+// GetModels handles the /api/models endpoint. It lists the models of every
+// backend, or of one with ?backend=name, and supports ?onlyFree=true,
+// ?sort=name|context|price and page/pageSize pagination over the combined
+// list, with each page split into free and non-free models. Authenticated
+// callers may bypass the cache with ?refresh=true; anonymous ones always get
+// the cached list.
 func GetModels(c echo.Context) error {
-	// Get pagination parameters (though we won't use them for local models)
 	page, _ := strconv.Atoi(c.QueryParam("page"))
 	if page < 1 {
 		page = 1
@@ -35,15 +121,40 @@ func GetModels(c echo.Context) error {
 		pageSize = 50 // Default page size
 	}
 
-	// Get all models from LiteLLM
-	client := litellm.NewClient() // <-- CHANGED
-	allModels, err := client.GetAvailableModels()
+	sortBy := c.QueryParam("sort")
+	if sortBy != "" && sortBy != "name" && sortBy != "context" && sortBy != "price" {
+		return echo.NewHTTPError(http.StatusBadRequest, "sort must be one of name, context or price")
+	}
+
+	backend := c.QueryParam("backend")
+	if backend != "" && getModelCache(backend) == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown backend")
+	}
+
+	// Get all models from the backends, served from cache unless a refresh is requested
+	refresh := c.QueryParam("refresh") == "true"
+	if _, err := GetUserID(c); err != nil {
+		refresh = false
+	}
+	allModels, err := listModels(backend, refresh)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch models from LiteLLM proxy")
+		requestLogger(c).Error("failed to fetch models", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch models")
+	}
+
+	// Work on a copy so sorting never reorders the cached list
+	models := make([]litellm.Model, 0, len(allModels))
+	for _, model := range allModels {
+		if c.QueryParam("onlyFree") == "true" && !isFreeModel(model) {
+			continue
+		}
+		models = append(models, model)
 	}
+	sortModels(models, sortBy)
+
+	start := min((page-1)*pageSize, len(models))
+	end := min(start+pageSize, len(models))
 
-	// With LiteLLM + Ollama, all models are considered free.
-	// We will place them all in the "Free" list and leave "NonFree" empty.
 	var responseData struct {
 		Free     []litellm.Model `json:"free"`
 		NonFree  []litellm.Model `json:"nonFree"`
@@ -52,14 +163,85 @@ func GetModels(c echo.Context) error {
 		PageSize int             `json:"pageSize"`
 	}
 
-	responseData.Free = allModels
-	responseData.NonFree = []litellm.Model{} // Empty list for non-free models
-	responseData.HasMore = false             // No pagination needed
-	responseData.Page = 1
-	responseData.PageSize = len(allModels)
+	responseData.Free = []litellm.Model{}
+	responseData.NonFree = []litellm.Model{}
+	for _, model := range models[start:end] {
+		if isFreeModel(model) {
+			responseData.Free = append(responseData.Free, model)
+		} else {
+			responseData.NonFree = append(responseData.NonFree, model)
+		}
+	}
+	responseData.HasMore = end < len(models)
+	responseData.Page = page
+	responseData.PageSize = pageSize
 
 	return c.JSON(http.StatusOK, ModelsResponse{
 		Success: true,
 		Data:    responseData,
 	})
 }
+
+// isFreeModel reports whether a model costs nothing for prompt and completion
+// tokens. LiteLLM models are always free; OpenRouter reports real pricing.
+func isFreeModel(model litellm.Model) bool {
+	return model.Pricing.Prompt == "0" && model.Pricing.Completion == "0"
+}
+
+// sortModels orders models by name, by context length (largest first) or by
+// prompt price (cheapest first). Any other value keeps the provider's order.
+func sortModels(models []litellm.Model, sortBy string) {
+	switch sortBy {
+	case "name":
+		sort.SliceStable(models, func(i, j int) bool {
+			return strings.ToLower(models[i].Name) < strings.ToLower(models[j].Name)
+		})
+	case "context":
+		sort.SliceStable(models, func(i, j int) bool {
+			return models[i].ContextLength > models[j].ContextLength
+		})
+	case "price":
+		sort.SliceStable(models, func(i, j int) bool {
+			return promptPrice(models[i]) < promptPrice(models[j])
+		})
+	}
+}
+
+// promptPrice parses a model's prompt price, treating unknown prices as the
+// most expensive
+func promptPrice(model litellm.Model) float64 {
+	price, err := strconv.ParseFloat(model.Pricing.Prompt, 64)
+	if err != nil {
+		return math.Inf(1)
+	}
+	return price
+}
+
+// isKnownModel reports whether the model is offered by the default backend
+func isKnownModel(modelID string) (bool, error) {
+	model, err := findModel("", modelID)
+	if err != nil {
+		return false, err
+	}
+	return model != nil, nil
+}
+
+// findModel looks up a model offered by the named backend, or the default
+// backend if name is empty, returning nil if it is not available
+func findModel(backend string, modelID string) (*litellm.Model, error) {
+	cache := getModelCache(backend)
+	if cache == nil {
+		return nil, nil
+	}
+	allModels, err := cache.Models(false)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range allModels {
+		if allModels[i].ID == modelID {
+			return &allModels[i], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"botanic/internal/auth"
+	"botanic/internal/litellm"
+	"botanic/internal/llm"
+
+	"github.com/labstack/echo/v4"
+)
+
+// initTestModels serves the given model IDs from a fake LiteLLM proxy as the
+// only backend, and returns the number of model lists the proxy has served
+func initTestModels(t *testing.T, ids ...string) *atomic.Int32 {
+	t.Helper()
+	var fetches atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/models":
+			fetches.Add(1)
+			var result struct {
+				Data []struct {
+					ID string `json:"id"`
+				} `json:"data"`
+			}
+			for _, id := range ids {
+				result.Data = append(result.Data, struct {
+					ID string `json:"id"`
+				}{ID: id})
+			}
+			json.NewEncoder(w).Encode(result)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(proxy.Close)
+
+	t.Setenv("LITELLM_URL", proxy.URL)
+	t.Setenv("LITELLM_MAX_RETRIES", "0")
+	t.Setenv("LLM_PROVIDER", "")
+	t.Setenv("OPENROUTER_API_KEY", "")
+	InitModels(llm.NewBackends(litellm.NewClient()))
+	return &fetches
+}
+
+func getModels(t *testing.T, userID string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/api/models?refresh=true", nil), rec)
+	if userID != "" {
+		c.Set(auth.UserIDKey, userID)
+	}
+	if err := GetModels(c); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("get models: %d, %v", rec.Code, err)
+	}
+}
+
+func TestAnonymousRefreshIsServedFromCache(t *testing.T) {
+	fetches := initTestModels(t, "gpt-4o")
+
+	getModels(t, "")
+	getModels(t, "")
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("anonymous refreshes fetched the models %d times, want 1", n)
+	}
+
+	getModels(t, "user-1")
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("authenticated refresh fetched the models %d times in all, want 2", n)
+	}
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const defaultMaxQueuedCompletions = 100
+
+// errQueueFull is returned when a completion cannot even wait for a slot
+var errQueueFull = errors.New("completion queue is full")
+
+// completionQueue limits how many completions run at once so that a single
+// model is not swamped. Completions beyond the limit wait in line, up to a
+// cap. A nil queue runs everything at once.
+type completionQueue struct {
+	slots      chan struct{}
+	mu         sync.Mutex
+	waiting    int
+	maxWaiting int
+}
+
+// newCompletionQueueFromEnv limits concurrent completions to
+// MAX_CONCURRENT_COMPLETIONS with up to MAX_QUEUED_COMPLETIONS (default 100)
+// waiting. It returns nil, imposing no limit, unless the former is set.
+func newCompletionQueueFromEnv() *completionQueue {
+	concurrency := 0
+	if value := os.Getenv("MAX_CONCURRENT_COMPLETIONS"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			concurrency = parsed
+		}
+	}
+	if concurrency == 0 {
+		return nil
+	}
+
+	maxWaiting := defaultMaxQueuedCompletions
+	if value := os.Getenv("MAX_QUEUED_COMPLETIONS"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed >= 0 {
+			maxWaiting = parsed
+		}
+	}
+	return &completionQueue{slots: make(chan struct{}, concurrency), maxWaiting: maxWaiting}
+}
+
+// acquire takes a completion slot, waiting in line while all are in use.
+// onQueued is told the caller's position before it starts waiting. It
+// returns errQueueFull if the line is at its cap, or the context's error if
+// ctx is done first. The returned function releases the slot.
+func (q *completionQueue) acquire(ctx context.Context, onQueued func(position int)) (func(), error) {
+	if q == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case q.slots <- struct{}{}:
+		return q.release, nil
+	default:
+	}
+
+	q.mu.Lock()
+	if q.waiting >= q.maxWaiting {
+		q.mu.Unlock()
+		return nil, errQueueFull
+	}
+	q.waiting++
+	position := q.waiting
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		q.waiting--
+		q.mu.Unlock()
+	}()
+
+	onQueued(position)
+	select {
+	case q.slots <- struct{}{}:
+		return q.release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (q *completionQueue) release() {
+	<-q.slots
+}
+
+// queued returns how many completions are waiting for a slot
+func (q *completionQueue) queued() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waiting
+}
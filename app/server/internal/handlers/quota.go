@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"net/http"
+
+	"botanic/internal/models"
+
+	"github.com/labstack/echo/v4"
+)
+
+// GetQuota returns the user's AI completion usage against their quotas
+func GetQuota(c echo.Context) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	statuses, err := models.GetQuotaStatus(c.Request().Context(), userID)
+	if err != nil {
+		requestLogger(c).Error("failed to get quota", "user_id", userID, "error", err)
+		return storeFailed(err, "failed to get quota")
+	}
+
+	return c.JSON(http.StatusOK, statuses)
+}
+
+// GetStats returns the user's session and message counts, account age and AI
+// usage totals
+func GetStats(c echo.Context) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	user, err := models.GetUserByIDCtx(c.Request().Context(), userID)
+	if err != nil {
+		return lookupFailed(err, "user not found", "failed to get user")
+	}
+
+	stats, err := models.GetUserStats(c.Request().Context(), user)
+	if err != nil {
+		requestLogger(c).Error("failed to get stats", "user_id", userID, "error", err)
+		return storeFailed(err, "failed to get stats")
+	}
+
+	return c.JSON(http.StatusOK, stats)
+}
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"botanic/internal/validation"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ValidationErrorResponse is returned with 422 when a request body fails
+// validation
+type ValidationErrorResponse struct {
+	Message string                 `json:"message"`
+	Errors  validation.FieldErrors `json:"errors"`
+}
+
+// bindAndValidate binds the request body into req and enforces its validate
+// tags, returning 400 for malformed bodies and 422 with field-level errors
+// for invalid ones
+func bindAndValidate(c echo.Context, req interface{}) error {
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	}
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
+	}
+	return nil
+}
+
+// validationError converts validation failures into a 422 response
+func validationError(err error) error {
+	var fieldErrors validation.FieldErrors
+	if errors.As(err, &fieldErrors) {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, ValidationErrorResponse{
+			Message: "validation failed",
+			Errors:  fieldErrors,
+		})
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+}
@@ -3,24 +3,48 @@ package handlers
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"botanic/internal/auth"
 	"botanic/internal/litellm"
+	"botanic/internal/llm"
+	"botanic/internal/metrics"
+	"botanic/internal/models"
+	"botanic/internal/tokenizer"
 
 	"github.com/google/uuid" // New import for UUID generation
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
 )
 
 const (
-	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 4096
+	defaultWriteWait = 10 * time.Second
+	defaultPongWait  = 60 * time.Second
+	// Frames carrying attachments may be this much larger than the message
+	// size limit
+	maxAttachmentFrameSize = maxAttachments * (len("data:image/jpeg;base64,") + maxAttachmentBase64Size)
+	// maxFrameOverhead leaves room for the JSON fields around a message's
+	// content
+	maxFrameOverhead = 1024
+
+	defaultMaxMessageSize = 4096
+	defaultSendBuffer     = 256
+	defaultSendTimeout    = 250 * time.Millisecond
+
+	// wsCloseUnauthorized closes connections whose token has expired or
+	// stopped being valid
+	wsCloseUnauthorized = 4401
 )
 
 // Message defines the structure for websocket messages.
@@ -33,110 +57,959 @@ type Message struct {
 	Content   string    `json:"content"` // Changed: from json.RawMessage to string
 	Model     string    `json:"model,omitempty"`
 	CreatedAt time.Time `json:"createdAt,omitempty"`
+	Cached    bool      `json:"cached,omitempty"` // Served from the completion cache
+	// RequestedModel is set when a fallback model answered instead of Model
+	RequestedModel string         `json:"requestedModel,omitempty"`
+	Usage          *litellm.Usage `json:"usage,omitempty"`
+	// Options tunes generation for a user message, overriding the session's settings
+	Options *litellm.CompletionOptions `json:"options,omitempty"`
+	// ToolCalls lists the calls requested by a "tool_call" message
+	ToolCalls []litellm.ToolCall `json:"toolCalls,omitempty"`
+	// ToolCallID names the call a "tool_result" message answers
+	ToolCallID string `json:"toolCallId,omitempty"`
+	// Attachments carries images sent with a user message for vision models
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Connections is the number of clients open on the session, for "presence"
+	Connections int `json:"connections,omitempty"`
+	// Position is the place in line of a "queued" completion, starting at 1
+	Position int `json:"position,omitempty"`
+	// Partial marks an assistant reply cut short by a stop
+	Partial bool `json:"partial,omitempty"`
+	// ReplyTo correlates server messages with the user message that caused
+	// them: it is the ID of that message on its "typing" indicator, "queued",
+	// "server_busy" and "tool_call" messages and its assistant reply, on the
+	// "stopped" message ending its completion and on a "moderation" message
+	// rejecting it. Clients with several requests in flight match replies by it,
+	// and may set it on a "stop" to cancel only that request rather than every
+	// request in the session. Replies are sent whole, never streamed in chunks.
+	ReplyTo string `json:"replyTo,omitempty"`
 	// Note: UpdatedAt is not in the JSON tags here, but is in frontend Message interface.
 	// Ensure consistency if you need UpdatedAt to be sent over WS.
 }
 
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
-	hub  *Hub
-	conn *websocket.Conn
-	send chan []byte // Buffered channel of outbound messages.
-	room string      // session_id
+	hub    *Hub
+	conn   *websocket.Conn
+	send   chan []byte  // Buffered channel of outbound messages.
+	room   string       // session_id
+	userID string       // authenticated user
+	owner  string       // owner of the session, charged for its completions
+	token  string       // access token the client connected with
+	logger *slog.Logger // tagged with the session and user IDs
+	// limiter caps the rate of messages the client may send
+	limiter *rate.Limiter
+	// lastActive is when the client last sent a message, in Unix nanoseconds
+	lastActive atomic.Int64
+}
+
+// directMessage is a frame for a single client rather than its whole room
+type directMessage struct {
+	client *Client
+	data   []byte
+}
+
+// clientMessageRoles lists the message types clients may send and the roles
+// each may carry
+var clientMessageRoles = map[string][]string{
+	"message":     {"user"},
+	"stop":        {"", "user"},
+	"tool_result": {"", "user"},
+	"ping":        {""},
+	"pong":        {""},
 }
 
 // Hub maintains the set of active clients and broadcasts messages to the clients.
 type Hub struct {
 	rooms      map[string]map[*Client]bool
 	broadcast  chan *Message
+	direct     chan directMessage
 	register   chan *Client
 	unregister chan *Client
 	mu         sync.RWMutex
-	llmClient  *litellm.Client
-	// For cancelling in-flight AI requests
-	aiRequests   map[string]context.CancelFunc
+	llmClient  llm.Provider
+	// backends are the providers sessions may choose instead of llmClient
+	backends *llm.Backends
+	// For cancelling in-flight AI requests, by session and then by the user
+	// message that started them
+	aiRequests   map[string]map[string]*aiRequest
 	aiRequestMux sync.Mutex
+	// Completion cache settings
+	cacheTTL            time.Duration
+	cacheAnyTemperature bool
+	// Per-connection message rate limit
+	messageRate  rate.Limit
+	messageBurst int
+	// Clients that send nothing, not even a pong, for this long are dropped
+	idleTimeout time.Duration
+	// Largest text message a client may send, excluding attachments
+	maxMessageSize int
+	// Whether user messages may carry attachments, which need larger frames
+	attachments bool
+	// How long a write may take, how long to wait for a pong before dropping
+	// the connection, and how often to ping, which must be under pongWait
+	writeWait  time.Duration
+	pongWait   time.Duration
+	pingPeriod time.Duration
+	// Frames queued per client, and how long a broadcast waits for room in a
+	// full queue before dropping the client
+	sendBuffer  int
+	sendTimeout time.Duration
+	// Session and user message IDs that recently triggered a completion, and when. Only
+	// run touches it.
+	recentTriggers map[string]time.Time
+	dedupWindow    time.Duration
+	// Generation state per session, so clients that reconnect while the
+	// assistant is answering still see the typing indicator and the reply
+	generations  map[string]*generation
+	generationMu sync.Mutex
+	replayWindow time.Duration
+	// Conversations waiting on tool results, keyed by session
+	toolConversations map[string]*toolConversation
+	toolMu            sync.Mutex
+	// completions limits how many completions run at once; nil means no limit
+	completions *completionQueue
+	// quit is closed to stop the hub; done is closed once it has stopped
+	quit     chan struct{}
+	done     chan struct{}
+	quitOnce sync.Once
+}
+
+// aiRequest is an in-flight completion that a "stop" message can cancel
+type aiRequest struct {
+	cancel context.CancelFunc
+	// messageID is the message that started the completion
+	messageID string
+}
+
+// toolConversation holds a completion that is paused until the client answers
+// every tool call the model requested.
+type toolConversation struct {
+	model    string
+	session  *models.ChatSession
+	messages []litellm.ChatMessage
+	opts     litellm.CompletionOptions
+	pending  map[string]bool
+	// replyTo is the user message the conversation answers
+	replyTo string
+}
+
+// generation is the state of the latest completion in a session: its typing
+// indicator while it runs, then its reply until the replay window passes.
+type generation struct {
+	// replyTo is the user message the completion answers
+	replyTo    string
+	typing     []byte
+	reply      []byte
+	finishedAt time.Time
 }
 
-func newHub(llmClient *litellm.Client) *Hub {
+func newHub(llmClient llm.Provider) *Hub {
+	// Default to 1 hour if not specified
+	cacheTTL := time.Hour
+	if ttl := os.Getenv("COMPLETION_CACHE_TTL"); ttl != "" {
+		if parsed, err := time.ParseDuration(ttl); err == nil {
+			cacheTTL = parsed
+		}
+	}
+
+	// Clients may send WS_MESSAGE_RATE messages per second (default 1) with
+	// bursts of up to WS_MESSAGE_BURST (default 5)
+	messageRate := 1.0
+	if value := os.Getenv("WS_MESSAGE_RATE"); value != "" {
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil && parsed > 0 {
+			messageRate = parsed
+		}
+	}
+	messageBurst := 5
+	if value := os.Getenv("WS_MESSAGE_BURST"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			messageBurst = parsed
+		}
+	}
+
+	// Clients must answer the application-level pings sent every pingPeriod,
+	// so the timeout should span a few of them
+	idleTimeout := 3 * time.Minute
+	if value := os.Getenv("WS_IDLE_TIMEOUT"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			idleTimeout = parsed
+		}
+	}
+
+	maxMessageSize := defaultMaxMessageSize
+	if value := os.Getenv("WS_MAX_MESSAGE_SIZE"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			maxMessageSize = parsed
+		}
+	}
+
+	// High-latency mobile networks need a longer WS_PONG_WAIT, LANs can
+	// detect dead connections sooner with a shorter one. WS_PING_PERIOD
+	// defaults to nine tenths of the pong wait.
+	writeWait := defaultWriteWait
+	if value := os.Getenv("WS_WRITE_WAIT"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			writeWait = parsed
+		}
+	}
+	pongWait := defaultPongWait
+	if value := os.Getenv("WS_PONG_WAIT"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			pongWait = parsed
+		}
+	}
+	var pingPeriod time.Duration
+	if value := os.Getenv("WS_PING_PERIOD"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			pingPeriod = parsed
+		}
+	}
+
+	// Every client may hold sendBuffer frames, each as large as a reply, so
+	// memory grows with the buffer times the number of connected clients
+	sendBuffer := defaultSendBuffer
+	if value := os.Getenv("WS_SEND_BUFFER"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			sendBuffer = parsed
+		}
+	}
+
+	// The hub blocks while it waits, so this should stay short
+	sendTimeout := defaultSendTimeout
+	if value := os.Getenv("WS_SEND_TIMEOUT"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			sendTimeout = parsed
+		}
+	}
+
+	dedupWindow := time.Minute
+	if value := os.Getenv("WS_DEDUP_WINDOW"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			dedupWindow = parsed
+		}
+	}
+
+	// Replies are replayed to clients that reconnect within WS_REPLAY_WINDOW
+	// of the reply being sent
+	replayWindow := time.Minute
+	if value := os.Getenv("WS_REPLAY_WINDOW"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			replayWindow = parsed
+		}
+	}
+
 	return &Hub{
-		broadcast:  make(chan *Message),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		rooms:      make(map[string]map[*Client]bool),
-		aiRequests: make(map[string]context.CancelFunc),
-		llmClient:  llmClient,
+		broadcast:           make(chan *Message),
+		direct:              make(chan directMessage),
+		register:            make(chan *Client),
+		unregister:          make(chan *Client),
+		rooms:               make(map[string]map[*Client]bool),
+		aiRequests:          make(map[string]map[string]*aiRequest),
+		llmClient:           llmClient,
+		cacheTTL:            cacheTTL,
+		cacheAnyTemperature: os.Getenv("COMPLETION_CACHE_ANY_TEMPERATURE") == "true",
+		messageRate:         rate.Limit(messageRate),
+		messageBurst:        messageBurst,
+		idleTimeout:         idleTimeout,
+		maxMessageSize:      maxMessageSize,
+		attachments:         os.Getenv("WS_ATTACHMENTS") != "false",
+		writeWait:           writeWait,
+		pongWait:            pongWait,
+		pingPeriod:          pingPeriod,
+		sendBuffer:          sendBuffer,
+		sendTimeout:         sendTimeout,
+		recentTriggers:      make(map[string]time.Time),
+		dedupWindow:         dedupWindow,
+		generations:         make(map[string]*generation),
+		replayWindow:        replayWindow,
+		toolConversations:   make(map[string]*toolConversation),
+		completions:         newCompletionQueueFromEnv(),
+		quit:                make(chan struct{}),
+		done:                make(chan struct{}),
 	}
 }
 
+// publish hands a message to the hub, dropping it if the hub has stopped
+func (h *Hub) publish(message *Message) {
+	select {
+	case h.broadcast <- message:
+	case <-h.quit:
+	}
+}
+
+// Shutdown stops the hub: in-flight AI requests are cancelled and every
+// client is sent a close frame. It waits until the hub has stopped or ctx is
+// done.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.quitOnce.Do(func() { close(h.quit) })
+	select {
+	case <-h.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stop cancels AI requests and disconnects all clients once the hub quits
+func (h *Hub) stop() {
+	h.aiRequestMux.Lock()
+	for sessionID, requests := range h.aiRequests {
+		for _, request := range requests {
+			request.cancel()
+		}
+		delete(h.aiRequests, sessionID)
+	}
+	h.aiRequestMux.Unlock()
+
+	h.mu.Lock()
+	for roomID, room := range h.rooms {
+		for client := range room {
+			// writePump sends a close frame when its channel is closed
+			close(client.send)
+		}
+		delete(h.rooms, roomID)
+	}
+	h.mu.Unlock()
+
+	close(h.done)
+}
+
+// useCompletionCache reports whether completions for the session may be
+// served from and stored in the cache. Sessions must opt in, and only
+// deterministic requests are cached unless caching is enabled for all
+// temperatures.
+func (h *Hub) useCompletionCache(session *models.ChatSession, opts litellm.CompletionOptions) bool {
+	if session == nil || !session.CacheCompletions {
+		return false
+	}
+	return (opts.Temperature != nil && *opts.Temperature == 0) || h.cacheAnyTemperature
+}
+
+// newWSMessage converts a stored message into its websocket form, so a message
+// looks the same whether it is received live or fetched from storage. The
+// assistant is identified by its role alone and carries no user ID.
+func newWSMessage(message *models.Message, model string) *Message {
+	return &Message{
+		ID:        message.ID,
+		Type:      "message",
+		SessionID: message.SessionID,
+		Role:      message.Role,
+		Content:   message.Content,
+		Model:     model,
+		CreatedAt: message.CreatedAt,
+		Usage:     message.Usage,
+		Partial:   message.Partial,
+	}
+}
+
+// storeAssistantMessage persists an assistant reply and returns it ready for
+// broadcast. If storing fails the reply is still delivered live.
+func (h *Hub) storeAssistantMessage(sessionID string, content string, model string, usage *litellm.Usage, partial bool) *Message {
+	message := models.NewMessage(sessionID, "assistant", content)
+	message.Usage = usage
+	message.Partial = partial
+	if err := models.StoreMessage(message); err != nil {
+		slog.Error("failed to store assistant message", "session_id", sessionID, "error", err)
+	} else if err := models.TouchChatSession(sessionID); err != nil {
+		slog.Error("failed to update session activity", "session_id", sessionID, "error", err)
+	}
+	return newWSMessage(message, model)
+}
+
+// moderate checks a user message with the moderator, telling the room why
+// the message was rejected if it was. It reports whether the message may go
+// to the model.
+func (h *Hub) moderate(ctx context.Context, msg *Message) bool {
+	allowed, reason, err := moderator.Check(ctx, msg.Content)
+	if ctx.Err() != nil {
+		// The request was stopped and the room told so
+		return false
+	}
+	if err != nil {
+		slog.Error("failed to moderate message", "session_id", msg.SessionID, "user_id", msg.UserID, "error", err)
+		allowed, reason = false, "content moderation unavailable"
+	}
+	if allowed {
+		return true
+	}
+
+	h.endGeneration(msg.SessionID, msg.ID)
+	h.publish(&Message{
+		ID:        uuid.New().String(),
+		Type:      "moderation",
+		SessionID: msg.SessionID,
+		Role:      "system",
+		Content:   reason,
+		ReplyTo:   msg.ID,
+		CreatedAt: time.Now(),
+	})
+	return false
+}
+
+// startAIRequest registers a cancellable AI request for the session, started
+// by the given message. Requests started by other messages of the session
+// may run alongside it. The returned function must be called once the
+// request finishes.
+func (h *Hub) startAIRequest(sessionID string, messageID string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	request := &aiRequest{cancel: cancel, messageID: messageID}
+	h.aiRequestMux.Lock()
+	if h.aiRequests[sessionID] == nil {
+		h.aiRequests[sessionID] = make(map[string]*aiRequest)
+	}
+	h.aiRequests[sessionID][messageID] = request
+	h.aiRequestMux.Unlock()
+
+	return ctx, func() {
+		cancel()
+		h.aiRequestMux.Lock()
+		// A stop may already have removed the request, and a resend of the
+		// same message may have replaced it
+		if h.aiRequests[sessionID][messageID] == request {
+			delete(h.aiRequests[sessionID], messageID)
+			if len(h.aiRequests[sessionID]) == 0 {
+				delete(h.aiRequests, sessionID)
+			}
+		}
+		h.aiRequestMux.Unlock()
+		h.endGeneration(sessionID, messageID)
+	}
+}
+
+// stopAIRequests cancels the session's request started by messageID, or all
+// of its requests when messageID is empty, and returns those it cancelled
+func (h *Hub) stopAIRequests(sessionID string, messageID string) []*aiRequest {
+	h.aiRequestMux.Lock()
+	defer h.aiRequestMux.Unlock()
+
+	var stopped []*aiRequest
+	for id, request := range h.aiRequests[sessionID] {
+		if messageID != "" && id != messageID {
+			continue
+		}
+		request.cancel()
+		delete(h.aiRequests[sessionID], id)
+		stopped = append(stopped, request)
+	}
+	if len(h.aiRequests[sessionID]) == 0 {
+		delete(h.aiRequests, sessionID)
+	}
+	return stopped
+}
+
+// startGeneration records that the session is waiting on the assistant to
+// answer the user message replyTo
+func (h *Hub) startGeneration(sessionID string, replyTo string, typing []byte) {
+	h.generationMu.Lock()
+	defer h.generationMu.Unlock()
+	h.pruneGenerations()
+	h.generations[sessionID] = &generation{replyTo: replyTo, typing: typing}
+}
+
+// finishGeneration records the reply sent to the session. The request may
+// already have ended, since its reply is broadcast asynchronously.
+func (h *Hub) finishGeneration(sessionID string, reply []byte) {
+	h.generationMu.Lock()
+	defer h.generationMu.Unlock()
+	h.pruneGenerations()
+	h.generations[sessionID] = &generation{reply: reply, finishedAt: time.Now()}
+}
+
+// endGeneration forgets a request answering replyTo that ended without a
+// reply, such as one that failed or was stopped. A later request of the
+// session keeps its typing indicator.
+func (h *Hub) endGeneration(sessionID string, replyTo string) {
+	h.generationMu.Lock()
+	defer h.generationMu.Unlock()
+	if state, ok := h.generations[sessionID]; ok && state.reply == nil && state.replyTo == replyTo {
+		delete(h.generations, sessionID)
+	}
+}
+
+// pruneGenerations drops replies older than the replay window. The caller
+// must hold generationMu.
+func (h *Hub) pruneGenerations() {
+	for sessionID, state := range h.generations {
+		if state.reply != nil && time.Since(state.finishedAt) > h.replayWindow {
+			delete(h.generations, sessionID)
+		}
+	}
+}
+
+// replayGeneration catches a newly registered client up on its session: the
+// typing indicator if the assistant is still answering, or the reply if it
+// was sent within the replay window. Clients ignore messages they already have.
+func (h *Hub) replayGeneration(client *Client) {
+	h.generationMu.Lock()
+	state, ok := h.generations[client.room]
+	h.generationMu.Unlock()
+	if !ok {
+		return
+	}
+
+	frame := state.typing
+	if state.reply != nil {
+		if time.Since(state.finishedAt) > h.replayWindow {
+			return
+		}
+		frame = state.reply
+	}
+	select {
+	case client.send <- frame:
+	default:
+	}
+}
+
+// generate requests a completion and broadcasts the outcome: either the
+// assistant's answer or, when the model asks for tools, a "tool_call" message
+// that pauses the conversation until the client sends the results. Every
+// message it sends replies to the user message replyTo. An empty cacheKey
+// disables caching of the answer.
+func (h *Hub) generate(ctx context.Context, sessionID string, replyTo string, model string, session *models.ChatSession, chatMessages []litellm.ChatMessage, opts litellm.CompletionOptions, cacheKey string) {
+	release, err := h.completions.acquire(ctx, func(position int) {
+		h.publish(&Message{
+			ID:        uuid.New().String(),
+			Type:      "queued",
+			SessionID: sessionID,
+			Role:      "system",
+			Position:  position,
+			ReplyTo:   replyTo,
+			CreatedAt: time.Now(),
+		})
+	})
+	if err != nil {
+		if errors.Is(err, errQueueFull) {
+			slog.Warn("rejecting completion, queue is full", "session_id", sessionID)
+			h.publish(&Message{
+				ID:        uuid.New().String(),
+				Type:      "server_busy",
+				SessionID: sessionID,
+				Role:      "system",
+				Content:   "server busy, please try again shortly",
+				ReplyTo:   replyTo,
+				CreatedAt: time.Now(),
+			})
+		}
+		// Otherwise the request was stopped while it waited
+		return
+	}
+	defer release()
+
+	provider := h.providerFor(session)
+	result, err := h.complete(ctx, provider, chatMessages, model, opts)
+	if err != nil {
+		if ctx.Err() == context.Canceled {
+			// The hub tells the room when it cancels a request
+			slog.Info("AI request cancelled", "session_id", sessionID)
+			if result != nil && result.Content != "" {
+				h.storePartialReply(sessionID, replyTo, session, chatMessages, result)
+			}
+			return
+		}
+		slog.Error("AI completion failed", "session_id", sessionID, "model", model, "error", err)
+		// TODO: Send an error message back to the client
+		// errorMsg, _ := json.Marshal(map[string]string{"error": "Failed to get AI response"})
+		// h.broadcast <- &Message{Type: "error", SessionID: sessionID, Content: string(errorMsg), Role: "system"}
+		return
+	}
+
+	slog.Debug("received AI response", "session_id", sessionID, "provider", provider.Name(), "model", result.Model, "content", result.Content)
+
+	h.recordCompletion(ctx, sessionID, session, result.Usage)
+
+	if len(result.ToolCalls) > 0 {
+		conversation := &toolConversation{
+			model:    result.Model,
+			session:  session,
+			messages: append(chatMessages, litellm.ChatMessage{Role: "assistant", Content: result.Content, ToolCalls: result.ToolCalls}),
+			opts:     opts,
+			pending:  make(map[string]bool),
+			replyTo:  replyTo,
+		}
+		for _, call := range result.ToolCalls {
+			conversation.pending[call.ID] = true
+		}
+		h.toolMu.Lock()
+		h.toolConversations[sessionID] = conversation
+		h.toolMu.Unlock()
+
+		h.publish(&Message{
+			ID:        uuid.New().String(),
+			Type:      "tool_call",
+			SessionID: sessionID,
+			Role:      "assistant",
+			Content:   result.Content,
+			Model:     result.Model,
+			CreatedAt: time.Now(),
+			Usage:     result.Usage,
+			ToolCalls: result.ToolCalls,
+			ReplyTo:   replyTo,
+		})
+		return
+	}
+
+	if cacheKey != "" {
+		if err := models.SetCachedCompletion(cacheKey, result.Content, h.cacheTTL); err != nil {
+			slog.Warn("failed to cache completion", "session_id", sessionID, "error", err)
+		}
+	}
+
+	assistantMessage := h.storeAssistantMessage(sessionID, result.Content, result.Model, result.Usage, false)
+	if result.Model != model {
+		assistantMessage.RequestedModel = model
+	}
+	assistantMessage.ReplyTo = replyTo
+	h.publish(assistantMessage)
+}
+
+// complete requests a completion, streamed when the provider supports it so
+// that a stopped request keeps what was generated. Tool calls are not
+// streamed.
+func (h *Hub) complete(ctx context.Context, provider llm.Provider, messages []litellm.ChatMessage, model string, opts litellm.CompletionOptions) (*litellm.CompletionResult, error) {
+	if streamer, ok := provider.(llm.Streamer); ok && len(opts.Tools) == 0 {
+		return streamer.Stream(ctx, messages, model, opts, nil)
+	}
+	return provider.Complete(ctx, messages, model, opts)
+}
+
+// providerFor returns the backend chosen by the session, falling back to the
+// hub's provider for sessions without one or whose backend is gone
+func (h *Hub) providerFor(session *models.ChatSession) llm.Provider {
+	if session != nil && session.Backend != "" && h.backends != nil {
+		if provider, ok := h.backends.Get(session.Backend); ok {
+			return provider
+		}
+		slog.Warn("session backend is not configured, using the default", "session_id", session.ID, "backend", session.Backend)
+	}
+	return h.llmClient
+}
+
+// recordCompletion counts a completion against the user's quota and records
+// its token usage, if known
+func (h *Hub) recordCompletion(ctx context.Context, sessionID string, session *models.ChatSession, usage *litellm.Usage) {
+	if session == nil {
+		return
+	}
+	if err := models.ConsumeQuota(ctx, session.UserID); err != nil {
+		slog.Error("failed to count completion against quota", "session_id", sessionID, "user_id", session.UserID, "error", err)
+	}
+	if usage != nil {
+		if err := models.RecordUsage(session.ID, session.UserID, *usage); err != nil {
+			slog.Error("failed to record usage", "session_id", sessionID, "error", err)
+		}
+	}
+}
+
+// storePartialReply keeps and broadcasts what a stopped completion produced.
+// Interrupted streams carry no usage report, so usage is estimated.
+func (h *Hub) storePartialReply(sessionID string, replyTo string, session *models.ChatSession, messages []litellm.ChatMessage, result *litellm.CompletionResult) {
+	usage := result.Usage
+	if usage == nil {
+		usage = &litellm.Usage{CompletionTokens: tokenizer.Count(result.Content)}
+		for _, message := range messages {
+			usage.PromptTokens += tokenizer.Count(message.Content)
+		}
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	// The request's context is already cancelled
+	h.recordCompletion(context.Background(), sessionID, session, usage)
+	reply := h.storeAssistantMessage(sessionID, result.Content, result.Model, usage, true)
+	reply.ReplyTo = replyTo
+	h.publish(reply)
+}
+
+// handleToolResult adds a tool result to the paused conversation of the
+// session and resumes the completion once every requested call is answered.
+func (h *Hub) handleToolResult(msg *Message) {
+	h.toolMu.Lock()
+	conversation, ok := h.toolConversations[msg.SessionID]
+	if !ok || !conversation.pending[msg.ToolCallID] {
+		h.toolMu.Unlock()
+		slog.Warn("ignoring unexpected tool result", "session_id", msg.SessionID, "tool_call_id", msg.ToolCallID)
+		return
+	}
+	delete(conversation.pending, msg.ToolCallID)
+	conversation.messages = append(conversation.messages, litellm.ChatMessage{Role: "tool", Content: msg.Content, ToolCallID: msg.ToolCallID})
+	if len(conversation.pending) > 0 {
+		h.toolMu.Unlock()
+		return
+	}
+	delete(h.toolConversations, msg.SessionID)
+	h.toolMu.Unlock()
+
+	// The resumed completion still answers the original user message, so a
+	// stop naming that message cancels it
+	ctx, done := h.startAIRequest(msg.SessionID, conversation.replyTo)
+	go func() {
+		defer done()
+		h.generate(ctx, msg.SessionID, conversation.replyTo, conversation.model, conversation.session, conversation.messages, conversation.opts, "")
+	}()
+}
+
+// seenRecently reports whether a user message with this ID already triggered
+// a completion in the session within the dedup window, and records it
+// otherwise. Messages without an ID are never considered duplicates.
+func (h *Hub) seenRecently(sessionID string, messageID string) bool {
+	if messageID == "" {
+		return false
+	}
+	key := sessionID + ":" + messageID
+
+	now := time.Now()
+	for id, seen := range h.recentTriggers {
+		if now.Sub(seen) > h.dedupWindow {
+			delete(h.recentTriggers, id)
+		}
+	}
+
+	if _, ok := h.recentTriggers[key]; ok {
+		return true
+	}
+	h.recentTriggers[key] = now
+	return false
+}
+
+// RoomCount returns the number of clients connected to a session
+func (h *Hub) RoomCount(sessionID string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.rooms[sessionID])
+}
+
+// broadcastPresence tells a session's clients how many connections it has.
+// It must only be called from run, which is the only writer of rooms.
+func (h *Hub) broadcastPresence(sessionID string) {
+	count := h.RoomCount(sessionID)
+	if count == 0 {
+		return
+	}
+	presence, err := json.Marshal(&Message{
+		Type:        "presence",
+		SessionID:   sessionID,
+		Connections: count,
+		CreatedAt:   time.Now(),
+	})
+	if err != nil {
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for client := range h.rooms[sessionID] {
+		select {
+		case client.send <- presence:
+		default:
+		}
+	}
+}
+
+// sendToRoom broadcasts a message to every client in its session, dropping
+// those that stay too far behind, and returns the frame sent. It must only be
+// called from run.
+func (h *Hub) sendToRoom(message *Message) []byte {
+	marshalledMsg, err := json.Marshal(message)
+	if err != nil {
+		slog.Error("failed to marshal broadcast message", "session_id", message.SessionID, "error", err)
+		return nil
+	}
+
+	h.mu.RLock()
+	clientsInRoom := make([]*Client, 0, len(h.rooms[message.SessionID]))
+	for client := range h.rooms[message.SessionID] {
+		clientsInRoom = append(clientsInRoom, client)
+	}
+	h.mu.RUnlock()
+
+	var slow []*Client
+	for _, client := range clientsInRoom {
+		if !h.deliver(client, marshalledMsg) {
+			slow = append(slow, client)
+		}
+	}
+	h.dropClients(slow)
+	return marshalledMsg
+}
+
+// deliver queues a frame for a client, waiting up to the send timeout when
+// its queue is full. It reports whether the frame was queued.
+func (h *Hub) deliver(client *Client, data []byte) bool {
+	select {
+	case client.send <- data:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(h.sendTimeout)
+	defer timer.Stop()
+	select {
+	case client.send <- data:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// dropClients disconnects clients that could not keep up with their room.
+// It must only be called from run, which is the only writer of rooms.
+func (h *Hub) dropClients(clients []*Client) {
+	if len(clients) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, client := range clients {
+		if h.rooms[client.room][client] {
+			client.logger.Warn("dropping client that fell behind", "send_buffer", h.sendBuffer)
+			delete(h.rooms[client.room], client)
+			close(client.send)
+			if len(h.rooms[client.room]) == 0 {
+				delete(h.rooms, client.room)
+			}
+		}
+	}
+}
+
+// counts returns the number of open rooms and connected clients
+func (h *Hub) counts() (rooms int, clients int) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, room := range h.rooms {
+		clients += len(room)
+	}
+	return len(h.rooms), clients
+}
+
+// HubStats is a snapshot of the hub for operators
+type HubStats struct {
+	Rooms          int            `json:"rooms"`
+	Clients        int            `json:"clients"`
+	ClientsPerRoom map[string]int `json:"clients_per_room"`
+	// AIRequests counts sessions with a completion in flight, including
+	// QueuedCompletions waiting for a slot
+	AIRequests        int `json:"ai_requests"`
+	QueuedCompletions int `json:"queued_completions"`
+	Goroutines        int `json:"goroutines"`
+}
+
+// Stats returns a snapshot of the hub's rooms, clients and in-flight AI
+// requests, with the process's goroutine count
+func (h *Hub) Stats() HubStats {
+	stats := HubStats{ClientsPerRoom: make(map[string]int)}
+
+	h.mu.RLock()
+	for room, clients := range h.rooms {
+		stats.ClientsPerRoom[room] = len(clients)
+		stats.Clients += len(clients)
+	}
+	stats.Rooms = len(h.rooms)
+	h.mu.RUnlock()
+
+	h.aiRequestMux.Lock()
+	for _, requests := range h.aiRequests {
+		stats.AIRequests += len(requests)
+	}
+	h.aiRequestMux.Unlock()
+	stats.QueuedCompletions = h.completions.queued()
+
+	stats.Goroutines = runtime.NumGoroutine()
+	return stats
+}
+
 func (h *Hub) run() {
 	for {
 		select {
+		case <-h.quit:
+			h.stop()
+			return
+
 		case client := <-h.register:
 			h.mu.Lock()
 			if h.rooms[client.room] == nil {
 				h.rooms[client.room] = make(map[*Client]bool)
 			}
 			h.rooms[client.room][client] = true
-			log.Printf("Client registered to room %s. Total clients in room: %d", client.room, len(h.rooms[client.room]))
+			client.logger.Info("client registered", "room_clients", len(h.rooms[client.room]))
 			h.mu.Unlock()
+			h.replayGeneration(client)
+			h.broadcastPresence(client.room)
 
 		case client := <-h.unregister:
 			h.mu.Lock()
-			if _, ok := h.rooms[client.room]; ok {
+			// Slow clients are dropped during broadcasts, so the client may
+			// already be gone and its channel closed
+			if h.rooms[client.room][client] {
 				delete(h.rooms[client.room], client)
 				close(client.send)
 				if len(h.rooms[client.room]) == 0 {
 					delete(h.rooms, client.room)
-					log.Printf("Room %s closed.", client.room)
+					client.logger.Info("room closed")
 				}
 			}
 			h.mu.Unlock()
+			h.broadcastPresence(client.room)
+
+		case direct := <-h.direct:
+			// The client may have disconnected since the frame was queued
+			h.mu.RLock()
+			if h.rooms[direct.client.room][direct.client] {
+				select {
+				case direct.client.send <- direct.data:
+				default:
+				}
+			}
+			h.mu.RUnlock()
 
 		case message := <-h.broadcast:
-			// Handle 'stop' message (command, not to be broadcasted to clients)
+			// Handle 'stop' message (command, not to be broadcasted to clients).
+			// A stop naming a user message in ReplyTo cancels only the
+			// completion answering it.
 			if message.Type == "stop" {
-				h.aiRequestMux.Lock()
-				if cancel, exists := h.aiRequests[message.SessionID]; exists {
-					cancel()
-					delete(h.aiRequests, message.SessionID)
+				// Let clients clear the typing indicator and accept input again
+				for _, request := range h.stopAIRequests(message.SessionID, message.ReplyTo) {
+					h.sendToRoom(&Message{
+						ID:        uuid.New().String(),
+						Type:      "stopped",
+						SessionID: message.SessionID,
+						Role:      "system",
+						ReplyTo:   request.messageID,
+						CreatedAt: time.Now(),
+					})
 				}
-				h.aiRequestMux.Unlock()
 				continue // Do not broadcast stop messages to clients
 			}
 
-			// Only broadcast messages intended for display (assistant responses, typing indicators)
-			// This prevents echoing user messages back to themselves.
-			if message.Role == "assistant" || message.Type == "typing" {
-				h.mu.RLock()
-				clientsInRoom := h.rooms[message.SessionID]
-				h.mu.RUnlock()
-
-				marshalledMsg, err := json.Marshal(message)
-				if err != nil {
-					log.Printf("Error marshalling broadcast message: %v", err)
-					continue
-				}
+			// Tool results feed a paused completion and are not broadcast either
+			if message.Type == "tool_result" {
+				h.handleToolResult(message)
+				continue
+			}
 
-				// Broadcast to all clients in the room
-				for client := range clientsInRoom {
-					select {
-					case client.send <- marshalledMsg:
-					default:
-						close(client.send)
-						delete(clientsInRoom, client)
-					}
+			// Only broadcast messages intended for display (assistant responses, typing indicators,
+			// quota notices). This prevents echoing user messages back to themselves.
+			if message.Role == "assistant" || message.Type == "typing" || message.Type == "quota_exceeded" ||
+				message.Type == "queued" || message.Type == "server_busy" || message.Type == "moderation" {
+				marshalledMsg := h.sendToRoom(message)
+				if marshalledMsg != nil && message.Role == "assistant" && message.Type != "typing" {
+					h.finishGeneration(message.SessionID, marshalledMsg)
 				}
 			}
 
 			// If it's a user message, process it to get an AI response
 			if message.Role == "user" {
+				// Two tabs or a replaying client may send the same turn twice
+				if h.seenRecently(message.SessionID, message.ID) {
+					slog.Info("ignoring duplicate user message", "session_id", message.SessionID, "message_id", message.ID)
+					continue
+				}
+
 				// Send typing indicator immediately
 				typingMsg, _ := json.Marshal(&Message{
 					ID:        uuid.New().String(),
 					Type:      "typing",
 					SessionID: message.SessionID,
 					Role:      "assistant",
+					ReplyTo:   message.ID,
 					CreatedAt: time.Now(),
 				})
 				h.mu.RLock()
@@ -147,61 +1020,104 @@ func (h *Hub) run() {
 					select {
 					case client.send <- typingMsg:
 					default:
-						log.Printf("Warning: Client send channel for typing message is full for room %s", message.SessionID)
+						client.logger.Warn("client send buffer full, dropping typing message")
 					}
 				}
 
-				ctx, cancel := context.WithCancel(context.Background())
-				h.aiRequestMux.Lock()
-				h.aiRequests[message.SessionID] = cancel
-				h.aiRequestMux.Unlock()
+				h.startGeneration(message.SessionID, message.ID, typingMsg)
+				ctx, done := h.startAIRequest(message.SessionID, message.ID)
 
 				go func(ctx context.Context, msg *Message) {
-					defer func() {
-						h.aiRequestMux.Lock()
-						delete(h.aiRequests, msg.SessionID)
-						h.aiRequestMux.Unlock()
-					}()
+					defer done()
 
 					// The incoming user message 'Content' field is already a string
 					// due to the struct change, so no need for json.Unmarshal here.
 					contentStr := msg.Content
-					log.Printf("LITELLM DEBUG Sending message to model : %q", contentStr)
 
-					aiResp, err := h.llmClient.GetChatCompletion(ctx, []litellm.ChatMessage{{Role: "user", Content: contentStr}}, msg.Model, 0.7)
+					// Moderation runs while the room already shows the typing
+					// indicator. Rejected messages are neither stored nor sent on.
+					if !h.moderate(ctx, msg) {
+						return
+					}
+
+					var storedID string
+					if stored, err := models.CreateMessage(msg.SessionID, "user", contentStr); err != nil {
+						slog.Error("failed to store user message", "session_id", msg.SessionID, "user_id", msg.UserID, "error", err)
+					} else {
+						storedID = stored.ID
+						if err := models.TouchChatSession(msg.SessionID); err != nil {
+							slog.Error("failed to update session activity", "session_id", msg.SessionID, "error", err)
+						}
+					}
+					slog.Debug("sending message to model", "session_id", msg.SessionID, "user_id", msg.UserID, "content", contentStr)
+
+					session, err := models.GetChatSession(msg.SessionID)
 					if err != nil {
-						if ctx.Err() == context.Canceled {
-							log.Printf("AI request for session %s was cancelled.", msg.SessionID)
-							// Optionally send a "stop" message to the frontend if needed
-							// h.broadcast <- &Message{Type: "stop", SessionID: msg.SessionID}
-							return
+						slog.Warn("failed to load session settings", "session_id", msg.SessionID, "error", err)
+						session = nil
+					}
+
+					// A message naming no model uses the session's
+					model := msg.Model
+					if model == "" && session != nil {
+						model = sessionModel(session)
+					} else if model == "" {
+						model = defaultModel()
+					}
+
+					var chatMessages []litellm.ChatMessage
+					var opts litellm.CompletionOptions
+					if session != nil {
+						opts = session.CompletionOptions
+						if session.SystemPrompt != "" {
+							chatMessages = append(chatMessages, litellm.ChatMessage{Role: "system", Content: session.SystemPrompt})
+						}
+
+						history, err := h.buildHistory(ctx, session, model, storedID)
+						if err != nil {
+							slog.Warn("failed to load conversation history", "session_id", msg.SessionID, "error", err)
+						}
+						chatMessages = append(chatMessages, history...)
+					}
+					userMessage := litellm.ChatMessage{Role: "user", Content: contentStr}
+					if len(msg.Attachments) > 0 {
+						userMessage.Parts = append(userMessage.Parts, litellm.TextPart(contentStr))
+						for _, attachment := range msg.Attachments {
+							userMessage.Parts = append(userMessage.Parts, litellm.ImagePart(attachment.URL))
 						}
-						log.Printf("AI completion error: %v", err)
-						// TODO: Send an error message back to the client
-						// errorMsg, _ := json.Marshal(map[string]string{"error": "Failed to get AI response"})
-						// h.broadcast <- &Message{Type: "error", SessionID: msg.SessionID, Content: string(errorMsg), Role: "system"}
-						return
 					}
+					chatMessages = append(chatMessages, userMessage)
 
-					log.Printf("Received response from LiteLLM: %s", aiResp)
-
-					// aiResp is already a string, and Message.Content is now string.
-					// No need to json.Marshal(aiResp) again unless aiResp itself is expected to be JSON string.
-					// If aiResp from litellm.Client.GetChatCompletion is a plain string,
-					// assign it directly. If it's a JSON string, ensure it's still treated as string.
-					// Assuming GetChatCompletion returns a plain string:
-					assistantMessage := &Message{
-						ID:        uuid.New().String(), // Generate a unique ID for the assistant's message
-						Type:      "message",
-						SessionID: msg.SessionID,
-						UserID:    "assistant", // This represents the AI assistant
-						Content:   aiResp,      // Directly assign the string content
-						Model:     msg.Model,
-						CreatedAt: time.Now(),
-						Role:      "assistant", // Set role to assistant
+					if msg.Options != nil {
+						if err := msg.Options.Validate(); err != nil {
+							slog.Warn("ignoring invalid completion options", "session_id", msg.SessionID, "user_id", msg.UserID, "error", err)
+						} else {
+							opts = opts.Merge(msg.Options)
+						}
+					}
+					// A message's temperature overrides the session's, which
+					// overrides the server default
+					if opts.Temperature == nil {
+						temperature := defaultTemperature()
+						opts.Temperature = &temperature
 					}
-					h.broadcast <- assistantMessage
 
+					useCache := h.useCompletionCache(session, opts)
+					cacheKey := litellm.CacheKey(model, opts, chatMessages)
+					if useCache {
+						if cached, err := models.GetCachedCompletion(cacheKey); err == nil {
+							assistantMessage := h.storeAssistantMessage(msg.SessionID, cached, model, nil, false)
+							assistantMessage.Cached = true
+							assistantMessage.ReplyTo = msg.ID
+							h.publish(assistantMessage)
+							return
+						}
+					}
+
+					if !useCache {
+						cacheKey = ""
+					}
+					h.generate(ctx, msg.SessionID, msg.ID, model, session, chatMessages, opts, cacheKey)
 				}(ctx, message)
 			}
 		}
@@ -210,36 +1126,173 @@ func (h *Hub) run() {
 
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.quit:
+		}
 		c.conn.Close()
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.conn.SetReadLimit(c.hub.readLimit())
+	c.conn.SetReadDeadline(time.Now().Add(c.hub.pongWait))
+	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(c.hub.pongWait)); return nil })
 	for {
 		_, rawMessage, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("Unexpected close error: %v", err)
+				c.logger.Warn("unexpected websocket close", "error", err)
 			}
 			break
 		}
+		// Frames over the read limit end the read above; the connection is
+		// then closed with "message too big" by the websocket library.
+		c.lastActive.Store(time.Now().UnixNano())
+
 		var msg Message
-		// Unmarshal the incoming message from frontend.
-		// If frontend sends user message content as a simple string, it will be unmarshaled into msg.Content.
-		// If frontend sends user message content as a nested JSON string, it will attempt to unmarshal.
-		// To be safe, if frontend sends nested, you might need to adapt here or ensure frontend sends plain string content.
 		if err := json.Unmarshal(rawMessage, &msg); err != nil {
-			log.Printf("Error unmarshalling message from client: %v", err)
+			c.logger.Warn("closing connection after malformed message", "error", err)
+			c.closePolicyViolation("malformed message")
+			break
+		}
+		roles, ok := clientMessageRoles[msg.Type]
+		if !ok || !slices.Contains(roles, msg.Role) {
+			c.logger.Warn("closing connection after disallowed message", "type", msg.Type, "role", msg.Role)
+			c.closePolicyViolation("message type or role not allowed")
+			break
+		}
+		// Heartbeats only keep the connection alive
+		switch msg.Type {
+		case "ping":
+			c.sendDirect(&Message{Type: "pong", SessionID: c.room, CreatedAt: time.Now()})
+			continue
+		case "pong":
+			continue
+		}
+		if !c.limiter.Allow() {
+			c.sendError("rate limit exceeded, message dropped")
+			continue
+		}
+		// The frame limit leaves room for escaping and attachments, so the
+		// text itself is measured once decoded
+		if len(msg.Content) > c.hub.maxMessageSize {
+			c.sendError("message too large: at most " + strconv.Itoa(c.hub.maxMessageSize) + " bytes of text are allowed")
+			continue
+		}
+		if len(msg.Attachments) > 0 && !c.hub.attachments {
+			c.sendError("attachments are not allowed")
 			continue
 		}
+		if err := validateAttachments(msg.Attachments); err != nil {
+			c.logger.Warn("rejecting message with invalid attachments", "error", err)
+			c.sendError("invalid attachments: " + err.Error())
+			continue
+		}
+		if msg.Type == "message" {
+			content, reason := sanitizeContent(msg.Content)
+			if reason != "" {
+				c.sendError("invalid content: " + reason)
+				continue
+			}
+			msg.Content = content
+		}
 		msg.SessionID = c.room // Ensure session ID is always from the URL param
-		c.hub.broadcast <- &msg
+		// Only user messages carry a user ID, and it always comes from the token
+		msg.UserID = ""
+		if msg.Role == "user" {
+			msg.UserID = c.userID
+			if c.quotaExceeded() {
+				continue
+			}
+		}
+		c.hub.publish(&msg)
+	}
+}
+
+// readLimit is the largest frame a client may send: a message of
+// maxMessageSize bytes, which JSON escaping may double, its other fields, and
+// attachments when they are allowed
+func (h *Hub) readLimit() int64 {
+	limit := 2*h.maxMessageSize + maxFrameOverhead
+	if h.attachments {
+		limit += maxAttachmentFrameSize
+	}
+	return int64(limit)
+}
+
+// sendDirect sends a message to this client only
+func (c *Client) sendDirect(message *Message) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	select {
+	case c.hub.direct <- directMessage{client: c, data: data}:
+	case <-c.hub.quit:
 	}
 }
 
+// sendError sends an error frame to this client only
+func (c *Client) sendError(content string) {
+	c.sendDirect(&Message{
+		ID:        uuid.New().String(),
+		Type:      "error",
+		SessionID: c.room,
+		Role:      "system",
+		Content:   content,
+		CreatedAt: time.Now(),
+	})
+}
+
+// idle reports whether the client has sent nothing for longer than the
+// hub's idle timeout
+func (c *Client) idle() bool {
+	return time.Since(time.Unix(0, c.lastActive.Load())) > c.hub.idleTimeout
+}
+
+// closePolicyViolation tells the client why its connection is being closed.
+// The caller stops reading, which closes the connection.
+func (c *Client) closePolicyViolation(reason string) {
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason), time.Now().Add(c.hub.writeWait))
+}
+
+// quotaExceeded reports whether the session's owner, whom recordCompletion
+// charges, is out of AI completions, telling the room so when they are. Quota
+// lookups that fail let the message through.
+func (c *Client) quotaExceeded() bool {
+	exceeded, err := models.QuotaExceeded(context.Background(), c.owner)
+	if err != nil {
+		c.logger.Error("failed to check quota", "error", err)
+		return false
+	}
+	if exceeded {
+		c.hub.publish(&Message{
+			ID:        uuid.New().String(),
+			Type:      "quota_exceeded",
+			SessionID: c.room,
+			Role:      "system",
+			Content:   "AI request quota exceeded",
+			CreatedAt: time.Now(),
+		})
+	}
+	return exceeded
+}
+
+// userDeleted reports whether the client's user no longer exists. Like quota
+// checks, lookups that fail keep the client connected.
+func (c *Client) userDeleted() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), c.hub.writeWait)
+	defer cancel()
+	_, err := models.GetUserByIDCtx(ctx, c.userID)
+	if errors.Is(err, models.ErrNotFound) {
+		return true
+	}
+	if err != nil {
+		c.logger.Error("failed to look up user", "error", err)
+	}
+	return false
+}
+
 func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.hub.pingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
@@ -247,17 +1300,42 @@ func (c *Client) writePump() {
 	for {
 		select {
 		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.writeWait))
 			if !ok {
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 			c.conn.WriteMessage(websocket.TextMessage, message)
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			// Browsers answer transport pings even from tabs that are gone
+			// for good, so liveness is judged by application messages.
+			// Closing the connection ends readPump, which unregisters.
+			if c.idle() {
+				c.logger.Info("disconnecting idle client")
+				c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "idle timeout"), time.Now().Add(c.hub.writeWait))
+				return
+			}
+			// Connections outlive tokens, so the token is checked again on
+			// every ping
+			if _, err := auth.ValidateToken(c.token); err != nil {
+				c.logger.Info("disconnecting client whose token is no longer valid", "error", err)
+				c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(wsCloseUnauthorized, "token expired"), time.Now().Add(c.hub.writeWait))
+				return
+			}
+			// Tokens outlive their users, so deleted users are disconnected too
+			if c.userDeleted() {
+				c.logger.Info("disconnecting client whose user no longer exists")
+				c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(wsCloseUnauthorized, "user not found"), time.Now().Add(c.hub.writeWait))
+				return
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
 				return
 			}
+			ping, _ := json.Marshal(&Message{Type: "ping", SessionID: c.room, CreatedAt: time.Now()})
+			if err := c.conn.WriteMessage(websocket.TextMessage, ping); err != nil {
+				return
+			}
 		}
 	}
 }
@@ -266,37 +1344,217 @@ type WSHandler struct {
 	hub *Hub
 }
 
-func NewWSHandler(llmClient *litellm.Client) *WSHandler {
+// WSOption overrides a setting that otherwise comes from the environment
+type WSOption func(*Hub)
+
+// WithMaxMessageSize sets the largest text message, in bytes, a client may
+// send (WS_MAX_MESSAGE_SIZE, default 4096). Attachments are allowed on top.
+func WithMaxMessageSize(size int) WSOption {
+	return func(h *Hub) {
+		if size > 0 {
+			h.maxMessageSize = size
+		}
+	}
+}
+
+// WithAttachments sets whether user messages may carry images
+// (WS_ATTACHMENTS, default true). Without them frames are limited to about
+// the message size.
+func WithAttachments(enabled bool) WSOption {
+	return func(h *Hub) {
+		h.attachments = enabled
+	}
+}
+
+// WithSendBuffer sets how many outbound frames are queued per client
+// (WS_SEND_BUFFER, default 256). A larger buffer absorbs bursts of
+// broadcasts but costs memory for every connected client.
+func WithSendBuffer(size int) WSOption {
+	return func(h *Hub) {
+		if size > 0 {
+			h.sendBuffer = size
+		}
+	}
+}
+
+// WithSendTimeout sets how long a broadcast waits on a client whose queue is
+// full before dropping it (WS_SEND_TIMEOUT, default 250ms)
+func WithSendTimeout(timeout time.Duration) WSOption {
+	return func(h *Hub) {
+		if timeout > 0 {
+			h.sendTimeout = timeout
+		}
+	}
+}
+
+// WithTimeouts sets how long a write may take (WS_WRITE_WAIT, default 10s),
+// how long a connection may go without a pong (WS_PONG_WAIT, default 60s) and
+// how often clients are pinged (WS_PING_PERIOD, default nine tenths of the
+// pong wait). Zero keeps the current value.
+func WithTimeouts(writeWait, pongWait, pingPeriod time.Duration) WSOption {
+	return func(h *Hub) {
+		if writeWait > 0 {
+			h.writeWait = writeWait
+		}
+		if pongWait > 0 {
+			h.pongWait = pongWait
+		}
+		if pingPeriod > 0 {
+			h.pingPeriod = pingPeriod
+		}
+	}
+}
+
+// WithBackends lets sessions choose which of the backends their completions
+// use, rather than always using the hub's provider
+func WithBackends(backends *llm.Backends) WSOption {
+	return func(h *Hub) {
+		h.backends = backends
+	}
+}
+
+// checkTimeouts derives the ping period from the pong wait when it is unset.
+// A ping period that is not shorter than the pong wait would drop healthy
+// connections before they are pinged, so it is replaced the same way.
+func (h *Hub) checkTimeouts() {
+	if h.pingPeriod > 0 && h.pingPeriod < h.pongWait {
+		return
+	}
+	if h.pingPeriod > 0 {
+		slog.Warn("websocket ping period must be shorter than the pong wait, using the default", "ping_period", h.pingPeriod, "pong_wait", h.pongWait)
+	}
+	h.pingPeriod = (h.pongWait * 9) / 10
+}
+
+func NewWSHandler(llmClient llm.Provider, opts ...WSOption) *WSHandler {
 	hub := newHub(llmClient)
+	for _, opt := range opts {
+		opt(hub)
+	}
+	hub.checkTimeouts()
 	go hub.run()
+
+	metrics.NewGaugeFunc("websocket_rooms", "Chat sessions with at least one connected client.", func() float64 {
+		rooms, _ := hub.counts()
+		return float64(rooms)
+	})
+	metrics.NewGaugeFunc("websocket_clients", "Connected WebSocket clients.", func() float64 {
+		_, clients := hub.counts()
+		return float64(clients)
+	})
+
 	return &WSHandler{hub: hub}
 }
 
+// GetStats returns the hub's live state for administrators
+func (wh *WSHandler) GetStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, wh.hub.Stats())
+}
+
+// Shutdown stops the handler's hub, disconnecting every client
+func (wh *WSHandler) Shutdown(ctx context.Context) error {
+	return wh.hub.Shutdown(ctx)
+}
+
+// allowedWSOrigin accepts requests without an Origin, which do not come from
+// browsers, and origins allowed for CORS. WS_ALLOW_ALL_ORIGINS=true accepts
+// every origin and is meant for development only.
+func allowedWSOrigin(r *http.Request) bool {
+	if os.Getenv("WS_ALLOW_ALL_ORIGINS") == "true" {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	return origin == "" || auth.IsAllowedOrigin(origin)
+}
+
+// wsBearerProtocol is the subprotocol that carries the access token. Browsers
+// cannot set headers on websockets, so they offer ["bearer", token] as
+// subprotocols and the server accepts "bearer".
+const wsBearerProtocol = "bearer"
+
+// wsToken returns the access token of a websocket request, preferring the
+// bearer subprotocol, then the Authorization header, then the deprecated
+// token query parameter
+func wsToken(c echo.Context) string {
+	protocols := websocket.Subprotocols(c.Request())
+	for i, protocol := range protocols {
+		if protocol == wsBearerProtocol && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
+	}
+
+	if token, ok := strings.CutPrefix(c.Request().Header.Get("Authorization"), "Bearer "); ok && token != "" {
+		return token
+	}
+
+	token := c.QueryParam("token")
+	if token != "" {
+		requestLogger(c).Warn("websocket token passed in query parameter, which is deprecated; use the bearer subprotocol or Authorization header")
+	}
+	return token
+}
+
 func (wh *WSHandler) HandleWebSocket(c echo.Context) error {
 	sessionID := c.QueryParam("session_id")
-	token := c.QueryParam("token")
+	token := wsToken(c)
 	if sessionID == "" || token == "" {
 		return echo.NewHTTPError(http.StatusBadRequest, "missing session_id or token")
 	}
 
-	if _, err := auth.VerifyToken(token); err != nil {
+	userID, err := auth.VerifyToken(token)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
 	}
 
+	// Browsers always send Origin, so checking it stops other sites from
+	// opening sockets with a user's credentials
+	if !allowedWSOrigin(c.Request()) {
+		requestLogger(c).Warn("rejecting websocket from disallowed origin", "origin", c.Request().Header.Get("Origin"))
+		return echo.NewHTTPError(http.StatusForbidden, "origin not allowed")
+	}
+
+	// The hub stores what clients send and relays replies to everyone in the
+	// room, so only the session's owner may join it
+	session, err := loadOwnedSession(c, sessionID, userID)
+	if err != nil {
+		return err
+	}
+	sessionID = session.ID
+
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
-		CheckOrigin:     func(r *http.Request) bool { return true },
+		CheckOrigin:     allowedWSOrigin,
+		// Only selected when the client offers it, so the token is not echoed
+		Subprotocols: []string{wsBearerProtocol},
 	}
 
 	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
-		log.Printf("Upgrade error: %v", err)
+		requestLogger(c).Warn("websocket upgrade failed", "error", err)
 		return err
 	}
 
-	client := &Client{hub: wh.hub, conn: conn, send: make(chan []byte, 256), room: sessionID}
-	client.hub.register <- client
+	logger := requestLogger(c).With("session_id", sessionID, "user_id", userID)
+	client := &Client{
+		hub:     wh.hub,
+		conn:    conn,
+		send:    make(chan []byte, wh.hub.sendBuffer),
+		room:    sessionID,
+		userID:  userID,
+		owner:   session.UserID,
+		token:   token,
+		logger:  logger,
+		limiter: rate.NewLimiter(wh.hub.messageRate, wh.hub.messageBurst),
+	}
+	client.lastActive.Store(time.Now().UnixNano())
+	select {
+	case client.hub.register <- client:
+	case <-client.hub.quit:
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+		conn.Close()
+		return nil
+	}
 
 	go client.writePump()
 	go client.readPump()
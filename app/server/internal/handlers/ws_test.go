@@ -0,0 +1,509 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"botanic/internal/auth"
+	"botanic/internal/db"
+	"botanic/internal/db/dbtest"
+	"botanic/internal/litellm"
+	"botanic/internal/llm"
+	"botanic/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
+)
+
+// startTestHub runs a hub configured like NewWSHandler's, without the
+// metrics it registers
+func startTestHub(t *testing.T, opts ...WSOption) *Hub {
+	t.Helper()
+	hub := newHub(nil)
+	for _, opt := range opts {
+		opt(hub)
+	}
+	hub.checkTimeouts()
+	go hub.run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+	})
+	return hub
+}
+
+// connectTestClient connects a client of the hub to room "session" as
+// "user-1", skipping authentication, and returns the client's end. The
+// connection's token is only checked on pings.
+func connectTestClient(t *testing.T, hub *Hub, token string) *websocket.Conn {
+	t.Helper()
+	return connectTestClientTo(t, hub, "session", token)
+}
+
+// connectTestClientTo connects a client like connectTestClient, to room
+func connectTestClientTo(t *testing.T, hub *Hub, room string, token string) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := &Client{
+			hub:     hub,
+			conn:    conn,
+			send:    make(chan []byte, hub.sendBuffer),
+			room:    room,
+			userID:  "user-1",
+			owner:   "user-1",
+			token:   token,
+			logger:  slog.Default(),
+			limiter: rate.NewLimiter(hub.messageRate, hub.messageBurst),
+		}
+		client.lastActive.Store(time.Now().UnixNano())
+		hub.register <- client
+		go client.writePump()
+		go client.readPump()
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readUntil reads messages until one of the given type arrives
+func readUntil(t *testing.T, conn *websocket.Conn, messageType string) *Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var message Message
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatalf("waiting for %q: %v", messageType, err)
+		}
+		if message.Type == messageType {
+			return &message
+		}
+	}
+}
+
+func TestTextOverTheMessageSizeIsRejected(t *testing.T) {
+	hub := startTestHub(t, WithMaxMessageSize(100))
+	conn := connectTestClient(t, hub, "")
+
+	// Escaped quotes double the frame, which must still be read
+	text := strings.Repeat(`"`, 101)
+	if err := conn.WriteJSON(Message{Type: "message", Role: "user", Content: text}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if reply := readUntil(t, conn, "error"); !strings.Contains(reply.Content, "too large") {
+		t.Fatalf("error is %q, want message too large", reply.Content)
+	}
+
+	// The connection stays open
+	if err := conn.WriteJSON(Message{Type: "ping"}); err != nil {
+		t.Fatalf("write ping: %v", err)
+	}
+	readUntil(t, conn, "pong")
+}
+
+func TestReadLimitAllowsAttachmentsOnlyWhenEnabled(t *testing.T) {
+	enabled := startTestHub(t, WithMaxMessageSize(100))
+	disabled := startTestHub(t, WithMaxMessageSize(100), WithAttachments(false))
+
+	if limit := disabled.readLimit(); limit >= int64(maxAttachmentFrameSize) {
+		t.Fatalf("read limit without attachments is %d, want under %d", limit, maxAttachmentFrameSize)
+	}
+	if limit := enabled.readLimit(); limit < int64(maxAttachmentFrameSize) {
+		t.Fatalf("read limit with attachments is %d, want at least %d", limit, maxAttachmentFrameSize)
+	}
+
+	// A text-only frame of attachment size ends the connection
+	conn := connectTestClient(t, disabled, "")
+	frame, _ := json.Marshal(Message{Type: "message", Role: "user", Content: strings.Repeat("a", 1<<20)})
+	if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+				t.Fatalf("read: %v, want close for a message too big", err)
+			}
+			break
+		}
+	}
+}
+
+func TestAttachmentsRejectedWhenDisabled(t *testing.T) {
+	hub := startTestHub(t, WithAttachments(false))
+	conn := connectTestClient(t, hub, "")
+
+	message := Message{Type: "message", Role: "user", Content: "what is this?", Attachments: []Attachment{{URL: "https://example.com/plant.png"}}}
+	if err := conn.WriteJSON(message); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if reply := readUntil(t, conn, "error"); reply.Content != "attachments are not allowed" {
+		t.Fatalf("error is %q, want attachments are not allowed", reply.Content)
+	}
+}
+
+func TestStopCancelsOnlyTheNamedRequest(t *testing.T) {
+	hub := newHub(nil)
+	first, doneFirst := hub.startAIRequest("session", "first")
+	second, doneSecond := hub.startAIRequest("session", "second")
+	defer doneSecond()
+
+	stopped := hub.stopAIRequests("session", "first")
+	if len(stopped) != 1 || stopped[0].messageID != "first" {
+		t.Fatalf("stopped %v, want only the first request", stopped)
+	}
+	if first.Err() == nil {
+		t.Error("first request was not cancelled")
+	}
+	if second.Err() != nil {
+		t.Error("second request was cancelled by a stop naming the first")
+	}
+
+	// The first request finishing must not forget the second
+	doneFirst()
+	if stopped := hub.stopAIRequests("session", "second"); len(stopped) != 1 {
+		t.Fatalf("second request was lost when the first finished")
+	}
+	if second.Err() == nil {
+		t.Error("second request was not cancelled")
+	}
+}
+
+func TestStopWithoutReplyToCancelsEveryRequest(t *testing.T) {
+	hub := newHub(nil)
+	first, doneFirst := hub.startAIRequest("session", "first")
+	defer doneFirst()
+	second, doneSecond := hub.startAIRequest("session", "second")
+	defer doneSecond()
+	other, doneOther := hub.startAIRequest("other", "third")
+	defer doneOther()
+
+	if stopped := hub.stopAIRequests("session", ""); len(stopped) != 2 {
+		t.Fatalf("stopped %d requests, want 2", len(stopped))
+	}
+	if first.Err() == nil || second.Err() == nil {
+		t.Error("a request of the session was not cancelled")
+	}
+	if other.Err() != nil {
+		t.Error("a request of another session was cancelled")
+	}
+}
+
+func TestFinishedRequestKeepsLaterTypingIndicator(t *testing.T) {
+	hub := newHub(nil)
+	hub.startGeneration("session", "first", []byte("typing first"))
+	hub.startGeneration("session", "second", []byte("typing second"))
+
+	hub.endGeneration("session", "first")
+	if state := hub.generations["session"]; state == nil || state.replyTo != "second" {
+		t.Fatal("the first request ending removed the second's typing indicator")
+	}
+	hub.endGeneration("session", "second")
+	if _, ok := hub.generations["session"]; ok {
+		t.Error("typing indicator kept after its request ended")
+	}
+}
+
+// testToken returns a valid token for "user-1"
+func testToken(t *testing.T) string {
+	t.Helper()
+	initTestAuth(t)
+	token, err := auth.GenerateToken("user-1", "")
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	return token
+}
+
+func TestCustomTimeoutsKeepAnsweringClientsConnected(t *testing.T) {
+	// Pings keep clients whose user cannot be looked up
+	dbtest.SetupUnreachable(t)
+	hub := startTestHub(t, WithTimeouts(time.Second, 300*time.Millisecond, 50*time.Millisecond))
+	conn := connectTestClient(t, hub, testToken(t))
+
+	var pings atomic.Int32
+	conn.SetPingHandler(func(data string) error {
+		pings.Add(1)
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+
+	// Three pong waits pass while the client answers every ping
+	deadline := time.Now().Add(900 * time.Millisecond)
+	conn.SetReadDeadline(deadline)
+	for time.Now().Before(deadline) {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if time.Now().Before(deadline) {
+				t.Fatalf("connection ended after %d pings: %v", pings.Load(), err)
+			}
+			break
+		}
+	}
+	if n := pings.Load(); n < 5 {
+		t.Fatalf("got %d pings in 900ms, want one every 50ms", n)
+	}
+}
+
+func TestCustomPongWaitDropsSilentClients(t *testing.T) {
+	dbtest.SetupUnreachable(t)
+	hub := startTestHub(t, WithTimeouts(time.Second, 300*time.Millisecond, 50*time.Millisecond))
+	conn := connectTestClient(t, hub, testToken(t))
+
+	// Ignore pings, as a connection that has gone away would
+	conn.SetPingHandler(func(string) error { return nil })
+
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(2 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				t.Fatal("silent client was not dropped")
+			}
+			break
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("silent client was dropped after %s, want about the 300ms pong wait", elapsed)
+	}
+}
+
+func TestPingDisconnectsDeletedUsers(t *testing.T) {
+	dbtest.Setup(t)
+	if err := db.Set(models.UserPrefix+"user-1", &models.User{ID: "user-1", Email: "owner@example.com"}, 0); err != nil {
+		t.Fatalf("store user: %v", err)
+	}
+	hub := startTestHub(t, WithTimeouts(time.Second, 300*time.Millisecond, 50*time.Millisecond))
+	conn := connectTestClient(t, hub, testToken(t))
+
+	// The user exists, so pings keep coming
+	for range 3 {
+		readUntil(t, conn, "ping")
+	}
+
+	if err := db.Delete(models.UserPrefix + "user-1"); err != nil {
+		t.Fatalf("delete user: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, wsCloseUnauthorized) {
+			t.Fatalf("connection ended with %v, want close code %d", err, wsCloseUnauthorized)
+		}
+		return
+	}
+}
+
+func TestPingPeriodMustBeShorterThanPongWait(t *testing.T) {
+	hub := newHub(nil)
+	WithTimeouts(0, time.Second, 2*time.Second)(hub)
+	hub.checkTimeouts()
+	if hub.pingPeriod >= hub.pongWait {
+		t.Fatalf("ping period %s is not shorter than the pong wait %s", hub.pingPeriod, hub.pongWait)
+	}
+}
+
+func TestAssistantMessageLooksTheSameLiveAndStored(t *testing.T) {
+	dbtest.Setup(t)
+	hub := newHub(nil)
+
+	usage := &litellm.Usage{PromptTokens: 12, CompletionTokens: 34, TotalTokens: 46}
+	live := hub.storeAssistantMessage("session", "Water it weekly.", "openai/gpt-4o", usage, true)
+	if live.UserID != "" || live.Role != "assistant" {
+		t.Fatalf("live message has user %q and role %q, want no user and role assistant", live.UserID, live.Role)
+	}
+
+	stored, err := models.GetMessage(live.ID)
+	if err != nil {
+		t.Fatalf("get stored message: %v", err)
+	}
+	liveJSON, err := json.Marshal(live)
+	if err != nil {
+		t.Fatalf("marshal live message: %v", err)
+	}
+	storedJSON, err := json.Marshal(newWSMessage(stored, "openai/gpt-4o"))
+	if err != nil {
+		t.Fatalf("marshal stored message: %v", err)
+	}
+	if string(liveJSON) != string(storedJSON) {
+		t.Fatalf("live message\n%s\ndiffers from stored message\n%s", liveJSON, storedJSON)
+	}
+}
+
+// dialWebSocket opens a websocket to the handler of hub for sessionID, sending
+// origin, and returns the connection or the failed handshake's response
+func dialWebSocket(t *testing.T, hub *Hub, sessionID, token, origin string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	e := echo.New()
+	e.GET("/ws", (&WSHandler{hub: hub}).HandleWebSocket)
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	header := http.Header{}
+	header.Set("Origin", origin)
+	header.Set("Authorization", "Bearer "+token)
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?session_id="+sessionID, header)
+	if conn != nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+func TestWebSocketRejectsForgedOrigin(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://botanic.example")
+	t.Setenv("WS_ALLOW_ALL_ORIGINS", "")
+	hub := startTestHub(t)
+
+	_, resp, err := dialWebSocket(t, hub, uuid.New().String(), testToken(t), "https://evil.example")
+	if err == nil {
+		t.Fatal("websocket from a forged origin was accepted")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("handshake from a forged origin: %v, want 403", resp)
+	}
+}
+
+func TestWebSocketAcceptsAllowedOrigin(t *testing.T) {
+	dbtest.Setup(t)
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://botanic.example")
+	t.Setenv("WS_ALLOW_ALL_ORIGINS", "")
+	hub := startTestHub(t)
+	session, err := models.CreateChatSession("user-1", "plants", "", models.SessionSettings{})
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	_, resp, err := dialWebSocket(t, hub, session.ID, testToken(t), "https://botanic.example")
+	if err != nil {
+		t.Fatalf("websocket from an allowed origin: %v (%v)", err, resp)
+	}
+}
+
+// recordingProvider answers every completion, reporting the model each was
+// requested with
+type recordingProvider struct {
+	llm.Provider
+	models chan string
+}
+
+func (p *recordingProvider) Name() string { return "recording" }
+
+func (p *recordingProvider) Complete(ctx context.Context, messages []litellm.ChatMessage, model string, opts litellm.CompletionOptions) (*litellm.CompletionResult, error) {
+	p.models <- model
+	return &litellm.CompletionResult{Content: "Water it weekly.", Model: model}, nil
+}
+
+// startRecordingHub runs a test hub completing with a recordingProvider
+func startRecordingHub(t *testing.T) (*Hub, *recordingProvider) {
+	t.Helper()
+	provider := &recordingProvider{models: make(chan string, 4)}
+	hub := startTestHub(t, func(h *Hub) { h.llmClient = provider })
+	return hub, provider
+}
+
+// sendUserMessage hands the hub a user message for sessionID naming model
+func sendUserMessage(hub *Hub, sessionID, model string) {
+	hub.broadcast <- &Message{
+		ID:        uuid.New().String(),
+		Type:      "message",
+		SessionID: sessionID,
+		UserID:    "user-1",
+		Role:      "user",
+		Content:   "How often should I water a fern?",
+		Model:     model,
+		CreatedAt: time.Now(),
+	}
+}
+
+// requestedModel waits for the provider to be asked for a completion
+func requestedModel(t *testing.T, provider *recordingProvider) string {
+	t.Helper()
+	select {
+	case model := <-provider.models:
+		return model
+	case <-time.After(2 * time.Second):
+		t.Fatal("no completion was requested")
+		return ""
+	}
+}
+
+func TestMessageWithoutModelUsesTheSessionModel(t *testing.T) {
+	dbtest.Setup(t)
+	hub, provider := startRecordingHub(t)
+	session, err := models.CreateChatSession("user-1", "ferns", "session-model", models.SessionSettings{})
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	sendUserMessage(hub, session.ID, "")
+	if model := requestedModel(t, provider); model != "session-model" {
+		t.Errorf("message without a model completed with %q, want session-model", model)
+	}
+
+	sendUserMessage(hub, session.ID, "message-model")
+	if model := requestedModel(t, provider); model != "message-model" {
+		t.Errorf("message naming a model completed with %q, want message-model", model)
+	}
+}
+
+func TestCachedReplyUsesTheSessionModel(t *testing.T) {
+	dbtest.Setup(t)
+	hub, provider := startRecordingHub(t)
+	zero := 0.0
+	settings := models.SessionSettings{
+		CacheCompletions:  true,
+		CompletionOptions: litellm.CompletionOptions{Temperature: &zero},
+	}
+	named, err := models.CreateChatSession("user-1", "ferns", "session-model", settings)
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	omitted, err := models.CreateChatSession("user-1", "ferns", "session-model", settings)
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	// Naming the session's model explicitly fills the cache
+	conn := connectTestClientTo(t, hub, named.ID, "")
+	sendUserMessage(hub, named.ID, "session-model")
+	requestedModel(t, provider)
+	readUntil(t, conn, "message")
+
+	// Omitting it asks the same question of the same model
+	conn = connectTestClientTo(t, hub, omitted.ID, "")
+	sendUserMessage(hub, omitted.ID, "")
+	reply := readUntil(t, conn, "message")
+	if !reply.Cached {
+		t.Error("reply to a message omitting the model was not served from the cache")
+	}
+	if reply.Model != "session-model" {
+		t.Errorf("cached reply has model %q, want session-model", reply.Model)
+	}
+	select {
+	case model := <-provider.models:
+		t.Errorf("cached question was completed again with %q", model)
+	default:
+	}
+}
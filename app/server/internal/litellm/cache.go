@@ -0,0 +1,70 @@
+package litellm
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ModelLister is a source of available models.
+type ModelLister interface {
+	GetAvailableModels() ([]Model, error)
+}
+
+// ModelCache keeps a provider's model list in memory. Once the list is older
+// than the TTL it is still served while a background refresh runs.
+type ModelCache struct {
+	client ModelLister
+	ttl    time.Duration
+
+	mu         sync.RWMutex
+	models     []Model
+	fetchedAt  time.Time
+	refreshing bool
+}
+
+// NewModelCache creates a model list cache backed by client.
+func NewModelCache(client ModelLister, ttl time.Duration) *ModelCache {
+	return &ModelCache{client: client, ttl: ttl}
+}
+
+// Models returns the cached model list. The list is fetched synchronously
+// when nothing is cached yet or when forceRefresh is set.
+func (mc *ModelCache) Models(forceRefresh bool) ([]Model, error) {
+	mc.mu.RLock()
+	models, fetchedAt := mc.models, mc.fetchedAt
+	mc.mu.RUnlock()
+
+	if models == nil || forceRefresh {
+		return mc.refresh()
+	}
+
+	if time.Since(fetchedAt) > mc.ttl {
+		mc.mu.Lock()
+		if !mc.refreshing {
+			mc.refreshing = true
+			go func() {
+				if _, err := mc.refresh(); err != nil {
+					slog.Error("background model list refresh failed", "error", err)
+				}
+			}()
+		}
+		mc.mu.Unlock()
+	}
+
+	return models, nil
+}
+
+func (mc *ModelCache) refresh() ([]Model, error) {
+	models, err := mc.client.GetAvailableModels()
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.refreshing = false
+	if err != nil {
+		return nil, err
+	}
+	mc.models = models
+	mc.fetchedAt = time.Now()
+	return models, nil
+}
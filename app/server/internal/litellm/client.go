@@ -1,23 +1,38 @@
 package litellm
 
 import (
-	"bytes"
 	"context" // Import context package
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"time"
+
+	"botanic/internal/logging"
 )
 
 type Model struct {
-	ID            string  `json:"id"`
-	Name          string  `json:"name"`
-	ContextLength int     `json:"context_length"`
-	Pricing       Pricing `json:"pricing"`
-	Description   string  `json:"description,omitempty"`
+	ID            string       `json:"id"`
+	Name          string       `json:"name"`
+	ContextLength int          `json:"context_length"`
+	Pricing       Pricing      `json:"pricing"`
+	Description   string       `json:"description,omitempty"`
+	Capabilities  Capabilities `json:"capabilities"`
+	// Backend names the provider offering the model when several are
+	// configured
+	Backend string `json:"backend,omitempty"`
+}
+
+// Capabilities lists what a model supports. Capabilities the provider does
+// not report are false.
+type Capabilities struct {
+	Streaming bool `json:"streaming"`
+	Tools     bool `json:"tools"`
+	Vision    bool `json:"vision"`
 }
 
 // Pricing represents model pricing information.
@@ -31,12 +46,55 @@ type Pricing struct {
 type ChatMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// ToolCalls is set on assistant messages that requested tool calls.
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// ToolCallID links a "tool" message to the call it answers.
+	ToolCallID string `json:"tool_call_id,omitempty"`
+	// Parts replaces Content with multimodal content when set.
+	Parts []ContentPart `json:"-"`
+}
+
+// ConnectionError indicates that the LiteLLM proxy could not be reached.
+type ConnectionError struct {
+	URL string
+	Err error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("could not connect to litellm proxy at %s (is the proxy running and LITELLM_URL correct?): %v", e.URL, e.Err)
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// APIError indicates that the LiteLLM proxy responded with a non-200 status.
+type APIError struct {
+	URL        string
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("litellm proxy at %s returned %s: %s", e.URL, e.Status, e.Body)
+}
+
+// Usage is the token usage reported for a completion.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
 }
 
 // Client represents a LiteLLM API client.
 type Client struct {
 	baseURL    string
 	httpClient *http.Client
+	timeout    time.Duration
+	maxRetries int
+	retryBase  time.Duration
+	fallbacks  map[string]string
 }
 
 // NewClient creates a new LiteLLM client.
@@ -47,32 +105,83 @@ func NewClient() *Client {
 	if baseURL == "" {
 		baseURL = "http://localhost:4000"
 	}
-	log.Printf("[LITELLM DEBUG] Using proxy base URL: %s", baseURL)
+	slog.Debug("using LiteLLM proxy", "base_url", baseURL)
+
+	// Default to 90 seconds, which suits most local models
+	timeout := 90 * time.Second
+	if value := os.Getenv("LITELLM_TIMEOUT"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			timeout = parsed
+		}
+	}
+
+	maxRetries, retryBase := retryConfig()
 
 	return &Client{
 		baseURL: baseURL,
-		httpClient: &http.Client{
-			Timeout: 90 * time.Second, // Increased timeout for local models
-		},
+		// Requests are bounded through their context so that the timeout
+		// can be overridden per call
+		httpClient: &http.Client{},
+		timeout:    timeout,
+		maxRetries: maxRetries,
+		retryBase:  retryBase,
+		fallbacks:  loadFallbacks(),
 	}
 }
 
-// GetAvailableModels fetches available models from the LiteLLM proxy.
-func (c *Client) GetAvailableModels() ([]Model, error) {
-	req, err := http.NewRequest("GET", c.baseURL+"/v1/models", nil)
+// Name identifies the client as an LLM provider.
+func (c *Client) Name() string {
+	return "litellm"
+}
+
+// withTimeout bounds ctx by the override, or by the client's configured
+// timeout when override is zero.
+func (c *Client) withTimeout(ctx context.Context, override time.Duration) (context.Context, context.CancelFunc) {
+	timeout := c.timeout
+	if override > 0 {
+		timeout = override
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// BaseURL returns the proxy URL the client is configured with.
+func (c *Client) BaseURL() string {
+	return c.baseURL
+}
+
+// HealthCheck verifies that the LiteLLM proxy is reachable and answering
+// requests. It makes a single attempt without retries, so callers control how
+// long it may take through ctx.
+func (c *Client) HealthCheck(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/v1/models", nil)
 	if err != nil {
-		return nil, fmt.Errorf("error creating request: %w", err)
+		return fmt.Errorf("error creating request for %s: %w", c.baseURL, err)
 	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error making request to litellm proxy: %w. Is the proxy running?", err)
+		return &ConnectionError{URL: c.baseURL, Err: err}
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("litellm proxy returned non-200 status: %s", resp.Status)
+		body, _ := io.ReadAll(resp.Body)
+		return &APIError{URL: c.baseURL, StatusCode: resp.StatusCode, Status: resp.Status, Body: string(body)}
+	}
+
+	return nil
+}
+
+// GetAvailableModels fetches available models from the LiteLLM proxy.
+func (c *Client) GetAvailableModels() ([]Model, error) {
+	ctx, cancel := c.withTimeout(context.Background(), 0)
+	defer cancel()
+
+	resp, err := c.do(ctx, "GET", "/v1/models", nil)
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -90,84 +199,184 @@ func (c *Client) GetAvailableModels() ([]Model, error) {
 		return nil, fmt.Errorf("error decoding response from litellm: %w", err)
 	}
 
+	// Richer details are optional; older proxies do not expose them.
+	info, err := c.getModelInfo()
+	if err != nil {
+		slog.Debug("LiteLLM model info unavailable, using defaults", "error", err)
+	}
+
 	// Adapt the response to the Model struct expected by the handlers.
 	models := make([]Model, len(result.Data))
 	for i, m := range result.Data {
 		models[i] = Model{
 			ID:            m.ID,
-			Name:          m.ID, // Use ID as Name
-			ContextLength: 8192, // Default context length
+			Name:          m.ID,                 // Use ID as Name
+			ContextLength: defaultContextLength, // Default context length
 			Pricing: Pricing{ // All local models are free
 				Prompt:     "0",
 				Completion: "0",
 			},
 			Description: fmt.Sprintf("Locally hosted model: %s", m.ID),
 		}
+		if details, ok := info[m.ID]; ok {
+			details.apply(&models[i])
+		}
 	}
 
 	return models, nil
 }
 
+// defaultContextLength is assumed when the proxy does not report a model's
+// context window.
+const defaultContextLength = 8192
+
+// modelInfo holds the details LiteLLM reports for a model on /v1/model/info.
+type modelInfo struct {
+	ModelName     string `json:"model_name"`
+	LiteLLMParams struct {
+		Model string `json:"model"`
+	} `json:"litellm_params"`
+	ModelInfo struct {
+		MaxTokens               int  `json:"max_tokens"`
+		MaxInputTokens          int  `json:"max_input_tokens"`
+		SupportsNativeStreaming bool `json:"supports_native_streaming"`
+		SupportsFunctionCalling bool `json:"supports_function_calling"`
+		SupportsVision          bool `json:"supports_vision"`
+	} `json:"model_info"`
+}
+
+// apply fills in the model's details that the proxy reported.
+func (info modelInfo) apply(model *Model) {
+	if info.ModelInfo.MaxInputTokens > 0 {
+		model.ContextLength = info.ModelInfo.MaxInputTokens
+	} else if info.ModelInfo.MaxTokens > 0 {
+		model.ContextLength = info.ModelInfo.MaxTokens
+	}
+	if info.LiteLLMParams.Model != "" && info.LiteLLMParams.Model != model.ID {
+		model.Description = fmt.Sprintf("Locally hosted model: %s (%s)", model.ID, info.LiteLLMParams.Model)
+	}
+	model.Capabilities = Capabilities{
+		Streaming: info.ModelInfo.SupportsNativeStreaming,
+		Tools:     info.ModelInfo.SupportsFunctionCalling,
+		Vision:    info.ModelInfo.SupportsVision,
+	}
+}
+
+// getModelInfo fetches per-model details from /v1/model/info, keyed by model
+// name.
+func (c *Client) getModelInfo() (map[string]modelInfo, error) {
+	ctx, cancel := c.withTimeout(context.Background(), 0)
+	defer cancel()
+
+	resp, err := c.do(ctx, "GET", "/v1/model/info", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Data []modelInfo `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error decoding model info from litellm: %w", err)
+	}
+
+	info := make(map[string]modelInfo, len(result.Data))
+	for _, m := range result.Data {
+		info[m.ModelName] = m
+	}
+	return info, nil
+}
+
 func (c *Client) GetChatCompletion(ctx context.Context, messages []ChatMessage, model string, temperature float64) (string, error) { // Add context.Context
+	return c.GetChatCompletionWithOptions(ctx, messages, model, CompletionOptions{Temperature: &temperature})
+}
+
+// GetChatCompletionWithOptions gets a chat completion using the given
+// generation options.
+func (c *Client) GetChatCompletionWithOptions(ctx context.Context, messages []ChatMessage, model string, opts CompletionOptions) (string, error) {
+	result, err := c.Complete(ctx, messages, model, opts)
+	if err != nil {
+		return "", err
+	}
+	return result.Content, nil
+}
+
+// complete requests a chat completion from a single model.
+func (c *Client) complete(ctx context.Context, messages []ChatMessage, model string, opts CompletionOptions) (*CompletionResult, error) {
+	logger := logging.FromContext(ctx)
 	if len(messages) > 0 {
-		log.Printf("[LITELLM DEBUG] Sending message to model %s: \"%s\"", model, messages[0].Content)
+		logger.Debug("sending chat completion", "provider", "litellm", "model", model, "content", messages[0].Content)
 	}
 
 	payload := struct {
-		Model       string        `json:"model"`
-		Messages    []ChatMessage `json:"messages"`
-		Temperature float64       `json:"temperature"`
+		Model    string        `json:"model"`
+		Messages []ChatMessage `json:"messages"`
+		CompletionOptions
 	}{
-		Model:       model,
-		Messages:    messages,
-		Temperature: temperature,
+		Model:             model,
+		Messages:          messages,
+		CompletionOptions: opts,
 	}
 
 	jsonData, err := json.Marshal(payload)
 	if err != nil {
-		return "", fmt.Errorf("error marshaling request: %w", err)
-	}
-
-	// Create request with context for cancellation
-	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/v1/chat/completions", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("error creating request: %w", err)
+		return nil, fmt.Errorf("error marshaling request: %w", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	// Send the request with context for cancellation
+	ctx, cancel := c.withTimeout(ctx, time.Duration(opts.Timeout)*time.Second)
+	defer cancel()
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(ctx, "POST", "/v1/chat/completions", jsonData)
 	if err != nil {
-		// Check if the error is due to context cancellation
 		if ctx.Err() == context.Canceled {
-			return "", ctx.Err()
+			return nil, ctx.Err()
 		}
-		log.Printf("[LITELLM ERROR] HTTP request failed: %v", err)
-		return "", fmt.Errorf("error making request to litellm proxy: %w", err)
+		logger.Error("LiteLLM chat completion failed", "model", model, "error", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		log.Printf("[LITELLM ERROR] API returned non-200 status: %s, Body: %s", resp.Status, string(body))
-		return "", fmt.Errorf("API error: %s - %s", resp.Status, string(body))
-	}
-
 	var result struct {
 		Choices []struct {
 			Message struct {
-				Content string `json:"content"`
+				Content   string     `json:"content"`
+				ToolCalls []ToolCall `json:"tool_calls"`
 			} `json:"message"`
 		} `json:"choices"`
+		Usage *Usage `json:"usage"`
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("error decoding response: %w", err)
+		return nil, fmt.Errorf("error decoding response: %w", err)
 	}
 
 	if len(result.Choices) == 0 {
-		return "", fmt.Errorf("no choices in response from litellm")
+		return nil, fmt.Errorf("no choices in response from litellm")
 	}
 
-	return result.Choices[0].Message.Content, nil
+	message := result.Choices[0].Message
+	return &CompletionResult{
+		Content:   message.Content,
+		ToolCalls: message.ToolCalls,
+		Model:     model,
+		Usage:     result.Usage,
+	}, nil
+}
+
+// CacheKey returns a stable hash of the completion inputs, suitable for
+// keying a response cache.
+func CacheKey(model string, opts CompletionOptions, messages []ChatMessage) string {
+	data, _ := json.Marshal(struct {
+		Model    string            `json:"model"`
+		Options  CompletionOptions `json:"options"`
+		Messages []ChatMessage     `json:"messages"`
+	}{
+		Model:    model,
+		Options:  opts,
+		Messages: messages,
+	})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,71 @@
+package litellm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// embeddingBatchSize caps how many inputs are sent to the proxy per request.
+const embeddingBatchSize = 64
+
+// CreateEmbedding returns one embedding vector per input, in input order.
+// Large inputs are split into batches.
+func (c *Client) CreateEmbedding(ctx context.Context, input []string, model string) ([][]float32, error) {
+	embeddings := make([][]float32, 0, len(input))
+	for start := 0; start < len(input); start += embeddingBatchSize {
+		end := min(start+embeddingBatchSize, len(input))
+		batch, err := c.createEmbeddingBatch(ctx, input[start:end], model)
+		if err != nil {
+			return nil, err
+		}
+		embeddings = append(embeddings, batch...)
+	}
+	return embeddings, nil
+}
+
+func (c *Client) createEmbeddingBatch(ctx context.Context, input []string, model string) ([][]float32, error) {
+	jsonData, err := json.Marshal(struct {
+		Model string   `json:"model"`
+		Input []string `json:"input"`
+	}{
+		Model: model,
+		Input: input,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	ctx, cancel := c.withTimeout(ctx, 0)
+	defer cancel()
+
+	resp, err := c.do(ctx, "POST", "/v1/embeddings", jsonData)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error decoding response: %w", err)
+	}
+	if len(result.Data) != len(input) {
+		return nil, fmt.Errorf("litellm returned %d embeddings for %d inputs", len(result.Data), len(input))
+	}
+
+	// The API reports each embedding's input position, which need not match
+	// the response order
+	embeddings := make([][]float32, len(input))
+	for _, item := range result.Data {
+		if item.Index < 0 || item.Index >= len(input) {
+			return nil, fmt.Errorf("litellm returned embedding for unknown input %d", item.Index)
+		}
+		embeddings[item.Index] = item.Embedding
+	}
+	return embeddings, nil
+}
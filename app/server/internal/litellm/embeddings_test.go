@@ -0,0 +1,101 @@
+package litellm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+type embeddingData struct {
+	Index     int       `json:"index"`
+	Embedding []float32 `json:"embedding"`
+}
+
+// serveEmbeddings starts a fake proxy embedding each numeric input as a
+// one-element vector holding its value, answering in reverse order. It
+// returns the client and the sizes of the batches received.
+func serveEmbeddings(t *testing.T) (*Client, *[]int) {
+	t.Helper()
+	var batches []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/embeddings" {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			Model string   `json:"model"`
+			Input []string `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Model != "embed-small" {
+			http.Error(w, `{"error":"bad request"}`, http.StatusBadRequest)
+			return
+		}
+		batches = append(batches, len(req.Input))
+
+		var result struct {
+			Data []embeddingData `json:"data"`
+		}
+		for i := len(req.Input) - 1; i >= 0; i-- {
+			value, _ := strconv.Atoi(req.Input[i])
+			result.Data = append(result.Data, embeddingData{Index: i, Embedding: []float32{float32(value)}})
+		}
+		json.NewEncoder(w).Encode(result)
+	}))
+	t.Cleanup(server.Close)
+	return newTestClient(server.URL), &batches
+}
+
+func TestCreateEmbeddingBatchesInOrder(t *testing.T) {
+	client, batches := serveEmbeddings(t)
+	input := make([]string, embeddingBatchSize+10)
+	for i := range input {
+		input[i] = strconv.Itoa(i)
+	}
+
+	embeddings, err := client.CreateEmbedding(context.Background(), input, "embed-small")
+	if err != nil {
+		t.Fatalf("create embedding: %v", err)
+	}
+	if len(embeddings) != len(input) {
+		t.Fatalf("got %d embeddings for %d inputs", len(embeddings), len(input))
+	}
+	for i, embedding := range embeddings {
+		if len(embedding) != 1 || embedding[0] != float32(i) {
+			t.Fatalf("embedding %d is %v, want [%d]", i, embedding, i)
+		}
+	}
+	if fmt.Sprint(*batches) != fmt.Sprint([]int{embeddingBatchSize, 10}) {
+		t.Errorf("batches %v, want [%d 10]", *batches, embeddingBatchSize)
+	}
+}
+
+func TestCreateEmbeddingErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		payload string
+	}{
+		{"api error", http.StatusBadRequest, `{"error":{"message":"unknown model"}}`},
+		{"too few embeddings", http.StatusOK, `{"data":[{"index":0,"embedding":[1]}]}`},
+		{"unknown index", http.StatusOK, `{"data":[{"index":0,"embedding":[1]},{"index":5,"embedding":[2]}]}`},
+		{"malformed", http.StatusOK, `{"data":`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.payload)
+			}))
+			defer server.Close()
+
+			embeddings, err := newTestClient(server.URL).CreateEmbedding(context.Background(), []string{"a", "b"}, "embed-small")
+			if err == nil {
+				t.Fatalf("got embeddings %v, want an error", embeddings)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package litellm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"botanic/internal/logging"
+)
+
+// CompletionResult is the outcome of a chat completion
+type CompletionResult struct {
+	Content string
+	// Model is the model that produced the completion, which differs from
+	// the requested model when a fallback answered
+	Model string
+	// Usage is nil when the proxy did not report token usage
+	Usage *Usage
+	// ToolCalls holds the calls the model requested instead of, or alongside,
+	// a text answer
+	ToolCalls []ToolCall
+}
+
+// parseFallbacks reads MODEL_FALLBACKS, a comma-separated list of
+// primary=fallback pairs such as "llama3:70b=llama3:8b,llama3:8b=mistral".
+func parseFallbacks(value string) map[string]string {
+	fallbacks := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		primary, fallback, ok := strings.Cut(pair, "=")
+		primary, fallback = strings.TrimSpace(primary), strings.TrimSpace(fallback)
+		if !ok || primary == "" || fallback == "" {
+			continue
+		}
+		fallbacks[primary] = fallback
+	}
+	return fallbacks
+}
+
+func loadFallbacks() map[string]string {
+	return parseFallbacks(os.Getenv("MODEL_FALLBACKS"))
+}
+
+// isModelError reports whether the proxy rejected the request because of the
+// model itself, as opposed to a network or server failure
+func isModelError(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.StatusCode == http.StatusNotFound {
+		return true
+	}
+	if apiErr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+
+	body := strings.ToLower(apiErr.Body)
+	for _, marker := range []string{"invalid model", "model not found", "does not exist", "not available", "unavailable"} {
+		if strings.Contains(body, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// Complete gets a chat completion, moving down the configured fallback chain
+// while the proxy reports the model as unavailable.
+func (c *Client) Complete(ctx context.Context, messages []ChatMessage, model string, opts CompletionOptions) (*CompletionResult, error) {
+	tried := make(map[string]bool)
+	for {
+		tried[model] = true
+
+		start := time.Now()
+		result, err := c.complete(ctx, messages, model, opts)
+		observeCompletion(model, start, err)
+		if err == nil {
+			return result, nil
+		}
+
+		fallback, ok := c.fallbacks[model]
+		if !ok || tried[fallback] || !isModelError(err) {
+			return nil, err
+		}
+
+		logging.FromContext(ctx).Warn("model unavailable, falling back", "model", model, "fallback", fallback, "error", err)
+		model = fallback
+	}
+}
@@ -0,0 +1,26 @@
+package litellm
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"botanic/internal/metrics"
+)
+
+var (
+	completionDuration = metrics.NewHistogramVec("ai_request_duration_seconds",
+		"Chat completion latency in seconds, by model.",
+		[]float64{.25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}, "model")
+	completionErrors = metrics.NewCounterVec("ai_request_errors_total",
+		"Failed chat completions, by model.", "model")
+)
+
+// observeCompletion records the duration and outcome of one completion
+// attempt. Cancelled requests are timed but not counted as errors.
+func observeCompletion(model string, start time.Time, err error) {
+	completionDuration.Observe(time.Since(start).Seconds(), model)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		completionErrors.Inc(model)
+	}
+}
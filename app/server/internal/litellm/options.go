@@ -0,0 +1,90 @@
+package litellm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// CompletionOptions tunes generation for a chat completion. Unset fields are
+// left out of the request so the proxy applies its own defaults.
+type CompletionOptions struct {
+	Temperature      *float64        `json:"temperature,omitempty"`
+	MaxTokens        int             `json:"max_tokens,omitempty"`
+	TopP             *float64        `json:"top_p,omitempty"`
+	Stop             []string        `json:"stop,omitempty"`
+	PresencePenalty  *float64        `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64        `json:"frequency_penalty,omitempty"`
+	Tools            []Tool          `json:"tools,omitempty"`
+	ToolChoice       json.RawMessage `json:"tool_choice,omitempty"`
+	// Timeout in seconds overrides the client's LITELLM_TIMEOUT for one
+	// call; LiteLLM also applies it to the upstream model request.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// maxTimeout caps per-call timeouts so a request cannot hold a connection
+// indefinitely.
+const maxTimeout = 600
+
+// Validate checks that the set options are within the ranges the
+// OpenAI-compatible API accepts.
+func (o CompletionOptions) Validate() error {
+	if o.Temperature != nil && (*o.Temperature < 0 || *o.Temperature > 2) {
+		return errors.New("temperature must be between 0 and 2")
+	}
+	if o.MaxTokens < 0 {
+		return errors.New("max_tokens must not be negative")
+	}
+	if o.TopP != nil && (*o.TopP < 0 || *o.TopP > 1) {
+		return errors.New("top_p must be between 0 and 1")
+	}
+	if len(o.Stop) > 4 {
+		return errors.New("at most 4 stop sequences are allowed")
+	}
+	if o.PresencePenalty != nil && (*o.PresencePenalty < -2 || *o.PresencePenalty > 2) {
+		return errors.New("presence_penalty must be between -2 and 2")
+	}
+	if o.FrequencyPenalty != nil && (*o.FrequencyPenalty < -2 || *o.FrequencyPenalty > 2) {
+		return errors.New("frequency_penalty must be between -2 and 2")
+	}
+	if o.Timeout < 0 || o.Timeout > maxTimeout {
+		return fmt.Errorf("timeout must be between 0 and %d seconds", maxTimeout)
+	}
+	return validateTools(o.Tools, o.ToolChoice)
+}
+
+// Merge returns a copy of o with every field set in override replacing its
+// counterpart.
+func (o CompletionOptions) Merge(override *CompletionOptions) CompletionOptions {
+	if override == nil {
+		return o
+	}
+	if override.Temperature != nil {
+		o.Temperature = override.Temperature
+	}
+	if override.MaxTokens != 0 {
+		o.MaxTokens = override.MaxTokens
+	}
+	if override.TopP != nil {
+		o.TopP = override.TopP
+	}
+	if len(override.Stop) > 0 {
+		o.Stop = override.Stop
+	}
+	if override.PresencePenalty != nil {
+		o.PresencePenalty = override.PresencePenalty
+	}
+	if override.FrequencyPenalty != nil {
+		o.FrequencyPenalty = override.FrequencyPenalty
+	}
+	if len(override.Tools) > 0 {
+		o.Tools = override.Tools
+	}
+	if len(override.ToolChoice) > 0 {
+		o.ToolChoice = override.ToolChoice
+	}
+	if override.Timeout != 0 {
+		o.Timeout = override.Timeout
+	}
+	return o
+}
@@ -0,0 +1,134 @@
+package litellm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"botanic/internal/logging"
+)
+
+const (
+	defaultMaxRetries = 3
+	defaultRetryBase  = 500 * time.Millisecond
+)
+
+// retryConfig reads the retry settings from the environment
+func retryConfig() (int, time.Duration) {
+	maxRetries := defaultMaxRetries
+	if value := os.Getenv("LITELLM_MAX_RETRIES"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed >= 0 {
+			maxRetries = parsed
+		}
+	}
+
+	retryBase := defaultRetryBase
+	if value := os.Getenv("LITELLM_RETRY_BASE_MS"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			retryBase = time.Duration(parsed) * time.Millisecond
+		}
+	}
+
+	return maxRetries, retryBase
+}
+
+// isRetryable reports whether a failed request is worth another attempt.
+// 5xx and 429 responses are transient; other 4xx responses are not. A
+// connection failure is retried only when the request cannot have reached
+// the proxy, unless the method is idempotent: a POST whose body was sent
+// may already be generating, and sending it again would pay for it twice.
+func isRetryable(method string, err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500 || apiErr.StatusCode == http.StatusTooManyRequests
+	}
+	var connErr *ConnectionError
+	if !errors.As(err, &connErr) {
+		return false
+	}
+	if method == http.MethodGet {
+		return true
+	}
+	return neverSent(connErr.Err)
+}
+
+// neverSent reports whether a request failed before reaching the server:
+// the connection was refused or could not be dialed. Timeouts never count,
+// as the request may have been sent before one fired.
+func neverSent(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// backoff returns the delay before the given retry attempt: exponential in
+// the attempt number with up to 50% random jitter
+func (c *Client) backoff(attempt int) time.Duration {
+	delay := c.retryBase << attempt
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// do sends a request to the proxy, retrying transient failures with
+// exponential backoff. Retries share the deadline of ctx and stop once the
+// next delay would outlast it. On success the caller must close the response
+// body.
+func (c *Client) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; attempt <= c.maxRetries; attempt++ {
+		if attempt > 0 {
+			delay := c.backoff(attempt - 1)
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+				break
+			}
+			logging.FromContext(ctx).Warn("retrying LiteLLM request", "method", method, "path", path, "delay", delay.String(), "attempt", attempt, "max_retries", c.maxRetries, "error", lastErr)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			// Check if the error is due to context cancellation
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = &ConnectionError{URL: c.baseURL, Err: err}
+		} else if resp.StatusCode != http.StatusOK {
+			respBody, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			lastErr = &APIError{URL: c.baseURL, StatusCode: resp.StatusCode, Status: resp.Status, Body: string(respBody)}
+		} else {
+			return resp, nil
+		}
+
+		if !isRetryable(method, lastErr) {
+			break
+		}
+	}
+
+	return nil, lastErr
+}
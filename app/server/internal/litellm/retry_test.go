@@ -0,0 +1,130 @@
+package litellm
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestClient(baseURL string) *Client {
+	return &Client{
+		baseURL:    baseURL,
+		httpClient: &http.Client{},
+		timeout:    5 * time.Second,
+		maxRetries: 3,
+		retryBase:  time.Millisecond,
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsRetryable(t *testing.T) {
+	refused := &ConnectionError{Err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}
+	dialTimeout := &ConnectionError{Err: &net.OpError{Op: "dial", Err: timeoutError{}}}
+	readTimeout := &ConnectionError{Err: &net.OpError{Op: "read", Err: timeoutError{}}}
+	reset := &ConnectionError{Err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}}
+
+	tests := []struct {
+		name   string
+		method string
+		err    error
+		want   bool
+	}{
+		{"refused POST", http.MethodPost, refused, true},
+		{"dial timeout POST", http.MethodPost, dialTimeout, false},
+		{"read timeout POST", http.MethodPost, readTimeout, false},
+		{"reset POST", http.MethodPost, reset, false},
+		{"read timeout GET", http.MethodGet, readTimeout, true},
+		{"server error", http.MethodPost, &APIError{StatusCode: http.StatusBadGateway}, true},
+		{"rate limited", http.MethodPost, &APIError{StatusCode: http.StatusTooManyRequests}, true},
+		{"bad request", http.MethodPost, &APIError{StatusCode: http.StatusBadRequest}, false},
+		{"other error", http.MethodGet, errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		if got := isRetryable(tt.method, tt.err); got != tt.want {
+			t.Errorf("%s: isRetryable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDoRetriesTransientResponses(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch calls.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+
+	resp, err := newTestClient(server.URL).do(context.Background(), http.MethodPost, "/v1/chat/completions", []byte("{}"))
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	resp.Body.Close()
+	if calls.Load() != 3 {
+		t.Fatalf("sent %d requests, want 3", calls.Load())
+	}
+}
+
+func TestDoDoesNotResendPostAfterTheBodyWasSent(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		// Drop the connection without answering, as a proxy that died
+		// mid-generation would
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer server.Close()
+
+	_, err := newTestClient(server.URL).do(context.Background(), http.MethodPost, "/v1/chat/completions", []byte("{}"))
+	var connErr *ConnectionError
+	if !errors.As(err, &connErr) {
+		t.Fatalf("do: got %v, want a ConnectionError", err)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("sent %d requests, want 1", calls.Load())
+	}
+}
+
+func TestDoStopsRetryingAtTheDeadline(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	client := newTestClient(server.URL)
+	client.retryBase = time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.do(ctx, http.MethodPost, "/v1/chat/completions", []byte("{}"))
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("do: got %v, want the 502", err)
+	}
+	if calls.Load() != 1 || time.Since(start) > 250*time.Millisecond {
+		t.Fatalf("sent %d requests in %s, want 1 without waiting", calls.Load(), time.Since(start))
+	}
+}
@@ -0,0 +1,139 @@
+package litellm
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"botanic/internal/logging"
+)
+
+// streamChunk is one server-sent event of a streamed chat completion
+type streamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+	// Usage is only sent in the final chunk, when requested
+	Usage *Usage `json:"usage"`
+}
+
+// Stream gets a chat completion as it is generated, calling onDelta, which
+// may be nil, with each piece of content. The result holds the content
+// received so far even when the stream ends early, for instance because ctx
+// was cancelled, in which case the error is also returned. Streamed tool calls
+// are not supported; use Complete when opts offers tools.
+func (c *Client) Stream(ctx context.Context, messages []ChatMessage, model string, opts CompletionOptions, onDelta func(delta string)) (*CompletionResult, error) {
+	tried := make(map[string]bool)
+	for {
+		tried[model] = true
+
+		start := time.Now()
+		result, err := c.stream(ctx, messages, model, opts, onDelta)
+		observeCompletion(model, start, err)
+		if err == nil {
+			return result, nil
+		}
+
+		// Once content has been delivered, the answer cannot move to
+		// another model
+		fallback, ok := c.fallbacks[model]
+		if result.Content != "" || !ok || tried[fallback] || !isModelError(err) {
+			return result, err
+		}
+
+		logging.FromContext(ctx).Warn("model unavailable, falling back", "model", model, "fallback", fallback, "error", err)
+		model = fallback
+	}
+}
+
+// stream requests a streamed chat completion from a single model. It always
+// returns a result, holding whatever content arrived before any error.
+func (c *Client) stream(ctx context.Context, messages []ChatMessage, model string, opts CompletionOptions, onDelta func(delta string)) (*CompletionResult, error) {
+	result := &CompletionResult{Model: model}
+
+	payload := struct {
+		Model    string        `json:"model"`
+		Messages []ChatMessage `json:"messages"`
+		CompletionOptions
+		Stream        bool `json:"stream"`
+		StreamOptions struct {
+			IncludeUsage bool `json:"include_usage"`
+		} `json:"stream_options"`
+	}{
+		Model:             model,
+		Messages:          messages,
+		CompletionOptions: opts,
+		Stream:            true,
+	}
+	payload.StreamOptions.IncludeUsage = true
+
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return result, fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	ctx, cancel := c.withTimeout(ctx, time.Duration(opts.Timeout)*time.Second)
+	defer cancel()
+
+	resp, err := c.do(ctx, "POST", "/v1/chat/completions", jsonData)
+	if err != nil {
+		if ctx.Err() == context.Canceled {
+			return result, ctx.Err()
+		}
+		logging.FromContext(ctx).Error("LiteLLM chat completion stream failed", "model", model, "error", err)
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	var content strings.Builder
+	finished := false
+	scanner := bufio.NewScanner(resp.Body)
+	// A single event may carry a long delta
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			finished = true
+			break
+		}
+
+		var chunk streamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			result.Content = content.String()
+			return result, fmt.Errorf("error decoding stream chunk: %w", err)
+		}
+		if chunk.Usage != nil {
+			result.Usage = chunk.Usage
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		delta := chunk.Choices[0].Delta.Content
+		content.WriteString(delta)
+		if onDelta != nil {
+			onDelta(delta)
+		}
+	}
+
+	result.Content = content.String()
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		return result, fmt.Errorf("error reading stream: %w", err)
+	}
+	// The body may end without an error when the request is cancelled
+	if !finished && ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	return result, nil
+}
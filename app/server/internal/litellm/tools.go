@@ -0,0 +1,55 @@
+package litellm
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Tool describes a function the model may call.
+type Tool struct {
+	Type     string             `json:"type"`
+	Function FunctionDefinition `json:"function"`
+}
+
+// FunctionDefinition describes a callable function and its JSON Schema
+// parameters.
+type FunctionDefinition struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// ToolCall is a function call requested by the model.
+type ToolCall struct {
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
+
+// FunctionCall holds the name and JSON-encoded arguments of a requested call.
+type FunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// validateTools checks tool definitions and the tool choice, which is either
+// a string such as "auto" or an object naming a function.
+func validateTools(tools []Tool, toolChoice json.RawMessage) error {
+	for _, tool := range tools {
+		if tool.Type != "function" {
+			return errors.New("tool type must be \"function\"")
+		}
+		if tool.Function.Name == "" {
+			return errors.New("tool function name is required")
+		}
+	}
+	if len(toolChoice) > 0 {
+		if len(tools) == 0 {
+			return errors.New("tool_choice requires tools")
+		}
+		if !json.Valid(toolChoice) {
+			return errors.New("tool_choice must be valid JSON")
+		}
+	}
+	return nil
+}
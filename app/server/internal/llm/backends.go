@@ -0,0 +1,58 @@
+package llm
+
+import (
+	"os"
+
+	"botanic/internal/litellm"
+	"botanic/internal/openrouter"
+)
+
+// Backends are the providers a chat session can choose between, by name
+type Backends struct {
+	providers   map[string]Provider
+	defaultName string
+}
+
+// NewBackends offers the LiteLLM backend, and the OpenRouter backend when it
+// is the default or OPENROUTER_API_KEY is set. The default backend is the
+// one selected by LLM_PROVIDER, as with NewProvider.
+func NewBackends(liteLLMClient *litellm.Client) *Backends {
+	defaultProvider := NewProvider(liteLLMClient)
+	b := &Backends{
+		providers: map[string]Provider{
+			liteLLMClient.Name():   liteLLMClient,
+			defaultProvider.Name(): defaultProvider,
+		},
+		defaultName: defaultProvider.Name(),
+	}
+	if _, ok := b.providers["openrouter"]; !ok && os.Getenv("OPENROUTER_API_KEY") != "" {
+		b.providers["openrouter"] = NewOpenRouterProvider(openrouter.NewClient())
+	}
+	return b
+}
+
+// Default returns the backend used when a session does not choose one
+func (b *Backends) Default() Provider {
+	return b.providers[b.defaultName]
+}
+
+// Get returns the backend named name, or the default backend if name is
+// empty. It reports false if no such backend is configured.
+func (b *Backends) Get(name string) (Provider, bool) {
+	if name == "" {
+		name = b.defaultName
+	}
+	provider, ok := b.providers[name]
+	return provider, ok
+}
+
+// Names returns the names of the configured backends, the default first
+func (b *Backends) Names() []string {
+	names := []string{b.defaultName}
+	for _, name := range []string{"litellm", "openrouter"} {
+		if _, ok := b.providers[name]; ok && name != b.defaultName {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,71 @@
+package llm
+
+import (
+	"context"
+
+	"botanic/internal/litellm"
+	"botanic/internal/openrouter"
+)
+
+// defaultTemperature is sent to OpenRouter when the options leave it unset
+const defaultTemperature = 0.7
+
+// OpenRouterProvider adapts the OpenRouter client to the Provider interface.
+// OpenRouter requests carry the messages' text and the temperature only, so its
+// models report no capabilities.
+type OpenRouterProvider struct {
+	client *openrouter.Client
+}
+
+// NewOpenRouterProvider wraps an OpenRouter client
+func NewOpenRouterProvider(client *openrouter.Client) *OpenRouterProvider {
+	return &OpenRouterProvider{client: client}
+}
+
+func (p *OpenRouterProvider) Name() string {
+	return "openrouter"
+}
+
+func (p *OpenRouterProvider) Complete(ctx context.Context, messages []litellm.ChatMessage, model string, opts litellm.CompletionOptions) (*litellm.CompletionResult, error) {
+	chatMessages := make([]openrouter.ChatMessage, len(messages))
+	for i, message := range messages {
+		chatMessages[i] = openrouter.ChatMessage{Role: message.Role, Content: message.Content}
+	}
+
+	temperature := defaultTemperature
+	if opts.Temperature != nil {
+		temperature = *opts.Temperature
+	}
+
+	content, err := p.client.GetChatCompletion(ctx, chatMessages, model, temperature)
+	if err != nil {
+		return nil, err
+	}
+	return &litellm.CompletionResult{Content: content, Model: model}, nil
+}
+
+func (p *OpenRouterProvider) GetAvailableModels() ([]litellm.Model, error) {
+	models, err := p.client.GetAvailableModels()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]litellm.Model, len(models))
+	for i, m := range models {
+		result[i] = litellm.Model{
+			ID:            m.ID,
+			Name:          m.Name,
+			ContextLength: m.ContextLength,
+			Pricing: litellm.Pricing{
+				Prompt:     m.Pricing.Prompt,
+				Completion: m.Pricing.Completion,
+			},
+			Description: m.Description,
+		}
+	}
+	return result, nil
+}
+
+func (p *OpenRouterProvider) HealthCheck(ctx context.Context) error {
+	return p.client.HealthCheck(ctx)
+}
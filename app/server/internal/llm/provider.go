@@ -0,0 +1,40 @@
+package llm
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"botanic/internal/litellm"
+	"botanic/internal/openrouter"
+)
+
+// Provider is a chat completion backend. The LiteLLM client implements it
+// directly; OpenRouter is adapted to it.
+type Provider interface {
+	// Name identifies the provider in logs and health reports
+	Name() string
+	Complete(ctx context.Context, messages []litellm.ChatMessage, model string, opts litellm.CompletionOptions) (*litellm.CompletionResult, error)
+	GetAvailableModels() ([]litellm.Model, error)
+	HealthCheck(ctx context.Context) error
+}
+
+// Streamer is implemented by providers that can stream completions. The
+// result holds the content received so far even when an error is returned.
+type Streamer interface {
+	Stream(ctx context.Context, messages []litellm.ChatMessage, model string, opts litellm.CompletionOptions, onDelta func(delta string)) (*litellm.CompletionResult, error)
+}
+
+// NewProvider selects the provider named by LLM_PROVIDER ("litellm" or
+// "openrouter"), defaulting to the given LiteLLM client.
+func NewProvider(liteLLMClient *litellm.Client) Provider {
+	switch name := os.Getenv("LLM_PROVIDER"); name {
+	case "openrouter":
+		return NewOpenRouterProvider(openrouter.NewClient())
+	case "", "litellm":
+		return liteLLMClient
+	default:
+		slog.Warn("unknown LLM_PROVIDER, using litellm", "provider", name)
+		return liteLLMClient
+	}
+}
@@ -0,0 +1,93 @@
+// Package logging configures structured JSON logging and carries a
+// request-scoped logger through contexts.
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type contextKey struct{}
+
+// Init makes a JSON logger at LOG_LEVEL (debug, info, warn or error; default
+// info) the default, including for the standard log package
+func Init() {
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level()})
+	slog.SetDefault(slog.New(handler))
+}
+
+func level() slog.Level {
+	switch strings.ToLower(os.Getenv("LOG_LEVEL")) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+// WithLogger returns a copy of ctx carrying logger
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Middleware attaches a logger tagged with the request ID to each request's
+// context and logs the request once it completes. It must run after Echo's
+// RequestID middleware.
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			logger := slog.Default().With("request_id", c.Response().Header().Get(echo.HeaderXRequestID))
+			c.SetRequest(req.WithContext(WithLogger(req.Context(), logger)))
+
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				// Let Echo write the error response so the status is final
+				c.Error(err)
+			}
+
+			logger.Info("request",
+				"method", req.Method,
+				"route", c.Path(),
+				"uri", redactURI(req.RequestURI),
+				"status", c.Response().Status,
+				"latency_ms", time.Since(start).Milliseconds(),
+				"remote_ip", c.RealIP(),
+			)
+			return nil
+		}
+	}
+}
+
+// redactURI hides the access token that websocket clients may still pass as
+// a query parameter
+func redactURI(uri string) string {
+	path, rawQuery, ok := strings.Cut(uri, "?")
+	if !ok {
+		return uri
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil || !query.Has("token") {
+		return uri
+	}
+	query.Set("token", "REDACTED")
+	return path + "?" + query.Encode()
+}
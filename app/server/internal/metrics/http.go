@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	httpRequests = NewCounterVec("http_requests_total",
+		"HTTP requests handled, by method, route and status.", "method", "route", "status")
+	httpDuration = NewHistogramVec("http_request_duration_seconds",
+		"HTTP request latency in seconds, by method and route.", nil, "method", "route")
+)
+
+// Middleware counts and times each request by its route pattern
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+
+			status := c.Response().Status
+			if err != nil {
+				// The error handler has not written the response yet
+				var httpErr *echo.HTTPError
+				if errors.As(err, &httpErr) {
+					status = httpErr.Code
+				} else {
+					status = http.StatusInternalServerError
+				}
+			}
+
+			// Unmatched requests share one label so paths cannot blow up cardinality
+			route := c.Path()
+			if route == "" {
+				route = "unmatched"
+			}
+
+			method := c.Request().Method
+			httpRequests.Inc(method, route, strconv.Itoa(status))
+			httpDuration.Observe(time.Since(start).Seconds(), method, route)
+			return err
+		}
+	}
+}
+
+// Handler serves the registered metrics in the Prometheus text format
+func Handler(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	c.Response().WriteHeader(http.StatusOK)
+	WriteAll(c.Response())
+	return nil
+}
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// scrape returns everything WriteAll writes
+func scrape() string {
+	var b strings.Builder
+	WriteAll(&b)
+	return b.String()
+}
+
+// assertLines fails unless every line appears in the scraped output
+func assertLines(t *testing.T, output string, lines ...string) {
+	t.Helper()
+	have := make(map[string]bool)
+	for _, line := range strings.Split(output, "\n") {
+		have[line] = true
+	}
+	for _, line := range lines {
+		if !have[line] {
+			t.Errorf("missing %q in:\n%s", line, output)
+		}
+	}
+}
+
+func TestHistogramBucketsAreCumulative(t *testing.T) {
+	h := NewHistogramVec("test_latency_seconds", "Test latency.", []float64{0.1, 1}, "op")
+	h.Observe(0.05, "read")
+	h.Observe(0.5, "read")
+	h.Observe(0.5, "read")
+	h.Observe(3, "read")
+
+	assertLines(t, scrape(),
+		"# HELP test_latency_seconds Test latency.",
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{op="read",le="0.1"} 1`,
+		`test_latency_seconds_bucket{op="read",le="1"} 3`,
+		`test_latency_seconds_bucket{op="read",le="+Inf"} 4`,
+		`test_latency_seconds_sum{op="read"} 4.05`,
+		`test_latency_seconds_count{op="read"} 4`,
+	)
+}
+
+func TestCounterEscapesLabelValues(t *testing.T) {
+	c := NewCounterVec("test_events_total", "Test events.", "name")
+	c.Inc(`say "hi"`)
+	c.Inc(`C:\path`)
+	c.Inc("two\nlines")
+	c.Inc("two\nlines")
+
+	assertLines(t, scrape(),
+		"# TYPE test_events_total counter",
+		`test_events_total{name="say \"hi\""} 1`,
+		`test_events_total{name="C:\\path"} 1`,
+		`test_events_total{name="two\nlines"} 2`,
+	)
+}
+
+func TestGaugeFuncIsReadOnScrape(t *testing.T) {
+	value := 1.0
+	NewGaugeFunc("test_queue_depth", "Test queue depth.", func() float64 { return value })
+	value = 7
+
+	assertLines(t, scrape(), "# TYPE test_queue_depth gauge", "test_queue_depth 7")
+}
+
+func TestMiddlewareLabelsRequestsByRoute(t *testing.T) {
+	e := echo.New()
+	e.Use(Middleware())
+	e.GET("/test/sessions/:id", func(c echo.Context) error {
+		return c.NoContent(http.StatusNoContent)
+	})
+	e.GET("/test/fail", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "down")
+	})
+
+	for _, path := range []string{"/test/sessions/1", "/test/sessions/2", "/test/fail", "/test/unknown/path"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	output := scrape()
+	assertLines(t, output,
+		`http_requests_total{method="GET",route="/test/sessions/:id",status="204"} 2`,
+		`http_requests_total{method="GET",route="/test/fail",status="503"} 1`,
+		`http_request_duration_seconds_count{method="GET",route="/test/sessions/:id"} 2`,
+		`http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+	)
+	if strings.Contains(output, "/test/sessions/1") || strings.Contains(output, "/test/unknown/path") {
+		t.Errorf("request path leaked into the labels:\n%s", output)
+	}
+}
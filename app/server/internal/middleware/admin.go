@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"botanic/internal/auth"
+	"botanic/internal/models"
+
+	"github.com/labstack/echo/v4"
+)
+
+// AdminAuth middleware allows only administrators through: users flagged as
+// admins, or whose email is listed in the comma-separated ADMIN_EMAILS. It
+// must run after Auth.
+func AdminAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := auth.UserID(c)
+		if err != nil {
+			return err
+		}
+
+		user, err := models.GetUserByIDCtx(c.Request().Context(), userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusForbidden, "admin access required")
+		}
+		if !user.IsAdmin && !slices.Contains(adminEmails(), strings.ToLower(user.Email)) {
+			return echo.NewHTTPError(http.StatusForbidden, "admin access required")
+		}
+
+		return next(c)
+	}
+}
+
+// adminEmails returns the lowercased emails in ADMIN_EMAILS
+func adminEmails() []string {
+	var emails []string
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if email = strings.ToLower(strings.TrimSpace(email)); email != "" {
+			emails = append(emails, email)
+		}
+	}
+	return emails
+}
@@ -12,26 +12,46 @@ import (
 // Auth middleware checks for a valid JWT token in the Authorization header
 func Auth(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		authHeader := c.Request().Header.Get("Authorization")
-		if authHeader == "" {
-			return echo.NewHTTPError(http.StatusUnauthorized, "missing authorization header")
+		if err := authenticate(c); err != nil {
+			return err
 		}
+		return next(c)
+	}
+}
 
-		// Check if the header has the Bearer prefix
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			return echo.NewHTTPError(http.StatusUnauthorized, "invalid authorization header format")
-		}
+// OptionalAuth middleware authenticates requests that carry a valid token,
+// like Auth, and lets the rest through anonymously. Handlers tell them apart
+// with auth.UserID.
+func OptionalAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		authenticate(c)
+		return next(c)
+	}
+}
 
-		// Verify the token
-		userID, err := auth.VerifyToken(parts[1])
-		if err != nil {
-			return echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
-		}
+// authenticate verifies the bearer token of a request and stores its user in
+// the context
+func authenticate(c echo.Context) error {
+	authHeader := c.Request().Header.Get("Authorization")
+	if authHeader == "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, "missing authorization header")
+	}
 
-		// Set the user ID in the context
-		c.Set("userID", userID)
+	// Check if the header has the Bearer prefix
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid authorization header format")
+	}
 
-		return next(c)
+	// Verify the token
+	claims, err := auth.ValidateToken(parts[1])
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
 	}
+
+	// Set the user's ID and email in the context. Tokens issued before the
+	// email was added to them carry none.
+	c.Set(auth.UserIDKey, claims.UserID)
+	c.Set(auth.EmailKey, claims.Email)
+	return nil
 }
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"botanic/internal/auth"
+
+	"github.com/labstack/echo/v4"
+)
+
+// initTestAuth configures token signing and returns a token for user-1
+func initTestAuth(t *testing.T) string {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "test-secret")
+	t.Setenv("JWT_DURATION", "")
+	t.Setenv("JWT_REMEMBER_DURATION", "")
+	t.Setenv("JWT_ISSUER", "")
+	t.Setenv("JWT_AUDIENCE", "")
+	t.Setenv("SMTP_HOST", "")
+	if err := auth.Initialize(); err != nil {
+		t.Fatalf("initialize auth: %v", err)
+	}
+	token, err := auth.GenerateToken("user-1", "owner@example.com")
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	return token
+}
+
+// serveAuthenticated requests a route behind middleware with the given
+// Authorization header, returning the response and the user the handler saw
+func serveAuthenticated(t *testing.T, middleware echo.MiddlewareFunc, authorization string) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	var userID string
+	e := echo.New()
+	e.GET("/", func(c echo.Context) error {
+		userID, _ = auth.UserID(c)
+		return c.NoContent(http.StatusOK)
+	}, middleware)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec, userID
+}
+
+func TestUserIDIsSetByEitherMiddleware(t *testing.T) {
+	token := initTestAuth(t)
+
+	for name, middleware := range map[string]echo.MiddlewareFunc{"Auth": Auth, "OptionalAuth": OptionalAuth} {
+		rec, userID := serveAuthenticated(t, middleware, "Bearer "+token)
+		if rec.Code != http.StatusOK || userID != "user-1" {
+			t.Errorf("%s: %d, user %q, want 200 and user-1", name, rec.Code, userID)
+		}
+	}
+}
+
+func TestAuthRejectsMissingAndInvalidTokens(t *testing.T) {
+	token := initTestAuth(t)
+
+	for _, authorization := range []string{"", "Bearer not-a-token", "Basic " + token, token} {
+		if rec, _ := serveAuthenticated(t, Auth, authorization); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%q: %d, want 401", authorization, rec.Code)
+		}
+	}
+}
+
+func TestOptionalAuthLetsAnonymousRequestsThrough(t *testing.T) {
+	initTestAuth(t)
+
+	for _, authorization := range []string{"", "Bearer not-a-token"} {
+		rec, userID := serveAuthenticated(t, OptionalAuth, authorization)
+		if rec.Code != http.StatusOK || userID != "" {
+			t.Errorf("%q: %d, user %q, want 200 and no user", authorization, rec.Code, userID)
+		}
+	}
+}
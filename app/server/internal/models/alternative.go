@@ -0,0 +1,100 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"botanic/internal/db"
+
+	"github.com/google/uuid"
+)
+
+// AlternativePrefix is the key prefix for a message's alternatives list
+const AlternativePrefix = MessagePrefix + "alternatives:"
+
+var (
+	ErrTooManyAlternatives = errors.New("maximum number of alternatives reached")
+	ErrAlternativeNotFound = errors.New("alternative not found")
+)
+
+// Alternative represents an alternative response to a message
+type Alternative struct {
+	ID        string    `json:"id"`
+	MessageID string    `json:"message_id"`
+	Content   string    `json:"content"`
+	Model     string    `json:"model"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AddMessageAlternative appends an alternative to a message, refusing to grow
+// the list past max entries. The alternative is pushed before the list is
+// measured, so concurrent additions cannot both take the last place.
+func AddMessageAlternative(messageID string, content string, model string, max int) (*Alternative, error) {
+	alternativesKey := AlternativePrefix + messageID
+	alternative := &Alternative{
+		ID:        uuid.New().String(),
+		MessageID: messageID,
+		Content:   content,
+		Model:     model,
+		CreatedAt: time.Now(),
+	}
+	data, err := json.Marshal(alternative)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := db.RPush(alternativesKey, json.RawMessage(data))
+	if err != nil {
+		return nil, err
+	}
+	if count > int64(max) {
+		// Take back this alternative, which may no longer be the last one
+		if err := db.LRem(alternativesKey, -1, string(data)); err != nil {
+			return nil, err
+		}
+		return nil, ErrTooManyAlternatives
+	}
+
+	return alternative, nil
+}
+
+// GetMessageAlternatives retrieves all alternatives for a message
+func GetMessageAlternatives(messageID string) ([]*Alternative, error) {
+	vals, err := db.LRange(AlternativePrefix+messageID, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	alternatives := make([]*Alternative, 0, len(vals))
+	for _, val := range vals {
+		var alternative Alternative
+		if err := json.Unmarshal([]byte(val), &alternative); err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, &alternative)
+	}
+
+	return alternatives, nil
+}
+
+// DeleteMessageAlternative removes a single alternative from a message
+func DeleteMessageAlternative(messageID string, alternativeID string) error {
+	alternativesKey := AlternativePrefix + messageID
+	vals, err := db.LRange(alternativesKey, 0, -1)
+	if err != nil {
+		return err
+	}
+
+	for _, val := range vals {
+		var alternative Alternative
+		if err := json.Unmarshal([]byte(val), &alternative); err != nil {
+			continue
+		}
+		if alternative.ID == alternativeID {
+			return db.LRem(alternativesKey, 1, val)
+		}
+	}
+
+	return ErrAlternativeNotFound
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"botanic/internal/db/dbtest"
+)
+
+func TestAddMessageAlternativeCap(t *testing.T) {
+	dbtest.Setup(t)
+
+	for i := range 3 {
+		if _, err := AddMessageAlternative("message-1", "answer", "openai/gpt-4o", 3); err != nil {
+			t.Fatalf("add alternative %d: %v", i+1, err)
+		}
+	}
+	if _, err := AddMessageAlternative("message-1", "answer", "openai/gpt-4o", 3); !errors.Is(err, ErrTooManyAlternatives) {
+		t.Fatalf("add over the cap: got %v, want ErrTooManyAlternatives", err)
+	}
+
+	alternatives, err := GetMessageAlternatives("message-1")
+	if err != nil {
+		t.Fatalf("get alternatives: %v", err)
+	}
+	if len(alternatives) != 3 {
+		t.Fatalf("message has %d alternatives, want 3", len(alternatives))
+	}
+}
+
+func TestAddMessageAlternativeCapUnderConcurrency(t *testing.T) {
+	dbtest.Setup(t)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	added := 0
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := AddMessageAlternative("message-1", "answer", "openai/gpt-4o", 5); err == nil {
+				mu.Lock()
+				added++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	alternatives, err := GetMessageAlternatives("message-1")
+	if err != nil {
+		t.Fatalf("get alternatives: %v", err)
+	}
+	if len(alternatives) != 5 || added != 5 {
+		t.Fatalf("stored %d alternatives and reported %d added, want 5", len(alternatives), added)
+	}
+}
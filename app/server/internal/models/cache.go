@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"botanic/internal/db"
+)
+
+// CompletionCachePrefix is the key prefix for cached completions
+const CompletionCachePrefix = "completion_cache:"
+
+// GetCachedCompletion retrieves a cached completion by its hash
+func GetCachedCompletion(hash string) (string, error) {
+	return db.GetT[string](CompletionCachePrefix + hash)
+}
+
+// SetCachedCompletion stores a completion under its hash for the given TTL
+func SetCachedCompletion(hash string, content string, ttl time.Duration) error {
+	return db.SetT(CompletionCachePrefix+hash, content, ttl)
+}
@@ -1,11 +1,20 @@
 package models
 
 import (
+	"context"
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"botanic/internal/db"
+	"botanic/internal/litellm"
+	"botanic/internal/tokenizer"
 
 	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
 )
 
 // Key prefixes for Redis
@@ -20,66 +29,261 @@ type ChatSession struct {
 	UserID    string    `json:"user_id"`
 	Title     string    `json:"title"`
 	Model     string    `json:"model"`
+	Tags      []string  `json:"tags,omitempty"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	// DeletedAt marks a session deleted but still recoverable until the
+	// recovery window has passed
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Summary condenses the messages up to the SummaryThrough score, for
+	// sessions too long to send in full
+	Summary        string  `json:"summary,omitempty"`
+	SummaryThrough float64 `json:"summary_through,omitempty"`
+	SessionSettings
+}
+
+// SessionSettings holds the optional generation settings of a chat session
+type SessionSettings struct {
+	// Backend names the LLM backend the session's completions use, empty
+	// for the server's default
+	Backend          string `json:"backend,omitempty"`
+	CacheCompletions bool   `json:"cache_completions"`
+	SystemPrompt     string `json:"system_prompt,omitempty"`
+	litellm.CompletionOptions
 }
 
 // Message represents a chat message
 type Message struct {
-	ID        string    `json:"id"`
-	SessionID string    `json:"session_id"`
-	Role      string    `json:"role"`
-	Content   string    `json:"content"`
-	CreatedAt time.Time `json:"created_at"`
+	ID         string    `json:"id"`
+	SessionID  string    `json:"session_id"`
+	Role       string    `json:"role"`
+	Content    string    `json:"content"`
+	TokenCount int       `json:"token_count"`
+	CreatedAt  time.Time `json:"created_at"`
+	// Usage is the token usage reported by the model for an assistant message
+	Usage *litellm.Usage `json:"usage,omitempty"`
+	// Partial marks an assistant message cut short by a stop
+	Partial bool `json:"partial,omitempty"`
 }
 
+// ErrTooManySessions is returned when creating a session would exceed
+// MaxSessionsPerUser and the limit policy is to reject
+var ErrTooManySessions = errors.New("maximum number of sessions reached")
+
 // NewChatSession creates a new chat session
-func NewChatSession(userID string, title string, model string) *ChatSession {
+func NewChatSession(userID string, title string, model string, settings SessionSettings) *ChatSession {
 	now := time.Now()
 	return &ChatSession{
-		ID:        uuid.New().String(),
-		UserID:    userID,
-		Title:     title,
-		Model:     model,
-		CreatedAt: now,
-		UpdatedAt: now,
+		ID:              uuid.New().String(),
+		UserID:          userID,
+		Title:           title,
+		Model:           model,
+		SessionSettings: settings,
+		CreatedAt:       now,
+		UpdatedAt:       now,
 	}
 }
 
 // NewMessage creates a new message
 func NewMessage(sessionID string, role string, content string) *Message {
 	return &Message{
-		ID:        uuid.New().String(),
-		SessionID: sessionID,
-		Role:      role,
-		Content:   content,
-		CreatedAt: time.Now(),
+		ID:         uuid.New().String(),
+		SessionID:  sessionID,
+		Role:       role,
+		Content:    content,
+		TokenCount: tokenizer.Count(content),
+		CreatedAt:  time.Now(),
 	}
 }
 
-// CreateChatSession creates a new chat session
-func CreateChatSession(userID string, title string, model string) (*ChatSession, error) {
-	session := NewChatSession(userID, title, model)
+// CreateChatSession creates a new chat session, enforcing the user's session
+// limit
+func CreateChatSession(userID string, title string, model string, settings SessionSettings) (*ChatSession, error) {
+	session := NewChatSession(userID, title, model, settings)
 
-	// Store session data
-	sessionKey := ChatPrefix + session.ID
-	if err := db.Set(sessionKey, session, 0); err != nil {
+	// Store session data, add it to the user's sessions and count them
+	// atomically, so concurrent creates cannot both see room for one more
+	var count *redis.IntCmd
+	err := db.Tx(func(p *db.Pipeliner) error {
+		if err := p.Set(ChatPrefix+session.ID, session, SessionTTL()); err != nil {
+			return err
+		}
+		p.ZAdd(userSessionsKey(userID), activityScore(session), session.ID)
+		count = p.ZCard(userSessionsKey(userID))
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	// Add session to user's sessions
-	userSessionsKey := ChatPrefix + "user:" + userID
-	if err := db.ZAdd(userSessionsKey, float64(session.CreatedAt.Unix()), session.ID); err != nil {
+	if limit := MaxSessionsPerUser(); limit > 0 && count.Val() > int64(limit) {
+		if err := enforceSessionLimit(session, limit); err != nil {
+			return nil, err
+		}
+	}
+
+	return session, nil
+}
+
+// enforceSessionLimit brings the user of a session that was just added over
+// MaxSessionsPerUser back to the limit. The new session is removed again and
+// ErrTooManySessions returned, or when EvictOldestSessions is set the least
+// recently active sessions are deleted instead. Soft-deleted sessions do not
+// count.
+func enforceSessionLimit(session *ChatSession, limit int) error {
+	key := userSessionsKey(session.UserID)
+	if !EvictOldestSessions() {
+		err := db.Tx(func(p *db.Pipeliner) error {
+			p.ZRem(key, session.ID)
+			p.Delete(ChatPrefix + session.ID)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return ErrTooManySessions
+	}
+
+	// Count again, since concurrent creates may have evicted sessions already
+	count, err := db.ZCard(key)
+	if err != nil {
+		return err
+	}
+	if count <= int64(limit) {
+		return nil
+	}
+	oldest, err := db.ZRange(key, 0, count-int64(limit)-1)
+	if err != nil {
+		return err
+	}
+	for _, sessionID := range oldest {
+		if sessionID == session.ID {
+			continue
+		}
+		err := DeleteChatSession(sessionID)
+		if errors.Is(err, ErrNotFound) {
+			// Expired but not yet swept, so only the index entry is left
+			err = db.ZRem(key, sessionID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// userSessionsKey returns the key of the sorted set indexing a user's
+// sessions by last activity
+func userSessionsKey(userID string) string {
+	return ChatPrefix + "user:" + userID
+}
+
+// deletedSessionsKey returns the key of the sorted set indexing a user's
+// soft-deleted sessions by deletion time
+func deletedSessionsKey(userID string) string {
+	return ChatPrefix + "deleted:" + userID
+}
+
+// activityScore returns the score of a session in its user's index: its
+// last activity in seconds, as sessions indexed by creation time were scored
+func activityScore(s *ChatSession) float64 {
+	return float64(s.UpdatedAt.UnixMilli()) / 1000
+}
+
+// TouchChatSession marks a session as active now, moving it to the top of
+// its user's session list. The session is rewritten only if it is unchanged
+// since it was read, so tags, summaries or deletion saved meanwhile are kept.
+func TouchChatSession(sessionID string) error {
+	return db.WatchTx(func(p *db.Pipeliner) error {
+		// Read without refreshing the TTL, which would count as a change
+		session, err := loadChatSession(context.Background(), sessionID)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil || session.DeletedAt != nil {
+			return err
+		}
+		session.UpdatedAt = time.Now()
+
+		if err := p.Set(ChatPrefix+session.ID, session, SessionTTL()); err != nil {
+			return err
+		}
+		p.ZAdd(userSessionsKey(session.UserID), activityScore(session), session.ID)
+		return nil
+	}, ChatPrefix+sessionID)
+}
+
+// DuplicateChatSession copies a chat session and all of its messages into a
+// new session owned by newUserID. Messages get fresh IDs but keep their
+// timestamps so their order is preserved.
+func DuplicateChatSession(sessionID string, newUserID string) (*ChatSession, error) {
+	original, err := GetChatSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if original == nil {
+		return nil, ErrNotFound
+	}
+
+	messages, err := GetSessionMessages(sessionID)
+	if err != nil {
 		return nil, err
 	}
 
+	session, err := CreateChatSession(newUserID, original.Title+" (copy)", original.Model, original.SessionSettings)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, source := range messages {
+		message := NewMessage(session.ID, source.Role, source.Content)
+		message.CreatedAt = source.CreatedAt
+		if err := StoreMessage(message); err != nil {
+			return nil, err
+		}
+	}
+
 	return session, nil
 }
 
-// GetUserSessions retrieves all chat sessions for a user
+// GetUserSessions retrieves all chat sessions for a user, most recently
+// active first
 func GetUserSessions(userID string) ([]*ChatSession, error) {
-	userSessionsKey := ChatPrefix + "user:" + userID
-	sessionIDs, err := db.ZRange(userSessionsKey, 0, -1)
+	return GetUserSessionsCtx(context.Background(), userID)
+}
+
+// GetUserSessionsCtx is like GetUserSessions but honors the cancellation and deadline of ctx
+func GetUserSessionsCtx(ctx context.Context, userID string) ([]*ChatSession, error) {
+	sessionIDs, err := db.ZRevRangeCtx(ctx, userSessionsKey(userID), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*ChatSession
+	for _, sessionID := range sessionIDs {
+		var session ChatSession
+		sessionKey := ChatPrefix + sessionID
+		if err := db.GetCtx(ctx, sessionKey, &session); err != nil {
+			// Expired sessions stay indexed until the sweeper runs
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+
+	return sessions, nil
+}
+
+// GetUserSessionsByTag retrieves the chat sessions of a user carrying a tag
+func GetUserSessionsByTag(userID string, tag string) ([]*ChatSession, error) {
+	tags := NormalizeTags([]string{tag})
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	sessionIDs, err := db.ZRange(tagIndexKey(userID, tags[0]), 0, -1)
 	if err != nil {
 		return nil, err
 	}
@@ -89,6 +293,9 @@ func GetUserSessions(userID string) ([]*ChatSession, error) {
 		var session ChatSession
 		sessionKey := ChatPrefix + sessionID
 		if err := db.Get(sessionKey, &session); err != nil {
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
 			return nil, err
 		}
 		sessions = append(sessions, &session)
@@ -97,23 +304,214 @@ func GetUserSessions(userID string) ([]*ChatSession, error) {
 	return sessions, nil
 }
 
-// GetChatSession retrieves a chat session by ID
+// tagIndexKey returns the key of the sorted set indexing a user's sessions by tag
+func tagIndexKey(userID string, tag string) string {
+	return ChatPrefix + "tag:" + userID + ":" + tag
+}
+
+// NormalizeTags lowercases and trims tags, dropping empty and duplicate ones
+func NormalizeTags(tags []string) []string {
+	seen := make(map[string]bool)
+	var normalized []string
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// SetTags replaces the session's tags and updates the tag indexes. Only the
+// tags of the stored session change, so a touch or deletion saved since s was
+// read is kept; a session deleted meanwhile is ErrNotFound.
+func (s *ChatSession) SetTags(tags []string) error {
+	tags = NormalizeTags(tags)
+
+	var updated *ChatSession
+	err := db.WatchTx(func(p *db.Pipeliner) error {
+		// Read without refreshing the TTL, which would count as a change
+		session, err := loadChatSession(context.Background(), s.ID)
+		if err != nil {
+			return err
+		}
+		if session.DeletedAt != nil {
+			return ErrNotFound
+		}
+
+		for _, tag := range session.Tags {
+			p.ZRem(tagIndexKey(session.UserID, tag), session.ID)
+		}
+		for _, tag := range tags {
+			p.ZAdd(tagIndexKey(session.UserID, tag), float64(session.CreatedAt.Unix()), session.ID)
+		}
+		session.Tags = tags
+		session.UpdatedAt = time.Now()
+		updated = session
+		return p.Set(ChatPrefix+session.ID, session, SessionTTL())
+	}, ChatPrefix+s.ID)
+	if err != nil {
+		return err
+	}
+
+	*s = *updated
+	return nil
+}
+
+// SetSummary replaces the session's summary, which now covers the messages
+// scored up to through. Only the summary of the stored session changes, so
+// tags, activity or deletion saved while it was written are kept. Deleted
+// sessions, and summaries already covering more messages, are left alone.
+func (s *ChatSession) SetSummary(summary string, through float64) error {
+	s.Summary = summary
+	s.SummaryThrough = through
+
+	return db.WatchTx(func(p *db.Pipeliner) error {
+		// Read without refreshing the TTL, which would count as a change
+		session, err := loadChatSession(context.Background(), s.ID)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil || session.DeletedAt != nil || session.SummaryThrough >= through {
+			return err
+		}
+		session.Summary = summary
+		session.SummaryThrough = through
+		return p.Set(ChatPrefix+session.ID, session, SessionTTL())
+	}, ChatPrefix+s.ID)
+}
+
+// GetChatSession retrieves a chat session by ID. It returns a nil session
+// and nil error if there is no such session or it was deleted.
 func GetChatSession(sessionID string) (*ChatSession, error) {
-	var session ChatSession
-	sessionKey := ChatPrefix + sessionID
-	if err := db.Get(sessionKey, &session); err != nil {
+	return GetChatSessionCtx(context.Background(), sessionID)
+}
+
+// GetChatSessionCtx is like GetChatSession but honors the cancellation and deadline of ctx
+func GetChatSessionCtx(ctx context.Context, sessionID string) (*ChatSession, error) {
+	session, err := loadChatSession(ctx, sessionID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
 		return nil, err
 	}
+	if session.DeletedAt != nil {
+		return nil, nil
+	}
+	refreshTTL(ctx, ChatPrefix+sessionID, SessionTTL())
+
+	return session, nil
+}
 
+// GetDeletedChatSessionCtx retrieves a soft-deleted chat session by ID.
+// Sessions that are not deleted are ErrNotFound.
+func GetDeletedChatSessionCtx(ctx context.Context, sessionID string) (*ChatSession, error) {
+	session, err := loadChatSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session.DeletedAt == nil {
+		return nil, ErrNotFound
+	}
+	return session, nil
+}
+
+// loadChatSession reads a chat session whether or not it is deleted
+func loadChatSession(ctx context.Context, sessionID string) (*ChatSession, error) {
+	session, err := db.GetTCtx[ChatSession](ctx, ChatPrefix+sessionID)
+	if err != nil {
+		return nil, lookupError(err)
+	}
 	return &session, nil
 }
 
-// DeleteChatSession deletes a chat session and its messages
-func DeleteChatSession(sessionID string) error {
+// GetDeletedUserSessions retrieves a user's soft-deleted chat sessions, most
+// recently deleted first
+func GetDeletedUserSessions(ctx context.Context, userID string) ([]*ChatSession, error) {
+	sessionIDs, err := db.ZRevRangeCtx(ctx, deletedSessionsKey(userID), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*ChatSession
+	for _, sessionID := range sessionIDs {
+		session, err := loadChatSession(ctx, sessionID)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+// SoftDeleteChatSession marks a chat session deleted and hides it from its
+// user's listings. Its data is kept so it can be restored until the sweeper
+// deletes it once SessionRecoveryWindow has passed.
+func SoftDeleteChatSession(sessionID string) error {
 	session, err := GetChatSession(sessionID)
 	if err != nil {
 		return err
 	}
+	if session == nil {
+		return ErrNotFound
+	}
+	now := time.Now()
+	session.DeletedAt = &now
+
+	return db.Tx(func(p *db.Pipeliner) error {
+		if err := p.Set(ChatPrefix+session.ID, session, SessionTTL()); err != nil {
+			return err
+		}
+		p.ZRem(userSessionsKey(session.UserID), session.ID)
+		for _, tag := range session.Tags {
+			p.ZRem(tagIndexKey(session.UserID, tag), session.ID)
+		}
+		p.ZAdd(deletedSessionsKey(session.UserID), float64(now.Unix()), session.ID)
+		return nil
+	})
+}
+
+// RestoreChatSession undoes SoftDeleteChatSession, returning the session to
+// its user's listings where it was before
+func RestoreChatSession(ctx context.Context, sessionID string) (*ChatSession, error) {
+	session, err := GetDeletedChatSessionCtx(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	session.DeletedAt = nil
+
+	err = db.TxCtx(ctx, func(p *db.Pipeliner) error {
+		if err := p.Set(ChatPrefix+session.ID, session, SessionTTL()); err != nil {
+			return err
+		}
+		p.ZRem(deletedSessionsKey(session.UserID), session.ID)
+		p.ZAdd(userSessionsKey(session.UserID), activityScore(session), session.ID)
+		for _, tag := range session.Tags {
+			p.ZAdd(tagIndexKey(session.UserID, tag), float64(session.CreatedAt.Unix()), session.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// DeleteChatSession deletes a chat session and its messages, whether or not
+// it was soft-deleted
+func DeleteChatSession(sessionID string) error {
+	session, err := loadChatSession(context.Background(), sessionID)
+	if err != nil {
+		return err
+	}
 
 	// Delete session data
 	sessionKey := ChatPrefix + sessionID
@@ -121,12 +519,26 @@ func DeleteChatSession(sessionID string) error {
 		return err
 	}
 
+	// Revoke any share link
+	if err := RevokeShareLink(sessionID); err != nil {
+		return err
+	}
+
 	// Remove session from user's sessions
-	userSessionsKey := ChatPrefix + "user:" + session.UserID
-	if err := db.ZRem(userSessionsKey, sessionID); err != nil {
+	if err := db.ZRem(userSessionsKey(session.UserID), sessionID); err != nil {
+		return err
+	}
+	if err := db.ZRem(deletedSessionsKey(session.UserID), sessionID); err != nil {
 		return err
 	}
 
+	// Remove session from its tag indexes
+	for _, tag := range session.Tags {
+		if err := db.ZRem(tagIndexKey(session.UserID, tag), sessionID); err != nil {
+			return err
+		}
+	}
+
 	// Delete all messages in the session
 	sessionMessagesKey := MessagePrefix + "session:" + sessionID
 	messageIDs, err := db.ZRange(sessionMessagesKey, 0, -1)
@@ -139,6 +551,12 @@ func DeleteChatSession(sessionID string) error {
 		if err := db.Delete(messageKey); err != nil {
 			return err
 		}
+		if err := db.Delete(AlternativePrefix + messageID); err != nil {
+			return err
+		}
+		if err := deleteMessageFeedback(messageID); err != nil {
+			return err
+		}
 	}
 
 	// Delete the session's messages set
@@ -152,22 +570,25 @@ func DeleteChatSession(sessionID string) error {
 // CreateMessage creates a new message in a chat session
 func CreateMessage(sessionID string, role string, content string) (*Message, error) {
 	message := NewMessage(sessionID, role, content)
-
-	// Store message data
-	messageKey := MessagePrefix + message.ID
-	if err := db.Set(messageKey, message, 0); err != nil {
-		return nil, err
-	}
-
-	// Add message to session's messages
-	sessionMessagesKey := MessagePrefix + "session:" + sessionID
-	if err := db.ZAdd(sessionMessagesKey, float64(message.CreatedAt.Unix()), message.ID); err != nil {
+	if err := StoreMessage(message); err != nil {
 		return nil, err
 	}
 
 	return message, nil
 }
 
+// StoreMessage persists a new message and adds it to its session
+func StoreMessage(message *Message) error {
+	// Store message data and add it to the session's messages atomically
+	return db.Tx(func(p *db.Pipeliner) error {
+		if err := p.Set(MessagePrefix+message.ID, message, MessageTTL()); err != nil {
+			return err
+		}
+		p.ZAdd(MessagePrefix+"session:"+message.SessionID, MessageScore(message), message.ID)
+		return nil
+	})
+}
+
 // GetSessionMessages retrieves all messages in a chat session
 func GetSessionMessages(sessionID string) ([]*Message, error) {
 	sessionMessagesKey := MessagePrefix + "session:" + sessionID
@@ -181,6 +602,10 @@ func GetSessionMessages(sessionID string) ([]*Message, error) {
 		var message Message
 		messageKey := MessagePrefix + messageID
 		if err := db.Get(messageKey, &message); err != nil {
+			// Expired messages stay indexed until the sweeper runs
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
 			return nil, err
 		}
 		messages = append(messages, &message)
@@ -189,6 +614,157 @@ func GetSessionMessages(sessionID string) ([]*Message, error) {
 	return messages, nil
 }
 
+// MessageScore returns the sorted set score of a message. Millisecond
+// precision keeps messages sent within the same second in order.
+func MessageScore(message *Message) float64 {
+	return float64(message.CreatedAt.UnixMilli())
+}
+
+// legacyScoreLimit separates message scores in seconds, which older messages
+// were indexed by, from scores in milliseconds
+const legacyScoreLimit = 1e11
+
+// MessageCursor is a message's place in its session's index: its score, with
+// its ID ordering messages stored in the same millisecond
+type MessageCursor struct {
+	Score float64
+	ID    string
+}
+
+// LatestMessages is the cursor before which every message lies
+var LatestMessages = MessageCursor{Score: math.Inf(1)}
+
+// CursorOf returns the cursor of a message
+func CursorOf(message *Message) MessageCursor {
+	return MessageCursor{Score: MessageScore(message), ID: message.ID}
+}
+
+// String formats the cursor as "<score>:<id>", the form ParseMessageCursor
+// reads
+func (c MessageCursor) String() string {
+	return strconv.FormatFloat(c.Score, 'f', -1, 64) + ":" + c.ID
+}
+
+// ParseMessageCursor reads a cursor formatted by MessageCursor.String. A bare
+// score is accepted too, and lies before every message with that score.
+func ParseMessageCursor(value string) (MessageCursor, error) {
+	score, id, _ := strings.Cut(value, ":")
+	parsed, err := strconv.ParseFloat(score, 64)
+	if err != nil {
+		return MessageCursor{}, err
+	}
+	return MessageCursor{Score: parsed, ID: id}, nil
+}
+
+// GetSessionMessagesPaged retrieves up to limit messages in a chat session
+// that lie before the cursor, in chronological order
+func GetSessionMessagesPaged(sessionID string, before MessageCursor, limit int) ([]*Message, error) {
+	return GetSessionMessagesPagedCtx(context.Background(), sessionID, before, limit)
+}
+
+// GetSessionMessagesPagedCtx is like GetSessionMessagesPaged but honors the cancellation and deadline of ctx
+func GetSessionMessagesPagedCtx(ctx context.Context, sessionID string, before MessageCursor, limit int) ([]*Message, error) {
+	sessionMessagesKey := MessagePrefix + "session:" + sessionID
+
+	// Members with the cursor's score are listed newest first by descending
+	// ID, so those from the cursor's ID up are skipped
+	var skip int64
+	if !math.IsInf(before.Score, 1) {
+		tied, err := db.ZRangeByScoreCtx(ctx, sessionMessagesKey, before.Score, before.Score)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range tied {
+			if member.Member >= before.ID {
+				skip++
+			}
+		}
+	}
+
+	members, err := db.ZRevRangeByScoreFromCtx(ctx, sessionMessagesKey, before.Score, skip, int64(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*Message, 0, len(members))
+	for _, member := range members {
+		var message Message
+		messageKey := MessagePrefix + member.Member
+		if err := db.GetCtx(ctx, messageKey, &message); err != nil {
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			return nil, err
+		}
+		refreshTTL(ctx, messageKey, MessageTTL())
+		messages = append(messages, &message)
+	}
+
+	// Members come back newest first
+	slices.Reverse(messages)
+	return messages, nil
+}
+
+// MigrateMessageScores rescores messages still indexed by their creation
+// time in seconds with the millisecond score of MessageScore, so that they
+// page in order with newer messages. It returns the number of messages
+// rescored, and does nothing once every index is migrated.
+func MigrateMessageScores() (int, error) {
+	migrated := 0
+	err := db.Scan(MessagePrefix+"session:*", func(sessionMessagesKey string) error {
+		legacy, err := db.ZRangeByScore(sessionMessagesKey, math.Inf(-1), legacyScoreLimit)
+		if err != nil {
+			return err
+		}
+		for _, member := range legacy {
+			score := member.Score * 1000
+			var message Message
+			if err := db.Get(MessagePrefix+member.Member, &message); err == nil {
+				score = MessageScore(&message)
+			} else if !errors.Is(err, redis.Nil) {
+				return err
+			}
+			if err := db.ZAdd(sessionMessagesKey, score, member.Member); err != nil {
+				return err
+			}
+			migrated++
+		}
+		return nil
+	})
+	return migrated, err
+}
+
+// GetSessionMessageCount returns the number of messages in a chat session
+func GetSessionMessageCount(sessionID string) (int64, error) {
+	return GetSessionMessageCountCtx(context.Background(), sessionID)
+}
+
+// GetSessionMessageCountCtx is like GetSessionMessageCount but honors the cancellation and deadline of ctx
+func GetSessionMessageCountCtx(ctx context.Context, sessionID string) (int64, error) {
+	sessionMessagesKey := MessagePrefix + "session:" + sessionID
+	return db.ZCardCtx(ctx, sessionMessagesKey)
+}
+
+// GetLatestMessage retrieves the most recent message in a chat session, or
+// nil if the session has no messages
+func GetLatestMessage(sessionID string) (*Message, error) {
+	return GetLatestMessageCtx(context.Background(), sessionID)
+}
+
+// GetLatestMessageCtx is like GetLatestMessage but honors the cancellation and deadline of ctx
+func GetLatestMessageCtx(ctx context.Context, sessionID string) (*Message, error) {
+	sessionMessagesKey := MessagePrefix + "session:" + sessionID
+	messageIDs, err := db.ZRevRangeCtx(ctx, sessionMessagesKey, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(messageIDs) == 0 {
+		return nil, nil
+	}
+
+	return GetMessageCtx(ctx, messageIDs[0])
+}
+
 // DeleteMessage deletes a message from a chat session
 func DeleteMessage(messageID string) error {
 	message, err := GetMessage(messageID)
@@ -208,16 +784,32 @@ func DeleteMessage(messageID string) error {
 		return err
 	}
 
+	// Delete the message's alternatives
+	if err := db.Delete(AlternativePrefix + messageID); err != nil {
+		return err
+	}
+
+	// Delete the message's feedback
+	if err := deleteMessageFeedback(messageID); err != nil {
+		return err
+	}
+
 	return nil
 }
 
 // GetMessage retrieves a message by ID
 func GetMessage(messageID string) (*Message, error) {
+	return GetMessageCtx(context.Background(), messageID)
+}
+
+// GetMessageCtx is like GetMessage but honors the cancellation and deadline of ctx
+func GetMessageCtx(ctx context.Context, messageID string) (*Message, error) {
 	var message Message
 	messageKey := MessagePrefix + messageID
-	if err := db.Get(messageKey, &message); err != nil {
-		return nil, err
+	if err := db.GetCtx(ctx, messageKey, &message); err != nil {
+		return nil, lookupError(err)
 	}
+	refreshTTL(ctx, messageKey, MessageTTL())
 
 	return &message, nil
 }
@@ -0,0 +1,376 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"botanic/internal/db"
+	"botanic/internal/db/dbtest"
+)
+
+func createSessions(t *testing.T, userID string, n int) []*ChatSession {
+	t.Helper()
+	sessions := make([]*ChatSession, 0, n)
+	for range n {
+		// Activity is scored in milliseconds, so sessions created in the same
+		// millisecond would have no order
+		time.Sleep(2 * time.Millisecond)
+		session, err := CreateChatSession(userID, "chat", "openai/gpt-4o", SessionSettings{})
+		if err != nil {
+			t.Fatalf("create session %d: %v", len(sessions)+1, err)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+func TestSessionLimitRejects(t *testing.T) {
+	dbtest.Setup(t)
+	t.Setenv("MAX_SESSIONS_PER_USER", "3")
+	t.Setenv("SESSION_LIMIT_POLICY", "")
+
+	createSessions(t, "user-1", 3)
+
+	_, err := CreateChatSession("user-1", "one too many", "openai/gpt-4o", SessionSettings{})
+	if !errors.Is(err, ErrTooManySessions) {
+		t.Fatalf("create over the limit: got %v, want ErrTooManySessions", err)
+	}
+	if count, err := db.ZCard(userSessionsKey("user-1")); err != nil || count != 3 {
+		t.Fatalf("user has %d sessions (%v), want 3", count, err)
+	}
+
+	// Other users have their own limit
+	createSessions(t, "user-2", 1)
+}
+
+func TestSessionLimitEvictsOldest(t *testing.T) {
+	dbtest.Setup(t)
+	t.Setenv("MAX_SESSIONS_PER_USER", "3")
+	t.Setenv("SESSION_LIMIT_POLICY", "evict")
+
+	sessions := createSessions(t, "user-1", 4)
+
+	gone, err := GetChatSession(sessions[0].ID)
+	if err != nil || gone != nil {
+		t.Fatalf("oldest session still exists: %v, %v", gone, err)
+	}
+	ids, err := GetUserSessions("user-1")
+	if err != nil {
+		t.Fatalf("list sessions: %v", err)
+	}
+	if len(ids) != 3 {
+		t.Fatalf("user has %d sessions, want 3", len(ids))
+	}
+	for _, session := range ids {
+		if session.ID == sessions[0].ID {
+			t.Error("evicted session is still listed")
+		}
+	}
+}
+
+func TestSessionLimitHoldsUnderConcurrency(t *testing.T) {
+	dbtest.Setup(t)
+	t.Setenv("MAX_SESSIONS_PER_USER", "5")
+	t.Setenv("SESSION_LIMIT_POLICY", "")
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			CreateChatSession("user-1", "chat", "openai/gpt-4o", SessionSettings{})
+		}()
+	}
+	wg.Wait()
+
+	if count, err := db.ZCard(userSessionsKey("user-1")); err != nil || count != 5 {
+		t.Fatalf("user has %d sessions (%v), want 5", count, err)
+	}
+}
+
+// pageAll reads every message in a session a page at a time, newest page first
+func pageAll(t *testing.T, sessionID string, limit int) []string {
+	t.Helper()
+	var ids []string
+	before := LatestMessages
+	for range 100 {
+		page, err := GetSessionMessagesPaged(sessionID, before, limit)
+		if err != nil {
+			t.Fatalf("page before %s: %v", before, err)
+		}
+		if len(page) == 0 {
+			return ids
+		}
+		pageIDs := make([]string, len(page))
+		for i, message := range page {
+			pageIDs[i] = message.ID
+		}
+		ids = append(pageIDs, ids...)
+		before = CursorOf(page[0])
+	}
+	t.Fatal("paging did not finish")
+	return nil
+}
+
+func TestPagingKeepsMessagesTiedAtThePageBoundary(t *testing.T) {
+	dbtest.Setup(t)
+
+	createdAt := time.Now()
+	var want []string
+	for range 5 {
+		message := NewMessage("session-1", "user", "hi")
+		message.CreatedAt = createdAt
+		if err := StoreMessage(message); err != nil {
+			t.Fatalf("store message: %v", err)
+		}
+		want = append(want, message.ID)
+	}
+	// Messages stored in the same millisecond are ordered by ID
+	all, err := GetSessionMessages("session-1")
+	if err != nil {
+		t.Fatalf("get messages: %v", err)
+	}
+	for i, message := range all {
+		want[i] = message.ID
+	}
+
+	got := pageAll(t, "session-1", 2)
+	if len(got) != len(want) {
+		t.Fatalf("paged %d messages, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("message %d is %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParseMessageCursor(t *testing.T) {
+	cursor := MessageCursor{Score: 1700000000123, ID: "5f0c8a4e-1b2c-4d3e-8f90-0a1b2c3d4e5f"}
+	parsed, err := ParseMessageCursor(cursor.String())
+	if err != nil || parsed != cursor {
+		t.Fatalf("round trip of %s: got %v, %v", cursor, parsed, err)
+	}
+
+	// A bare score, as older clients send, lies before every message with it
+	parsed, err = ParseMessageCursor("1700000000123")
+	if err != nil || parsed != (MessageCursor{Score: 1700000000123}) {
+		t.Fatalf("bare score: got %v, %v", parsed, err)
+	}
+
+	if _, err := ParseMessageCursor("yesterday"); err == nil {
+		t.Fatal("invalid cursor was accepted")
+	}
+}
+
+func TestMigrateMessageScores(t *testing.T) {
+	dbtest.Setup(t)
+
+	old := NewMessage("session-1", "user", "old")
+	old.CreatedAt = time.Now().Add(-time.Hour)
+	recent := NewMessage("session-1", "assistant", "recent")
+	for _, message := range []*Message{old, recent} {
+		if err := StoreMessage(message); err != nil {
+			t.Fatalf("store message: %v", err)
+		}
+	}
+	// Index the old message the way it used to be, by second
+	key := MessagePrefix + "session:session-1"
+	if err := db.ZAdd(key, float64(old.CreatedAt.Unix()), old.ID); err != nil {
+		t.Fatalf("index by second: %v", err)
+	}
+
+	migrated, err := MigrateMessageScores()
+	if err != nil || migrated != 1 {
+		t.Fatalf("migrated %d (%v), want 1", migrated, err)
+	}
+	got := pageAll(t, "session-1", 1)
+	if len(got) != 2 || got[0] != old.ID || got[1] != recent.ID {
+		t.Fatalf("paged %v, want [%s %s]", got, old.ID, recent.ID)
+	}
+
+	if migrated, err := MigrateMessageScores(); err != nil || migrated != 0 {
+		t.Fatalf("second migration rescored %d (%v), want 0", migrated, err)
+	}
+}
+
+func TestTouchMovesSessionToTheTop(t *testing.T) {
+	dbtest.Setup(t)
+	sessions := createSessions(t, "user-1", 3)
+
+	time.Sleep(2 * time.Millisecond)
+	if err := TouchChatSession(sessions[0].ID); err != nil {
+		t.Fatalf("touch: %v", err)
+	}
+	ids, err := GetUserSessions("user-1")
+	if err != nil {
+		t.Fatalf("list sessions: %v", err)
+	}
+	want := []string{sessions[0].ID, sessions[2].ID, sessions[1].ID}
+	if len(ids) != len(want) {
+		t.Fatalf("listed %d sessions, want %d", len(ids), len(want))
+	}
+	for i, session := range ids {
+		if session.ID != want[i] {
+			t.Fatalf("session %d is %s, want %s", i, session.ID, want[i])
+		}
+	}
+}
+
+func TestTouchKeepsConcurrentChanges(t *testing.T) {
+	dbtest.Setup(t)
+	session := createSessions(t, "user-1", 1)[0]
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				if err := TouchChatSession(session.ID); err != nil {
+					t.Errorf("touch: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	for i := range 20 {
+		loaded, err := GetChatSession(session.ID)
+		if err != nil || loaded == nil {
+			t.Errorf("get session: %v, %v", loaded, err)
+			break
+		}
+		if err := loaded.SetTags([]string{fmt.Sprintf("tag-%d", i)}); err != nil {
+			t.Errorf("set tags: %v", err)
+			break
+		}
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	loaded, err := GetChatSession(session.ID)
+	if err != nil || loaded == nil {
+		t.Fatalf("get session: %v, %v", loaded, err)
+	}
+	if len(loaded.Tags) != 1 || loaded.Tags[0] != "tag-19" {
+		t.Fatalf("tags are %v, want [tag-19]", loaded.Tags)
+	}
+}
+
+func TestTouchDoesNotRestoreDeletedSession(t *testing.T) {
+	dbtest.Setup(t)
+	session := createSessions(t, "user-1", 1)[0]
+
+	if err := SoftDeleteChatSession(session.ID); err != nil {
+		t.Fatalf("soft delete: %v", err)
+	}
+	if err := TouchChatSession(session.ID); err != nil {
+		t.Fatalf("touch: %v", err)
+	}
+	if ids, err := GetUserSessions("user-1"); err != nil || len(ids) != 0 {
+		t.Fatalf("listed %d sessions (%v), want none", len(ids), err)
+	}
+}
+
+func TestSetTagsOnAStaleCopyKeepsTheIndexConsistent(t *testing.T) {
+	dbtest.Setup(t)
+	session := createSessions(t, "user-1", 1)[0]
+	stale, err := GetChatSession(session.ID)
+	if err != nil || stale == nil {
+		t.Fatalf("get session: %v, %v", stale, err)
+	}
+
+	if err := session.SetTags([]string{"ferns", "Watering"}); err != nil {
+		t.Fatalf("set tags: %v", err)
+	}
+	// The stale copy never saw the tags above, which must still be unindexed
+	if err := stale.SetTags([]string{"watering", "light"}); err != nil {
+		t.Fatalf("set tags on stale copy: %v", err)
+	}
+	if fmt.Sprint(stale.Tags) != "[watering light]" {
+		t.Errorf("stale copy has tags %v, want [watering light]", stale.Tags)
+	}
+
+	for tag, want := range map[string]int{"ferns": 0, "watering": 1, "light": 1} {
+		sessions, err := GetUserSessionsByTag("user-1", tag)
+		if err != nil {
+			t.Fatalf("sessions tagged %s: %v", tag, err)
+		}
+		if len(sessions) != want {
+			t.Errorf("%d sessions tagged %s, want %d", len(sessions), tag, want)
+		}
+	}
+}
+
+func TestSetTagsDoesNotRestoreDeletedSession(t *testing.T) {
+	dbtest.Setup(t)
+	session := createSessions(t, "user-1", 1)[0]
+
+	if err := SoftDeleteChatSession(session.ID); err != nil {
+		t.Fatalf("soft delete: %v", err)
+	}
+	if err := session.SetTags([]string{"ferns"}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("set tags on deleted session: %v, want ErrNotFound", err)
+	}
+	if loaded, err := GetChatSession(session.ID); err != nil || loaded != nil {
+		t.Fatalf("deleted session came back: %v, %v", loaded, err)
+	}
+	if sessions, err := GetUserSessionsByTag("user-1", "ferns"); err != nil || len(sessions) != 0 {
+		t.Fatalf("deleted session indexed under its new tag: %d, %v", len(sessions), err)
+	}
+}
+
+func TestSetSummaryKeepsChangesMadeMeanwhile(t *testing.T) {
+	dbtest.Setup(t)
+	session := createSessions(t, "user-1", 1)[0]
+	stale, err := GetChatSession(session.ID)
+	if err != nil || stale == nil {
+		t.Fatalf("get session: %v, %v", stale, err)
+	}
+
+	if err := session.SetTags([]string{"ferns"}); err != nil {
+		t.Fatalf("set tags: %v", err)
+	}
+	if err := stale.SetSummary("Talked about ferns.", 100); err != nil {
+		t.Fatalf("set summary: %v", err)
+	}
+
+	loaded, err := GetChatSession(session.ID)
+	if err != nil || loaded == nil {
+		t.Fatalf("get session: %v, %v", loaded, err)
+	}
+	if loaded.Summary != "Talked about ferns." || loaded.SummaryThrough != 100 {
+		t.Errorf("summary %q through %v, want it stored", loaded.Summary, loaded.SummaryThrough)
+	}
+	if fmt.Sprint(loaded.Tags) != "[ferns]" {
+		t.Errorf("tags %v, want the ones set while summarizing", loaded.Tags)
+	}
+
+	// An older summary finishing late does not replace a newer one
+	if err := stale.SetSummary("Said hello.", 50); err != nil {
+		t.Fatalf("set older summary: %v", err)
+	}
+	if loaded, err := GetChatSession(session.ID); err != nil || loaded.Summary != "Talked about ferns." {
+		t.Errorf("summary replaced by an older one: %v, %v", loaded, err)
+	}
+}
+
+func TestSetSummaryDoesNotRestoreDeletedSession(t *testing.T) {
+	dbtest.Setup(t)
+	session := createSessions(t, "user-1", 1)[0]
+
+	if err := SoftDeleteChatSession(session.ID); err != nil {
+		t.Fatalf("soft delete: %v", err)
+	}
+	if err := session.SetSummary("Talked about ferns.", 100); err != nil {
+		t.Fatalf("set summary: %v", err)
+	}
+	if loaded, err := GetChatSession(session.ID); err != nil || loaded != nil {
+		t.Fatalf("deleted session came back: %v, %v", loaded, err)
+	}
+}
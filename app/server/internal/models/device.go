@@ -0,0 +1,36 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"botanic/internal/db"
+)
+
+// KnownDevicesPrefix is the key prefix of the sets of device fingerprints
+// each user has logged in from
+const KnownDevicesPrefix = "devices:user:"
+
+// DeviceFingerprint identifies a device by its IP address and user agent. It
+// is hashed so the stored set does not retain either.
+func DeviceFingerprint(ip string, userAgent string) string {
+	sum := sha256.Sum256([]byte(ip + "\x00" + userAgent))
+	return hex.EncodeToString(sum[:])
+}
+
+// RememberDevice adds a device to the user's known devices. It reports
+// whether the device is new to a user who has logged in before; a user's
+// first device is remembered without being reported.
+func RememberDevice(ctx context.Context, userID string, fingerprint string) (bool, error) {
+	key := KnownDevicesPrefix + userID
+	known, err := db.SCardCtx(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	added, err := db.SAddCtx(ctx, key, fingerprint)
+	if err != nil {
+		return false, err
+	}
+	return added && known > 0, nil
+}
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+
+	"botanic/internal/db"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// ErrNotFound is returned when a looked up record does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrUnavailable is returned when Redis cannot be reached
+	ErrUnavailable = errors.New("storage unavailable")
+)
+
+// lookupError classifies an error from reading a record as ErrNotFound or
+// ErrUnavailable, keeping the original error in the chain
+func lookupError(err error) error {
+	switch {
+	case errors.Is(err, redis.Nil):
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case db.IsConnectionError(err):
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	return err
+}
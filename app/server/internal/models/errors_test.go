@@ -0,0 +1,51 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"botanic/internal/db/dbtest"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestLookupErrorTellsMissingFromUnreachable(t *testing.T) {
+	if err := lookupError(redis.Nil); !errors.Is(err, ErrNotFound) || errors.Is(err, ErrUnavailable) {
+		t.Errorf("redis.Nil: %v, want ErrNotFound", err)
+	}
+	if err := lookupError(redis.ErrClosed); !errors.Is(err, ErrUnavailable) || errors.Is(err, ErrNotFound) {
+		t.Errorf("closed client: %v, want ErrUnavailable", err)
+	}
+	other := errors.New("WRONGTYPE")
+	if err := lookupError(other); err != other {
+		t.Errorf("other error: %v, want it unchanged", err)
+	}
+}
+
+func TestLookupsFailAsUnavailableWhenRedisIsDown(t *testing.T) {
+	dbtest.SetupUnreachable(t)
+
+	lookups := map[string]func() error{
+		"user by email": func() error {
+			user, err := GetUserByEmail("owner@example.com")
+			if user != nil {
+				return fmt.Errorf("got user %v", user)
+			}
+			return err
+		},
+		"user by id": func() error {
+			_, err := GetUserByID("user-1")
+			return err
+		},
+		"chat session": func() error {
+			_, err := GetChatSession("session-1")
+			return err
+		},
+	}
+	for name, lookup := range lookups {
+		if err := lookup(); !errors.Is(err, ErrUnavailable) {
+			t.Errorf("%s: %v, want ErrUnavailable", name, err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"botanic/internal/litellm"
+)
+
+// UserExport is everything stored about a user, for data-export requests.
+// Credentials are never included: User omits its password hash when encoded.
+// Chat sessions are loaded with their messages one at a time while the
+// export is written, so a large history is never held in memory at once.
+type UserExport struct {
+	ExportedAt    time.Time      `json:"exported_at"`
+	Profile       *User          `json:"profile"`
+	LoginSessions []UserSession  `json:"login_sessions"`
+	Feedback      []*Feedback    `json:"feedback"`
+	Usage         *litellm.Usage `json:"usage"`
+
+	sessions []*ChatSession
+}
+
+// SessionExport is a chat session with its full message history
+type SessionExport struct {
+	*ChatSession
+	Messages []*MessageExport `json:"messages"`
+}
+
+// MessageExport is a chat message with its alternatives
+type MessageExport struct {
+	*Message
+	Alternatives []*Alternative `json:"alternatives,omitempty"`
+}
+
+// ExportUserData gathers the user's profile, chat sessions, login sessions,
+// feedback and token usage. Messages are loaded by WriteJSON.
+func ExportUserData(ctx context.Context, userID string) (*UserExport, error) {
+	user, err := GetUserByIDCtx(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	export := &UserExport{
+		ExportedAt:    time.Now(),
+		Profile:       user,
+		LoginSessions: []UserSession{},
+		Feedback:      []*Feedback{},
+	}
+
+	if export.sessions, err = GetUserSessionsCtx(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	loginSessions, err := GetUserActiveSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+	export.LoginSessions = append(export.LoginSessions, loginSessions...)
+
+	feedback, err := GetUserFeedback(userID)
+	if err != nil {
+		return nil, err
+	}
+	export.Feedback = append(export.Feedback, feedback...)
+
+	if export.Usage, err = GetUserTokenUsage(userID); err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+// WriteJSON writes the export to w as one JSON object, loading and encoding
+// the chat sessions one at a time under "sessions". It stops when ctx is
+// done. On error the object written so far is left incomplete.
+func (e *UserExport) WriteJSON(ctx context.Context, w io.Writer) error {
+	head, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	head = bytes.TrimSuffix(head, []byte("}"))
+	if _, err := io.WriteString(w, string(head)+`,"sessions":[`); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	for i, session := range e.sessions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		sessionExport, err := exportSession(session)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := enc.Encode(sessionExport); err != nil {
+			return err
+		}
+	}
+
+	_, err = io.WriteString(w, "]}\n")
+	return err
+}
+
+// exportSession loads a chat session's messages and their alternatives
+func exportSession(session *ChatSession) (*SessionExport, error) {
+	messages, err := GetSessionMessages(session.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionExport := &SessionExport{ChatSession: session, Messages: []*MessageExport{}}
+	for _, message := range messages {
+		alternatives, err := GetMessageAlternatives(message.ID)
+		if err != nil {
+			return nil, err
+		}
+		sessionExport.Messages = append(sessionExport.Messages, &MessageExport{
+			Message:      message,
+			Alternatives: alternatives,
+		})
+	}
+	return sessionExport, nil
+}
@@ -0,0 +1,79 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"botanic/internal/db/dbtest"
+)
+
+func TestExportStreamsEverySession(t *testing.T) {
+	dbtest.Setup(t)
+	user, err := CreateUser("owner@example.com", "correct horse battery", "email", "", "Owner", "")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	userID := user.ID
+
+	sessions := createSessions(t, userID, 3)
+	for _, session := range sessions {
+		if _, err := CreateMessage(session.ID, "user", "hello from "+session.ID); err != nil {
+			t.Fatalf("create message: %v", err)
+		}
+	}
+
+	export, err := ExportUserData(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := export.WriteJSON(context.Background(), &buf); err != nil {
+		t.Fatalf("write export: %v", err)
+	}
+
+	var decoded struct {
+		Profile  *User            `json:"profile"`
+		Sessions []*SessionExport `json:"sessions"`
+		Feedback []*Feedback      `json:"feedback"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("decode %q: %v", buf.String(), err)
+	}
+	if decoded.Profile == nil || decoded.Profile.ID != userID {
+		t.Fatalf("profile = %+v, want user %s", decoded.Profile, userID)
+	}
+	if len(decoded.Sessions) != len(sessions) {
+		t.Fatalf("exported %d sessions, want %d", len(decoded.Sessions), len(sessions))
+	}
+	for _, session := range decoded.Sessions {
+		if len(session.Messages) != 1 || session.Messages[0].Content != "hello from "+session.ID {
+			t.Fatalf("session %s messages = %+v, want its one message", session.ID, session.Messages)
+		}
+	}
+}
+
+func TestExportWithoutSessionsIsValidJSON(t *testing.T) {
+	dbtest.Setup(t)
+	user, err := CreateUser("owner@example.com", "correct horse battery", "email", "", "Owner", "")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	export, err := ExportUserData(context.Background(), user.ID)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := export.WriteJSON(context.Background(), &buf); err != nil {
+		t.Fatalf("write export: %v", err)
+	}
+	var decoded map[string]json.RawMessage
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("decode %q: %v", buf.String(), err)
+	}
+	if string(decoded["sessions"]) != "[]" {
+		t.Fatalf("sessions = %s, want []", decoded["sessions"])
+	}
+}
@@ -0,0 +1,170 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"botanic/internal/db"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// FeedbackKey is the hash holding feedback for all messages, keyed by message ID
+const FeedbackKey = "feedback:messages"
+
+// feedbackIndexedKey marks that feedback stored before the per-user index
+// existed has been indexed
+const feedbackIndexedKey = "feedback:indexed"
+
+// feedbackUserKey returns the hash holding the feedback a user left, keyed by
+// message ID like FeedbackKey
+func feedbackUserKey(userID string) string {
+	return "feedback:user:" + userID
+}
+
+// Feedback ratings
+const (
+	RatingUp   = "up"
+	RatingDown = "down"
+)
+
+// Feedback is a user's rating of an assistant message
+type Feedback struct {
+	MessageID string    `json:"message_id"`
+	SessionID string    `json:"session_id"`
+	UserID    string    `json:"user_id"`
+	Model     string    `json:"model"`
+	Rating    string    `json:"rating"`
+	Comment   string    `json:"comment,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// FeedbackStats summarizes ratings overall and per model
+type FeedbackStats struct {
+	Total   int                     `json:"total"`
+	Up      int                     `json:"up"`
+	Down    int                     `json:"down"`
+	ByModel map[string]*RatingCount `json:"by_model"`
+}
+
+// RatingCount counts up and down ratings
+type RatingCount struct {
+	Up   int `json:"up"`
+	Down int `json:"down"`
+}
+
+// SetMessageFeedback stores feedback for a message, replacing any earlier rating
+func SetMessageFeedback(feedback *Feedback) error {
+	return db.Tx(func(p *db.Pipeliner) error {
+		if err := p.HSet(FeedbackKey, feedback.MessageID, feedback); err != nil {
+			return err
+		}
+		return p.HSet(feedbackUserKey(feedback.UserID), feedback.MessageID, feedback)
+	})
+}
+
+// deleteMessageFeedback removes the feedback for a message, if there is any
+func deleteMessageFeedback(messageID string) error {
+	feedback, err := GetMessageFeedback(messageID)
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return db.Tx(func(p *db.Pipeliner) error {
+		p.HDel(FeedbackKey, messageID)
+		p.HDel(feedbackUserKey(feedback.UserID), messageID)
+		return nil
+	})
+}
+
+// GetMessageFeedback retrieves the feedback for a message
+func GetMessageFeedback(messageID string) (*Feedback, error) {
+	var feedback Feedback
+	if err := db.HGet(FeedbackKey, messageID, &feedback); err != nil {
+		return nil, err
+	}
+	return &feedback, nil
+}
+
+// GetFeedbackStats aggregates all stored feedback
+func GetFeedbackStats() (*FeedbackStats, error) {
+	vals, err := db.HGetAll(FeedbackKey)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &FeedbackStats{ByModel: make(map[string]*RatingCount)}
+	for _, val := range vals {
+		var feedback Feedback
+		if err := json.Unmarshal([]byte(val), &feedback); err != nil {
+			continue
+		}
+
+		count, ok := stats.ByModel[feedback.Model]
+		if !ok {
+			count = &RatingCount{}
+			stats.ByModel[feedback.Model] = count
+		}
+
+		stats.Total++
+		switch feedback.Rating {
+		case RatingUp:
+			stats.Up++
+			count.Up++
+		case RatingDown:
+			stats.Down++
+			count.Down++
+		}
+	}
+
+	return stats, nil
+}
+
+// GetUserFeedback retrieves all feedback left by a user
+func GetUserFeedback(userID string) ([]*Feedback, error) {
+	vals, err := db.HGetAll(feedbackUserKey(userID))
+	if err != nil {
+		return nil, err
+	}
+
+	var feedbacks []*Feedback
+	for _, val := range vals {
+		var feedback Feedback
+		if err := json.Unmarshal([]byte(val), &feedback); err != nil {
+			continue
+		}
+		feedbacks = append(feedbacks, &feedback)
+	}
+
+	return feedbacks, nil
+}
+
+// MigrateFeedbackIndex adds feedback stored before feedback was indexed per
+// user to its user's index. It returns the number of ratings indexed, and
+// does nothing once the migration has run.
+func MigrateFeedbackIndex() (int, error) {
+	indexed, err := db.Exists(feedbackIndexedKey)
+	if err != nil || indexed {
+		return 0, err
+	}
+
+	vals, err := db.HGetAll(FeedbackKey)
+	if err != nil {
+		return 0, err
+	}
+	migrated := 0
+	for messageID, val := range vals {
+		var feedback Feedback
+		if err := json.Unmarshal([]byte(val), &feedback); err != nil || feedback.UserID == "" {
+			continue
+		}
+		if err := db.HSet(feedbackUserKey(feedback.UserID), messageID, &feedback); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, db.Set(feedbackIndexedKey, true, 0)
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"testing"
+
+	"botanic/internal/db"
+	"botanic/internal/db/dbtest"
+)
+
+func TestUserFeedbackOnlyListsTheUsersRatings(t *testing.T) {
+	dbtest.Setup(t)
+
+	for _, feedback := range []*Feedback{
+		{MessageID: "message-1", UserID: "user-1", Rating: RatingUp},
+		{MessageID: "message-2", UserID: "user-2", Rating: RatingDown},
+		{MessageID: "message-3", UserID: "user-1", Rating: RatingDown},
+	} {
+		if err := SetMessageFeedback(feedback); err != nil {
+			t.Fatalf("set feedback for %s: %v", feedback.MessageID, err)
+		}
+	}
+	if err := deleteMessageFeedback("message-3"); err != nil {
+		t.Fatalf("delete feedback: %v", err)
+	}
+	if err := deleteMessageFeedback("message-4"); err != nil {
+		t.Fatalf("delete missing feedback: %v", err)
+	}
+
+	feedbacks, err := GetUserFeedback("user-1")
+	if err != nil {
+		t.Fatalf("get user feedback: %v", err)
+	}
+	if len(feedbacks) != 1 || feedbacks[0].MessageID != "message-1" {
+		t.Fatalf("user-1 feedback = %+v, want only message-1", feedbacks)
+	}
+	if _, err := GetMessageFeedback("message-3"); err == nil {
+		t.Fatal("deleted feedback is still stored")
+	}
+}
+
+func TestMigrateFeedbackIndex(t *testing.T) {
+	dbtest.Setup(t)
+
+	// Feedback stored before the per-user index existed
+	if err := db.HSet(FeedbackKey, "message-1", &Feedback{MessageID: "message-1", UserID: "user-1", Rating: RatingUp}); err != nil {
+		t.Fatalf("store feedback: %v", err)
+	}
+
+	migrated, err := MigrateFeedbackIndex()
+	if err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if migrated != 1 {
+		t.Fatalf("migrated %d ratings, want 1", migrated)
+	}
+	feedbacks, err := GetUserFeedback("user-1")
+	if err != nil {
+		t.Fatalf("get user feedback: %v", err)
+	}
+	if len(feedbacks) != 1 {
+		t.Fatalf("user-1 has %d ratings after the migration, want 1", len(feedbacks))
+	}
+
+	if migrated, err := MigrateFeedbackIndex(); err != nil || migrated != 0 {
+		t.Fatalf("second migration = %d, %v; want 0, nil", migrated, err)
+	}
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+
+	"botanic/internal/db"
+)
+
+// PendingLinkPrefix is the key prefix of OAuth logins waiting to be linked
+const PendingLinkPrefix = "pending_link:"
+
+// PendingLink is an OAuth identity waiting for the owner of an existing
+// account to confirm it should be linked
+type PendingLink struct {
+	UserID     string `json:"user_id"`
+	Provider   string `json:"provider"`
+	ProviderID string `json:"provider_id"`
+}
+
+// CreatePendingLink stores link under a new opaque token that expires after ttl
+func CreatePendingLink(link PendingLink, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	if err := db.Set(PendingLinkPrefix+token, link, ttl); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ConsumePendingLink returns the pending link stored under token and deletes
+// it, so each token can be used once
+func ConsumePendingLink(token string) (*PendingLink, error) {
+	link, err := db.GetT[PendingLink](PendingLinkPrefix + token)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Delete(PendingLinkPrefix + token); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
@@ -0,0 +1,148 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"botanic/internal/db"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Quota periods
+const (
+	QuotaDaily   = "daily"
+	QuotaMonthly = "monthly"
+)
+
+// UserQuota overrides the global completion quotas for one user. A nil limit
+// uses the global default and zero means unlimited.
+type UserQuota struct {
+	Daily   *int `json:"daily,omitempty" validate:"omitempty,min=0"`
+	Monthly *int `json:"monthly,omitempty" validate:"omitempty,min=0"`
+}
+
+// QuotaStatus is a user's AI completion usage within one quota period
+type QuotaStatus struct {
+	Period    string    `json:"period"`
+	Limit     int       `json:"limit"`
+	Used      int       `json:"used"`
+	Remaining int       `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+// Exceeded reports whether the period's limit has been reached
+func (s QuotaStatus) Exceeded() bool {
+	return s.Limit > 0 && s.Used >= s.Limit
+}
+
+// quotaLimit returns the user's limit for a period: their override if set,
+// otherwise QUOTA_DAILY or QUOTA_MONTHLY (default 0, unlimited)
+func quotaLimit(user *User, period string) int {
+	if user.Quota != nil {
+		override := user.Quota.Daily
+		if period == QuotaMonthly {
+			override = user.Quota.Monthly
+		}
+		if override != nil {
+			return *override
+		}
+	}
+
+	env := "QUOTA_DAILY"
+	if period == QuotaMonthly {
+		env = "QUOTA_MONTHLY"
+	}
+	limit, err := strconv.Atoi(os.Getenv(env))
+	if err != nil || limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// quotaWindow returns the key suffix identifying the period containing now
+// and the time the period ends. Periods follow UTC calendar days and months.
+func quotaWindow(period string, now time.Time) (string, time.Time) {
+	now = now.UTC()
+	if period == QuotaMonthly {
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return period + ":" + start.Format("2006-01"), start.AddDate(0, 1, 0)
+	}
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return period + ":" + start.Format("2006-01-02"), start.AddDate(0, 0, 1)
+}
+
+func quotaKey(userID string, window string) string {
+	return UsagePrefix + userID + ":" + window
+}
+
+// GetQuotaStatus returns the user's usage against each quota period
+func GetQuotaStatus(ctx context.Context, userID string) ([]QuotaStatus, error) {
+	user, err := GetUserByIDCtx(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	statuses := make([]QuotaStatus, 0, 2)
+	for _, period := range []string{QuotaDaily, QuotaMonthly} {
+		window, resetsAt := quotaWindow(period, now)
+		used, err := db.GetTCtx[int](ctx, quotaKey(userID, window))
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+
+		status := QuotaStatus{
+			Period:   period,
+			Limit:    quotaLimit(user, period),
+			Used:     used,
+			ResetsAt: resetsAt,
+		}
+		if status.Limit > 0 {
+			status.Remaining = max(status.Limit-status.Used, 0)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// QuotaExceeded reports whether the user has used up any of their quotas
+func QuotaExceeded(ctx context.Context, userID string) (bool, error) {
+	statuses, err := GetQuotaStatus(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, status := range statuses {
+		if status.Exceeded() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ConsumeQuota counts one AI completion against each of the user's quota
+// periods. Counters expire at the end of their period; the expiry is set with
+// each increment in one transaction, so a counter never outlives its period.
+// The end of a period is fixed, so setting it again changes nothing.
+func ConsumeQuota(ctx context.Context, userID string) error {
+	now := time.Now()
+	return db.TxCtx(ctx, func(p *db.Pipeliner) error {
+		for _, period := range []string{QuotaDaily, QuotaMonthly} {
+			window, resetsAt := quotaWindow(period, now)
+			key := quotaKey(userID, window)
+			p.Incr(key)
+			p.ExpireAt(key, resetsAt)
+		}
+		return nil
+	})
+}
+
+// SetUserQuota replaces the user's quota overrides
+func SetUserQuota(user *User, quota *UserQuota) error {
+	user.Quota = quota
+	user.UpdatedAt = time.Now()
+	return db.Set(UserPrefix+user.ID, user, 0)
+}
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"context"
+	"testing"
+
+	"botanic/internal/db/dbtest"
+)
+
+func TestConsumeQuotaCountsEveryPeriod(t *testing.T) {
+	dbtest.Setup(t)
+	user, err := CreateUser("owner@example.com", "correct horse battery", "email", "", "Owner", "")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	ctx := context.Background()
+	for range 2 {
+		if err := ConsumeQuota(ctx, user.ID); err != nil {
+			t.Fatalf("consume quota: %v", err)
+		}
+	}
+
+	statuses, err := GetQuotaStatus(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("get quota status: %v", err)
+	}
+	if len(statuses) != 2 {
+		t.Fatalf("got %d quota periods, want daily and monthly", len(statuses))
+	}
+	for _, status := range statuses {
+		if status.Used != 2 {
+			t.Errorf("%s quota used %d, want 2", status.Period, status.Used)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"botanic/internal/db"
+)
+
+// SessionTTL returns the retention of chat sessions from SESSION_TTL, or zero
+// (no expiry) when unset
+func SessionTTL() time.Duration {
+	return retentionTTL("SESSION_TTL")
+}
+
+// MessageTTL returns the retention of messages from MESSAGE_TTL, or zero (no
+// expiry) when unset
+func MessageTTL() time.Duration {
+	return retentionTTL("MESSAGE_TTL")
+}
+
+const defaultSessionRecoveryWindow = 7 * 24 * time.Hour
+
+// SessionRecoveryWindow returns how long deleted chat sessions can be
+// restored from SESSION_RECOVERY_WINDOW (default 7 days). Zero deletes
+// sessions immediately.
+func SessionRecoveryWindow() time.Duration {
+	if value := os.Getenv("SESSION_RECOVERY_WINDOW"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed >= 0 {
+			return parsed
+		}
+	}
+	return defaultSessionRecoveryWindow
+}
+
+// MaxSessionsPerUser returns how many chat sessions a user may keep from
+// MAX_SESSIONS_PER_USER, or zero (no limit) when unset
+func MaxSessionsPerUser() int {
+	if value := os.Getenv("MAX_SESSIONS_PER_USER"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return 0
+}
+
+// EvictOldestSessions reports whether SESSION_LIMIT_POLICY=evict is set, so
+// that creating a session at the limit deletes the user's least recently
+// active sessions instead of failing
+func EvictOldestSessions() bool {
+	return os.Getenv("SESSION_LIMIT_POLICY") == "evict"
+}
+
+func retentionTTL(key string) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < 0 {
+		slog.Warn("invalid TTL, keeping data forever", "env", key, "value", value)
+		return 0
+	}
+	return ttl
+}
+
+// refreshTTL extends a key's expiry on access so that retention is measured
+// from last use. Failures are logged rather than failing the read.
+func refreshTTL(ctx context.Context, key string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	if err := db.ExpireCtx(ctx, key, ttl); err != nil {
+		slog.Warn("failed to refresh expiry", "key", key, "error", err)
+	}
+}
+
+// SweepChatSessions removes expired chat sessions from their users' indexes
+// and deletes the messages they left behind. It returns the number of
+// sessions removed.
+func SweepChatSessions() (int, error) {
+	removed := 0
+	err := db.Scan(ChatPrefix+"user:*", func(userSessionsKey string) error {
+		sessionIDs, err := db.ZRange(userSessionsKey, 0, -1)
+		if err != nil {
+			return err
+		}
+		for _, sessionID := range sessionIDs {
+			exists, err := db.Exists(ChatPrefix + sessionID)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			if err := deleteSessionMessages(sessionID); err != nil {
+				return err
+			}
+			if err := db.ZRem(userSessionsKey, sessionID); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// SweepDeletedChatSessions permanently deletes soft-deleted chat sessions
+// whose recovery window has passed. It returns the number of sessions
+// deleted.
+func SweepDeletedChatSessions() (int, error) {
+	cutoff := float64(time.Now().Add(-SessionRecoveryWindow()).Unix())
+	removed := 0
+	err := db.Scan(ChatPrefix+"deleted:*", func(deletedKey string) error {
+		for {
+			expired, err := db.ZRevRangeByScore(deletedKey, cutoff, 100)
+			if err != nil {
+				return err
+			}
+			if len(expired) == 0 {
+				return nil
+			}
+			for _, member := range expired {
+				err := DeleteChatSession(member.Member)
+				if errors.Is(err, ErrNotFound) {
+					// The session expired on its own, leaving its messages
+					err = deleteSessionMessages(member.Member)
+				}
+				if err != nil {
+					return err
+				}
+				if err := db.ZRem(deletedKey, member.Member); err != nil {
+					return err
+				}
+				removed++
+			}
+		}
+	})
+	return removed, err
+}
+
+// SweepMessages removes expired messages from their sessions' indexes. It
+// returns the number of messages removed.
+func SweepMessages() (int, error) {
+	removed := 0
+	err := db.Scan(MessagePrefix+"session:*", func(sessionMessagesKey string) error {
+		messageIDs, err := db.ZRange(sessionMessagesKey, 0, -1)
+		if err != nil {
+			return err
+		}
+		for _, messageID := range messageIDs {
+			exists, err := db.Exists(MessagePrefix + messageID)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			if err := db.ZRem(sessionMessagesKey, messageID); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// deleteSessionMessages deletes all messages of a session and its index
+func deleteSessionMessages(sessionID string) error {
+	sessionMessagesKey := MessagePrefix + "session:" + sessionID
+	messageIDs, err := db.ZRange(sessionMessagesKey, 0, -1)
+	if err != nil {
+		return err
+	}
+	for _, messageID := range messageIDs {
+		if err := db.Delete(MessagePrefix + messageID); err != nil {
+			return err
+		}
+	}
+	return db.Delete(sessionMessagesKey)
+}
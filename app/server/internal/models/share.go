@@ -0,0 +1,62 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"botanic/internal/db"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Key prefixes for share links
+const (
+	SharePrefix        = "share:"
+	SessionSharePrefix = SharePrefix + "session:"
+)
+
+// CreateShareLink generates an opaque share token for a chat session,
+// replacing any existing one. A zero ttl creates a link that never expires.
+func CreateShareLink(sessionID string, ttl time.Duration) (string, error) {
+	if err := RevokeShareLink(sessionID); err != nil {
+		return "", err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	if err := db.Set(SharePrefix+token, sessionID, ttl); err != nil {
+		return "", err
+	}
+	if err := db.Set(SessionSharePrefix+sessionID, token, ttl); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// GetSharedSessionID resolves a share token to its chat session ID
+func GetSharedSessionID(token string) (string, error) {
+	return db.GetT[string](SharePrefix + token)
+}
+
+// RevokeShareLink deletes the share link of a chat session, if any
+func RevokeShareLink(sessionID string) error {
+	token, err := db.GetT[string](SessionSharePrefix + sessionID)
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		return err
+	}
+
+	if err := db.Delete(SharePrefix + token); err != nil {
+		return err
+	}
+	return db.Delete(SessionSharePrefix + sessionID)
+}
@@ -0,0 +1,93 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"botanic/internal/db"
+	"botanic/internal/litellm"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// StatsPrefix is the key prefix of cached user statistics
+const StatsPrefix = "stats:user:"
+
+// statsCacheTTL is how long a user's message count is cached, as counting
+// takes a round trip per session
+const statsCacheTTL = time.Minute
+
+// UserStats summarizes a user's account for their profile dashboard
+type UserStats struct {
+	Sessions    int64         `json:"sessions"`
+	Messages    int64         `json:"messages"`
+	MemberSince time.Time     `json:"member_since"`
+	AccountAge  int           `json:"account_age_days"`
+	Requests    int64         `json:"requests"`
+	Usage       litellm.Usage `json:"usage"`
+}
+
+// GetUserStats returns the user's session and message counts, account age
+// and AI usage totals. The message count may be up to a minute old.
+func GetUserStats(ctx context.Context, user *User) (*UserStats, error) {
+	sessions, err := db.ZCardCtx(ctx, userSessionsKey(user.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := countUserMessages(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := db.HGetAllCtx(ctx, UserUsagePrefix+user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &UserStats{
+		Sessions:    sessions,
+		Messages:    messages,
+		MemberSince: user.CreatedAt,
+		AccountAge:  int(time.Since(user.CreatedAt).Hours() / 24),
+	}
+	stats.Requests, _ = strconv.ParseInt(fields["requests"], 10, 64)
+	stats.Usage.PromptTokens, _ = strconv.Atoi(fields["prompt_tokens"])
+	stats.Usage.CompletionTokens, _ = strconv.Atoi(fields["completion_tokens"])
+	stats.Usage.TotalTokens, _ = strconv.Atoi(fields["total_tokens"])
+	return stats, nil
+}
+
+// countUserMessages returns the number of messages in the user's sessions,
+// served from a short-lived cache
+func countUserMessages(ctx context.Context, userID string) (int64, error) {
+	cacheKey := StatsPrefix + userID + ":messages"
+	cached, err := db.GetTCtx[int64](ctx, cacheKey)
+	if err == nil {
+		return cached, nil
+	}
+	if !errors.Is(err, redis.Nil) {
+		return 0, err
+	}
+
+	sessionIDs, err := db.ZRangeCtx(ctx, userSessionsKey(userID), 0, -1)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, sessionID := range sessionIDs {
+		count, err := db.ZCardCtx(ctx, MessagePrefix+"session:"+sessionID)
+		if err != nil {
+			return 0, err
+		}
+		total += count
+	}
+
+	if err := db.SetTCtx(ctx, cacheKey, total, statsCacheTTL); err != nil {
+		slog.Warn("failed to cache message count", "user_id", userID, "error", err)
+	}
+	return total, nil
+}
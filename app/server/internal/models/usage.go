@@ -0,0 +1,67 @@
+package models
+
+import (
+	"strconv"
+
+	"botanic/internal/db"
+	"botanic/internal/litellm"
+)
+
+// Key prefixes for aggregated token usage
+const (
+	UsagePrefix        = "usage:"
+	SessionUsagePrefix = UsagePrefix + "session:"
+	UserUsagePrefix    = UsagePrefix + "user:"
+)
+
+// RecordUsage adds a completion's token usage to the session and user totals
+func RecordUsage(sessionID string, userID string, usage litellm.Usage) error {
+	if err := addUsage(SessionUsagePrefix+sessionID, usage); err != nil {
+		return err
+	}
+	return addUsage(UserUsagePrefix+userID, usage)
+}
+
+// RecordUserUsage adds the token usage of a completion made outside any chat
+// session to the user's totals
+func RecordUserUsage(userID string, usage litellm.Usage) error {
+	return addUsage(UserUsagePrefix+userID, usage)
+}
+
+// addUsage adds a completion to the totals under key, counting the request
+// and its tokens
+func addUsage(key string, usage litellm.Usage) error {
+	if err := db.HIncrBy(key, "requests", 1); err != nil {
+		return err
+	}
+	if err := db.HIncrBy(key, "prompt_tokens", int64(usage.PromptTokens)); err != nil {
+		return err
+	}
+	if err := db.HIncrBy(key, "completion_tokens", int64(usage.CompletionTokens)); err != nil {
+		return err
+	}
+	return db.HIncrBy(key, "total_tokens", int64(usage.TotalTokens))
+}
+
+// GetSessionTokenUsage returns the accumulated token usage of a chat session
+func GetSessionTokenUsage(sessionID string) (*litellm.Usage, error) {
+	return getTokenUsage(SessionUsagePrefix + sessionID)
+}
+
+// GetUserTokenUsage returns the accumulated token usage of a user
+func GetUserTokenUsage(userID string) (*litellm.Usage, error) {
+	return getTokenUsage(UserUsagePrefix + userID)
+}
+
+func getTokenUsage(key string) (*litellm.Usage, error) {
+	fields, err := db.HGetAll(key)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &litellm.Usage{}
+	usage.PromptTokens, _ = strconv.Atoi(fields["prompt_tokens"])
+	usage.CompletionTokens, _ = strconv.Atoi(fields["completion_tokens"])
+	usage.TotalTokens, _ = strconv.Atoi(fields["total_tokens"])
+	return usage, nil
+}
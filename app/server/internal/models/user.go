@@ -1,14 +1,17 @@
 package models
 
 import (
-	"log"
-	"net/http"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
 	"time"
 
 	"botanic/internal/db"
 
 	"github.com/google/uuid"
-	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -27,19 +30,70 @@ type User struct {
 	Name         string          `json:"name"`
 	AvatarURL    string          `json:"avatar_url"`
 	Preferences  UserPreferences `json:"preferences"`
+	IsAdmin      bool            `json:"is_admin,omitempty"`
+	Quota        *UserQuota      `json:"quota,omitempty"`
 	CreatedAt    time.Time       `json:"created_at"`
 	UpdatedAt    time.Time       `json:"updated_at"`
 }
 
 type UserPreferences struct {
-	Theme         string `json:"theme"`
-	Language      string `json:"language"`
-	Timezone      string `json:"timezone"`
-	Notifications bool   `json:"notifications"`
+	Theme               string   `json:"theme"`
+	Language            string   `json:"language"`
+	Timezone            string   `json:"timezone"`
+	Notifications       bool     `json:"notifications"`
+	LoginAlerts         bool     `json:"login_alerts"`
+	FontSize            string   `json:"font_size"`
+	MessageDensity      string   `json:"message_density"`
+	DefaultModel        string   `json:"default_model,omitempty"`
+	DefaultTemperature  *float64 `json:"default_temperature,omitempty"`
+	DefaultSystemPrompt string   `json:"default_system_prompt,omitempty"`
 }
 
+// DefaultPreferences returns the preferences of a new user. Emails about
+// sign-ins from new devices (LoginAlerts) are opt-in.
+func DefaultPreferences() UserPreferences {
+	return UserPreferences{
+		Theme:          "system",
+		Language:       "en",
+		Timezone:       "UTC",
+		Notifications:  true,
+		FontSize:       "medium",
+		MessageDensity: "comfortable",
+	}
+}
+
+// UnmarshalJSON fills fields missing from the stored JSON with their
+// defaults, so users saved before a preference existed still get one
+func (p *UserPreferences) UnmarshalJSON(data []byte) error {
+	type preferences UserPreferences
+	decoded := preferences(DefaultPreferences())
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*p = UserPreferences(decoded)
+	return nil
+}
+
+// NormalizeEmail returns the form of email stored and indexed: trimmed and
+// lowercased, so the same address in any case maps to one account
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// emailKey returns the key mapping email to a user ID
+func emailKey(email string) string {
+	return UserPrefix + "email:" + email
+}
+
+// ErrEmailRequired is returned when creating a user without an email
+var ErrEmailRequired = errors.New("email is required")
+
 // CreateUser creates a new user in Redis
 func CreateUser(email, password, provider, providerID, name, avatarURL string) (*User, error) {
+	email = NormalizeEmail(email)
+	if email == "" {
+		return nil, ErrEmailRequired
+	}
 	user := &User{
 		ID:         uuid.New().String(),
 		Email:      email,
@@ -51,60 +105,76 @@ func CreateUser(email, password, provider, providerID, name, avatarURL string) (
 		UpdatedAt:  time.Now(),
 	}
 
-	log.Printf("Creating user with ID: %s", user.ID)
-
 	if password != "" {
 		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 		if err != nil {
-			log.Printf("Failed to hash password: %v", err)
+			slog.Error("failed to hash password", "error", err)
 			return nil, err
 		}
 		user.PasswordHash = string(hash)
 	}
 
-	user.Preferences = UserPreferences{
-		Theme:         "system",
-		Language:      "en",
-		Timezone:      "UTC",
-		Notifications: true,
-	}
+	user.Preferences = DefaultPreferences()
 
 	userKey := UserPrefix + user.ID
 	if err := db.Set(userKey, user, 0); err != nil {
-		log.Printf("Failed to create user: %v", err)
+		slog.Error("failed to create user", "user_id", user.ID, "error", err)
 		return nil, err
 	}
 
-	emailKey := UserPrefix + "email:" + email
-	if err := db.Set(emailKey, user.ID, 0); err != nil {
-		log.Printf("Failed to create email mapping: %v", err)
+	if user.PasswordHash != "" {
+		if err := db.Set(passwordKey(user.ID), user.PasswordHash, 0); err != nil {
+			slog.Error("failed to store password", "user_id", user.ID, "error", err)
+			return nil, err
+		}
+	}
+
+	if err := db.Set(emailKey(email), user.ID, 0); err != nil {
+		slog.Error("failed to create email mapping", "user_id", user.ID, "error", err)
 		return nil, err
 	}
 
 	if provider != "" && providerID != "" {
 		providerKey := UserPrefix + "provider:" + provider + ":" + providerID
 		if err := db.Set(providerKey, user.ID, 0); err != nil {
-			log.Printf("Failed to create provider mapping: %v", err)
+			slog.Error("failed to create provider mapping", "user_id", user.ID, "error", err)
 			return nil, err
 		}
 	}
 
-	log.Printf("Successfully created user: %s", user.Email)
+	slog.Info("created user", "user_id", user.ID, "provider", user.Provider)
 	return user, nil
 }
 
-// GetUserByEmail retrieves a user by email
+// GetUserByEmail retrieves a user by email, ignoring case and surrounding
+// whitespace. Users indexed before emails were normalized are found under the
+// email exactly as given, and are indexed under the normalized email too. It
+// returns a nil user and nil error if no user has the email.
 func GetUserByEmail(email string) (*User, error) {
-	emailKey := UserPrefix + "email:" + email
-	var userID string
-	if err := db.Get(emailKey, &userID); err != nil {
-		return nil, err
+	normalized := NormalizeEmail(email)
+	userID, err := db.GetT[string](emailKey(normalized))
+	if errors.Is(err, redis.Nil) && email != normalized {
+		userID, err = db.GetT[string](emailKey(email))
+		if err == nil {
+			if err := db.Set(emailKey(normalized), userID, 0); err != nil {
+				slog.Error("failed to normalize email mapping", "user_id", userID, "error", err)
+			}
+		}
+	}
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, lookupError(err)
 	}
 
 	userKey := UserPrefix + userID
 	var user User
 	if err := db.Get(userKey, &user); err != nil {
-		return nil, err
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		return nil, lookupError(err)
 	}
 
 	return &user, nil
@@ -115,27 +185,59 @@ func GetUserByProviderID(provider, providerID string) (*User, error) {
 	providerKey := UserPrefix + "provider:" + provider + ":" + providerID
 	var userID string
 	if err := db.Get(providerKey, &userID); err != nil {
-		return nil, err
+		return nil, lookupError(err)
 	}
 
 	userKey := UserPrefix + userID
 	var user User
 	if err := db.Get(userKey, &user); err != nil {
-		return nil, err
+		return nil, lookupError(err)
 	}
 
 	return &user, nil
 }
 
+// passwordKey is where a user's password hash is stored. It is kept apart
+// from the user, which is returned by the API, so it is never sent to clients.
+func passwordKey(userID string) string {
+	return UserPrefix + "password:" + userID
+}
+
+// HasPassword reports whether a password hash is stored for the user, that
+// is whether the user can sign in with a password
+func HasPassword(userID string) (bool, error) {
+	return db.Exists(passwordKey(userID))
+}
+
 // VerifyPassword checks if the provided password matches the user's password hash
 func (u *User) VerifyPassword(password string) bool {
+	if u.PasswordHash == "" {
+		hash, err := db.GetT[string](passwordKey(u.ID))
+		if err != nil {
+			if !errors.Is(err, redis.Nil) {
+				slog.Error("failed to load password", "user_id", u.ID, "error", err)
+			}
+			return false
+		}
+		u.PasswordHash = hash
+	}
 	err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password))
 	return err == nil
 }
 
-// UpdateProfile updates the user's profile information
-func (u *User) UpdateProfile(name, avatarURL string) error {
+// UpdateProfile updates the user's name. The avatar is changed only by
+// SetAvatar.
+func (u *User) UpdateProfile(name string) error {
 	u.Name = name
+	u.UpdatedAt = time.Now()
+
+	userKey := UserPrefix + u.ID
+	return db.Set(userKey, u, 0)
+}
+
+// SetAvatar replaces the user's avatar URL, or clears it when avatarURL is
+// empty. Callers pass only URLs the avatar store returned.
+func (u *User) SetAvatar(avatarURL string) error {
 	u.AvatarURL = avatarURL
 	u.UpdatedAt = time.Now()
 
@@ -160,14 +262,48 @@ func LinkProviderToUser(userID, provider, providerID string) error {
 
 // GetUserByID retrieves a user by ID
 func GetUserByID(id string) (*User, error) {
-	userKey := UserPrefix + id
-	var user User
-	if err := db.Get(userKey, &user); err != nil {
-		return nil, err
+	return GetUserByIDCtx(context.Background(), id)
+}
+
+// GetUserByIDCtx is like GetUserByID but honors the cancellation and deadline of ctx
+func GetUserByIDCtx(ctx context.Context, id string) (*User, error) {
+	user, err := db.GetTCtx[User](ctx, UserPrefix+id)
+	if err != nil {
+		return nil, lookupError(err)
 	}
 	return &user, nil
 }
 
+// ListUsers returns a page of about limit users starting at cursor, and the
+// cursor of the next page, which is empty after the last page. Users may
+// repeat across pages if the keyspace changes during the listing.
+func ListUsers(ctx context.Context, cursor string, limit int) ([]*User, string, error) {
+	keys, next, err := db.ScanPageCtx(ctx, cursor, UserPrefix+"*", int64(limit))
+	if err != nil {
+		return nil, "", err
+	}
+
+	users := make([]*User, 0, len(keys))
+	for _, key := range keys {
+		// Skip the email and provider index keys that share the prefix
+		id := strings.TrimPrefix(key, UserPrefix)
+		if _, err := uuid.Parse(id); err != nil {
+			continue
+		}
+
+		user, err := GetUserByIDCtx(ctx, id)
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			return nil, "", err
+		}
+		users = append(users, user)
+	}
+
+	return users, next, nil
+}
+
 // UserSession represents a user's active session
 type UserSession struct {
 	SessionID string    `json:"session_id"`
@@ -199,6 +335,34 @@ func GetUserActiveSessions(userID string) ([]UserSession, error) {
 	return sessions, nil
 }
 
+// SweepUserSessions removes expired sessions from every user's session index.
+// Session records expire on their own, but their index entries do not. It
+// returns the number of entries removed.
+func SweepUserSessions() (int, error) {
+	removed := 0
+	err := db.Scan(UserSessionPrefix+"*", func(sessionsKey string) error {
+		sessionIDs, err := db.ZRange(sessionsKey, 0, -1)
+		if err != nil {
+			return err
+		}
+		for _, sessionID := range sessionIDs {
+			exists, err := db.Exists(SessionPrefix + sessionID)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			if err := db.ZRem(sessionsKey, sessionID); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
 // DeleteUserSession deletes a user session
 func DeleteUserSession(userID, sessionID string) error {
 	sessionsKey := UserSessionPrefix + userID
@@ -232,12 +396,3 @@ func CreateUserSession(userID string, expiresAt time.Time) (*UserSession, error)
 
 	return session, nil
 }
-
-// GetUserID retrieves the user ID from the Echo context
-func GetUserID(c echo.Context) (string, error) {
-	userID, ok := c.Get("userID").(string)
-	if !ok {
-		return "", echo.NewHTTPError(http.StatusUnauthorized, "user not authenticated")
-	}
-	return userID, nil
-}
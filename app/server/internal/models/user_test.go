@@ -0,0 +1,114 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"botanic/internal/db"
+	"botanic/internal/db/dbtest"
+)
+
+func TestLoginAlertsAreOptIn(t *testing.T) {
+	if DefaultPreferences().LoginAlerts {
+		t.Fatal("new users get login alerts")
+	}
+
+	// Users saved before the preference existed had notifications on
+	var stored UserPreferences
+	if err := json.Unmarshal([]byte(`{"theme":"dark","notifications":true}`), &stored); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if stored.LoginAlerts {
+		t.Fatal("users saved before login alerts existed get them")
+	}
+	if !stored.Notifications || stored.Theme != "dark" {
+		t.Fatalf("stored preferences lost: %+v", stored)
+	}
+}
+
+func TestPasswordSurvivesRoundTrip(t *testing.T) {
+	dbtest.Setup(t)
+	if _, err := CreateUser("owner@example.com", "correct horse battery", "email", "", "", ""); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	user, err := GetUserByEmail("owner@example.com")
+	if err != nil || user == nil {
+		t.Fatalf("load user: %v, %v", user, err)
+	}
+	if !user.VerifyPassword("correct horse battery") {
+		t.Fatal("password of a stored user does not verify")
+	}
+	if user.VerifyPassword("wrong password") {
+		t.Fatal("wrong password verifies")
+	}
+
+	// The hash is never part of the user sent to clients
+	data, err := json.Marshal(user)
+	if err != nil {
+		t.Fatalf("marshal user: %v", err)
+	}
+	if strings.Contains(string(data), user.PasswordHash) {
+		t.Fatal("marshaled user contains the password hash")
+	}
+}
+
+func TestEmailsIgnoreCaseAndWhitespace(t *testing.T) {
+	dbtest.Setup(t)
+
+	created, err := CreateUser("  User@Gmail.com ", "", "github", "gh-1", "User", "")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	if created.Email != "user@gmail.com" {
+		t.Fatalf("email stored as %q, want user@gmail.com", created.Email)
+	}
+
+	for _, email := range []string{"user@gmail.com", "USER@GMAIL.COM", " user@Gmail.com\t"} {
+		user, err := GetUserByEmail(email)
+		if err != nil || user == nil || user.ID != created.ID {
+			t.Errorf("lookup of %q: %v, %v, want user %s", email, user, err, created.ID)
+		}
+	}
+}
+
+func TestBlankEmailIsRejected(t *testing.T) {
+	dbtest.Setup(t)
+
+	for _, email := range []string{"", "  \t"} {
+		if _, err := CreateUser(email, "", "github", "gh-1", "User", ""); err != ErrEmailRequired {
+			t.Errorf("create user with email %q: %v, want ErrEmailRequired", email, err)
+		}
+	}
+	if exists, err := db.Exists(emailKey("")); err != nil || exists {
+		t.Fatalf("empty email indexed: %v, %v", exists, err)
+	}
+}
+
+func TestLegacyEmailIndexIsFoundAndNormalized(t *testing.T) {
+	dbtest.Setup(t)
+
+	// Users indexed before emails were normalized kept the case they signed
+	// up with
+	created, err := CreateUser("legacy@example.com", "", "github", "gh-1", "Legacy", "")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	if err := db.Delete(emailKey("legacy@example.com")); err != nil {
+		t.Fatalf("drop normalized index: %v", err)
+	}
+	if err := db.Set(emailKey("Legacy@Example.com"), created.ID, 0); err != nil {
+		t.Fatalf("write legacy index: %v", err)
+	}
+
+	user, err := GetUserByEmail("Legacy@Example.com")
+	if err != nil || user == nil || user.ID != created.ID {
+		t.Fatalf("legacy lookup: %v, %v, want user %s", user, err, created.ID)
+	}
+	// The lookup indexed the normalized email too
+	user, err = GetUserByEmail("legacy@example.com")
+	if err != nil || user == nil || user.ID != created.ID {
+		t.Fatalf("normalized lookup after migration: %v, %v, want user %s", user, err, created.ID)
+	}
+}
@@ -0,0 +1,117 @@
+package moderation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Moderator decides whether user content may be sent to the model. A
+// rejection comes with a reason that can be shown to the user.
+type Moderator interface {
+	Check(ctx context.Context, content string) (allowed bool, reason string, err error)
+}
+
+// NewFromEnv creates an HTTPModerator if MODERATION_URL is set, and a Noop
+// moderator otherwise
+func NewFromEnv() Moderator {
+	if os.Getenv("MODERATION_URL") == "" {
+		return Noop{}
+	}
+	return NewHTTPModeratorFromEnv()
+}
+
+// Noop allows all content
+type Noop struct{}
+
+func (Noop) Check(ctx context.Context, content string) (bool, string, error) {
+	return true, "", nil
+}
+
+// HTTPModerator asks an OpenAI-compatible moderation endpoint about content,
+// rejecting content the endpoint flags
+type HTTPModerator struct {
+	url        string
+	apiKey     string
+	model      string
+	httpClient *http.Client
+}
+
+// NewHTTPModeratorFromEnv configures an HTTPModerator from MODERATION_URL and
+// the optional MODERATION_API_KEY and MODERATION_MODEL
+func NewHTTPModeratorFromEnv() *HTTPModerator {
+	return &HTTPModerator{
+		url:        os.Getenv("MODERATION_URL"),
+		apiKey:     os.Getenv("MODERATION_API_KEY"),
+		model:      os.Getenv("MODERATION_MODEL"),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type moderationRequest struct {
+	Input string `json:"input"`
+	Model string `json:"model,omitempty"`
+}
+
+type moderationResponse struct {
+	Results []struct {
+		Flagged    bool            `json:"flagged"`
+		Categories map[string]bool `json:"categories"`
+	} `json:"results"`
+}
+
+func (m *HTTPModerator) Check(ctx context.Context, content string) (bool, string, error) {
+	body, err := json.Marshal(moderationRequest{Input: content, Model: m.model})
+	if err != nil {
+		return false, "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url, bytes.NewReader(body))
+	if err != nil {
+		return false, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if m.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+m.apiKey)
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, "", fmt.Errorf("moderation endpoint returned status %d", resp.StatusCode)
+	}
+
+	var result moderationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, "", fmt.Errorf("decode moderation response: %w", err)
+	}
+
+	var flagged []string
+	for _, r := range result.Results {
+		if !r.Flagged {
+			continue
+		}
+		for category, hit := range r.Categories {
+			if hit {
+				flagged = append(flagged, category)
+			}
+		}
+		if len(flagged) == 0 {
+			flagged = append(flagged, "policy violation")
+		}
+	}
+	if len(flagged) == 0 {
+		return true, "", nil
+	}
+	sort.Strings(flagged)
+	return false, "flagged for " + strings.Join(flagged, ", "), nil
+}
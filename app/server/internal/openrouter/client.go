@@ -2,13 +2,16 @@ package openrouter
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log" // Import the log package
+	"log/slog"
 	"net/http"
 	"os"
 	"time"
+
+	"botanic/internal/logging"
 )
 
 // Model represents an OpenRouter model
@@ -43,11 +46,8 @@ type Client struct {
 func NewClient() *Client {
 	apiKey := os.Getenv("OPENROUTER_API_KEY")
 
-	// This will print the first few chars of the key to verify it's loaded.
-	if len(apiKey) > 5 {
-		log.Printf("[OPENROUTER DEBUG] Using API Key starting with: \"%s...\"", apiKey[:5])
-	} else {
-		log.Printf("[OPENROUTER DEBUG] API Key is missing or too short!")
+	if apiKey == "" {
+		slog.Warn("OPENROUTER_API_KEY is not set")
 	}
 
 	return &Client{
@@ -138,10 +138,31 @@ func GetFreeModels(models []Model) []Model {
 	return freeModels
 }
 
+// HealthCheck verifies that the OpenRouter API is reachable
+func (c *Client) HealthCheck(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/models", nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("API error: %s", resp.Status)
+	}
+	return nil
+}
+
 // GetChatCompletion gets a chat completion from OpenRouter
-func (c *Client) GetChatCompletion(messages []ChatMessage, model string, temperature float64) (string, error) {
+func (c *Client) GetChatCompletion(ctx context.Context, messages []ChatMessage, model string, temperature float64) (string, error) {
+	logger := logging.FromContext(ctx)
 	if len(messages) > 0 {
-		log.Printf("[OPENROUTER DEBUG] Sending message to AI: \"%s\"", messages[0].Content)
+		logger.Debug("sending chat completion", "provider", "openrouter", "model", model, "content", messages[0].Content)
 	}
 
 	payload := struct {
@@ -159,7 +180,7 @@ func (c *Client) GetChatCompletion(messages []ChatMessage, model string, tempera
 		return "", fmt.Errorf("error marshaling request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", c.baseURL+"/chat/completions", bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/chat/completions", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return "", fmt.Errorf("error creating request: %w", err)
 	}
@@ -171,17 +192,18 @@ func (c *Client) GetChatCompletion(messages []ChatMessage, model string, tempera
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		// --- FINAL DEBUGGING LINE ---
-		// This will tell us if it's a network timeout or other connection error.
-		log.Printf("[OPENROUTER ERROR] HTTP request failed: %v", err)
+		// A cancelled request is not a failure worth logging
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		logger.Error("OpenRouter request failed", "model", model, "error", err)
 		return "", fmt.Errorf("error making request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		// This will show us the error message from the OpenRouter API itself.
-		log.Printf("[OPENROUTER ERROR] API returned non-200 status: %s, Body: %s", resp.Status, string(body))
+		logger.Error("OpenRouter returned an error", "model", model, "status", resp.StatusCode, "body", string(body))
 		return "", fmt.Errorf("API error: %s - %s", resp.Status, string(body))
 	}
 
@@ -194,6 +216,9 @@ func (c *Client) GetChatCompletion(messages []ChatMessage, model string, tempera
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
 		return "", fmt.Errorf("error decoding response: %w", err)
 	}
 
@@ -0,0 +1,47 @@
+package tokenizer
+
+import (
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Tokenizer counts the tokens in a piece of text
+type Tokenizer interface {
+	Count(text string) int
+}
+
+// HeuristicTokenizer estimates token counts without a vocabulary. English
+// text averages roughly four characters per token, and a token never spans
+// more than one word.
+type HeuristicTokenizer struct{}
+
+// Count estimates the number of tokens in text
+func (HeuristicTokenizer) Count(text string) int {
+	words := len(strings.Fields(text))
+	chars := (utf8.RuneCountInString(text) + 3) / 4
+	if words > chars {
+		return words
+	}
+	return chars
+}
+
+var (
+	current Tokenizer = HeuristicTokenizer{}
+	mu      sync.RWMutex
+)
+
+// SetDefault replaces the tokenizer used by Count, e.g. with a real BPE
+// tokenizer
+func SetDefault(t Tokenizer) {
+	mu.Lock()
+	defer mu.Unlock()
+	current = t
+}
+
+// Count returns the number of tokens in text using the default tokenizer
+func Count(text string) int {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current.Count(text)
+}
@@ -0,0 +1,199 @@
+// Package validation enforces `validate` struct tags on request bodies.
+//
+// It implements the subset of the go-playground/validator tag syntax used by
+// the request structs: required, omitempty, min, max, email and oneof, plus
+// maxbytes, which limits the UTF-8 length of strings where max limits their
+// characters. Any other rule is a programming error and panics.
+package validation
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// FieldErrors maps JSON field names to the reason they failed validation
+type FieldErrors map[string]string
+
+func (e FieldErrors) Error() string {
+	fields := make([]string, 0, len(e))
+	for field, reason := range e {
+		fields = append(fields, field+": "+reason)
+	}
+	return "validation failed: " + strings.Join(fields, "; ")
+}
+
+// Validator checks structs against their `validate` tags. It satisfies
+// echo.Validator.
+type Validator struct{}
+
+// New creates a Validator
+func New() *Validator {
+	return &Validator{}
+}
+
+// Validate returns FieldErrors describing every invalid field of i, or nil
+func (v *Validator) Validate(i interface{}) error {
+	errs := FieldErrors{}
+	validateStruct(reflect.ValueOf(i), "", errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateStruct(value reflect.Value, prefix string, errs FieldErrors) {
+	for value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return
+	}
+
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		fieldValue := value.Field(i)
+
+		name := prefix + jsonName(field)
+		if field.Anonymous {
+			// Embedded structs contribute their fields at the same level
+			name = prefix
+		}
+
+		if tag := field.Tag.Get("validate"); tag != "" {
+			if reason := validateField(fieldValue, tag); reason != "" {
+				errs[name] = reason
+				continue
+			}
+		}
+
+		nestedPrefix := name + "."
+		if field.Anonymous {
+			nestedPrefix = prefix
+		}
+		validateStruct(fieldValue, nestedPrefix, errs)
+
+		// Elements of slices of structs are checked as name[i].field
+		if fieldValue.Kind() == reflect.Slice || fieldValue.Kind() == reflect.Array {
+			for j := 0; j < fieldValue.Len(); j++ {
+				validateStruct(fieldValue.Index(j), fmt.Sprintf("%s[%d].", name, j), errs)
+			}
+		}
+	}
+}
+
+// jsonName returns the name a field has in JSON bodies
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
+
+// validateField applies the comma-separated rules of tag to value, returning
+// the first failure
+func validateField(value reflect.Value, tag string) string {
+	// As with go-playground/validator, a set pointer satisfies required even
+	// if it points to a zero value, such as false
+	pointer := value.Kind() == reflect.Pointer
+	for value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			if strings.Contains(","+tag+",", ",required,") {
+				return "is required"
+			}
+			return ""
+		}
+		value = value.Elem()
+	}
+
+	for _, rule := range strings.Split(tag, ",") {
+		name, param, _ := strings.Cut(rule, "=")
+		switch name {
+		case "omitempty":
+			if value.IsZero() {
+				return ""
+			}
+		case "required":
+			if !pointer && value.IsZero() {
+				return "is required"
+			}
+		case "min":
+			if size(value) < parseLimit(param) {
+				return fmt.Sprintf("must be at least %s", describeLimit(value, param))
+			}
+		case "max":
+			if size(value) > parseLimit(param) {
+				return fmt.Sprintf("must be at most %s", describeLimit(value, param))
+			}
+		case "oneof":
+			if value.Kind() == reflect.String && !slices.Contains(strings.Fields(param), value.String()) {
+				return "must be one of " + param
+			}
+		case "maxbytes":
+			if value.Kind() == reflect.String && float64(len(value.String())) > parseLimit(param) {
+				return fmt.Sprintf("must be at most %s bytes", param)
+			}
+		case "email":
+			if value.Kind() == reflect.String && !isEmail(value.String()) {
+				return "must be a valid email address"
+			}
+		default:
+			panic(fmt.Sprintf("validation: unknown rule %q in tag %q", name, tag))
+		}
+	}
+	return ""
+}
+
+// isEmail reports whether value is a bare email address. Display names and
+// angle brackets, which mail.ParseAddress accepts, are not.
+func isEmail(value string) bool {
+	addr, err := mail.ParseAddress(value)
+	return err == nil && addr.Address == value
+}
+
+// parseLimit parses the number of a min, max or maxbytes rule, panicking on
+// a malformed one like on an unknown rule
+func parseLimit(param string) float64 {
+	limit, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		panic(fmt.Sprintf("validation: invalid limit %q", param))
+	}
+	return limit
+}
+
+// size measures strings and collections by length and numbers by value
+func size(value reflect.Value) float64 {
+	switch value.Kind() {
+	case reflect.String:
+		return float64(len([]rune(value.String())))
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return float64(value.Len())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		return value.Float()
+	}
+	return 0
+}
+
+func describeLimit(value reflect.Value, param string) string {
+	switch value.Kind() {
+	case reflect.String:
+		return param + " characters"
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return param + " items"
+	}
+	return param
+}
@@ -0,0 +1,106 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	type preferences struct {
+		Theme string `json:"theme" validate:"required,oneof=light dark system"`
+	}
+	type item struct {
+		Name string `json:"name" validate:"required"`
+	}
+	type request struct {
+		Email       string      `json:"email" validate:"omitempty,email"`
+		Password    string      `json:"password" validate:"omitempty,min=8,maxbytes=72"`
+		Name        string      `json:"name" validate:"omitempty,min=2,max=5"`
+		Temperature *float64    `json:"temperature" validate:"omitempty,min=0,max=2"`
+		Tags        []string    `json:"tags" validate:"omitempty,min=1,max=2"`
+		Preferences preferences `json:"preferences"`
+		Items       []item      `json:"items"`
+	}
+	valid := func() request {
+		return request{Preferences: preferences{Theme: "dark"}}
+	}
+	temperature := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		name  string
+		edit  func(r *request)
+		field string
+	}{
+		{"valid", func(r *request) {}, ""},
+		{"email", func(r *request) { r.Email = "bob@example.com" }, ""},
+		{"email with display name", func(r *request) { r.Email = "Bob <bob@example.com>" }, "email"},
+		{"email in angle brackets", func(r *request) { r.Email = "<bob@example.com>" }, "email"},
+		{"email with spaces", func(r *request) { r.Email = " bob@example.com" }, "email"},
+		{"not an email", func(r *request) { r.Email = "bob" }, "email"},
+		{"short password", func(r *request) { r.Password = "hunter2" }, "password"},
+		{"password of 72 bytes", func(r *request) { r.Password = strings.Repeat("a", 72) }, ""},
+		{"password over 72 bytes", func(r *request) { r.Password = strings.Repeat("a", 73) }, "password"},
+		{"password of 72 characters over 72 bytes", func(r *request) { r.Password = strings.Repeat("é", 72) }, "password"},
+		{"name counts characters", func(r *request) { r.Name = "ééééé" }, ""},
+		{"long name", func(r *request) { r.Name = "abcdef" }, "name"},
+		{"short name", func(r *request) { r.Name = "a" }, "name"},
+		{"zero temperature", func(r *request) { r.Temperature = temperature(0) }, ""},
+		{"high temperature", func(r *request) { r.Temperature = temperature(2.5) }, "temperature"},
+		{"negative temperature", func(r *request) { r.Temperature = temperature(-1) }, "temperature"},
+		{"too many tags", func(r *request) { r.Tags = []string{"a", "b", "c"} }, "tags"},
+		{"missing nested", func(r *request) { r.Preferences.Theme = "" }, "preferences.theme"},
+		{"nested not one of", func(r *request) { r.Preferences.Theme = "blue" }, "preferences.theme"},
+		{"slice element", func(r *request) { r.Items = []item{{Name: "a"}, {}} }, "items[1].name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := valid()
+			tt.edit(&r)
+			err := New().Validate(&r)
+			if tt.field == "" {
+				if err != nil {
+					t.Fatalf("got %v, want no error", err)
+				}
+				return
+			}
+			errs, ok := err.(FieldErrors)
+			if !ok || len(errs) != 1 || errs[tt.field] == "" {
+				t.Fatalf("got %v, want one error for %s", err, tt.field)
+			}
+		})
+	}
+}
+
+func TestRequiredPointer(t *testing.T) {
+	type request struct {
+		Enabled *bool `json:"enabled" validate:"required"`
+	}
+	if err := New().Validate(&request{}); err == nil {
+		t.Fatal("nil pointer passed required")
+	}
+	enabled := false
+	if err := New().Validate(&request{Enabled: &enabled}); err != nil {
+		t.Fatalf("pointer to false failed required: %v", err)
+	}
+}
+
+func TestUnknownRulesPanic(t *testing.T) {
+	tests := map[string]interface{}{
+		"unknown rule": &struct {
+			URL string `validate:"url"`
+		}{URL: "https://example.com"},
+		"malformed limit": &struct {
+			Name string `validate:"max=ten"`
+		}{Name: "fern"},
+	}
+	for name, request := range tests {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("validation did not panic")
+				}
+			}()
+			New().Validate(request)
+		})
+	}
+}
@@ -39,6 +39,7 @@ interface ChatSession {
     user_id: string;
     title: string;
     model: string;
+    backend?: string;
     created_at: string;
     updated_at: string;
     messages: Message[];
@@ -46,7 +47,6 @@ interface ChatSession {
 
 interface UpdateProfileRequest {
     name?: string;
-    avatarUrl?: string;
     preferences?: {
         theme: string;
     };
@@ -57,6 +57,7 @@ interface UpdatePreferencesRequest {
     language?: string;
     timezone?: string;
     notifications?: boolean;
+    login_alerts?: boolean;
 }
 
 export interface SessionInfo {
@@ -264,7 +265,7 @@ export class ApiClient {
         if (data.token && data.session) {
             await this.saveToken(
                 data.token,
-                Date.now() + (30 * 24 * 60 * 60 * 1000), // 30 days
+                new Date(data.session.expires_at).getTime(), // Shorter unless "remember me" was checked
                 data.session.id
             );
         }
@@ -290,6 +291,20 @@ export class ApiClient {
         return response.json();
     }
 
+    async linkProvider(linkToken: string): Promise<void> {
+        const response = await this.fetchWithAuth(`${API_URL}/api/auth/link`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify({ link_token: linkToken }),
+        });
+
+        if (!response.ok) {
+            throw new ApiError('Failed to link account', response.status);
+        }
+    }
+
     async getGoogleAuthUrl(): Promise<string> {
         return `${API_URL}/api/auth/google`;
     }
@@ -318,7 +333,7 @@ export class ApiClient {
         return response.json();
     }
 
-    async createSession(data: { title: string; model: string }): Promise<ChatSession> {
+    async createSession(data: { title: string; model: string; backend?: string }): Promise<ChatSession> {
         const response = await this.fetchWithAuth(`${API_URL}/api/chat/sessions`, {
             method: 'POST',
             headers: {
@@ -356,6 +371,36 @@ export class ApiClient {
         }
     }
 
+    async deleteSessions(ids: string[] | 'all'): Promise<{ id: string; deleted: boolean; error?: string }[]> {
+        const url = ids === 'all'
+            ? `${API_URL}/api/chat/sessions?all=true`
+            : `${API_URL}/api/chat/sessions`;
+        const response = await this.fetchWithAuth(url, {
+            method: 'DELETE',
+            ...(ids === 'all' ? {} : {
+                headers: {
+                    'Content-Type': 'application/json',
+                },
+                body: JSON.stringify({ ids }),
+            }),
+        });
+        if (!response.ok) {
+            throw new ApiError('Failed to delete sessions', response.status);
+        }
+        const data = await response.json();
+        return data.results;
+    }
+
+    async restoreSession(id: string): Promise<ChatSession> {
+        const response = await this.fetchWithAuth(`${API_URL}/api/chat/sessions/${id}/restore`, {
+            method: 'POST'
+        });
+        if (!response.ok) {
+            throw new ApiError('Failed to restore session', response.status);
+        }
+        return response.json();
+    }
+
     // Messages
     async getSessionMessages(sessionId: string, beforeId?: string): Promise<Message[]> {
         const url = beforeId 
@@ -16,6 +16,14 @@ export interface Model {
     tokenizer: string;
     instruct_type: string;
   };
+  // What the model supports through the server; unknown capabilities are false
+  capabilities: {
+    streaming: boolean;
+    tools: boolean;
+    vision: boolean;
+  };
+  // The backend offering the model, when the server has several
+  backend?: string;
 }
 
 interface LLMStoreState {
@@ -14,6 +14,10 @@ interface WebSocketState {
   error: string | null;
   messages: Message[];
   retryCount: number;
+  // Open connections to the current session, including this one
+  connections: number;
+  // Place in line while the server queues the completion, otherwise null
+  queuePosition: number | null;
 }
 
 const MAX_RETRIES = 5;
@@ -32,7 +36,9 @@ function createWebSocketStore() {
     connecting: false,
     error: null,
     messages: [],
-    retryCount: 0
+    retryCount: 0,
+    connections: 0,
+    queuePosition: null
   });
 
   const loadMessages = async (sid?: string) => {
@@ -73,12 +79,12 @@ function createWebSocketStore() {
       return;
     }
 
-    const wsUrl = `${API_URL.replace(/^http/, 'ws')}/ws?session_id=${encodeURIComponent(sessionId)}&token=${encodeURIComponent(authState.token)}`;
+    const wsUrl = `${API_URL.replace(/^http/, 'ws')}/ws?session_id=${encodeURIComponent(sessionId)}`;
     console.log('Attempting to connect WebSocket to URL:', wsUrl);
-    console.log('Using token (first 10 chars):', authState.token.substring(0, 10), '...');
 
     try {
-      ws = new WebSocket(wsUrl);
+      // The token travels as a subprotocol so it stays out of URLs and logs
+      ws = new WebSocket(wsUrl, ['bearer', authState.token]);
 
       ws.onopen = () => {
         console.log('WebSocket connection established!');
@@ -96,6 +102,10 @@ function createWebSocketStore() {
         console.log('WebSocket connection closed:', event.code, event.reason);
         ws = null;
         update(state => ({ ...state, connected: false, connecting: false }));
+        // The server closes with 4401 once the token has expired
+        if (event.code === 4401) {
+          update(state => ({ ...state, error: 'Your session has expired' }));
+        }
         if (!manualClose) {
           reconnect();
         }
@@ -112,6 +122,35 @@ function createWebSocketStore() {
           const message: Message = JSON.parse(event.data);
           console.log('Parsed WebSocket message:', message);
 
+          // Answer heartbeats so the server does not drop the connection as idle
+          if (message.type === 'ping') {
+            ws?.send(JSON.stringify({ type: 'pong' }));
+            return;
+          }
+          if (message.type === 'pong') {
+            return;
+          }
+          if (message.type === 'presence') {
+            update(state => ({ ...state, connections: message.connections ?? 0 }));
+            return;
+          }
+          if (message.type === 'queued') {
+            update(state => ({ ...state, queuePosition: message.position ?? null }));
+            return;
+          }
+          // A stopped generation, a rejected one or a reply ends the typing indicator
+          if (message.type === 'stopped' || message.type === 'server_busy' || message.type === 'moderation' || message.role === 'assistant') {
+            update(state => ({
+              ...state,
+              messages: state.messages.filter(m => m.type !== 'typing'),
+              queuePosition: null,
+              error: message.type === 'server_busy' || message.type === 'moderation' ? message.content : state.error
+            }));
+          }
+          if (message.type === 'stopped' || message.type === 'server_busy' || message.type === 'moderation') {
+            return;
+          }
+
           if (messageCallback) {
             console.log('Calling messageCallback...');
             messageCallback(message);
@@ -175,7 +214,8 @@ function createWebSocketStore() {
       connecting: false,
       error: null,
       messages: [],
-      retryCount: 0
+      retryCount: 0,
+      connections: 0
     });
   }
 
@@ -242,3 +282,4 @@ export const isConnected = derived(store, $store => $store.connected);
 export const isLoading = derived(store, $store => $store.connecting);
 export const isReconnecting = derived(store, $store => $store.connecting && !$store.connected);
 export const error = derived(store, $store => $store.error);
+export const connections = derived(store, $store => $store.connections);
@@ -8,6 +8,7 @@ export interface User {
         language: string;
         timezone: string;
         notifications: boolean;
+        login_alerts?: boolean;
     };
     provider: string;
     providerId?: string;
@@ -21,7 +22,11 @@ export interface Message {
     user_id: string;
     content: string;
     model: string;
-    type: 'message' | 'error' | 'typing' | 'status';
+    type: 'message' | 'error' | 'typing' | 'status' | 'ping' | 'pong' | 'presence' | 'stopped' | 'queued' | 'server_busy' | 'moderation';
+    connections?: number;
+    position?: number;
+    replyTo?: string;
+    partial?: boolean;
     created_at: string;
     updated_at: string;
     role: 'user' | 'assistant';
@@ -28,6 +28,18 @@ export const load: PageServerLoad = async ({ params, url, fetch, cookies }) => {
             mode: 'cors'
         });
 
+        if (response.status === 409) {
+            // The email belongs to a password account: its owner must sign in
+            // and confirm the link
+            const link = await response.json();
+            const params = new URLSearchParams({
+                link_token: link.link_token,
+                email: link.email,
+                provider: link.provider
+            });
+            throw redirect(303, `/login?${params}`);
+        }
+
         if (!response.ok) {
             const errorData = await response.json();
             throw error(response.status, errorData.message || 'Authentication failed');